@@ -0,0 +1,188 @@
+// Package cluster holds the cluster metadata the nodes agree on through
+// Raft: the shard map, the members and the schema version. Metadata is the
+// replicated state machine; the leader proposes the commands built by
+// SetShardMap, Join, Leave and BumpSchema.
+package cluster
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"distributed-db/shard"
+)
+
+// Member is a node of the cluster as seen by the master.
+type Member struct {
+	ID     string    `json:"id"`
+	Addr   string    `json:"addr"`
+	Role   string    `json:"role"`
+	Joined time.Time `json:"joined"`
+}
+
+// State is the replicated metadata.
+type State struct {
+	ShardMap      shard.Snapshot    `json:"shard_map"`
+	Members       map[string]Member `json:"members"`
+	SchemaVersion uint64            `json:"schema_version"`
+}
+
+const (
+	opShardMap = "shard_map"
+	opJoin     = "join"
+	opLeave    = "leave"
+	opSchema   = "schema"
+)
+
+type command struct {
+	Op       string          `json:"op"`
+	ShardMap *shard.Snapshot `json:"shard_map,omitempty"`
+	Member   *Member         `json:"member,omitempty"`
+}
+
+func encode(c command) []byte {
+	data, _ := json.Marshal(c)
+	return data
+}
+
+// SetShardMap records a new version of the shard map. Older versions than
+// the one already recorded are ignored, so proposals may race.
+func SetShardMap(s shard.Snapshot) []byte {
+	return encode(command{Op: opShardMap, ShardMap: &s})
+}
+
+// Join records a member, replacing any earlier record with its ID.
+func Join(m Member) []byte {
+	return encode(command{Op: opJoin, Member: &m})
+}
+
+// Leave forgets a member.
+func Leave(id string) []byte {
+	return encode(command{Op: opLeave, Member: &Member{ID: id}})
+}
+
+// BumpSchema increments the schema version after a schema change.
+func BumpSchema() []byte {
+	return encode(command{Op: opSchema})
+}
+
+// Metadata is the state machine holding State. It is safe for concurrent
+// use.
+type Metadata struct {
+	mu    sync.RWMutex
+	state State
+	// onShardMap is called with every newer shard map, outside the lock.
+	onShardMap func(shard.Snapshot)
+}
+
+// New returns empty metadata. onShardMap, if not nil, is called whenever a
+// newer shard map is applied or restored.
+func New(onShardMap func(shard.Snapshot)) *Metadata {
+	return &Metadata{state: State{Members: make(map[string]Member)}, onShardMap: onShardMap}
+}
+
+// State returns a copy of the metadata.
+func (m *Metadata) State() State {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	s := m.state
+	s.Members = make(map[string]Member, len(m.state.Members))
+	for id, member := range m.state.Members {
+		s.Members[id] = member
+	}
+	return s
+}
+
+// Members returns the members ordered by ID.
+func (m *Metadata) Members() []Member {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	members := make([]Member, 0, len(m.state.Members))
+	for _, member := range m.state.Members {
+		members = append(members, member)
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].ID < members[j].ID })
+	return members
+}
+
+// Apply implements raft.FSM.
+func (m *Metadata) Apply(data []byte) {
+	var c command
+	if err := json.Unmarshal(data, &c); err != nil {
+		return
+	}
+	m.mu.Lock()
+	var changed *shard.Snapshot
+	switch c.Op {
+	case opShardMap:
+		if c.ShardMap != nil && c.ShardMap.Version > m.state.ShardMap.Version {
+			m.state.ShardMap = *c.ShardMap
+			changed = c.ShardMap
+		}
+	case opJoin:
+		if c.Member != nil {
+			m.state.Members[c.Member.ID] = *c.Member
+		}
+	case opLeave:
+		if c.Member != nil {
+			delete(m.state.Members, c.Member.ID)
+		}
+	case opSchema:
+		m.state.SchemaVersion++
+	}
+	m.mu.Unlock()
+	if changed != nil && m.onShardMap != nil {
+		m.onShardMap(*changed)
+	}
+}
+
+// Snapshot implements raft.FSM.
+func (m *Metadata) Snapshot() ([]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return json.Marshal(m.state)
+}
+
+// Restore implements raft.FSM.
+func (m *Metadata) Restore(data []byte) error {
+	var s State
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	if s.Members == nil {
+		s.Members = make(map[string]Member)
+	}
+	m.mu.Lock()
+	m.state = s
+	m.mu.Unlock()
+	if m.onShardMap != nil {
+		m.onShardMap(s.ShardMap)
+	}
+	return nil
+}
+
+// ParsePeers parses a comma-separated list of id=host:port pairs.
+func ParsePeers(spec string) (map[string]string, error) {
+	peers := make(map[string]string)
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		id, addr, ok := strings.Cut(item, "=")
+		if !ok || id == "" || addr == "" {
+			return nil, fmt.Errorf("invalid peer %q, expected id=host:port", item)
+		}
+		if _, dup := peers[id]; dup {
+			return nil, fmt.Errorf("peer %s listed twice", id)
+		}
+		peers[id] = addr
+	}
+	if len(peers) == 0 {
+		return nil, fmt.Errorf("no peers in %q", spec)
+	}
+	return peers, nil
+}
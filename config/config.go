@@ -0,0 +1,420 @@
+// Package config loads the settings of a master or slave node. Every
+// setting has a default, which a YAML file given with -config (or
+// DISTDB_CONFIG) overrides, then a DISTDB_* environment variable, then a
+// command-line flag. The result is validated before the node starts.
+package config
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"distributed-db/cluster"
+
+	"github.com/go-sql-driver/mysql"
+	"gopkg.in/yaml.v3"
+)
+
+// Role selects the settings and defaults of a node.
+type Role int
+
+const (
+	Master Role = iota
+	Slave
+)
+
+// Shard is one shard database. DSN names the MySQL server holding it, in
+// go-sql-driver form and without a database; it defaults to the node's
+// main server.
+type Shard struct {
+	Name string `yaml:"name"`
+	DSN  string `yaml:"dsn,omitempty"`
+}
+
+// Listen holds the addresses a node listens on.
+type Listen struct {
+	// HTTP serves the web UI and API.
+	HTTP string `yaml:"http"`
+	// Replication is where the master accepts slaves.
+	Replication string `yaml:"replication,omitempty"`
+}
+
+// Replication holds the replication and failover settings.
+type Replication struct {
+	WriteConcern      string        `yaml:"write_concern,omitempty"`
+	AckTimeout        time.Duration `yaml:"ack_timeout,omitempty"`
+	HeartbeatInterval time.Duration `yaml:"heartbeat_interval"`
+	HeartbeatTimeout  time.Duration `yaml:"heartbeat_timeout"`
+	FailoverTimeout   time.Duration `yaml:"failover_timeout,omitempty"`
+	MasterCmd         string        `yaml:"master_cmd,omitempty"`
+	// SlaveWrites is how a slave handles the writes of its clients:
+	// "local" applies them and then forwards them to the master, which
+	// detects conflicting ones; "forward" only forwards them, returns the
+	// master's result, and they apply through replication.
+	SlaveWrites string `yaml:"slave_writes,omitempty"`
+	// Replicas is the number of slaves write concerns are counted
+	// against; 0 counts every slave registered with the master that is
+	// connected or was seen within NodeExpiry.
+	Replicas int `yaml:"replicas,omitempty"`
+	// NodeExpiry is how long a registered slave that disconnected still
+	// counts as a replica; 0 counts it until it is deregistered.
+	NodeExpiry time.Duration `yaml:"node_expiry,omitempty"`
+}
+
+// Raft holds the consensus settings; Raft is enabled when Peers is set.
+type Raft struct {
+	ID    string            `yaml:"id,omitempty"`
+	Peers map[string]string `yaml:"peers,omitempty"`
+	Dir   string            `yaml:"dir"`
+}
+
+// UI holds the web interface settings.
+type UI struct {
+	Title     string `yaml:"title"`
+	Templates string `yaml:"templates"`
+	Static    string `yaml:"static"`
+}
+
+// Config is the configuration of one node.
+type Config struct {
+	Role Role `yaml:"-"`
+
+	// MySQL is the DSN of the node's main MySQL server, without a
+	// database.
+	MySQL  string  `yaml:"mysql"`
+	Shards []Shard `yaml:"shards"`
+	Listen Listen  `yaml:"listen"`
+	// Master is the replication address of the master a slave follows.
+	Master  string `yaml:"master,omitempty"`
+	DataDir string `yaml:"data_dir"`
+
+	Replication Replication `yaml:"replication"`
+	Raft        Raft        `yaml:"raft"`
+	UI          UI          `yaml:"ui"`
+}
+
+// Defaults returns the settings a node of the given role starts with.
+func Defaults(role Role) *Config {
+	c := &Config{
+		Role:   role,
+		MySQL:  "root:1234@tcp(127.0.0.1:3306)/",
+		Shards: []Shard{{Name: "shard1"}, {Name: "shard2"}},
+		Replication: Replication{
+			HeartbeatInterval: time.Second,
+			HeartbeatTimeout:  5 * time.Second,
+		},
+		Raft: Raft{Dir: "raft_data"},
+		UI:   UI{Title: "Database Manager", Templates: "templates", Static: "static"},
+	}
+	if role == Master {
+		c.Listen = Listen{HTTP: ":8081", Replication: ":8083"}
+		c.DataDir = "master_data"
+		c.Replication.WriteConcern = "none"
+		c.Replication.AckTimeout = 5 * time.Second
+		c.Replication.NodeExpiry = 24 * time.Hour
+	} else {
+		c.Listen = Listen{HTTP: ":8082"}
+		c.DataDir = "slave_data"
+		c.Replication.MasterCmd = "go run master.go"
+		c.Replication.SlaveWrites = "local"
+	}
+	return c
+}
+
+// ShardDSN returns the DSN of the server holding shard i.
+func (c *Config) ShardDSN(i int) string {
+	if c.Shards[i].DSN != "" {
+		return c.Shards[i].DSN
+	}
+	return c.MySQL
+}
+
+// setting is a value that can be given as a flag or environment variable.
+type setting struct {
+	name  string
+	usage string
+	roles []Role
+	set   func(c *Config, v string) error
+}
+
+func both() []Role { return []Role{Master, Slave} }
+
+var settings = []setting{
+	{"mysql", "DSN of the main MySQL server, without a database", both(), func(c *Config, v string) error {
+		c.MySQL = v
+		return nil
+	}},
+	{"shards", "comma-separated shard databases, each name or name=dsn", both(), func(c *Config, v string) error {
+		var shards []Shard
+		for _, item := range strings.Split(v, ",") {
+			name, dsn, _ := strings.Cut(strings.TrimSpace(item), "=")
+			shards = append(shards, Shard{Name: name, DSN: dsn})
+		}
+		c.Shards = shards
+		return nil
+	}},
+	{"http", "listen address of the web UI and API", both(), func(c *Config, v string) error {
+		c.Listen.HTTP = v
+		return nil
+	}},
+	{"replication", "listen address for slave connections", []Role{Master}, func(c *Config, v string) error {
+		c.Listen.Replication = v
+		return nil
+	}},
+	{"master", "replication address of the master to follow", []Role{Slave}, func(c *Config, v string) error {
+		c.Master = v
+		return nil
+	}},
+	{"data-dir", "directory holding the node's state", both(), func(c *Config, v string) error {
+		c.DataDir = v
+		return nil
+	}},
+	{"write-concern", "default write concern for writes: none, one, majority or all", []Role{Master}, func(c *Config, v string) error {
+		c.Replication.WriteConcern = v
+		return nil
+	}},
+	{"replicas", "number of slaves write concerns are counted against (0: every current registered slave)", []Role{Master}, func(c *Config, v string) error {
+		n, err := strconv.Atoi(v)
+		c.Replication.Replicas = n
+		return err
+	}},
+	{"node-expiry", "how long a disconnected slave still counts as a replica (0: until it is deregistered)", []Role{Master}, func(c *Config, v string) error {
+		return setDuration(&c.Replication.NodeExpiry, v)
+	}},
+	{"ack-timeout", "how long a write waits for replica acknowledgements", []Role{Master}, func(c *Config, v string) error {
+		return setDuration(&c.Replication.AckTimeout, v)
+	}},
+	{"heartbeat-interval", "how often heartbeats are sent", both(), func(c *Config, v string) error {
+		return setDuration(&c.Replication.HeartbeatInterval, v)
+	}},
+	{"heartbeat-timeout", "how long the other side may stay silent before the link is dropped", both(), func(c *Config, v string) error {
+		return setDuration(&c.Replication.HeartbeatTimeout, v)
+	}},
+	{"failover-timeout", "promote the most up-to-date slave after the master has been unreachable this long (0 disables automatic failover)", []Role{Slave}, func(c *Config, v string) error {
+		return setDuration(&c.Replication.FailoverTimeout, v)
+	}},
+	{"master-cmd", "command that starts the master when this slave is promoted", []Role{Slave}, func(c *Config, v string) error {
+		c.Replication.MasterCmd = v
+		return nil
+	}},
+	{"slave-writes", "how client writes are handled: local (apply, then forward to the master) or forward (proxy to the master and return its result)", []Role{Slave}, func(c *Config, v string) error {
+		c.Replication.SlaveWrites = v
+		return nil
+	}},
+	{"raft-id", "ID of this node in the Raft cluster", both(), func(c *Config, v string) error {
+		c.Raft.ID = v
+		return nil
+	}},
+	{"raft-peers", "comma-separated id=host:port Raft addresses of all nodes; enables Raft", both(), func(c *Config, v string) error {
+		peers, err := cluster.ParsePeers(v)
+		c.Raft.Peers = peers
+		return err
+	}},
+	{"raft-dir", "directory holding this node's Raft state", both(), func(c *Config, v string) error {
+		c.Raft.Dir = v
+		return nil
+	}},
+	{"ui-title", "title of the web interface", both(), func(c *Config, v string) error {
+		c.UI.Title = v
+		return nil
+	}},
+	{"ui-templates", "directory of the web interface templates", both(), func(c *Config, v string) error {
+		c.UI.Templates = v
+		return nil
+	}},
+	{"ui-static", "directory of the web interface static files", both(), func(c *Config, v string) error {
+		c.UI.Static = v
+		return nil
+	}},
+}
+
+func setDuration(d *time.Duration, v string) error {
+	parsed, err := time.ParseDuration(v)
+	if err != nil {
+		return err
+	}
+	*d = parsed
+	return nil
+}
+
+// envName returns the environment variable overriding a setting.
+func envName(name string) string {
+	return "DISTDB_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+func (s setting) applies(role Role) bool {
+	for _, r := range s.roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// Load defines the settings of role as flags on fs, parses args and
+// returns the validated configuration. A slave also accepts the master's
+// host as its first argument, as in `go run slave.go 192.168.1.100`.
+func Load(role Role, fs *flag.FlagSet, args []string) (*Config, error) {
+	path := fs.String("config", "", "YAML configuration file (env "+envName("config")+")")
+	values := make(map[string]*string)
+	for _, s := range settings {
+		if s.applies(role) {
+			values[s.name] = fs.String(s.name, "", s.usage+" (env "+envName(s.name)+")")
+		}
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	c := Defaults(role)
+	if *path == "" {
+		*path = os.Getenv(envName("config"))
+	}
+	if *path != "" {
+		if err := c.loadFile(*path); err != nil {
+			return nil, err
+		}
+	}
+	for _, s := range settings {
+		if v, ok := os.LookupEnv(envName(s.name)); ok && s.applies(role) {
+			if err := s.set(c, v); err != nil {
+				return nil, fmt.Errorf("%s: %w", envName(s.name), err)
+			}
+		}
+	}
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		for _, s := range settings {
+			if s.name == f.Name && err == nil {
+				if e := s.set(c, *values[s.name]); e != nil {
+					err = fmt.Errorf("-%s: %w", s.name, e)
+				}
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if role == Slave && fs.NArg() > 0 {
+		c.Master = fs.Arg(0)
+	}
+	if role == Slave && c.Master != "" {
+		if _, _, err := net.SplitHostPort(c.Master); err != nil {
+			c.Master = net.JoinHostPort(c.Master, "8083")
+		}
+	}
+	return c, c.Validate()
+}
+
+func (c *Config) loadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	dec := yaml.NewDecoder(f)
+	// Misspelled keys would otherwise be silently ignored
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// Validate checks the configuration and reports every problem found.
+func (c *Config) Validate() error {
+	var problems []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+	checkDSN := func(what, dsn string) {
+		parsed, err := mysql.ParseDSN(dsn)
+		check(err == nil, "%s: invalid DSN: %v", what, err)
+		if err == nil {
+			check(parsed.DBName == "", "%s: the DSN must not name a database", what)
+		}
+	}
+	checkAddr := func(what, addr string) {
+		_, port, err := net.SplitHostPort(addr)
+		check(err == nil && port != "", "%s: %q is not a host:port address", what, addr)
+	}
+
+	checkDSN("mysql", c.MySQL)
+	check(len(c.Shards) > 0, "shards: at least one shard is required")
+	seen := make(map[string]bool)
+	for i, s := range c.Shards {
+		check(s.Name != "", "shards[%d]: a name is required", i)
+		check(!seen[s.Name], "shards[%d]: %s is listed twice", i, s.Name)
+		seen[s.Name] = true
+		if s.DSN != "" {
+			checkDSN(fmt.Sprintf("shards[%d]", i), s.DSN)
+		}
+	}
+	checkAddr("listen.http", c.Listen.HTTP)
+	check(c.DataDir != "", "data_dir: a directory is required")
+
+	r := c.Replication
+	check(r.HeartbeatInterval > 0, "replication.heartbeat_interval must be positive")
+	check(r.HeartbeatTimeout > r.HeartbeatInterval, "replication.heartbeat_timeout must be longer than the heartbeat interval")
+	if c.Role == Master {
+		checkAddr("listen.replication", c.Listen.Replication)
+		switch r.WriteConcern {
+		case "none", "one", "majority", "all":
+		default:
+			check(false, "replication.write_concern: unknown write concern %q", r.WriteConcern)
+		}
+		check(r.Replicas >= 0, "replication.replicas must not be negative")
+		check(r.NodeExpiry >= 0, "replication.node_expiry must not be negative")
+		check(r.AckTimeout > 0, "replication.ack_timeout must be positive")
+	} else {
+		check(c.Master != "", "master: the master's address is required")
+		if c.Master != "" {
+			checkAddr("master", c.Master)
+		}
+		check(r.FailoverTimeout >= 0, "replication.failover_timeout must not be negative")
+		check(strings.TrimSpace(r.MasterCmd) != "", "replication.master_cmd: a command is required")
+		check(r.SlaveWrites == "local" || r.SlaveWrites == "forward", "replication.slave_writes: unknown mode %q (want local or forward)", r.SlaveWrites)
+	}
+
+	if len(c.Raft.Peers) > 0 {
+		_, ok := c.Raft.Peers[c.Raft.ID]
+		check(ok, "raft.id: %q is not one of the peers", c.Raft.ID)
+		for id, addr := range c.Raft.Peers {
+			checkAddr("raft.peers."+id, addr)
+		}
+		check(c.Raft.Dir != "", "raft.dir: a directory is required")
+	}
+	check(c.UI.Templates != "" && c.UI.Static != "", "ui: the templates and static directories are required")
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("invalid configuration:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// RaftPeers returns the Raft peers in the -raft-peers form.
+func (c *Config) RaftPeers() string {
+	ids := make([]string, 0, len(c.Raft.Peers))
+	for id := range c.Raft.Peers {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for i, id := range ids {
+		ids[i] = id + "=" + c.Raft.Peers[id]
+	}
+	return strings.Join(ids, ",")
+}
+
+// Port returns the port of a listen address.
+func Port(addr string) string {
+	_, port, _ := net.SplitHostPort(addr)
+	return port
+}
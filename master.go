@@ -1,66 +1,171 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
 	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
+
+	"distributed-db/cluster"
+	"distributed-db/config"
+	"distributed-db/protocol"
+	"distributed-db/raft"
+	"distributed-db/replog"
+	"distributed-db/session"
+	"distributed-db/shard"
+	"distributed-db/sqlparse"
+	"distributed-db/txlog"
 
 	"github.com/gin-gonic/gin"
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/go-sql-driver/mysql"
 )
 
 var (
 	db       *sql.DB
 	mu       sync.Mutex
-	shardMap map[string]int
+	shardMap *shard.Map
 	shardDBs []*sql.DB
-	slaves   []net.Conn
+	slaves   []*protocol.Conn
+	replLog  *replog.Log
+	// replMu serializes mutating statements so that the order in which
+	// they are applied on the master matches their order in replLog.
+	replMu sync.Mutex
+	// servers tells which shards share a MySQL server, and serverDBs
+	// holds a pool for each server, the main one first.
+	servers   *shard.Servers
+	serverDBs []*sql.DB
+	// sessions holds the client sessions opened with /session.
+	sessions *session.Manager
+	// pendingAcks holds the acknowledgements being collected for log
+	// entries written with a write concern, guarded by mu.
+	pendingAcks = make(map[uint64]*ackWait)
+
+	// epoch numbers the masters the cluster has had. It grows with every
+	// promotion; a master that learns of a higher one has been replaced.
+	epoch uint64
+	// fencedBy is set once a newer master has taken over, guarded by mu.
+	fencedBy *protocol.Fence
+	// conflicts holds the latest conflicts with writes slaves applied
+	// themselves, guarded by mu.
+	conflicts []conflict
+
+	// cfg holds the settings loaded at startup; see the config package.
+	cfg         *config.Config
+	promoteFrom = flag.String("promote", "", "promotion file left by a slave taking over as master")
+
+	// members describes every connected slave, live or still catching up,
+	// guarded by mu.
+	members = make(map[*protocol.Conn]*slaveInfo)
+	// startedAt is when this master came up, shown as its connection time.
+	startedAt = time.Now()
+
+	// raftNode replicates the cluster metadata when Raft is enabled; the
+	// master only accepts writes while it is the Raft leader.
+	raftNode *raft.Node
+	metadata *cluster.Metadata
 )
 
+// Files kept in the data directory.
+func replicationLogPath() string { return filepath.Join(cfg.DataDir, "replication.log") }
+func epochPath() string          { return filepath.Join(cfg.DataDir, "epoch") }
+func fencePath() string          { return filepath.Join(cfg.DataDir, "fenced.json") }
+func peersPath() string          { return filepath.Join(cfg.DataDir, "peers.json") }
+func nodesPath() string          { return filepath.Join(cfg.DataDir, "nodes.json") }
+func conflictsPath() string      { return filepath.Join(cfg.DataDir, "conflicts.log") }
+
 func main() {
 	var err error
-	db, err = sql.Open("mysql", "root:1234@tcp(127.0.0.1:3306)/")
+	if cfg, err = config.Load(config.Master, flag.CommandLine, os.Args[1:]); err != nil {
+		log.Fatal(err)
+	}
+	if err := os.MkdirAll(cfg.DataDir, 0o755); err != nil {
+		log.Fatal("Error creating data directory:", err)
+	}
+
+	db, err = sql.Open("mysql", cfg.MySQL)
 	if err != nil {
 		log.Fatal("Error connecting to MySQL:", err)
 	}
 	defer db.Close()
 
 	// Create shard databases if they don't exist
-	_, err = db.Exec("CREATE DATABASE IF NOT EXISTS shard1")
-	if err != nil {
-		log.Fatal("Error creating shard1 database:", err)
+	shardDBs = make([]*sql.DB, len(cfg.Shards))
+	for i, s := range cfg.Shards {
+		shardDBs[i], err = shard.Open(cfg.ShardDSN(i), s.Name)
+		if err != nil {
+			log.Fatalf("Error connecting to shard %s: %v", s.Name, err)
+		}
+		defer shardDBs[i].Close()
 	}
-	_, err = db.Exec("CREATE DATABASE IF NOT EXISTS shard2")
-	if err != nil {
-		log.Fatal("Error creating shard2 database:", err)
+	dsns := make([]string, len(cfg.Shards))
+	for i := range cfg.Shards {
+		dsns[i] = cfg.ShardDSN(i)
+	}
+	if servers, err = shard.NewServers(cfg.MySQL, dsns); err != nil {
+		log.Fatal("Error grouping shards by server:", err)
 	}
+	serverDBs = servers.Pools(db, shardDBs)
+	fmt.Printf("%d shards on %d MySQL servers\n", len(shardDBs), len(serverDBs))
+	sessions = session.NewManager(serverDBs, sessionIdleTimeout)
 
-	shardDBs = make([]*sql.DB, 2)
-	shardDBs[0], err = sql.Open("mysql", "root:1234@tcp(127.0.0.1:3306)/shard1")
-	if err != nil {
-		log.Fatal("Error connecting to Shard1:", err)
+	// The shard map is stored in the metadata database so restarts never
+	// move tables; tables created before it existed are placed now.
+	shardMap = shard.NewMap(len(shardDBs))
+	if err := shardMap.Attach(db); err != nil {
+		log.Fatal("Error loading shard map:", err)
 	}
-	defer shardDBs[0].Close()
-	shardDBs[1], err = sql.Open("mysql", "root:1234@tcp(127.0.0.1:3306)/shard2")
-	if err != nil {
-		log.Fatal("Error connecting to Shard2:", err)
+	if err := backfillShardMap(); err != nil {
+		log.Fatal("Error initializing shard map:", err)
 	}
-	defer shardDBs[1].Close()
+	fmt.Printf("Shard map version %d with %d tables\n", shardMap.Version(), shardMap.Len())
 
-	shardMap = make(map[string]int)
+	promotion, err := openReplicationLog()
+	if err != nil {
+		log.Fatal("Error opening replication log:", err)
+	}
+	defer replLog.Close()
+	fmt.Printf("Replication log at LSN %d, epoch %d\n", replLog.LastLSN(), epoch)
+	if decisions, err = txlog.Open(filepath.Join(cfg.DataDir, "decisions.log")); err != nil {
+		log.Fatal("Error opening decision log:", err)
+	}
+	defer decisions.Close()
+	resolveTransactions(true)
+	if err := loadFence(); err != nil {
+		log.Fatal("Error loading fence:", err)
+	}
+	if err := loadRegistry(); err != nil {
+		log.Fatal("Error loading node registry:", err)
+	}
+	if err := startConsensus(); err != nil {
+		log.Fatal("Error starting Raft:", err)
+	}
 
-	// Start Master TCP Server on port 8083
-	listener, err := net.Listen("tcp", ":8083")
+	// Start Master TCP Server for the slaves
+	listener, err := net.Listen("tcp", cfg.Listen.Replication)
 	if err != nil {
 		log.Fatal("Error starting TCP server:", err)
 	}
 	defer listener.Close()
 
-	fmt.Println("Master is listening on port 8083")
+	fmt.Println("Master is listening for slaves on", cfg.Listen.Replication)
 
 	// Accept slave connections
 	go func() {
@@ -70,274 +175,3494 @@ func main() {
 				fmt.Println("Error accepting connection:", err)
 				continue
 			}
-			mu.Lock()
-			slaves = append(slaves, conn)
-			mu.Unlock()
-			go handleSlave(conn)
+			// The slave joins the broadcast set once it has caught up
+			go handleSlave(protocol.NewConn(conn, cfg.Replication.HeartbeatTimeout))
 		}
 	}()
 
-	// Start Web Frontend on port 8081
+	// A promoted master takes over the old master's slaves and fences it;
+	// any other master first makes sure it has not been replaced.
+	if promotion != nil {
+		go takeOver(*promotion)
+	} else {
+		go checkReplaced()
+	}
+
+	// Start Web Frontend
 	go startFrontend()
+	go resumeMigrations()
+	go watchTransactions()
+	go expireSessions()
 
 	// Keep main goroutine alive
 	select {}
 }
 
-func handleSlave(conn net.Conn) {
-	defer func() {
-		mu.Lock()
-		for i, c := range slaves {
-			if c == conn {
-				slaves = append(slaves[:i], slaves[i+1:]...)
-				break
+func removeSlave(conn *protocol.Conn) {
+	mu.Lock()
+	removed := false
+	for i, c := range slaves {
+		if c == conn {
+			slaves = append(slaves[:i], slaves[i+1:]...)
+			removed = true
+			break
+		}
+	}
+	if removed {
+		queueMetadata(cluster.Leave(slaveMember(conn).ID))
+	}
+	mu.Unlock()
+	if removed {
+		publishPeers()
+	}
+}
+
+// nodeRecord is a slave the master has registered. The registry is kept
+// in nodes.json so slaves are recognized across restarts of either side.
+type nodeRecord struct {
+	ID           string    `json:"id"`
+	Version      int       `json:"version"`
+	Capabilities []string  `json:"capabilities"`
+	Addr         string    `json:"addr"`
+	FirstSeen    time.Time `json:"first_seen"`
+	LastSeen     time.Time `json:"last_seen"`
+	Connections  int       `json:"connections"`
+}
+
+// registry holds every slave registered and not deregistered since, by
+// node ID, guarded by mu.
+var registry = make(map[string]*nodeRecord)
+
+func loadRegistry() error {
+	data, err := os.ReadFile(nodesPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var records []*nodeRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return err
+	}
+	for _, r := range records {
+		registry[r.ID] = r
+	}
+	return nil
+}
+
+// registeredNodes returns the registry ordered by node ID. It must be
+// called with mu held.
+func registeredNodes() []nodeRecord {
+	records := make([]nodeRecord, 0, len(registry))
+	for _, r := range registry {
+		records = append(records, *r)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].ID < records[j].ID })
+	return records
+}
+
+// saveRegistry writes the registry, as marshalled with mu held, to
+// nodes.json.
+func saveRegistry(data []byte, err error) {
+	if err == nil {
+		err = os.WriteFile(nodesPath(), data, 0o644)
+	}
+	if err != nil {
+		fmt.Println("Error saving node registry:", err)
+	}
+}
+
+// deregisterNode removes a slave that is gone for good from the registry,
+// so that write concerns stop counting it. A connected slave cannot be
+// removed.
+func deregisterNode(id string) error {
+	mu.Lock()
+	if _, ok := registry[id]; !ok {
+		mu.Unlock()
+		return fmt.Errorf("node %s is not registered", id)
+	}
+	for _, info := range members {
+		if info.NodeID == id {
+			mu.Unlock()
+			return fmt.Errorf("node %s is connected", id)
+		}
+	}
+	delete(registry, id)
+	data, err := json.Marshal(registeredNodes())
+	mu.Unlock()
+	saveRegistry(data, err)
+	fmt.Printf("Deregistered slave %s\n", id)
+	return nil
+}
+
+// registerSlave records the identity a slave presents. A node ID that is
+// still attached to another connection belongs to a slave that reconnected
+// before its old connection was noticed as dead; that connection is closed.
+func registerSlave(conn *protocol.Conn, reg protocol.Register) (protocol.Registered, error) {
+	if reg.NodeID == "" {
+		return protocol.Registered{}, fmt.Errorf("a node ID is required")
+	}
+	if reg.Version != protocol.Version {
+		return protocol.Registered{}, fmt.Errorf("protocol version %d is not supported, the master speaks version %d", reg.Version, protocol.Version)
+	}
+	if reg.Shards != len(shardDBs) {
+		return protocol.Registered{}, fmt.Errorf("the slave is configured with %d shards, the master with %d", reg.Shards, len(shardDBs))
+	}
+
+	now := time.Now()
+	mu.Lock()
+	record, returning := registry[reg.NodeID]
+	if !returning {
+		record = &nodeRecord{ID: reg.NodeID, FirstSeen: now}
+		registry[reg.NodeID] = record
+	}
+	record.Version = reg.Version
+	record.Capabilities = reg.Capabilities
+	record.Addr = conn.RemoteAddr().String()
+	record.LastSeen = now
+	record.Connections++
+	var stale []*protocol.Conn
+	for other, info := range members {
+		if other != conn && info.NodeID == reg.NodeID {
+			stale = append(stale, other)
+		}
+	}
+	members[conn].NodeID = reg.NodeID
+	members[conn].HTTP = withPort(hostOf(conn.RemoteAddr().String()), reg.HTTPPort, "8082")
+	data, err := json.Marshal(registeredNodes())
+	first := record.FirstSeen
+	mu.Unlock()
+
+	saveRegistry(data, err)
+	for _, other := range stale {
+		fmt.Printf("Closing stale connection %s of slave %s\n", other.RemoteAddr(), reg.NodeID)
+		other.Close()
+	}
+	if returning {
+		fmt.Printf("Slave %s reconnected from %s\n", reg.NodeID, conn.RemoteAddr())
+	} else {
+		fmt.Printf("Slave %s registered from %s\n", reg.NodeID, conn.RemoteAddr())
+	}
+	return protocol.Registered{NodeID: reg.NodeID, Returning: returning, FirstSeen: first}, nil
+}
+
+// slaveInfo is the master's view of a connected slave.
+type slaveInfo struct {
+	NodeID string `json:"node_id"`
+	Addr   string `json:"addr"`
+	// HTTP is the address of the slave's web server, known once the
+	// slave has registered.
+	HTTP      string    `json:"http"`
+	Connected time.Time `json:"connected"`
+	LastSeen  time.Time `json:"last_seen"`
+	LSN       uint64    `json:"lsn"`
+	Status    string    `json:"status"`
+	// Live is set once the slave has caught up and receives every write.
+	Live bool `json:"live"`
+}
+
+// sendHeartbeats keeps the link to a slave from going silent until stop is
+// closed.
+func sendHeartbeats(conn *protocol.Conn, stop <-chan struct{}) {
+	id := cfg.Raft.ID
+	if id == "" {
+		id = "master"
+	}
+	ticker := time.NewTicker(cfg.Replication.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		status := "healthy"
+		if fencedError() != nil {
+			status = "fenced"
+		}
+		hb := protocol.Heartbeat{NodeID: id, LSN: replLog.LastLSN(), Status: status}
+		if err := conn.Send(protocol.MsgHeartbeat, hb); err != nil {
+			return
+		}
+	}
+}
+
+// membership returns the view of every connected slave, ordered by
+// address.
+func membership() []slaveInfo {
+	mu.Lock()
+	defer mu.Unlock()
+	live := make(map[*protocol.Conn]bool, len(slaves))
+	for _, conn := range slaves {
+		live[conn] = true
+	}
+	view := make([]slaveInfo, 0, len(members))
+	for conn, info := range members {
+		member := *info
+		member.Live = live[conn]
+		view = append(view, member)
+	}
+	sort.Slice(view, func(i, j int) bool { return view[i].Addr < view[j].Addr })
+	return view
+}
+
+// clusterNode is one row of the topology shown at /cluster.
+type clusterNode struct {
+	ID        string    `json:"id"`
+	Address   string    `json:"address"`
+	Role      string    `json:"role"`
+	Status    string    `json:"status"`
+	Connected time.Time `json:"connected"`
+	LastSeen  time.Time `json:"last_seen"`
+	LSN       uint64    `json:"lsn"`
+	Lag       uint64    `json:"lag"`
+	Shards    []int     `json:"shards"`
+}
+
+// shardInfo lists the tables a shard holds: whole tables placed on it, and
+// sharded tables whose rows are spread over every shard.
+type shardInfo struct {
+	Shard     int      `json:"shard"`
+	Database  string   `json:"database"`
+	Tables    []string `json:"tables"`
+	Sharded   []string `json:"sharded"`
+	Reference []string `json:"reference"`
+}
+
+// clusterView describes every node and shard. host is the master's host as
+// the client reached it.
+func clusterView(host string) gin.H {
+	lsn := replLog.LastLSN()
+	// Every node holds a full copy of every shard
+	all := make([]int, len(shardDBs))
+	shards := make([]shardInfo, len(shardDBs))
+	for i := range shardDBs {
+		all[i] = i
+		shards[i] = shardInfo{Shard: i, Database: cfg.Shards[i].Name, Tables: []string{}, Sharded: []string{}, Reference: []string{}}
+	}
+	for _, t := range shardMap.Tables() {
+		name := t.DB + "." + t.Name
+		if t.Reference {
+			for i := range shards {
+				shards[i].Reference = append(shards[i].Reference, name)
+			}
+		} else if t.Sharded() {
+			for _, i := range t.Owners(len(shards)) {
+				if i < len(shards) {
+					shards[i].Sharded = append(shards[i].Sharded, name)
+				}
+			}
+		} else if t.Shard < len(shards) {
+			shards[t.Shard].Tables = append(shards[t.Shard].Tables, name)
+		}
+	}
+
+	id := cfg.Raft.ID
+	if id == "" {
+		id = "master"
+	}
+	status := "healthy"
+	if fencedError() != nil {
+		status = "fenced"
+	}
+	nodes := []clusterNode{{
+		ID:        id,
+		Address:   net.JoinHostPort(host, config.Port(cfg.Listen.Replication)),
+		Role:      "master",
+		Status:    status,
+		Connected: startedAt,
+		LastSeen:  time.Now(),
+		LSN:       lsn,
+		Shards:    all,
+	}}
+	for _, member := range membership() {
+		node := clusterNode{
+			ID:        member.NodeID,
+			Address:   member.Addr,
+			Role:      "slave",
+			Status:    member.Status,
+			Connected: member.Connected,
+			LastSeen:  member.LastSeen,
+			LSN:       member.LSN,
+			Shards:    all,
+		}
+		if !member.Live {
+			node.Status = "syncing"
+		}
+		if lsn > member.LSN {
+			node.Lag = lsn - member.LSN
+		}
+		nodes = append(nodes, node)
+	}
+
+	view := gin.H{
+		"epoch":     epoch,
+		"lsn":       lsn,
+		"shard_map": shardMap.Version(),
+		"nodes":     nodes,
+		"shards":    shards,
+	}
+	if raftNode != nil {
+		view["raft"] = raftNode.Status()
+	}
+	return view
+}
+
+// openReplicationLog opens the replication log and establishes the master's
+// epoch. A promoted master starts a new log right after the last entry it
+// applied as a slave, so slaves at the same position carry on without a
+// snapshot. The promotion file is removed once it has been applied.
+func openReplicationLog() (*protocol.Promotion, error) {
+	var promotion *protocol.Promotion
+	if *promoteFrom != "" {
+		data, err := os.ReadFile(*promoteFrom)
+		switch {
+		case os.IsNotExist(err):
+			fmt.Printf("Promotion file %s not found, assuming it was already applied\n", *promoteFrom)
+		case err != nil:
+			return nil, err
+		default:
+			promotion = &protocol.Promotion{}
+			if err := json.Unmarshal(data, promotion); err != nil {
+				return nil, fmt.Errorf("invalid promotion file %s: %w", *promoteFrom, err)
 			}
 		}
+	}
+
+	var err error
+	if promotion != nil {
+		if replLog, err = replog.OpenAt(replicationLogPath(), promotion.LSN); err != nil {
+			return nil, err
+		}
+		epoch = promotion.Epoch
+		// The epoch is a plain counter, stored like a replication position
+		if err := replog.SavePosition(epochPath(), epoch); err != nil {
+			return nil, err
+		}
+		if err := savePeers(promotion.Peers); err != nil {
+			return nil, err
+		}
+		fmt.Printf("Promoted to master at epoch %d, continuing after LSN %d\n", epoch, promotion.LSN)
+		return promotion, os.Remove(*promoteFrom)
+	}
+
+	if replLog, err = replog.Open(replicationLogPath()); err != nil {
+		return nil, err
+	}
+	saved, ok, err := replog.LoadPosition(epochPath())
+	if err != nil {
+		return nil, err
+	}
+	epoch = saved
+	if !ok {
+		epoch = 1
+		err = replog.SavePosition(epochPath(), epoch)
+	}
+	return nil, err
+}
+
+func loadFence() error {
+	data, err := os.ReadFile(fencePath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var f protocol.Fence
+	if err := json.Unmarshal(data, &f); err != nil {
+		return err
+	}
+	fencedBy = &f
+	fmt.Printf("This master was replaced by %s (epoch %d) and only serves reads\n", f.Master, f.Epoch)
+	return nil
+}
+
+// fence marks this master as replaced: writes are refused from now on, also
+// after a restart, and every slave is disconnected so it can follow the new
+// master.
+func fence(f protocol.Fence) {
+	if f.Epoch <= epoch {
+		return
+	}
+	mu.Lock()
+	if fencedBy != nil && fencedBy.Epoch >= f.Epoch {
 		mu.Unlock()
+		return
+	}
+	fencedBy = &f
+	conns := slaves
+	slaves = nil
+	mu.Unlock()
+
+	fmt.Printf("Fenced: replaced by master %s at epoch %d\n", f.Master, f.Epoch)
+	if data, err := json.Marshal(f); err == nil {
+		if err := os.WriteFile(fencePath(), data, 0o644); err != nil {
+			fmt.Println("Error saving fence:", err)
+		}
+	}
+	for _, conn := range conns {
+		conn.SendError(fencedError().Error())
 		conn.Close()
-	}()
+	}
+}
 
-	// Send initial setup commands to slave
-	setupCommands := []string{
-		"CREATE DATABASE IF NOT EXISTS shard1",
-		"CREATE DATABASE IF NOT EXISTS shard2",
+// fencedError returns the error reported for writes once this master has
+// been replaced, or while it is not the Raft leader, or nil.
+func fencedError() error {
+	if raftNode != nil && !raftNode.IsLeader() {
+		if leader := raftNode.Leader(); leader != "" {
+			return fmt.Errorf("this master is not the Raft leader, %s is", leader)
+		}
+		return fmt.Errorf("this master is not the Raft leader, no leader is elected yet")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if fencedBy == nil {
+		return nil
 	}
+	if fencedBy.Master == "" {
+		return fmt.Errorf("this master has been replaced by a newer one (epoch %d)", fencedBy.Epoch)
+	}
+	return fmt.Errorf("this master has been replaced by %s (epoch %d)", fencedBy.Master, fencedBy.Epoch)
+}
 
-	for _, cmd := range setupCommands {
-		_, err := conn.Write([]byte("master|" + cmd))
-		if err != nil {
-			fmt.Println("Error sending setup command to slave:", err)
-			return
+func loadPeers() []string {
+	var hosts []string
+	if data, err := os.ReadFile(peersPath()); err == nil {
+		json.Unmarshal(data, &hosts)
+	}
+	return hosts
+}
+
+// savePeers adds hosts to the slaves this master has known. They are asked
+// whether a newer master exists when this one restarts.
+func savePeers(hosts []string) error {
+	known := loadPeers()
+	for _, host := range hosts {
+		found := false
+		for _, k := range known {
+			found = found || k == host
+		}
+		if !found {
+			known = append(known, host)
+		}
+	}
+	data, err := json.Marshal(known)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(peersPath()), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(peersPath(), data, 0o644)
+}
+
+func hostOf(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// withPort returns addr with port added, or with fallback if port is
+// empty. An addr that already has a port, such as a peer address saved by
+// an earlier version, is returned as it is.
+func withPort(addr, port, fallback string) string {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+	if port == "" {
+		port = fallback
+	}
+	return net.JoinHostPort(addr, port)
+}
+
+// publishMu serializes publishPeers and publishShardMap, which send to the
+// slaves without holding mu, so that no slave receives an older peer list
+// or shard map after a newer one. It is taken before mu.
+var publishMu sync.Mutex
+
+// publishPeers sends the HTTP addresses of the live slaves to each of them,
+// so they can find each other if this master fails.
+func publishPeers() {
+	publishMu.Lock()
+	defer publishMu.Unlock()
+	mu.Lock()
+	var hosts []string
+	for _, conn := range slaves {
+		hosts = append(hosts, members[conn].HTTP)
+	}
+	live := append([]*protocol.Conn(nil), slaves...)
+	mu.Unlock()
+	for _, conn := range live {
+		if err := conn.Send(protocol.MsgPeers, protocol.Peers{Hosts: hosts}); err != nil {
+			fmt.Println("Error sending peers to slave:", err)
+		}
+	}
+	if err := savePeers(hosts); err != nil {
+		fmt.Println("Error saving peers:", err)
+	}
+}
+
+var peerClient = &http.Client{Timeout: 3 * time.Second}
+
+// takeOver completes a promotion: it points the other slaves at this master
+// and keeps trying to fence the old master until it answers, however long
+// it stays away.
+func takeOver(p protocol.Promotion) {
+	if p.Self == "" {
+		fmt.Println("Promotion does not name this host; slaves must be re-pointed by hand")
+	}
+	pending := make(map[string]bool)
+	for _, host := range p.Peers {
+		if host != p.Self && p.Self != "" {
+			pending[host] = true
+		}
+	}
+	oldMaster := p.OldMaster
+	// Slaves connect to the replication port, on the host the others know
+	// this node by
+	self := net.JoinHostPort(hostOf(p.Self), config.Port(cfg.Listen.Replication))
+	for delay := time.Second; len(pending) > 0 || oldMaster != ""; time.Sleep(delay) {
+		for host := range pending {
+			form := url.Values{"master": {self}, "epoch": {strconv.FormatUint(p.Epoch, 10)}}
+			if resp, err := peerClient.PostForm("http://"+withPort(host, "", "8082")+"/admin/repoint", form); err == nil {
+				resp.Body.Close()
+				delete(pending, host)
+				fmt.Printf("Re-pointed slave %s to this master\n", host)
+			}
+		}
+		if oldMaster != "" {
+			form := url.Values{"master": {self}, "epoch": {strconv.FormatUint(p.Epoch, 10)}}
+			if resp, err := peerClient.PostForm("http://"+withPort(oldMaster, "", "8081")+"/admin/fence", form); err == nil {
+				resp.Body.Close()
+				fmt.Printf("Fenced old master %s\n", oldMaster)
+				oldMaster = ""
+			}
+		}
+		if delay < 30*time.Second {
+			delay *= 2
 		}
-		// Wait for acknowledgment
-		buf := make([]byte, 1024)
-		_, err = conn.Read(buf)
+	}
+}
+
+// checkReplaced asks the slaves this master knew whether they follow a
+// newer master, which happens when it comes back after a failover.
+func checkReplaced() {
+	for _, host := range loadPeers() {
+		resp, err := peerClient.Get("http://" + withPort(host, "", "8082") + "/status")
 		if err != nil {
-			fmt.Println("Error reading setup acknowledgment:", err)
+			continue
+		}
+		var status struct {
+			Epoch  uint64 `json:"epoch"`
+			Master string `json:"master"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&status)
+		resp.Body.Close()
+		if err == nil && status.Epoch > epoch {
+			fence(protocol.Fence{Epoch: status.Epoch, Master: status.Master})
 			return
 		}
 	}
+}
+
+func handleSlave(conn *protocol.Conn) {
+	info := &slaveInfo{Addr: conn.RemoteAddr().String(), Connected: time.Now(), LastSeen: time.Now()}
+	mu.Lock()
+	members[conn] = info
+	mu.Unlock()
+	stop := make(chan struct{})
+	defer func() {
+		close(stop)
+		removeSlave(conn)
+		mu.Lock()
+		delete(members, conn)
+		// The expiry of a registered slave runs from its disconnection
+		record, registered := registry[info.NodeID]
+		if registered {
+			record.LastSeen = time.Now()
+		}
+		data, err := json.Marshal(registeredNodes())
+		mu.Unlock()
+		if registered {
+			saveRegistry(data, err)
+		}
+		conn.Close()
+	}()
+	go sendHeartbeats(conn, stop)
 
 	for {
-		buf := make([]byte, 1024)
-		n, err := conn.Read(buf)
+		// Slaves heartbeat while idle, so silence means the slave or
+		// the link is gone
+		conn.SetReadDeadline(time.Now().Add(cfg.Replication.HeartbeatTimeout))
+		msg, err := conn.Receive()
 		if err != nil {
-			fmt.Println("Error reading from Slave:", err)
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				fmt.Printf("Evicting slave %s: no heartbeat for %s\n", conn.RemoteAddr(), cfg.Replication.HeartbeatTimeout)
+			} else {
+				fmt.Println("Error reading from Slave:", err)
+			}
 			return
 		}
-		data := string(buf[:n])
-		parts := strings.SplitN(data, "|", 2)
-		if len(parts) < 2 {
-			conn.Write([]byte("Invalid request"))
-			continue
-		}
-
-		command := parts[0]
-		payload := parts[1]
+		mu.Lock()
+		info.LastSeen = time.Now()
+		mu.Unlock()
 
-		if command == "FULL_SYNC" {
-			syncData, err := dumpAllDatabases()
+		switch msg.Type {
+		case protocol.MsgHeartbeat:
+			var hb protocol.Heartbeat
+			if err := msg.Decode(&hb); err != nil {
+				continue
+			}
+			mu.Lock()
+			info.LSN, info.Status = hb.LSN, hb.Status
+			mu.Unlock()
+		case protocol.MsgAck:
+			var ack protocol.Ack
+			if err := msg.Decode(&ack); err != nil {
+				continue
+			}
+			recordAck(conn, ack)
+		case protocol.MsgError:
+			var e protocol.Error
+			if err := msg.Decode(&e); err == nil {
+				fmt.Println("Slave reported error:", e.Message)
+			}
+		case protocol.MsgRegister:
+			var reg protocol.Register
+			if err := msg.Decode(&reg); err != nil {
+				conn.SendError("Invalid request: " + err.Error())
+				continue
+			}
+			registered, err := registerSlave(conn, reg)
 			if err != nil {
-				conn.Write([]byte("Error syncing databases: " + err.Error()))
+				conn.SendError("Registration refused: " + err.Error())
+				return
+			}
+			if err := conn.Send(protocol.MsgRegistered, registered); err != nil {
+				fmt.Println("Error answering slave registration:", err)
+				return
+			}
+		case protocol.MsgHello:
+			var hello protocol.Hello
+			if err := msg.Decode(&hello); err != nil {
+				conn.SendError("Invalid request: " + err.Error())
 				continue
 			}
-			conn.Write([]byte("FULL_SYNC|" + syncData))
-		} else {
-			dbName := command
-			query := payload
+			mu.Lock()
+			registered := info.NodeID != ""
+			mu.Unlock()
+			if !registered {
+				conn.SendError("Slaves must register before replicating")
+				return
+			}
+			if hello.Epoch > epoch {
+				// The slave already follows a newer master
+				fence(protocol.Fence{Epoch: hello.Epoch})
+			}
+			if err := fencedError(); err != nil {
+				conn.SendError(err.Error())
+				return
+			}
+			mu.Lock()
+			welcome := protocol.Welcome{Epoch: epoch, Addr: info.HTTP, HTTPPort: config.Port(cfg.Listen.HTTP)}
+			mu.Unlock()
+			// A slave that missed entries says hello again to catch up;
+			// it rejoins the broadcast once replayed to
+			removeSlave(conn)
+			if err := conn.Send(protocol.MsgWelcome, welcome); err != nil {
+				fmt.Println("Error welcoming slave:", err)
+				return
+			}
+			if err := syncSlave(conn, hello); err != nil {
+				fmt.Println("Error synchronizing slave:", err)
+				return
+			}
+		case protocol.MsgFullSyncRequest:
+			var req protocol.FullSyncRequest
+			if err := msg.Decode(&req); err != nil {
+				conn.SendError("Invalid request: " + err.Error())
+				continue
+			}
+			if len(req.Tables) > 0 {
+				if err := repairSlave(conn, req.Tables); err != nil {
+					fmt.Println("Error repairing slave:", err)
+					return
+				}
+				continue
+			}
+			// Stop live replication until the new snapshot is in place
+			removeSlave(conn)
+			if err := syncSlave(conn, protocol.Hello{ResumeFrom: req.ResumeFrom}); err != nil {
+				fmt.Println("Error synchronizing slave:", err)
+				return
+			}
+		case protocol.MsgForward:
+			var stmt protocol.Statement
+			if err := msg.Decode(&stmt); err != nil {
+				conn.SendError("Invalid request: " + err.Error())
+				continue
+			}
+			// Replies name the statement, for the slave to hand them to
+			// the client waiting for them
+			reject := func(message string) {
+				conn.Send(protocol.MsgError, protocol.Error{ID: stmt.ID, Message: message})
+			}
+			dbName := stmt.DB
+			query := stmt.Query
 
-			_, err = db.Exec("USE " + dbName)
+			parsed, err := sqlparse.Parse(query)
 			if err != nil {
-				conn.Write([]byte("Error selecting database: " + err.Error()))
+				reject("Error parsing query: " + err.Error())
 				continue
 			}
-
-			queryType := strings.ToUpper(strings.Split(query, " ")[0])
-			if queryType == "CREATE" || queryType == "DROP" {
-				conn.Write([]byte("Error: CREATE and DROP are Master-only operations"))
+			if parsed.Kind.IsDDL() {
+				reject("Error: schema changes are Master-only operations")
+				continue
+			}
+			if parsed.Kind == sqlparse.Transaction {
+				reject("Error: transactions run on the Master only")
 				continue
 			}
 
-			// Execute the query on the master itself
-			result, err := executeQueryWithSharding(query, dbName)
+			concern, err := parseWriteConcern(stmt.WriteConcern)
 			if err != nil {
-				conn.Write([]byte("Error executing query: " + err.Error()))
+				reject(err.Error())
 				continue
 			}
 
-			// Broadcast the query to all other slaves immediately (Synchronous Replication)
-			mu.Lock()
-			for _, slave := range slaves {
-				if slave != conn { // Don't send back to the originating slave
-					_, err := slave.Write([]byte(dbName + "|" + query))
-					if err != nil {
-						fmt.Println("Error sending to Slave:", err)
+			// A slave forwarding in local mode applied the statement
+			// already; one in forward mode applies it when replicated
+			origin := conn
+			if stmt.Forward {
+				origin = nil
+			}
+
+			// Execute the query on the master itself, in the client's
+			// session variables, and replicate it
+			s := session.New(serverDBs)
+			var rowsAffected int64
+			write := protocol.LogEntry{DB: dbName, Query: query, Vars: stmt.Vars}
+			entry, wait, err := commitStatement(write, origin, concern, func() error {
+				if err := s.Use(context.Background(), dbName); err != nil {
+					return fmt.Errorf("selecting database: %w", err)
+				}
+				for _, set := range stmt.Vars {
+					if err := s.Set(context.Background(), set); err != nil {
+						return fmt.Errorf("setting session variables: %w", err)
 					}
 				}
+				var err error
+				rowsAffected, err = executeQueryWithSharding(s, query)
+				return err
+			})
+			insertID := s.InsertID()
+			s.Close()
+			if origin != nil {
+				if reason := detectConflict(stmt, parsed, entry.Origin, entry.LSN, rowsAffected, err); reason != "" {
+					mu.Lock()
+					slave := slaveMember(conn).ID
+					mu.Unlock()
+					recordConflict(conflict{Time: time.Now(), Slave: slave, LSN: entry.LSN, DB: dbName, Query: query, Reason: reason})
+					conn.Send(protocol.MsgConflict, protocol.Conflict{LSN: entry.LSN, DB: dbName, Query: query, Reason: reason})
+				}
+			}
+			if err != nil {
+				reject("Error executing query: " + err.Error())
+				continue
 			}
-			mu.Unlock()
 
-			conn.Write([]byte("Query executed: " + result))
+			// Wait for acknowledgements off the read loop, which has to
+			// keep reading this slave's own acks in the meantime.
+			go func() {
+				result := protocol.Result{
+					ID:           stmt.ID,
+					Message:      fmt.Sprintf("Query executed: Rows affected: %d", rowsAffected),
+					RowsAffected: rowsAffected,
+					LSN:          entry.LSN,
+				}
+				if parsed.Kind == sqlparse.Insert || parsed.Kind == sqlparse.Replace {
+					result.LastInsertID = insertID
+				}
+				replicas, err := waitForAcks(entry.LSN, wait)
+				result.Replicas = replicas
+				if err != nil {
+					result.Error = fmt.Sprintf("Query executed on master at LSN %d but %v", entry.LSN, err)
+				}
+				conn.Send(protocol.MsgResult, result)
+			}()
+		default:
+			conn.SendError("Invalid request: unexpected " + msg.Type.String() + " message")
 		}
 	}
 }
 
-func executeQueryWithSharding(query, dbName string) (string, error) {
-	queryType := strings.ToUpper(strings.Split(query, " ")[0])
-	var targetDB *sql.DB = db
-	var shardID int
+// writeConcern is the number of replicas that must confirm a write before
+// it is reported as successful.
+type writeConcern string
 
-	if queryType == "SELECT" || queryType == "INSERT" || queryType == "UPDATE" || queryType == "DELETE" {
-		parts := strings.Fields(query)
-		var tableName string
-		for i, part := range parts {
-			if strings.ToUpper(part) == "FROM" || strings.ToUpper(part) == "INTO" {
-				tableName = parts[i+1]
-				break
+const (
+	concernNone     writeConcern = "none"
+	concernOne      writeConcern = "one"
+	concernMajority writeConcern = "majority"
+	concernAll      writeConcern = "all"
+)
+
+// parseWriteConcern validates a write concern, falling back to the
+// -write-concern flag when s is empty.
+func parseWriteConcern(s string) (writeConcern, error) {
+	if s == "" {
+		s = cfg.Replication.WriteConcern
+	}
+	switch w := writeConcern(strings.ToLower(s)); w {
+	case concernNone, concernOne, concernMajority, concernAll:
+		return w, nil
+	}
+	return "", fmt.Errorf("invalid write concern %q (want none, one, majority or all)", s)
+}
+
+// required returns how many of the given number of replicas must confirm.
+// Any concern but none needs at least one.
+func (w writeConcern) required(replicas int) int {
+	switch w {
+	case concernOne:
+		return 1
+	case concernMajority:
+		return replicas/2 + 1
+	case concernAll:
+		if replicas == 0 {
+			return 1
+		}
+		return replicas
+	}
+	return 0
+}
+
+// replicaCount returns the number of replicas write concerns are counted
+// against: the configured number, or else every registered slave that is
+// connected or disconnected less than the node expiry ago, so that losing
+// slaves does not make a concern easier to meet until they have been gone
+// that long or are deregistered. It must be called with mu held.
+func replicaCount() int {
+	if cfg.Replication.Replicas > 0 {
+		return cfg.Replication.Replicas
+	}
+	connected := make(map[string]bool, len(members))
+	for _, info := range members {
+		connected[info.NodeID] = true
+	}
+	expiry := cfg.Replication.NodeExpiry
+	count := 0
+	for id, r := range registry {
+		if connected[id] || expiry == 0 || time.Since(r.LastSeen) < expiry {
+			count++
+		}
+	}
+	return count
+}
+
+// checkReplicas fails when too few slaves are connected for a write
+// concern to be met, so that the write is refused before it is executed.
+func checkReplicas(concern writeConcern) error {
+	mu.Lock()
+	defer mu.Unlock()
+	required := concern.required(replicaCount())
+	if len(slaves) < required {
+		return fmt.Errorf("write concern %s needs %d replicas but %d are connected", concern, required, len(slaves))
+	}
+	return nil
+}
+
+// ackWait collects the acknowledgements for one log entry. done is closed
+// once enough replicas confirmed, or once every replica answered.
+type ackWait struct {
+	concern   writeConcern
+	required  int
+	sent      int
+	confirmed []string
+	failed    []string
+	done      chan struct{}
+}
+
+func (w *ackWait) check() {
+	select {
+	case <-w.done:
+		return
+	default:
+	}
+	if len(w.confirmed) >= w.required || len(w.confirmed)+len(w.failed) >= w.sent {
+		close(w.done)
+	}
+}
+
+func recordAck(conn *protocol.Conn, ack protocol.Ack) {
+	mu.Lock()
+	defer mu.Unlock()
+	w, ok := pendingAcks[ack.LSN]
+	if !ok {
+		return
+	}
+	if ack.Error != "" {
+		fmt.Printf("Slave %s failed to apply LSN %d: %s\n", conn.RemoteAddr(), ack.LSN, ack.Error)
+		w.failed = append(w.failed, conn.RemoteAddr().String())
+	} else {
+		w.confirmed = append(w.confirmed, conn.RemoteAddr().String())
+	}
+	w.check()
+}
+
+// waitForAcks blocks until the write concern of a log entry is satisfied or
+// the -ack-timeout expires, and returns the replicas that confirmed it.
+func waitForAcks(lsn uint64, w *ackWait) ([]string, error) {
+	if w == nil {
+		return nil, nil
+	}
+	timer := time.NewTimer(cfg.Replication.AckTimeout)
+	defer timer.Stop()
+	select {
+	case <-w.done:
+	case <-timer.C:
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	delete(pendingAcks, lsn)
+	confirmed := append([]string(nil), w.confirmed...)
+	if len(confirmed) < w.required {
+		return confirmed, fmt.Errorf("write concern %s not satisfied: %d of %d required replicas confirmed", w.concern, len(confirmed), w.required)
+	}
+	return confirmed, nil
+}
+
+// Writes run under replMu wait at most lockWaitSlice seconds for a row
+// lock, so that one blocked by an open transaction does not hold up every
+// other write, nor the COMMIT that would release the lock. A write that
+// times out is retried without replMu until it has waited lockWaitLimit,
+// MySQL's default innodb_lock_wait_timeout, in all.
+const (
+	lockWaitSlice = 1
+	lockWaitLimit = 50 * time.Second
+)
+
+// commitStatement runs execute and, if it succeeds, appends entry to the
+// replication log and broadcasts it to every live slave. origin is the
+// slave that already applied the statement, if any; it is told the entry is
+// applied so it only advances its position. Unless concern is none, the
+// returned ackWait must be passed to waitForAcks. execute is run again if
+// it fails waiting for a row lock, as writes bounded by lockWaitSlice do.
+func commitStatement(entry protocol.LogEntry, origin *protocol.Conn, concern writeConcern, execute func() error) (protocol.LogEntry, *ackWait, error) {
+	if origin != nil {
+		mu.Lock()
+		entry.Origin = slaveMember(origin).ID
+		mu.Unlock()
+	}
+
+	deadline := time.Now().Add(lockWaitLimit)
+	backoff := 10 * time.Millisecond
+	for {
+		logged, wait, err := commitOnce(entry, origin, concern, execute)
+		if !isLockWait(err) || time.Now().After(deadline) {
+			return logged, wait, err
+		}
+		time.Sleep(backoff)
+		backoff = min(2*backoff, time.Second)
+	}
+}
+
+// commitOnce runs execute and logs entry under replMu.
+func commitOnce(entry protocol.LogEntry, origin *protocol.Conn, concern writeConcern, execute func() error) (protocol.LogEntry, *ackWait, error) {
+	replMu.Lock()
+	defer replMu.Unlock()
+
+	if err := fencedError(); err != nil {
+		return protocol.LogEntry{}, nil, err
+	}
+	if err := checkReplicas(concern); err != nil {
+		return protocol.LogEntry{}, nil, err
+	}
+	if err := execute(); err != nil {
+		// Shards that committed their part before the failure keep it
+		var partial *partialWrite
+		if errors.As(err, &partial) {
+			logPartialWrite(entry, partial)
+		}
+		return protocol.LogEntry{}, nil, err
+	}
+	return logStatement(entry, origin, concern)
+}
+
+// isLockWait reports whether err is MySQL giving up waiting for a row
+// lock, which leaves the statement unapplied.
+func isLockWait(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == 1205
+}
+
+// logStatement appends an executed statement to the replication log and
+// broadcasts it to every live slave. It must be called with replMu held.
+func logStatement(entry protocol.LogEntry, origin *protocol.Conn, concern writeConcern) (protocol.LogEntry, *ackWait, error) {
+	entry, err := replLog.AppendEntry(entry)
+	if err != nil {
+		// The statement is applied here but cannot be replicated; make
+		// it loud since slaves will diverge until they resync.
+		log.Println("Error appending to replication log:", err)
+		return entry, nil, err
+	}
+
+	mu.Lock()
+	var wait *ackWait
+	if concern != concernNone {
+		// Register before broadcasting so no acknowledgement is missed
+		wait = &ackWait{
+			concern:  concern,
+			required: concern.required(replicaCount()),
+			sent:     len(slaves),
+			done:     make(chan struct{}),
+		}
+		wait.check()
+		pendingAcks[entry.LSN] = wait
+	}
+	live := append([]*protocol.Conn(nil), slaves...)
+	mu.Unlock()
+
+	// Sent without mu, so a stuck slave only holds up writes until its
+	// connection times out; replMu keeps the entries in log order.
+	for _, slave := range live {
+		err := slave.Send(protocol.MsgReplicate, protocol.Replicate{LogEntry: entry, Applied: slave == origin})
+		if err != nil {
+			fmt.Println("Error sending to Slave:", err)
+			if wait != nil {
+				mu.Lock()
+				wait.failed = append(wait.failed, slave.RemoteAddr().String())
+				wait.check()
+				mu.Unlock()
+			}
+		}
+	}
+	return entry, wait, nil
+}
+
+// conflict is a write a slave applied itself before forwarding it, whose
+// outcome there may differ from the master's. The slave is told to
+// resynchronize, so that the master's outcome wins.
+type conflict struct {
+	Time   time.Time `json:"time"`
+	Slave  string    `json:"slave"`
+	LSN    uint64    `json:"lsn,omitempty"`
+	DB     string    `json:"db"`
+	Query  string    `json:"query"`
+	Reason string    `json:"reason"`
+}
+
+// maxConflicts is the number of recent conflicts kept for /admin/conflicts;
+// all of them are appended to conflicts.log.
+const maxConflicts = 100
+
+// detectConflict checks a write a slave applied before forwarding it
+// against its outcome on the master, executed at lsn unless the master
+// failed with execErr. The slave diverged if the master failed or changed
+// a different number of rows, or if the slave had not applied yet some
+// entries before lsn that touch the same tables: it applies them after
+// the write, the master before. It returns why, or "" for no conflict.
+func detectConflict(stmt protocol.Statement, parsed *sqlparse.Statement, origin string, lsn uint64, rows int64, execErr error) string {
+	if execErr != nil {
+		return "the master rejected it: " + execErr.Error()
+	}
+	written := make(map[sqlparse.TableName]bool)
+	reference := false
+	for _, name := range parsed.Tables {
+		if name.DB == "" {
+			name.DB = stmt.DB
+		}
+		written[name] = true
+		if table, ok := shardMap.Lookup(name.DB, name.Name); ok && (table.Reference || table.Filling) {
+			reference = true
+		}
+	}
+	// Rows of reference tables are counted once per server, and the
+	// slave may group its shards differently
+	if rows != stmt.Rows && !reference {
+		return fmt.Sprintf("it changed %d rows on the slave and %d on the master", stmt.Rows, rows)
+	}
+
+	var reason string
+	err := replLog.ReadAfter(stmt.BaseLSN, lsn-1, func(entry protocol.LogEntry) error {
+		if entry.Origin == origin || reason != "" {
+			return nil
+		}
+		for _, name := range entryTables(entry) {
+			if written[name] {
+				reason = fmt.Sprintf("LSN %d also changed %s.%s and the slave applies it after this write", entry.LSN, name.DB, name.Name)
+				return nil
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Sprintf("the entries after LSN %d cannot be checked: %v", stmt.BaseLSN, err)
+	}
+	return reason
+}
+
+// entryTables returns the tables the statements of a log entry reference,
+// qualified by its database.
+func entryTables(entry protocol.LogEntry) []sqlparse.TableName {
+	queries := entry.Statements
+	if entry.Query != "" {
+		queries = []string{entry.Query}
+	}
+	var names []sqlparse.TableName
+	for _, query := range queries {
+		stmt, err := sqlparse.Parse(query)
+		if err != nil {
+			continue
+		}
+		refs := stmt.Tables
+		if stmt.Table.Name != "" {
+			refs = append(refs, stmt.Table)
+		}
+		for _, name := range refs {
+			if name.DB == "" {
+				name.DB = entry.DB
+			}
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// recordConflict logs a conflict and keeps it for /admin/conflicts.
+func recordConflict(c conflict) {
+	fmt.Printf("Conflict with slave %s at LSN %d: %s\n", c.Slave, c.LSN, c.Reason)
+	f, err := os.OpenFile(conflictsPath(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err == nil {
+		err = json.NewEncoder(f).Encode(c)
+		f.Close()
+	}
+	if err != nil {
+		fmt.Println("Error writing conflict log:", err)
+	}
+	mu.Lock()
+	conflicts = append(conflicts, c)
+	if len(conflicts) > maxConflicts {
+		conflicts = conflicts[len(conflicts)-maxConflicts:]
+	}
+	mu.Unlock()
+}
+
+// syncSlave brings a slave up to date, either by replaying the log entries
+// after its position or, if it has none or the log no longer covers it, by
+// streaming a snapshot first. It then adds the slave to the broadcast set.
+func syncSlave(conn *protocol.Conn, hello protocol.Hello) error {
+	if err := conn.Send(protocol.MsgShardMap, shardMap.Snapshot()); err != nil {
+		return err
+	}
+
+	from := hello.LastLSN
+	if !hello.HasPosition || from > replLog.LastLSN() || from+1 < replLog.FirstLSN() {
+		lsn, err := streamSnapshot(conn, hello.ResumeFrom, nil)
+		if err != nil {
+			conn.SendError("Error syncing databases: " + err.Error())
+			return err
+		}
+		from = lsn
+	} else {
+		fmt.Printf("Slave %s resuming replication after LSN %d\n", conn.RemoteAddr(), from)
+	}
+	return joinSlave(conn, from)
+}
+
+// repairSlave sends a slave a fresh copy of tables that its own writes may
+// have left different from the master's. The slave leaves the broadcast
+// while they stream and is replayed what it missed afterwards.
+func repairSlave(conn *protocol.Conn, tables []protocol.SyncTable) error {
+	lsn, err := streamSnapshot(conn, 0, tables)
+	if err != nil {
+		conn.SendError("Error repairing tables: " + err.Error())
+		return err
+	}
+	fmt.Printf("Slave %s repaired %d tables at LSN %d\n", conn.RemoteAddr(), len(tables), lsn)
+	return joinSlave(conn, lsn)
+}
+
+// joinSlave replays the log entries after from to a slave and adds it to
+// the broadcast.
+func joinSlave(conn *protocol.Conn, from uint64) error {
+	send := func(entry protocol.LogEntry) error {
+		from = entry.LSN
+		return conn.Send(protocol.MsgReplicate, protocol.Replicate{LogEntry: entry})
+	}
+
+	// Replay the bulk of the backlog without blocking writers, then
+	// finish under replMu so no entry slips between catch-up and joining.
+	if err := replLog.ReadAfter(from, replLog.LastLSN(), send); err != nil {
+		return err
+	}
+	replMu.Lock()
+	defer replMu.Unlock()
+	// Placements made during the unlocked replay must reach the slave
+	// before the entries that depend on them.
+	if err := conn.Send(protocol.MsgShardMap, shardMap.Snapshot()); err != nil {
+		return err
+	}
+	if err := replLog.ReadAfter(from, replLog.LastLSN(), send); err != nil {
+		return err
+	}
+	mu.Lock()
+	slaves = append(slaves, conn)
+	queueMetadata(cluster.Join(slaveMember(conn)))
+	mu.Unlock()
+	fmt.Printf("Slave %s caught up at LSN %d\n", conn.RemoteAddr(), from)
+	publishPeers()
+	return nil
+}
+
+// executeQueryWithSharding runs a statement of a session on the shards that
+// hold the rows it touches and returns the total number of rows affected.
+// Schema changes run on every server and other statements that are not row
+// operations on the session's main connection.
+func executeQueryWithSharding(s *session.Session, query string) (int64, error) {
+	ctx := context.Background()
+	dbName := s.DB()
+	stmt, err := sqlparse.Parse(query)
+	if err != nil {
+		return 0, err
+	}
+	if stmt.Kind.IsDDL() {
+		n, _, err := executeSchemaChange(dbName, stmt)
+		return n, err
+	}
+	if !stmt.Kind.IsDML() {
+		n, err := s.Exec(ctx, 0, query)
+		if err == nil {
+			err = trackSchemaChange(dbName, stmt)
+		}
+		return n, err
+	}
+	if len(stmt.Tables) == 0 {
+		return s.Exec(ctx, 0, query)
+	}
+
+	tables := make([]shard.Table, len(stmt.Tables))
+	for i, name := range stmt.Tables {
+		if name.DB == "" {
+			name.DB = dbName
+		}
+		if tables[i], err = placeTable(name.DB, name.Name); err != nil {
+			return 0, err
+		}
+	}
+	targets, err := shard.Route(tables, servers, stmt)
+	if err != nil {
+		return 0, err
+	}
+	targets = servers.Distinct(targets)
+
+	// The shards' parts are applied together or not at all
+	stmts := make([]session.Stmt, len(targets))
+	for i, target := range targets {
+		fmt.Printf("Executing %s on Shard %d\n", target.Query, target.Shard)
+		stmts[i] = session.Stmt{Server: servers.Of(target.Shard), Query: target.Query}
+	}
+	total, err := s.ExecAllWithin(ctx, stmts, lockWaitSlice)
+	var partial *session.PartialError
+	if errors.As(err, &partial) {
+		var applied []shard.Target
+		for _, stmt := range partial.Applied {
+			for _, target := range targets {
+				if servers.Of(target.Shard) == stmt.Server && target.Query == stmt.Query {
+					applied = append(applied, target)
+				}
+			}
+		}
+		fmt.Printf("Error executing query: %v\n", err)
+		return total, &partialWrite{applied: applied, err: err}
+	}
+	if err != nil {
+		fmt.Printf("Error executing query: %v\n", err)
+	}
+	return total, err
+}
+
+// partialWrite is a write to several shards that failed after some of them
+// had committed their part, which commitStatement logs.
+type partialWrite struct {
+	applied []shard.Target
+	err     error
+}
+
+func (p *partialWrite) Error() string {
+	return p.err.Error()
+}
+
+func (p *partialWrite) Unwrap() error {
+	return p.err
+}
+
+// logPartialWrite logs the parts of a write that shards committed before
+// the write failed, pinned to those shards, so that slaves apply exactly
+// what the master did. Parts repeating the query of an earlier one are only
+// applied where that one's shard is on another server. write is the entry
+// the whole write would have had. It must be called with replMu held.
+func logPartialWrite(write protocol.LogEntry, p *partialWrite) {
+	for i, target := range p.applied {
+		id, peer := target.Shard, target.Shard
+		for _, earlier := range p.applied[:i] {
+			if earlier.Query == target.Query {
+				peer = earlier.Shard
+				break
+			}
+		}
+		entry := protocol.LogEntry{DB: write.DB, Query: target.Query, Vars: write.Vars, Shard: &id, Peer: peer}
+		if _, _, err := logStatement(entry, nil, concernNone); err != nil {
+			fmt.Printf("Error logging the part of a failed write applied on shard %d: %v\n", id, err)
+		}
+	}
+}
+
+// queryWithSharding runs a SELECT of a session on every shard that may hold
+// matching rows and merges their results. Tables missing from the shard map
+// are read through the session's main connection.
+func queryWithSharding(s *session.Session, query string) (*shard.ResultSet, error) {
+	ctx := context.Background()
+	dbName := s.DB()
+	stmt, err := sqlparse.Parse(query)
+	if err != nil {
+		return nil, err
+	}
+	tables := make([]shard.Table, 0, len(stmt.Tables))
+	for _, name := range stmt.Tables {
+		if name.DB == "" {
+			name.DB = dbName
+		}
+		if table, exists := shardMap.Lookup(name.DB, name.Name); exists {
+			tables = append(tables, table)
+		}
+	}
+	if stmt.Kind != sqlparse.Select || len(tables) == 0 || len(tables) < len(stmt.Tables) {
+		return s.Query(ctx, 0, query)
+	}
+	targets, err := shard.Route(tables, servers, stmt)
+	if err != nil {
+		return nil, err
+	}
+	targets = servers.Distinct(targets)
+	for _, target := range targets {
+		fmt.Printf("Querying Shard %d: %s\n", target.Shard, target.Query)
+	}
+	return shard.GatherWith(ctx, targets, func(ctx context.Context, id int, query string) (*shard.ResultSet, error) {
+		return s.Query(ctx, servers.Of(id), query)
+	})
+}
+
+// placeTable returns the placement of a table, assigning new tables to a
+// shard by the ring and announcing the change to the slaves.
+func placeTable(dbName, tableName string) (shard.Table, error) {
+	table, changed, err := shardMap.Assign(dbName, tableName, shardMap.Place(dbName, tableName))
+	if err != nil {
+		return table, err
+	}
+	if changed {
+		fmt.Printf("Assigned %s.%s to Shard %d\n", dbName, tableName, table.Shard)
+		publishShardMap()
+	}
+	return table, nil
+}
+
+// trackSchemaChange keeps the shard map in step with executed DDL: new
+// tables are placed right away, dropped ones are forgotten.
+func trackSchemaChange(dbName string, stmt *sqlparse.Statement) error {
+	qualify := func(name sqlparse.TableName) sqlparse.TableName {
+		if name.DB == "" {
+			name.DB = dbName
+		}
+		return name
+	}
+	removed := false
+	switch stmt.Kind {
+	case sqlparse.CreateTable:
+		if stmt.Table.Name == "" {
+			break
+		}
+		name := qualify(stmt.Table)
+		if _, err := placeTable(name.DB, name.Name); err != nil {
+			return err
+		}
+	case sqlparse.DropTable:
+		for _, name := range stmt.Tables {
+			name = qualify(name)
+			changed, err := shardMap.Remove(name.DB, name.Name)
+			if err != nil {
+				return err
+			}
+			removed = removed || changed
+		}
+	case sqlparse.DropDatabase:
+		changed, err := shardMap.Remove(stmt.Database, "")
+		if err != nil {
+			return err
+		}
+		removed = changed
+	}
+	if removed {
+		publishShardMap()
+	}
+	if stmt.Kind.IsDDL() {
+		queueMetadata(cluster.BumpSchema())
+	}
+	return nil
+}
+
+// backfillShardMap places every existing user table that the shard map
+// does not know yet.
+func backfillShardMap() error {
+	rows, err := db.Query("SELECT table_schema, table_name FROM information_schema.tables WHERE table_type = 'BASE TABLE' ORDER BY table_schema, table_name")
+	if err != nil {
+		return err
+	}
+	var names []sqlparse.TableName
+	for rows.Next() {
+		var name sqlparse.TableName
+		if err := rows.Scan(&name.DB, &name.Name); err != nil {
+			rows.Close()
+			return err
+		}
+		if !isSystemDatabase(name.DB) {
+			names = append(names, name)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, name := range names {
+		if _, err := placeTable(name.DB, name.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// publishShardMap sends the current shard map to every live slave, and
+// records it in the cluster metadata.
+func publishShardMap() {
+	publishMu.Lock()
+	defer publishMu.Unlock()
+	snapshot := shardMap.Snapshot()
+	queueMetadata(cluster.SetShardMap(snapshot))
+	mu.Lock()
+	live := append([]*protocol.Conn(nil), slaves...)
+	mu.Unlock()
+	for _, slave := range live {
+		if err := slave.Send(protocol.MsgShardMap, snapshot); err != nil {
+			fmt.Println("Error sending shard map to Slave:", err)
+		}
+	}
+}
+
+// startConsensus joins the configured Raft cluster, if any. The master
+// votes with its replication position so no slave that is behind it can
+// be elected in its place.
+func startConsensus() error {
+	peers := cfg.Raft.Peers
+	if len(peers) == 0 {
+		return nil
+	}
+	metadata = cluster.New(nil)
+	var err error
+	raftNode, err = raft.Start(raft.Config{
+		ID:       cfg.Raft.ID,
+		Peers:    peers,
+		Dir:      cfg.Raft.Dir,
+		FSM:      metadata,
+		Priority: replLog.LastLSN,
+		OnLeader: func(leader string, term uint64) {
+			switch leader {
+			case cfg.Raft.ID:
+				fmt.Printf("Elected Raft leader in term %d, accepting writes\n", term)
+				go announceLeadership()
+			case "":
+				fmt.Printf("No Raft leader in term %d, refusing writes\n", term)
+			default:
+				fmt.Printf("Raft leader is %s in term %d, refusing writes\n", leader, term)
+			}
+		},
+	})
+	if err != nil {
+		return err
+	}
+	go proposeQueued()
+	fmt.Printf("Raft node %s started with %d peers\n", cfg.Raft.ID, len(peers))
+	return nil
+}
+
+// announceLeadership brings the metadata up to date after this master has
+// been elected: its shard map, itself and the slaves connected to it.
+func announceLeadership() {
+	self := cluster.Member{ID: cfg.Raft.ID, Addr: raftNode.Status().Peers[cfg.Raft.ID], Role: "master", Joined: time.Now()}
+	publishMu.Lock()
+	defer publishMu.Unlock()
+	mu.Lock()
+	defer mu.Unlock()
+	queueMetadata(cluster.SetShardMap(shardMap.Snapshot()))
+	queueMetadata(cluster.Join(self))
+	for _, conn := range slaves {
+		queueMetadata(cluster.Join(slaveMember(conn)))
+	}
+}
+
+// slaveMember describes a connected slave for the cluster metadata. It must
+// be called with mu held.
+func slaveMember(conn *protocol.Conn) cluster.Member {
+	member := cluster.Member{Addr: conn.RemoteAddr().String(), Role: "slave", Joined: time.Now()}
+	if info, ok := members[conn]; ok {
+		member.ID, member.Joined = info.NodeID, info.Connected
+	}
+	return member
+}
+
+// metadataQueue holds the metadata changes waiting to be replicated, in the
+// order they were made, guarded by metadataMu. proposeQueued replicates
+// them one at a time, so that a slave's Leave never overtakes its Join and
+// an older shard map never replaces a newer one.
+var (
+	metadataMu    sync.Mutex
+	metadataQueue [][]byte
+	metadataReady = make(chan struct{}, 1)
+)
+
+// queueMetadata queues a metadata change for replication without waiting
+// for it. Changes that must be ordered with the state guarded by mu are
+// queued with mu held.
+func queueMetadata(cmd []byte) {
+	if raftNode == nil {
+		return
+	}
+	metadataMu.Lock()
+	metadataQueue = append(metadataQueue, cmd)
+	metadataMu.Unlock()
+	select {
+	case metadataReady <- struct{}{}:
+	default:
+	}
+}
+
+// proposeQueued replicates the queued metadata changes in order.
+func proposeQueued() {
+	for range metadataReady {
+		for {
+			metadataMu.Lock()
+			if len(metadataQueue) == 0 {
+				metadataMu.Unlock()
+				break
+			}
+			cmd := metadataQueue[0]
+			metadataQueue = metadataQueue[1:]
+			metadataMu.Unlock()
+			proposeMetadata(cmd)
+		}
+	}
+}
+
+// proposeMetadata replicates a metadata change through Raft. Changes made
+// while this master is not the leader are dropped; the next leader
+// re-announces the state it knows.
+func proposeMetadata(cmd []byte) {
+	if raftNode == nil {
+		return
+	}
+	if err := raftNode.Propose(cmd); err != nil && err != raft.ErrNotLeader {
+		fmt.Println("Error replicating cluster metadata:", err)
+	}
+}
+
+// schemaStatus is the outcome of a schema change on one MySQL server, and
+// so on the shards it holds: applied, failed, rolled back, or skipped after
+// an earlier server failed.
+type schemaStatus struct {
+	Server int    `json:"server"`
+	Shards []int  `json:"shards"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// execSchema runs a schema change on every MySQL server, the main one
+// first, and reports how it went on each. If a server fails, the change is
+// undone on the servers it was applied to, where sqlparse.Undo knows how,
+// so that every shard keeps the same schema.
+func execSchema(dbName string, stmt *sqlparse.Statement) (int64, []schemaStatus, error) {
+	report := make([]schemaStatus, len(serverDBs))
+	for i := range report {
+		report[i] = schemaStatus{Server: i, Shards: []int{}, Status: "skipped"}
+	}
+	for id := range shardDBs {
+		report[servers.Of(id)].Shards = append(report[servers.Of(id)].Shards, id)
+	}
+
+	var n int64
+	var failed error
+	var applied []int
+	for i, pool := range serverDBs {
+		m, err := session.ExecOn(pool, dbName, stmt.Query)
+		if err != nil {
+			report[i].Status, report[i].Error = "failed", err.Error()
+			failed = err
+			if i > 0 {
+				failed = fmt.Errorf("shard server %d: %w", i, err)
+			}
+			break
+		}
+		if i == 0 {
+			n = m
+		}
+		report[i].Status = "applied"
+		applied = append(applied, i)
+	}
+	if failed == nil {
+		return n, report, nil
+	}
+	if len(applied) == 0 {
+		return n, report, failed
+	}
+
+	undo, ok := sqlparse.Undo(stmt)
+	if !ok {
+		return n, report, fmt.Errorf("%w; the change cannot be rolled back and remains on servers %v", failed, applied)
+	}
+	for _, i := range applied {
+		if _, err := session.ExecOn(serverDBs[i], dbName, undo); err != nil {
+			fmt.Printf("Error rolling back schema change on server %d: %v\n", i, err)
+			report[i].Error = "rollback failed: " + err.Error()
+			continue
+		}
+		report[i].Status = "rolled back"
+	}
+	return n, report, fmt.Errorf("%w; rolled back with %s", failed, undo)
+}
+
+// executeSchemaChange runs a schema change on every server and updates the
+// shard map to match.
+func executeSchemaChange(dbName string, stmt *sqlparse.Statement) (int64, []schemaStatus, error) {
+	n, report, err := execSchema(dbName, stmt)
+	if err == nil {
+		err = trackSchemaChange(dbName, stmt)
+	}
+	return n, report, err
+}
+
+// txIdleTimeout is how long an open transaction may wait for its next
+// statement before it is rolled back, releasing the row locks it holds.
+const txIdleTimeout = 2 * time.Minute
+
+// txn is a transaction opened through /tx/begin. Its statements run on one
+// connection per MySQL server they touch, each holding a branch of an XA
+// transaction, and it commits with a two-phase commit: every branch is
+// prepared, the decision is recorded in the decision log, and only then
+// are the branches committed.
+type txn struct {
+	ID  string
+	XID string
+	DB  string
+
+	// mu serializes the statements of the transaction and guards the
+	// fields below.
+	mu         sync.Mutex
+	conns      map[int]*sql.Conn      // by server
+	tables     map[string]shard.Table // placement of the tables written
+	statements []string               // the writes, to replicate
+	vars       []string               // the SET statements of its session
+	started    time.Time
+	used       time.Time
+	done       bool
+}
+
+var (
+	// transactions holds the open transactions by ID, guarded by txMu.
+	txMu         sync.Mutex
+	transactions = make(map[string]*txn)
+	txSeq        uint64
+	// decisions records the transactions decided to commit until every
+	// server has committed them.
+	decisions *txlog.Log
+)
+
+// xidPrefix starts the XA transaction IDs of the master, which tells its
+// transactions apart from any other left prepared on a server.
+const xidPrefix = "distdb-"
+
+// beginTx opens a transaction on a database.
+func beginTx(dbName string, vars []string) (*txn, error) {
+	if err := fencedError(); err != nil {
+		return nil, err
+	}
+	if dbName == "" {
+		return nil, fmt.Errorf("a transaction needs a database")
+	}
+	txMu.Lock()
+	defer txMu.Unlock()
+	txSeq++
+	// The start time keeps IDs unique across restarts of the master
+	id := fmt.Sprintf("%x-%d", startedAt.UnixNano(), txSeq)
+	now := time.Now()
+	t := &txn{
+		ID:      id,
+		XID:     xidPrefix + id,
+		DB:      dbName,
+		vars:    vars,
+		conns:   make(map[int]*sql.Conn),
+		tables:  make(map[string]shard.Table),
+		started: now,
+		used:    now,
+	}
+	transactions[id] = t
+	fmt.Printf("Began transaction %s on %s\n", id, dbName)
+	return t, nil
+}
+
+// lookupTx returns an open transaction.
+func lookupTx(id string) (*txn, error) {
+	txMu.Lock()
+	defer txMu.Unlock()
+	t, ok := transactions[id]
+	if !ok {
+		return nil, fmt.Errorf("no open transaction %q", id)
+	}
+	return t, nil
+}
+
+// openXID reports whether an XA transaction ID belongs to a transaction
+// still open in this process, which the resolver must leave alone.
+func openXID(xid string) bool {
+	txMu.Lock()
+	defer txMu.Unlock()
+	_, ok := transactions[strings.TrimPrefix(xid, xidPrefix)]
+	return ok && strings.HasPrefix(xid, xidPrefix)
+}
+
+// exec runs a statement in the transaction and returns the rows it
+// changed, or those it read. A statement that fails rolls the whole
+// transaction back: MySQL may have rolled back a branch on its own, and
+// the statement may have run on some servers only.
+func (t *txn) exec(query string) (int64, *shard.ResultSet, error) {
+	stmt, err := sqlparse.Parse(query)
+	if err != nil {
+		return 0, nil, err
+	}
+	if stmt.Kind != sqlparse.Select && !stmt.Kind.IsDML() {
+		return 0, nil, fmt.Errorf("only SELECT, INSERT, REPLACE, UPDATE and DELETE can run in a transaction")
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.done {
+		return 0, nil, fmt.Errorf("transaction %s has ended", t.ID)
+	}
+	t.used = time.Now()
+	n, result, err := t.run(stmt)
+	if err != nil {
+		t.end()
+		return 0, nil, fmt.Errorf("%w; transaction %s rolled back", err, t.ID)
+	}
+	return n, result, nil
+}
+
+// run routes a statement of the transaction and runs it on the branches of
+// the servers holding its rows. It must be called with t.mu held.
+func (t *txn) run(stmt *sqlparse.Statement) (int64, *shard.ResultSet, error) {
+	ctx := context.Background()
+	tables := make([]shard.Table, len(stmt.Tables))
+	for i, name := range stmt.Tables {
+		if name.DB == "" {
+			name.DB = t.DB
+		}
+		table, err := placeTable(name.DB, name.Name)
+		if err != nil {
+			return 0, nil, err
+		}
+		// Migrations copy committed rows only, and route writes by a
+		// placement that changes while they run
+		if table.Migration != nil {
+			return 0, nil, fmt.Errorf("table %s.%s is being migrated and cannot be used in a transaction", name.DB, name.Name)
+		}
+		tables[i] = table
+	}
+	targets := []shard.Target{{Shard: 0, Query: stmt.Query}}
+	if len(tables) > 0 {
+		var err error
+		if targets, err = shard.Route(tables, servers, stmt); err != nil {
+			return 0, nil, err
+		}
+		targets = servers.Distinct(targets)
+	}
+	for _, target := range targets {
+		if _, err := t.conn(ctx, servers.Of(target.Shard)); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	if stmt.Kind == sqlparse.Select {
+		// A connection runs one query at a time
+		locks := make(map[int]*sync.Mutex, len(t.conns))
+		for server := range t.conns {
+			locks[server] = new(sync.Mutex)
+		}
+		result, err := shard.GatherWith(ctx, targets, func(ctx context.Context, id int, query string) (*shard.ResultSet, error) {
+			server := servers.Of(id)
+			locks[server].Lock()
+			defer locks[server].Unlock()
+			rows, err := t.conns[server].QueryContext(ctx, query)
+			if err != nil {
+				return nil, err
+			}
+			defer rows.Close()
+			return shard.ScanRows(rows)
+		})
+		return 0, result, err
+	}
+
+	var total int64
+	for _, target := range targets {
+		fmt.Printf("Executing %s on Shard %d in transaction %s\n", target.Query, target.Shard, t.ID)
+		result, err := t.conns[servers.Of(target.Shard)].ExecContext(ctx, target.Query)
+		if err != nil {
+			return 0, nil, fmt.Errorf("shard %d: %w", target.Shard, err)
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return 0, nil, err
+		}
+		total += n
+	}
+	for _, table := range tables {
+		t.tables[table.DB+"."+table.Name] = table
+	}
+	t.statements = append(t.statements, stmt.Query)
+	return total, nil, nil
+}
+
+// conn returns the transaction's connection to a server, starting its
+// branch there with the session's variables on first use. It must be
+// called with t.mu held.
+func (t *txn) conn(ctx context.Context, server int) (*sql.Conn, error) {
+	if conn, ok := t.conns[server]; ok {
+		return conn, nil
+	}
+	conn, err := serverDBs[server].Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.ExecContext(ctx, "XA START "+sqlparse.QuoteString(t.XID)); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("server %d: %w", server, err)
+	}
+	t.conns[server] = conn
+	if _, err := conn.ExecContext(ctx, "USE "+sqlparse.QuoteIdent(t.DB)); err != nil {
+		return nil, err
+	}
+	for _, set := range t.vars {
+		if _, err := conn.ExecContext(ctx, set); err != nil {
+			return nil, fmt.Errorf("server %d: %w", server, err)
+		}
+	}
+	return conn, nil
+}
+
+// release returns a connection of the transaction to its pool, unless the
+// session's variables were set on it.
+func (t *txn) release(conn *sql.Conn) {
+	if len(t.vars) > 0 {
+		discard(conn)
+		return
+	}
+	conn.Close()
+}
+
+// commit ends the transaction with a two-phase commit and logs its writes
+// as one replication log entry. Once the decision is recorded the
+// transaction is committed, even if a server then fails to commit its
+// branch: resolveTransactions finishes it later. Unless concern is none,
+// the returned ackWait must be passed to waitForAcks.
+func (t *txn) commit(concern writeConcern) (protocol.LogEntry, *ackWait, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.done {
+		return protocol.LogEntry{}, nil, fmt.Errorf("transaction %s has ended", t.ID)
+	}
+	// Whatever is left open on return is rolled back
+	defer t.end()
+
+	ctx := context.Background()
+	xid := sqlparse.QuoteString(t.XID)
+	for server, conn := range t.conns {
+		if _, err := conn.ExecContext(ctx, "XA END "+xid); err != nil {
+			return protocol.LogEntry{}, nil, fmt.Errorf("server %d: %w", server, err)
+		}
+	}
+	if len(t.statements) == 0 {
+		// Nothing was written, so there is nothing to decide or log
+		for server, conn := range t.conns {
+			if _, err := conn.ExecContext(ctx, "XA COMMIT "+xid+" ONE PHASE"); err != nil {
+				return protocol.LogEntry{}, nil, fmt.Errorf("server %d: %w", server, err)
+			}
+			t.release(conn)
+			delete(t.conns, server)
+		}
+		fmt.Printf("Committed read-only transaction %s\n", t.ID)
+		return protocol.LogEntry{}, nil, nil
+	}
+	for server, conn := range t.conns {
+		if _, err := conn.ExecContext(ctx, "XA PREPARE "+xid); err != nil {
+			return protocol.LogEntry{}, nil, fmt.Errorf("preparing on server %d: %w", server, err)
+		}
+	}
+
+	entry, wait, logErr, err := t.decide(concern)
+	if err != nil {
+		return protocol.LogEntry{}, nil, err
+	}
+	if logErr != nil {
+		logErr = fmt.Errorf("transaction committed but not replicated: %w", logErr)
+	}
+
+	// The prepared branches keep their row locks until they commit, so a
+	// write logged after the transaction that touches its rows still runs
+	// after it here, even though they commit outside replMu
+	committed := true
+	for server, conn := range t.conns {
+		if _, err := conn.ExecContext(ctx, "XA COMMIT "+xid); err != nil {
+			fmt.Printf("Error committing transaction %s on server %d, left to recovery: %v\n", t.ID, server, err)
+			committed = false
+			discard(conn)
+		} else {
+			t.release(conn)
+		}
+		delete(t.conns, server)
+	}
+	if committed {
+		if err := decisions.Done(t.XID); err != nil {
+			fmt.Println("Error updating decision log:", err)
+		}
+	}
+	fmt.Printf("Committed transaction %s at LSN %d\n", t.ID, entry.LSN)
+	return entry, wait, logErr
+}
+
+// decide records the decision to commit the prepared transaction and logs
+// its writes, under replMu so that slaves apply it in log order. err is set
+// if the transaction cannot commit, and logErr if it was decided but could
+// not be replicated. It must be called with t.mu held.
+func (t *txn) decide(concern writeConcern) (entry protocol.LogEntry, wait *ackWait, logErr, err error) {
+	replMu.Lock()
+	defer replMu.Unlock()
+	if err := fencedError(); err != nil {
+		return entry, nil, nil, err
+	}
+	if err := checkReplicas(concern); err != nil {
+		return entry, nil, nil, err
+	}
+	for name, placed := range t.tables {
+		table, _ := shardMap.Lookup(placed.DB, placed.Name)
+		if !reflect.DeepEqual(table, placed) {
+			return entry, nil, nil, fmt.Errorf("table %s was moved during the transaction", name)
+		}
+	}
+	decision := txlog.Decision{XID: t.XID, LSN: replLog.LastLSN() + 1, DB: t.DB, Statements: t.statements, Vars: t.vars}
+	if err := decisions.Commit(decision); err != nil {
+		return entry, nil, nil, fmt.Errorf("recording commit decision: %w", err)
+	}
+	entry, wait, logErr = logStatement(protocol.LogEntry{DB: t.DB, Statements: t.statements, Vars: t.vars}, nil, concern)
+	return entry, wait, logErr, nil
+}
+
+// rollback rolls the transaction back.
+func (t *txn) rollback() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.done {
+		return fmt.Errorf("transaction %s has ended", t.ID)
+	}
+	t.end()
+	fmt.Printf("Rolled back transaction %s\n", t.ID)
+	return nil
+}
+
+// end rolls back the branches still open, releases their connections and
+// forgets the transaction. It must be called with t.mu held.
+func (t *txn) end() {
+	ctx := context.Background()
+	xid := sqlparse.QuoteString(t.XID)
+	for server, conn := range t.conns {
+		// A branch may be active, ended or prepared; XA END fails on
+		// the latter two, which XA ROLLBACK accepts as they are
+		conn.ExecContext(ctx, "XA END "+xid)
+		if _, err := conn.ExecContext(ctx, "XA ROLLBACK "+xid); err != nil {
+			fmt.Printf("Error rolling back transaction %s on server %d: %v\n", t.ID, server, err)
+			discard(conn)
+		} else {
+			t.release(conn)
+		}
+	}
+	t.conns = nil
+	t.done = true
+	txMu.Lock()
+	delete(transactions, t.ID)
+	txMu.Unlock()
+}
+
+// discard closes a connection in an unknown state instead of returning it
+// to the pool. A branch left prepared on it survives for the resolver.
+func discard(conn *sql.Conn) {
+	conn.Raw(func(any) error { return driver.ErrBadConn })
+	conn.Close()
+}
+
+// resolveTransactions finishes the transactions left prepared on the
+// servers by a crash or a failed commit: those with a recorded decision
+// are committed and the others rolled back. At startup it first logs the
+// decisions whose replication log entry was never written.
+func resolveTransactions(startup bool) {
+	if startup {
+		for _, d := range decisions.Pending() {
+			if d.LSN <= replLog.LastLSN() {
+				continue
+			}
+			replMu.Lock()
+			entry, _, err := logStatement(protocol.LogEntry{DB: d.DB, Statements: d.Statements, Vars: d.Vars}, nil, concernNone)
+			replMu.Unlock()
+			if err != nil {
+				fmt.Printf("Error logging transaction %s: %v\n", d.XID, err)
+				return
+			}
+			fmt.Printf("Logged decided transaction %s at LSN %d\n", d.XID, entry.LSN)
+		}
+	}
+
+	inDoubt := make(map[string]bool)
+	for server, pool := range serverDBs {
+		xids, err := preparedXIDs(pool)
+		if err != nil {
+			fmt.Printf("Error listing prepared transactions on server %d: %v\n", server, err)
+			// its decisions may still be needed
+			for _, d := range decisions.Pending() {
+				inDoubt[d.XID] = true
+			}
+			continue
+		}
+		for _, xid := range xids {
+			if openXID(xid) {
+				continue
+			}
+			// A transaction that is no longer open has its final
+			// decision in the log, if it has one
+			action := "ROLLBACK"
+			if _, ok := decisions.Lookup(xid); ok {
+				action = "COMMIT"
+			}
+			if _, err := pool.Exec("XA " + action + " " + sqlparse.QuoteString(xid)); err != nil {
+				fmt.Printf("Error resolving transaction %s on server %d: %v\n", xid, server, err)
+				inDoubt[xid] = true
+				continue
+			}
+			fmt.Printf("Resolved in-doubt transaction %s on server %d: %s\n", xid, server, action)
+		}
+	}
+	for _, d := range decisions.Pending() {
+		if !inDoubt[d.XID] && !openXID(d.XID) {
+			if err := decisions.Done(d.XID); err != nil {
+				fmt.Println("Error updating decision log:", err)
+			}
+		}
+	}
+}
+
+// preparedXIDs returns the IDs of the master's XA transactions prepared on
+// a server.
+func preparedXIDs(pool *sql.DB) ([]string, error) {
+	rows, err := pool.Query("XA RECOVER")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var xids []string
+	for rows.Next() {
+		var format, gtridLength, bqualLength int
+		var data string
+		if err := rows.Scan(&format, &gtridLength, &bqualLength, &data); err != nil {
+			return nil, err
+		}
+		if bqualLength == 0 && strings.HasPrefix(data, xidPrefix) {
+			xids = append(xids, data)
+		}
+	}
+	return xids, rows.Err()
+}
+
+// watchTransactions rolls back transactions left idle for txIdleTimeout
+// and retries the resolution of in-doubt ones.
+func watchTransactions() {
+	for range time.Tick(10 * time.Second) {
+		txMu.Lock()
+		open := make([]*txn, 0, len(transactions))
+		for _, t := range transactions {
+			open = append(open, t)
+		}
+		txMu.Unlock()
+		for _, t := range open {
+			// A transaction running a statement is not idle
+			if !t.mu.TryLock() {
+				continue
+			}
+			if !t.done && time.Since(t.used) > txIdleTimeout {
+				t.end()
+				fmt.Printf("Rolled back transaction %s after %s idle\n", t.ID, txIdleTimeout)
+			}
+			t.mu.Unlock()
+		}
+		resolveTransactions(false)
+	}
+}
+
+// declareShardKey spreads the rows of a table over all shards by the hash
+// of column. Rows already stored could not be found again after the change,
+// so the table must be empty.
+func declareShardKey(dbName, tableName, column string) (shard.Table, error) {
+	dataType, collation, err := checkShardKey(dbName, tableName, column)
+	if err != nil {
+		return shard.Table{}, err
+	}
+	table, err := shardMap.SetKey(dbName, tableName, column, dataType, collation)
+	if err != nil {
+		return table, err
+	}
+	fmt.Printf("Sharding %s.%s on column %s\n", dbName, tableName, column)
+	publishShardMap()
+	return table, nil
+}
+
+// declareRangeKey places the rows of an empty table by ranges of column
+// values starting at each of splits, dealt out over the shards of the ring
+// from the table's own shard on.
+func declareRangeKey(dbName, tableName, column string, splits []string) (shard.Table, error) {
+	dataType, collation, err := checkShardKey(dbName, tableName, column)
+	if err != nil {
+		return shard.Table{}, err
+	}
+	ring := shardMap.Ring()
+	first := 0
+	if t, ok := shardMap.Lookup(dbName, tableName); ok {
+		if i := slices.Index(ring, t.Shard); i >= 0 {
+			first = i
+		}
+	}
+	ranges := []shard.KeyRange{{Shard: ring[first]}}
+	for i, start := range splits {
+		ranges = append(ranges, shard.KeyRange{Start: start, Shard: ring[(first+i+1)%len(ring)]})
+	}
+	table, err := shardMap.SetRangeKey(dbName, tableName, column, dataType, collation, ranges)
+	if err != nil {
+		return table, err
+	}
+	fmt.Printf("Sharding %s.%s on ranges of column %s\n", dbName, tableName, column)
+	publishShardMap()
+	return table, nil
+}
+
+// declareReference makes a table a reference table. Writes to the table go
+// to every shard as soon as it is marked as being filled; its rows are then
+// copied from its shard to the others in chunks, as a migration copies
+// them, so that writes only wait for one chunk at a time.
+func declareReference(dbName, tableName string) (shard.Table, error) {
+	table, err := placeTable(dbName, tableName)
+	if err != nil {
+		return table, err
+	}
+	if _, err := primaryKey(dbName, tableName); err != nil {
+		return table, err
+	}
+	if table, err = beginReference(dbName, tableName); err != nil || table.Reference {
+		return table, err
+	}
+	return fillReference(table)
+}
+
+// beginReference marks a table as being made a reference table.
+func beginReference(dbName, tableName string) (shard.Table, error) {
+	replMu.Lock()
+	defer replMu.Unlock()
+	table, _ := shardMap.Lookup(dbName, tableName)
+	if err := fencedError(); err != nil {
+		return table, err
+	}
+	switch {
+	case table.Reference || table.Filling:
+		return table, nil
+	case table.Sharded():
+		return table, fmt.Errorf("table %s.%s is sharded on %s", dbName, tableName, table.Key)
+	case table.Migration != nil:
+		return table, fmt.Errorf("table %s.%s is being migrated", dbName, tableName)
+	}
+	table, err := shardMap.FillReference(dbName, tableName)
+	if err != nil {
+		return table, err
+	}
+	publishShardMap()
+	return table, nil
+}
+
+// filling holds the tables whose rows this master is copying to every
+// shard, guarded by mu.
+var filling = make(map[string]bool)
+
+// fillReference copies the rows of a table being made a reference table
+// to every other shard and then makes it one.
+func fillReference(table shard.Table) (shard.Table, error) {
+	key := table.DB + "." + table.Name
+	mu.Lock()
+	if filling[key] {
+		mu.Unlock()
+		return table, fmt.Errorf("table %s is already being copied to every shard", key)
+	}
+	filling[key] = true
+	mu.Unlock()
+	defer func() {
+		mu.Lock()
+		delete(filling, key)
+		mu.Unlock()
+	}()
+
+	pk, err := primaryKey(table.DB, table.Name)
+	if err != nil {
+		return table, err
+	}
+	var copied int
+	var after []interface{}
+	for {
+		var n int
+		if after, n, err = fillStep(table, pk, after); err != nil {
+			return table, err
+		}
+		if n == 0 {
+			break
+		}
+		copied += n
+	}
+
+	replMu.Lock()
+	defer replMu.Unlock()
+	if err := fencedError(); err != nil {
+		return table, err
+	}
+	if table, err = shardMap.SetReference(table.DB, table.Name); err != nil {
+		return table, err
+	}
+	fmt.Printf("Made %s a reference table (%d rows copied to every shard)\n", key, copied)
+	publishShardMap()
+	return table, nil
+}
+
+// fillStep copies the chunk of rows after the primary key after from the
+// shard of a table being made a reference table to every other shard, and
+// returns the key of its last row and the number of rows copied.
+func fillStep(table shard.Table, pk []string, after []interface{}) ([]interface{}, int, error) {
+	replMu.Lock()
+	defer replMu.Unlock()
+	if err := fencedError(); err != nil {
+		return nil, 0, err
+	}
+	if t, ok := shardMap.Lookup(table.DB, table.Name); !ok || !t.Filling {
+		return nil, 0, fmt.Errorf("table %s.%s is no longer being made a reference table", table.DB, table.Name)
+	}
+
+	quoted := make([]string, len(pk))
+	for i, col := range pk {
+		quoted[i] = sqlparse.QuoteIdent(col)
+	}
+	keyList := strings.Join(quoted, ", ")
+	query := "SELECT * FROM " + sqlparse.QuoteIdent(table.DB) + "." + sqlparse.QuoteIdent(table.Name)
+	if after != nil {
+		query += fmt.Sprintf(" WHERE (%s) > (%s)", keyList, quoteValues(after))
+	}
+	query += fmt.Sprintf(" ORDER BY %s LIMIT %d", keyList, migrateChunkRows)
+
+	rows, err := shardDBs[table.Shard].Query(query)
+	if err != nil {
+		return nil, 0, err
+	}
+	columns, err := rows.Columns()
+	if err != nil {
+		rows.Close()
+		return nil, 0, err
+	}
+	pkIdx := make([]int, len(pk))
+	for i, col := range columns {
+		for j, k := range pk {
+			if strings.EqualFold(col, k) {
+				pkIdx[j] = i
+			}
+		}
+	}
+	var tuples []string
+	var last []interface{}
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		valuePtrs := make([]interface{}, len(columns))
+		for i := range values {
+			valuePtrs[i] = &values[i]
+		}
+		if err := rows.Scan(valuePtrs...); err != nil {
+			rows.Close()
+			return nil, 0, err
+		}
+		tuples = append(tuples, "("+quoteValues(values)+")")
+		last = values
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	if len(tuples) == 0 {
+		return nil, 0, nil
+	}
+
+	quotedColumns := make([]string, len(columns))
+	for i, col := range columns {
+		quotedColumns[i] = sqlparse.QuoteIdent(col)
+	}
+	query = fmt.Sprintf("REPLACE INTO %s (%s) VALUES %s",
+		sqlparse.QuoteIdent(table.Name), strings.Join(quotedColumns, ", "), strings.Join(tuples, ", "))
+	for id := range shardDBs {
+		if id == table.Shard {
+			continue
+		}
+		target := id
+		entry := protocol.LogEntry{DB: table.DB, Query: query, Shard: &target, Peer: table.Shard}
+		if !servers.Shared(id, table.Shard) {
+			if _, err := session.ExecOn(shardDBs[id], table.DB, query); err != nil {
+				return nil, 0, err
+			}
+		}
+		if _, _, err := logStatement(entry, nil, concernNone); err != nil {
+			return nil, 0, err
+		}
+	}
+	key := make([]interface{}, len(pkIdx))
+	for j, i := range pkIdx {
+		key[j] = last[i]
+	}
+	return key, len(tuples), nil
+}
+
+// checkShardKey returns the data type and collation of a shard key column,
+// once it has made sure that the table holds no rows yet. Columns that are
+// not text have no collation.
+func checkShardKey(dbName, tableName, column string) (string, string, error) {
+	var dataType, collation string
+	err := db.QueryRow("SELECT data_type, IFNULL(collation_name, '') FROM information_schema.columns "+
+		"WHERE table_schema = ? AND table_name = ? AND column_name = ?",
+		dbName, tableName, column).Scan(&dataType, &collation)
+	if err == sql.ErrNoRows {
+		return "", "", fmt.Errorf("table %s.%s has no column %s", dbName, tableName, column)
+	}
+	if err != nil {
+		return "", "", err
+	}
+
+	for _, pool := range serverDBs {
+		var one int
+		err = pool.QueryRow(fmt.Sprintf("SELECT 1 FROM %s.%s LIMIT 1", sqlparse.QuoteIdent(dbName), sqlparse.QuoteIdent(tableName))).Scan(&one)
+		if err == nil {
+			return "", "", fmt.Errorf("table %s.%s already contains rows", dbName, tableName)
+		}
+		if err != sql.ErrNoRows {
+			return "", "", err
+		}
+	}
+	return strings.ToLower(dataType), collation, nil
+}
+
+// migration is a move of a table, or of a hash range of a sharded table's
+// rows, to another shard, or of the key ranges of a range-sharded table that
+// a split or merge places elsewhere, run in the background by this master.
+// Rows are copied in chunks under replMu, each logged as a statement pinned
+// to the destination so that every slave copies its own rows. The cutover
+// then points the shard map at the destination, and the rows left behind are
+// removed from the old shards the same way.
+type migration struct {
+	DB      string           `json:"db"`
+	Table   string           `json:"table"`
+	Moves   []shard.Move     `json:"moves"`
+	Ranges  []shard.KeyRange `json:"ranges,omitempty"`
+	State   string           `json:"state"`
+	Copied  int64            `json:"copied"`
+	Removed int64            `json:"removed"`
+	Started time.Time        `json:"started"`
+	Error   string           `json:"error,omitempty"`
+	running bool
+}
+
+// A migration copies or removes this many rows per chunk, holding replMu
+// for one chunk at a time.
+const migrateChunkRows = 500
+
+// migrations holds the migrations run since this master came up, by table,
+// guarded by mu.
+var migrations = make(map[string]*migration)
+
+// startMigration moves a table to shard to, or only the rows of a sharded
+// table whose key hashes into r. A migration left unfinished by an earlier
+// master is resumed if it has the same destination and range.
+func startMigration(dbName, tableName string, to int, r *shard.HashRange) (*migration, error) {
+	if _, err := primaryKey(dbName, tableName); err != nil {
+		return nil, err
+	}
+	gen, err := generatedColumns(dbName, tableName)
+	if err != nil {
+		return nil, err
+	}
+	replMu.Lock()
+	err = fencedError()
+	table, ok := shardMap.Lookup(dbName, tableName)
+	switch {
+	case err != nil:
+	case !ok:
+		err = fmt.Errorf("table %s.%s does not exist", dbName, tableName)
+	case table.Migration == nil:
+		if table, err = shardMap.StartMigration(dbName, tableName, to, r, gen); err == nil {
+			publishShardMap()
+		}
+	case !resumes(table, to, r):
+		err = fmt.Errorf("table %s.%s is already being migrated", dbName, tableName)
+	}
+	replMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return runMigration(table)
+}
+
+// rerange places a range-sharded table on the ranges change derives from
+// its placement, and migrates the rows they put on other shards, if any.
+func rerange(dbName, tableName string, change func(t shard.Table) ([]shard.KeyRange, error)) (shard.Table, *migration, error) {
+	if _, err := primaryKey(dbName, tableName); err != nil {
+		return shard.Table{}, nil, err
+	}
+	gen, err := generatedColumns(dbName, tableName)
+	if err != nil {
+		return shard.Table{}, nil, err
+	}
+	replMu.Lock()
+	err = fencedError()
+	table, ok := shardMap.Lookup(dbName, tableName)
+	switch {
+	case err != nil:
+	case !ok:
+		err = fmt.Errorf("table %s.%s does not exist", dbName, tableName)
+	default:
+		var ranges []shard.KeyRange
+		if ranges, err = change(table); err != nil {
+			break
+		}
+		if table, err = shardMap.Rerange(dbName, tableName, ranges, gen); err == nil {
+			publishShardMap()
+		}
+	}
+	replMu.Unlock()
+	if err != nil || table.Migration == nil {
+		return table, nil, err
+	}
+	m, err := runMigration(table)
+	return table, m, err
+}
+
+// resumes reports whether the migration of table is the move of range r to
+// shard to.
+func resumes(table shard.Table, to int, r *shard.HashRange) bool {
+	moves := table.Migration.Moves
+	if r == nil {
+		return !table.Sharded() && moves[0].Shard == to
+	}
+	return len(moves) == 1 && moves[0] == shard.Move{HashRange: *r, Shard: to}
+}
+
+// respondRerange reports the outcome of a split or merge.
+func respondRerange(c *gin.Context, message string, table shard.Table, m *migration, err error) {
+	switch {
+	case err != nil:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case m != nil:
+		c.JSON(http.StatusAccepted, gin.H{"message": message + "; migrating the rows that move", "table": table, "migration": m.DB + "." + m.Table})
+	default:
+		c.JSON(http.StatusOK, gin.H{"message": message, "table": table})
+	}
+}
+
+// sessionIdleTimeout is how long a session opened with /session may go
+// without a request before it is closed.
+const sessionIdleTimeout = 30 * time.Minute
+
+// abandonSession rolls back the transaction a closed session left open.
+func abandonSession(s *session.Session) {
+	if id := s.Tx(); id != "" {
+		if t, err := lookupTx(id); err == nil {
+			t.rollback()
+		}
+	}
+}
+
+// expireSessions closes the sessions left idle for sessionIdleTimeout.
+func expireSessions() {
+	for range time.Tick(time.Minute) {
+		for _, s := range sessions.Expire() {
+			abandonSession(s)
+			fmt.Printf("Closed session %s after %s idle\n", s.ID, sessionIdleTimeout)
+		}
+	}
+}
+
+// transactionControl returns what a transaction control statement does:
+// "begin", "commit" or "rollback". Savepoints, XA statements and
+// transaction options are not supported and give "".
+func transactionControl(stmt *sqlparse.Statement) string {
+	toks := stmt.Tokens
+	plain := len(toks) == 1 || (len(toks) == 2 && toks[1].Is("WORK"))
+	switch {
+	case toks[0].Is("BEGIN") && plain, toks[0].Is("START") && len(toks) == 2 && toks[1].Is("TRANSACTION"):
+		return "begin"
+	case toks[0].Is("COMMIT") && plain:
+		return "commit"
+	case toks[0].Is("ROLLBACK") && plain:
+		return "rollback"
+	}
+	return ""
+}
+
+// txOf returns the transaction a request names in its tx parameter, or
+// else the one its session has open.
+func txOf(c *gin.Context) string {
+	if id := c.PostForm("tx"); id != "" {
+		return id
+	}
+	return session.Of(c).Tx()
+}
+
+// respondTransaction answers a /query request that controls a transaction
+// or runs a statement in the one named by the tx parameter, or else in the
+// one the session has open.
+func respondTransaction(c *gin.Context, s *session.Session, dbName string, stmt *sqlparse.Statement) {
+	txID := txOf(c)
+	control := ""
+	if stmt.Kind == sqlparse.Transaction {
+		if control = transactionControl(stmt); control == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Only BEGIN, START TRANSACTION, COMMIT and ROLLBACK are supported"})
+			return
+		}
+		if control == "begin" {
+			if txID != "" {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Transaction " + txID + " is already open"})
+				return
+			}
+			t, err := beginTx(dbName, s.Vars())
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			s.SetTx(t.ID)
+			c.JSON(http.StatusOK, gin.H{"message": "Transaction started", "tx": t.ID})
+			return
+		}
+		if txID == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "No transaction given: pass its ID as tx"})
+			return
+		}
+	}
+	t, err := lookupTx(txID)
+	if err != nil {
+		// The session's transaction may have been rolled back
+		if txID == s.Tx() {
+			s.SetTx("")
+		}
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if control != "" && s.Tx() == t.ID {
+		s.SetTx("")
+	}
+
+	switch control {
+	case "commit":
+		respondCommit(c, t)
+	case "rollback":
+		if err := t.rollback(); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Transaction rolled back", "tx": t.ID})
+	default:
+		rowsAffected, result, err := t.exec(stmt.Query)
+		if err != nil {
+			log.Println("Error executing query:", err)
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Error executing query: " + err.Error()})
+			return
+		}
+		if result == nil {
+			c.JSON(http.StatusOK, gin.H{"message": "Query executed in transaction", "rows": rowsAffected, "tx": t.ID})
+			return
+		}
+		var results []map[string]interface{}
+		for _, values := range result.Rows {
+			row := make(map[string]interface{})
+			for i, col := range result.Columns {
+				row[col] = values[i]
+			}
+			results = append(results, row)
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Query executed successfully", "data": results, "tx": t.ID})
+	}
+}
+
+// respondCommit commits a transaction and reports it once the write
+// concern is satisfied.
+func respondCommit(c *gin.Context, t *txn) {
+	concern, err := parseWriteConcern(c.PostForm("writeConcern"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	entry, wait, err := t.commit(concern)
+	if err != nil {
+		log.Println("Error committing transaction:", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Error committing transaction: " + err.Error(), "tx": t.ID})
+		return
+	}
+	replicas, err := waitForAcks(entry.LSN, wait)
+	if err != nil {
+		log.Println("Error replicating transaction:", err)
+		c.JSON(http.StatusGatewayTimeout, gin.H{
+			"error":         "Transaction committed on master but " + err.Error(),
+			"tx":            t.ID,
+			"lsn":           entry.LSN,
+			"write_concern": concern,
+			"replicas":      replicas,
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"message":       "Transaction committed",
+		"tx":            t.ID,
+		"lsn":           entry.LSN,
+		"write_concern": concern,
+		"replicas":      replicas,
+	})
+}
+
+// resumeMigrations carries on with the migrations, and the copies of
+// tables being made reference tables, recorded in the shard map once this
+// master accepts writes.
+func resumeMigrations() {
+	for fencedError() != nil {
+		time.Sleep(cfg.Replication.HeartbeatInterval)
+	}
+	for _, t := range shardMap.Tables() {
+		if t.Filling {
+			go func(t shard.Table) {
+				if _, err := fillReference(t); err != nil {
+					fmt.Printf("Error resuming copy of %s.%s to every shard: %v\n", t.DB, t.Name, err)
+				}
+			}(t)
+			continue
+		}
+		if t.Migration == nil {
+			continue
+		}
+		if _, err := runMigration(t); err != nil {
+			fmt.Printf("Error resuming migration of %s.%s: %v\n", t.DB, t.Name, err)
+		}
+	}
+}
+
+func runMigration(table shard.Table) (*migration, error) {
+	key := table.DB + "." + table.Name
+	mu.Lock()
+	if m, ok := migrations[key]; ok && m.running {
+		mu.Unlock()
+		return nil, fmt.Errorf("table %s is already being migrated", key)
+	}
+	m := &migration{
+		DB:      table.DB,
+		Table:   table.Name,
+		Moves:   table.Migration.Moves,
+		Ranges:  table.Migration.Ranges,
+		State:   table.Migration.State,
+		Started: time.Now(),
+		running: true,
+	}
+	migrations[key] = m
+	mu.Unlock()
+
+	if table.RangeSharded() {
+		fmt.Printf("Migrating %s to key ranges %v\n", key, m.Ranges)
+	} else {
+		fmt.Printf("Migrating %s (%.1f%% of its keys)\n", key, 100*shard.Fraction(m.Moves))
+	}
+	go func() {
+		err := m.run()
+		mu.Lock()
+		m.running = false
+		if err != nil {
+			m.Error = err.Error()
+		}
+		mu.Unlock()
+		if err != nil {
+			fmt.Printf("Migration of %s failed: %v\n", key, err)
+		} else {
+			fmt.Printf("Migrated %s\n", key)
+		}
+	}()
+	return m, nil
+}
+
+func (m *migration) run() error {
+	pk, err := primaryKey(m.DB, m.Table)
+	if err != nil {
+		return err
+	}
+	if m.State == shard.Copying {
+		if err := m.sweep(pk, true); err != nil {
+			return err
+		}
+		if err := m.advance(shardMap.Cutover); err != nil {
+			return err
+		}
+		m.setState(shard.Cleanup)
+	}
+	if err := m.sweep(pk, false); err != nil {
+		return err
+	}
+	if err := m.advance(shardMap.EndMigration); err != nil {
+		return err
+	}
+	m.setState("done")
+	return nil
+}
+
+func (m *migration) setState(state string) {
+	mu.Lock()
+	m.State = state
+	mu.Unlock()
+}
+
+// advance applies a change of migration state to the shard map and
+// publishes it, ordered with the statements around it.
+func (m *migration) advance(change func(db, table string) (shard.Table, error)) error {
+	replMu.Lock()
+	defer replMu.Unlock()
+	if err := fencedError(); err != nil {
+		return err
+	}
+	if _, err := change(m.DB, m.Table); err != nil {
+		return err
+	}
+	publishShardMap()
+	return nil
+}
+
+// sweep walks the rows on every server holding a source shard in primary
+// key order, copying those being moved to the destination or, once copying
+// is over, deleting them from their source.
+func (m *migration) sweep(pk []string, copying bool) error {
+	table, ok := shardMap.Lookup(m.DB, m.Table)
+	if !ok || table.Migration == nil {
+		return fmt.Errorf("table %s.%s is no longer being migrated", m.DB, m.Table)
+	}
+	seen := make(map[int]bool)
+	for _, src := range table.Migration.From {
+		if seen[servers.Of(src)] {
+			continue
+		}
+		seen[servers.Of(src)] = true
+		var after []interface{}
+		for {
+			var done bool
+			var err error
+			if after, done, err = m.step(src, pk, after, copying); err != nil {
+				return err
+			}
+			if done {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// step handles the chunk of rows after the primary key after on the server
+// of shard src, and returns the key of its last row and whether it was the
+// last chunk.
+func (m *migration) step(src int, pk []string, after []interface{}, copying bool) ([]interface{}, bool, error) {
+	replMu.Lock()
+	defer replMu.Unlock()
+	if err := fencedError(); err != nil {
+		return nil, false, err
+	}
+	table, ok := shardMap.Lookup(m.DB, m.Table)
+	if !ok || table.Migration == nil {
+		return nil, false, fmt.Errorf("table %s.%s is no longer being migrated", m.DB, m.Table)
+	}
+
+	quoted := make([]string, len(pk))
+	for i, col := range pk {
+		quoted[i] = sqlparse.QuoteIdent(col)
+	}
+	keyList := strings.Join(quoted, ", ")
+	query := "SELECT * FROM " + sqlparse.QuoteIdent(m.DB) + "." + sqlparse.QuoteIdent(m.Table)
+	if after != nil {
+		query += fmt.Sprintf(" WHERE (%s) > (%s)", keyList, quoteValues(after))
+	}
+	query += fmt.Sprintf(" ORDER BY %s LIMIT %d", keyList, migrateChunkRows)
+
+	rows, err := shardDBs[src].Query(query)
+	if err != nil {
+		return nil, false, err
+	}
+	columns, err := rows.Columns()
+	if err != nil {
+		rows.Close()
+		return nil, false, err
+	}
+	var chunk [][]interface{}
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		valuePtrs := make([]interface{}, len(columns))
+		for i := range values {
+			valuePtrs[i] = &values[i]
+		}
+		if err := rows.Scan(valuePtrs...); err != nil {
+			rows.Close()
+			return nil, false, err
+		}
+		chunk = append(chunk, values)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, false, err
+	}
+	if len(chunk) == 0 {
+		return nil, true, nil
+	}
+
+	keyIdx := -1
+	pkIdx := make([]int, len(pk))
+	for i, col := range columns {
+		if strings.EqualFold(col, table.Key) {
+			keyIdx = i
+		}
+		for j, k := range pk {
+			if strings.EqualFold(col, k) {
+				pkIdx[j] = i
+			}
+		}
+	}
+	keyOf := func(row []interface{}) []interface{} {
+		key := make([]interface{}, len(pkIdx))
+		for j, i := range pkIdx {
+			key[j] = row[i]
+		}
+		return key
+	}
+
+	// Rows on a shared server may belong to any of its shards; they are
+	// grouped by the shard each is moved from and to.
+	type path struct{ from, to int }
+	var order []path
+	moved := make(map[path][]string)
+	for _, row := range chunk {
+		value := ""
+		if table.Sharded() {
+			if keyIdx < 0 {
+				return nil, false, fmt.Errorf("table %s.%s has no shard key column %s", m.DB, m.Table, table.Key)
+			}
+			value = keyValue(row[keyIdx])
+		}
+		from, ok := table.Source(value, len(shardDBs))
+		if !ok {
+			continue
+		}
+		to, _ := table.Dest(value)
+		p := path{from, to}
+		if _, seen := moved[p]; !seen {
+			order = append(order, p)
+		}
+		if copying {
+			moved[p] = append(moved[p], "("+quoteValues(row)+")")
+		} else {
+			moved[p] = append(moved[p], "("+quoteValues(keyOf(row))+")")
+		}
+	}
+
+	quotedColumns := make([]string, len(columns))
+	for i, col := range columns {
+		quotedColumns[i] = sqlparse.QuoteIdent(col)
+	}
+	for _, p := range order {
+		entry := protocol.LogEntry{DB: m.DB}
+		var target int
+		if copying {
+			target, entry.Peer = p.to, p.from
+			entry.Query = fmt.Sprintf("REPLACE INTO %s (%s) VALUES %s",
+				sqlparse.QuoteIdent(m.Table), strings.Join(quotedColumns, ", "), strings.Join(moved[p], ", "))
+		} else {
+			target, entry.Peer = p.from, p.to
+			entry.Query = fmt.Sprintf("DELETE FROM %s WHERE (%s) IN (%s)",
+				sqlparse.QuoteIdent(m.Table), keyList, strings.Join(moved[p], ", "))
+		}
+		entry.Shard = &target
+		if !servers.Shared(target, entry.Peer) {
+			if _, err := session.ExecOn(shardDBs[target], m.DB, entry.Query); err != nil {
+				return nil, false, err
+			}
+		}
+		if _, _, err := logStatement(entry, nil, concernNone); err != nil {
+			return nil, false, err
+		}
+		mu.Lock()
+		if copying {
+			m.Copied += int64(len(moved[p]))
+		} else {
+			m.Removed += int64(len(moved[p]))
+		}
+		mu.Unlock()
+	}
+	return keyOf(chunk[len(chunk)-1]), len(chunk) < migrateChunkRows, nil
+}
+
+// primaryKey returns the primary key columns of a table, in order. Tables
+// without one cannot be migrated, as their rows cannot be walked in chunks.
+func primaryKey(dbName, tableName string) ([]string, error) {
+	rows, err := db.Query("SELECT column_name FROM information_schema.key_column_usage "+
+		"WHERE table_schema = ? AND table_name = ? AND constraint_name = 'PRIMARY' ORDER BY ordinal_position",
+		dbName, tableName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var columns []string
+	for rows.Next() {
+		var col string
+		if err := rows.Scan(&col); err != nil {
+			return nil, err
+		}
+		columns = append(columns, col)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(columns) == 0 {
+		return nil, fmt.Errorf("table %s.%s has no primary key", dbName, tableName)
+	}
+	return columns, nil
+}
+
+// generatedColumns returns the columns of a table MySQL fills in itself,
+// which a write copied to two shards during a migration must set.
+func generatedColumns(dbName, tableName string) (shard.Generated, error) {
+	var gen shard.Generated
+	rows, err := db.Query("SELECT column_name, extra FROM information_schema.columns "+
+		"WHERE table_schema = ? AND table_name = ? ORDER BY ordinal_position",
+		dbName, tableName)
+	if err != nil {
+		return gen, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var col, extra string
+		if err := rows.Scan(&col, &extra); err != nil {
+			return gen, err
+		}
+		extra = strings.ToLower(extra)
+		if strings.Contains(extra, "auto_increment") || strings.Contains(extra, "default_generated") {
+			gen.Insert = append(gen.Insert, col)
+		}
+		if strings.Contains(extra, "on update") {
+			gen.Update = append(gen.Update, col)
+		}
+	}
+	return gen, rows.Err()
+}
+
+// keyValue renders a scanned shard key value the way it appears as a
+// literal in a statement, which is what rows are hashed by.
+func keyValue(val interface{}) string {
+	if b, ok := val.([]byte); ok {
+		return string(b)
+	}
+	return fmt.Sprint(val)
+}
+
+func quoteValues(vals []interface{}) string {
+	quoted := make([]string, len(vals))
+	for i, val := range vals {
+		quoted[i] = quoteValue(val)
+	}
+	return strings.Join(quoted, ", ")
+}
+
+// tableChange is what placing the tables on another ring would do to one
+// table: move it whole, or move the hash ranges of its keys in Moves.
+type tableChange struct {
+	DB       string       `json:"db"`
+	Table    string       `json:"table"`
+	From     int          `json:"from"`
+	To       int          `json:"to"`
+	Moves    []shard.Move `json:"moves,omitempty"`
+	Fraction float64      `json:"fraction"`
+}
+
+// planTopology lists the tables that a ring of the given shards would
+// move. Tables sharded before the ring keep their placement.
+func planTopology(ring []int) []tableChange {
+	before, after := shard.NewRing(shardMap.Ring()), shard.NewRing(ring)
+	var changes []tableChange
+	for _, t := range shardMap.Tables() {
+		if t.Reference {
+			continue
+		}
+		if t.Sharded() {
+			if moves := t.Reassign(ring); len(moves) > 0 {
+				changes = append(changes, tableChange{DB: t.DB, Table: t.Name, From: -1, To: -1, Moves: moves, Fraction: shard.Fraction(moves)})
+			}
+			continue
+		}
+		h := shard.KeyHash(t.DB + "." + t.Name)
+		if to := after.Locate(h); to != before.Locate(h) && to != t.Shard {
+			changes = append(changes, tableChange{DB: t.DB, Table: t.Name, From: t.Shard, To: to, Fraction: 1})
+		}
+	}
+	return changes
+}
+
+// changeTopology places the tables on a ring of the given shards, starting
+// a migration for every table that moves. Shards can only be added to the
+// ring, as the rows of a removed one would go to shards already holding
+// rows of the same tables.
+func changeTopology(ring []int) ([]*migration, error) {
+	replMu.Lock()
+	if err := fencedError(); err != nil {
+		replMu.Unlock()
+		return nil, err
+	}
+	for _, id := range shardMap.Ring() {
+		if !slices.Contains(ring, id) {
+			replMu.Unlock()
+			return nil, fmt.Errorf("shard %d cannot be removed from the ring", id)
+		}
+	}
+	for _, t := range shardMap.Tables() {
+		if t.Migration != nil {
+			replMu.Unlock()
+			return nil, fmt.Errorf("table %s.%s is being migrated; change the ring once it is done", t.DB, t.Name)
+		}
+	}
+
+	changes := planTopology(ring)
+	err := shardMap.SetRing(ring)
+	var started []shard.Table
+	for _, t := range shardMap.Tables() {
+		if err != nil {
+			break
+		}
+		if t.Sharded() && t.Ring != nil && !slices.Equal(t.Ring, shardMap.Ring()) {
+			var gen shard.Generated
+			if gen, err = generatedColumns(t.DB, t.Name); err != nil {
+				break
+			}
+			if t, err = shardMap.Reshard(t.DB, t.Name, shardMap.Ring(), gen); err == nil && t.Migration != nil {
+				started = append(started, t)
+			}
+		}
+	}
+	for _, change := range changes {
+		if err != nil {
+			break
+		}
+		if change.Moves == nil {
+			var gen shard.Generated
+			if gen, err = generatedColumns(change.DB, change.Table); err != nil {
+				break
+			}
+			var t shard.Table
+			if t, err = shardMap.StartMigration(change.DB, change.Table, change.To, nil, gen); err == nil {
+				started = append(started, t)
 			}
 		}
+	}
+	publishShardMap()
+	replMu.Unlock()
+
+	var runs []*migration
+	for _, t := range started {
+		m, err := runMigration(t)
+		if err != nil {
+			return runs, err
+		}
+		runs = append(runs, m)
+	}
+	return runs, err
+}
+
+// parseShards reads a comma-separated list of shard IDs.
+func parseShards(s string) ([]int, error) {
+	var ids []int
+	for _, field := range strings.Split(s, ",") {
+		id, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || id < 0 || id >= len(shardDBs) {
+			return nil, fmt.Errorf("invalid shard %q", field)
+		}
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return slices.Compact(ids), nil
+}
+
+const (
+	// A snapshot chunk is flushed once it holds this many rows or bytes,
+	// whichever comes first.
+	syncChunkRows  = 500
+	syncChunkBytes = 1 << 20
+)
+
+func isSystemDatabase(name string) bool {
+	return name == "information_schema" || name == "mysql" || name == "performance_schema" || name == "sys" || name == shard.MetaDB
+}
+
+// streamSnapshot sends a consistent snapshot of every user database to a
+// slave as a manifest, a sequence of numbered chunks and a final checksum.
+// Rows are streamed from MySQL one chunk at a time so the master never holds
+// a whole table in memory. Chunks below resumeFrom are still read and hashed
+// but not sent, letting a slave continue an interrupted transfer.
+//
+// A snapshot of the repair tables only is a repair: the slave leaves the
+// broadcast as it is pinned, so that it has been sent every log entry up to
+// the snapshot and none after.
+func streamSnapshot(slave *protocol.Conn, resumeFrom int, repair []protocol.SyncTable) (uint64, error) {
+	ctx := context.Background()
+	// One connection per server: the schema is read from the main one,
+	// the rows from all of them
+	conns := make([]*sql.Conn, 0, len(serverDBs))
+	defer func() {
+		for _, conn := range conns {
+			conn.ExecContext(ctx, "ROLLBACK")
+			conn.Close()
+		}
+	}()
+	for _, pool := range serverDBs {
+		conn, err := pool.Conn(ctx)
+		if err != nil {
+			return 0, err
+		}
+		conns = append(conns, conn)
+	}
+
+	// Holding replMu while the snapshots open pins them to an exact LSN
+	replMu.Lock()
+	var err error
+	for _, conn := range conns {
+		if _, err = conn.ExecContext(ctx, "START TRANSACTION WITH CONSISTENT SNAPSHOT"); err != nil {
+			break
+		}
+	}
+	lsn := replLog.LastLSN()
+	if err == nil && repair != nil {
+		removeSlave(slave)
+	}
+	replMu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	var only map[string]bool
+	if repair != nil {
+		only = make(map[string]bool)
+		for _, t := range repair {
+			only[t.DB+"."+t.Table] = true
+		}
+	}
+	manifest, err := snapshotManifest(ctx, conns, only)
+	if err != nil {
+		return 0, err
+	}
+	if repair != nil {
+		// The slave has its databases already
+		manifest.Databases = nil
+		manifest.Repair = true
+	}
+	manifest.LSN = lsn
+	manifest.ResumeFrom = resumeFrom
+	if err := slave.Send(protocol.MsgSyncManifest, manifest); err != nil {
+		return 0, err
+	}
+
+	checksum := sha256.New()
+	seq := 0
+	emit := func(chunk *protocol.SyncChunk) error {
+		chunk.Seq = seq
+		seq++
+		chunk.Hash(checksum)
+		if chunk.Seq < resumeFrom {
+			return nil
+		}
+		return slave.Send(protocol.MsgSyncChunk, chunk)
+	}
+
+	for _, dbName := range manifest.Databases {
+		err := emit(&protocol.SyncChunk{
+			DB:         dbName,
+			Statements: []string{fmt.Sprintf("CREATE DATABASE IF NOT EXISTS %s", sqlparse.QuoteIdent(dbName))},
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	for _, table := range manifest.Tables {
+		if err := streamTable(ctx, conns, table, emit); err != nil {
+			return 0, fmt.Errorf("streaming %s.%s: %w", table.DB, table.Table, err)
+		}
+		fmt.Printf("Snapshot: sent %s.%s (%d rows)\n", table.DB, table.Table, table.Rows)
+	}
+
+	err = slave.Send(protocol.MsgSyncDone, protocol.SyncDone{
+		Chunks:   seq,
+		Checksum: hex.EncodeToString(checksum.Sum(nil)),
+	})
+	return lsn, err
+}
+
+// snapshotManifest lists the user databases and their tables, or only the
+// tables named in only, as "db.table", if it is not nil.
+func snapshotManifest(ctx context.Context, conns []*sql.Conn, only map[string]bool) (protocol.SyncManifest, error) {
+	var manifest protocol.SyncManifest
+	conn := conns[0]
+
+	rows, err := conn.QueryContext(ctx, "SHOW DATABASES")
+	if err != nil {
+		return manifest, err
+	}
+	for rows.Next() {
+		var dbName string
+		rows.Scan(&dbName)
+		if !isSystemDatabase(dbName) {
+			manifest.Databases = append(manifest.Databases, dbName)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return manifest, err
+	}
+
+	for _, dbName := range manifest.Databases {
+		tables, err := conn.QueryContext(ctx, "SHOW FULL TABLES FROM "+sqlparse.QuoteIdent(dbName)+" WHERE Table_type = 'BASE TABLE'")
+		if err != nil {
+			return manifest, err
+		}
+		var names []string
+		for tables.Next() {
+			var tableName, tableType string
+			tables.Scan(&tableName, &tableType)
+			names = append(names, tableName)
+		}
+		tables.Close()
+		if err := tables.Err(); err != nil {
+			return manifest, err
+		}
 
-		if tableName != "" {
-			var exists bool
-			shardID, exists = shardMap[tableName]
-			if !exists {
-				shardID = len(shardMap) % 2
-				shardMap[tableName] = shardID
-				fmt.Printf("Assigned %s to Shard %d\n", tableName, shardID)
+		for _, tableName := range names {
+			if only != nil && !only[dbName+"."+tableName] {
+				continue
 			}
-			if shardID >= 0 && shardID < 2 {
-				targetDB = shardDBs[shardID]
-				fmt.Printf("Executing %s on Shard %d\n", query, shardID)
-				_, err := targetDB.Exec("USE " + dbName)
+			var count int64
+			for _, c := range rowConns(conns, dbName, tableName) {
+				var n int64
+				err := c.QueryRowContext(ctx, fmt.Sprintf("SELECT COUNT(*) FROM %s.%s", sqlparse.QuoteIdent(dbName), sqlparse.QuoteIdent(tableName))).Scan(&n)
 				if err != nil {
-					fmt.Printf("Error selecting database %s on shard %d: %v\n", dbName, shardID, err)
-					return "", err
+					return manifest, err
 				}
+				count += n
 			}
+			manifest.Tables = append(manifest.Tables, protocol.SyncTable{DB: dbName, Table: tableName, Rows: count})
 		}
 	}
 
-	result, err := targetDB.Exec(query)
-	if err != nil {
-		fmt.Printf("Error executing query on shard %d: %s\nError: %v\n", shardID, query, err)
-		return "", err
+	return manifest, nil
+}
+
+// rowConns returns the connections to the servers that the rows of a table
+// are read from: all of them, or only that of its shard for a reference
+// table, whose other copies hold the same rows or, while it is being
+// filled, some of them.
+func rowConns(conns []*sql.Conn, dbName, tableName string) []*sql.Conn {
+	if t, ok := shardMap.Lookup(dbName, tableName); ok && (t.Reference || t.Filling) {
+		i := servers.Of(t.Shard)
+		return conns[i : i+1]
 	}
-	fmt.Printf("Executed query on shard %d: %s\n", shardID, query)
-	rowsAffected, _ := result.RowsAffected()
-	return fmt.Sprintf("Rows affected: %d", rowsAffected), nil
+	return conns
 }
 
-func dumpAllDatabases() (string, error) {
-	rows, err := db.Query("SHOW DATABASES")
+// streamTable emits the schema of a table followed by its rows, server by
+// server and ordered by primary key so that chunk boundaries are
+// reproducible across transfers.
+func streamTable(ctx context.Context, conns []*sql.Conn, table protocol.SyncTable, emit func(*protocol.SyncChunk) error) error {
+	qualified := sqlparse.QuoteIdent(table.DB) + "." + sqlparse.QuoteIdent(table.Table)
+	conn := conns[0]
+
+	var temp, createStmt string
+	err := conn.QueryRowContext(ctx, "SHOW CREATE TABLE "+qualified).Scan(&temp, &createStmt)
 	if err != nil {
-		return "", err
+		return err
+	}
+	err = emit(&protocol.SyncChunk{
+		DB:         table.DB,
+		Table:      table.Table,
+		Statements: []string{"DROP TABLE IF EXISTS " + sqlparse.QuoteIdent(table.Table), createStmt},
+	})
+	if err != nil {
+		return err
 	}
-	defer rows.Close()
 
-	var dump strings.Builder
-	for rows.Next() {
-		var dbName string
-		rows.Scan(&dbName)
-		if dbName == "information_schema" || dbName == "mysql" || dbName == "performance_schema" || dbName == "sys" {
-			continue
+	keyRows, err := conn.QueryContext(ctx, "SHOW KEYS FROM "+qualified+" WHERE Key_name = 'PRIMARY'")
+	if err != nil {
+		return err
+	}
+	keyColumns, _ := keyRows.Columns()
+	var orderBy []string
+	for keyRows.Next() {
+		values := make([]sql.RawBytes, len(keyColumns))
+		valuePtrs := make([]interface{}, len(keyColumns))
+		for i := range values {
+			valuePtrs[i] = &values[i]
 		}
-
-		_, err := db.Exec("USE " + dbName)
-		if err != nil {
-			return "", err
+		keyRows.Scan(valuePtrs...)
+		for i, col := range keyColumns {
+			if col == "Column_name" {
+				orderBy = append(orderBy, sqlparse.QuoteIdent(string(values[i])))
+			}
 		}
+	}
+	keyRows.Close()
 
-		dump.WriteString(fmt.Sprintf("CREATE DATABASE IF NOT EXISTS %s;\n", dbName))
-		dump.WriteString(fmt.Sprintf("USE %s;\n", dbName))
+	query := "SELECT * FROM " + qualified
+	if len(orderBy) > 0 {
+		query += " ORDER BY " + strings.Join(orderBy, ", ")
+	}
 
-		tables, err := db.Query("SHOW TABLES")
+	chunk := &protocol.SyncChunk{DB: table.DB, Table: table.Table}
+	var rowsDone int64
+	var chunkBytes int
+	streamRows := func(conn *sql.Conn) error {
+		dataRows, err := conn.QueryContext(ctx, query)
 		if err != nil {
-			return "", err
+			return err
 		}
-		defer tables.Close()
+		defer dataRows.Close()
 
-		for tables.Next() {
-			var tableName string
-			tables.Scan(&tableName)
-
-			createRow, err := db.Query("SHOW CREATE TABLE " + tableName)
-			if err != nil {
-				return "", err
-			}
-			defer createRow.Close()
-
-			if createRow.Next() {
-				var temp string
-				var createStmt string
-				createRow.Scan(&temp, &createStmt)
-				dump.WriteString(createStmt + ";\n")
-			}
+		columns, err := dataRows.Columns()
+		if err != nil {
+			return err
+		}
+		quotedColumns := make([]string, len(columns))
+		for i, col := range columns {
+			quotedColumns[i] = sqlparse.QuoteIdent(col)
+		}
+		// A row being migrated is on two servers until the source is
+		// cleaned up; the slave routes both copies to the same place.
+		insertPrefix := fmt.Sprintf("REPLACE INTO %s (%s) VALUES ", sqlparse.QuoteIdent(table.Table), strings.Join(quotedColumns, ","))
 
-			dataRows, err := db.Query("SELECT * FROM " + tableName)
-			if err != nil {
-				return "", err
-			}
-			defer dataRows.Close()
+		values := make([]interface{}, len(columns))
+		valuePtrs := make([]interface{}, len(columns))
+		for i := range values {
+			valuePtrs[i] = &values[i]
+		}
 
-			columns, err := dataRows.Columns()
+		for dataRows.Next() {
+			err = dataRows.Scan(valuePtrs...)
 			if err != nil {
-				return "", err
+				return err
 			}
-
-			values := make([]interface{}, len(columns))
-			valuePtrs := make([]interface{}, len(columns))
-			for i := range values {
-				valuePtrs[i] = &values[i]
+			vals := make([]string, len(values))
+			for i, val := range values {
+				vals[i] = quoteValue(val)
 			}
+			stmt := insertPrefix + "(" + strings.Join(vals, ",") + ")"
+			chunk.Statements = append(chunk.Statements, stmt)
+			chunkBytes += len(stmt)
+			rowsDone++
 
-			for dataRows.Next() {
-				err = dataRows.Scan(valuePtrs...)
-				if err != nil {
-					return "", err
-				}
-				var vals []string
-				for _, val := range values {
-					switch v := val.(type) {
-					case nil:
-						vals = append(vals, "NULL")
-					case string:
-						vals = append(vals, fmt.Sprintf("'%s'", v))
-					default:
-						vals = append(vals, fmt.Sprintf("%v", v))
-					}
+			if len(chunk.Statements) >= syncChunkRows || chunkBytes >= syncChunkBytes {
+				chunk.RowsDone = rowsDone
+				if err := emit(chunk); err != nil {
+					return err
 				}
-				dump.WriteString(fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s);\n", tableName, strings.Join(columns, ","), strings.Join(vals, ",")))
+				chunk = &protocol.SyncChunk{DB: table.DB, Table: table.Table}
+				chunkBytes = 0
 			}
 		}
+		return dataRows.Err()
+	}
+	for _, conn := range rowConns(conns, table.DB, table.Table) {
+		if err := streamRows(conn); err != nil {
+			return err
+		}
+	}
+	if len(chunk.Statements) > 0 {
+		chunk.RowsDone = rowsDone
+		return emit(chunk)
 	}
+	return nil
+}
 
-	return dump.String(), nil
+// quoteValue renders a scanned column value as a MySQL literal.
+func quoteValue(val interface{}) string {
+	switch v := val.(type) {
+	case nil:
+		return "NULL"
+	case []byte:
+		return sqlparse.QuoteString(string(v))
+	case string:
+		return sqlparse.QuoteString(v)
+	case time.Time:
+		return sqlparse.QuoteString(v.Format("2006-01-02 15:04:05.999999"))
+	default:
+		return fmt.Sprintf("%v", v)
+	}
 }
 
 func startFrontend() {
 	r := gin.Default()
-	r.LoadHTMLGlob("templates/*.html")
-	r.Static("/static", "./static")
+	r.Use(sessions.Attach)
+	r.LoadHTMLGlob(filepath.Join(cfg.UI.Templates, "*.html"))
+	r.Static("/static", cfg.UI.Static)
 
 	r.GET("/", func(c *gin.Context) {
 		c.HTML(http.StatusOK, "index.html", gin.H{
-			"IsMaster": true,
+			"Title":       cfg.UI.Title,
+			"IsMaster":    true,
+			"ShowCluster": true,
 		})
 	})
 
 	r.GET("/databases", func(c *gin.Context) {
-		rows, err := db.Query("SHOW DATABASES")
+		result, err := session.Of(c).Query(context.Background(), 0, "SHOW DATABASES")
 		if err != nil {
 			log.Println("Error fetching databases:", err)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
-		defer rows.Close()
 		var databases []string
-		for rows.Next() {
-			var dbName string
-			rows.Scan(&dbName)
-			if dbName != "information_schema" && dbName != "mysql" && dbName != "performance_schema" && dbName != "sys" {
+		for _, row := range result.Rows {
+			if dbName := fmt.Sprint(row[0]); !isSystemDatabase(dbName) {
 				databases = append(databases, dbName)
 			}
 		}
@@ -350,24 +3675,21 @@ func startFrontend() {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "Database name is required"})
 			return
 		}
-		_, err := db.Exec("USE " + dbName)
-		if err != nil {
+		s := session.Of(c)
+		if err := s.Use(context.Background(), dbName); err != nil {
 			log.Println("Error selecting database:", err)
 			c.JSON(http.StatusBadRequest, gin.H{"error": "Error selecting database: " + err.Error()})
 			return
 		}
-		rows, err := db.Query("SHOW TABLES")
+		result, err := s.Query(context.Background(), 0, "SHOW TABLES")
 		if err != nil {
 			log.Println("Error fetching tables:", err)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
-		defer rows.Close()
 		var tables []string
-		for rows.Next() {
-			var tableName string
-			rows.Scan(&tableName)
-			tables = append(tables, tableName)
+		for _, row := range result.Rows {
+			tables = append(tables, fmt.Sprint(row[0]))
 		}
 		c.JSON(http.StatusOK, gin.H{"tables": tables})
 	})
@@ -379,32 +3701,23 @@ func startFrontend() {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "Database and table names are required"})
 			return
 		}
-		_, err := db.Exec("USE " + dbName)
-		if err != nil {
+		s := session.Of(c)
+		if err := s.Use(context.Background(), dbName); err != nil {
 			log.Println("Error selecting database:", err)
 			c.JSON(http.StatusBadRequest, gin.H{"error": "Error selecting database: " + err.Error()})
 			return
 		}
-		rows, err := db.Query("DESCRIBE " + tableName)
+		result, err := s.Query(context.Background(), 0, "DESCRIBE "+tableName)
 		if err != nil {
 			log.Println("Error describing table:", err)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
-		defer rows.Close()
 		var columns []map[string]string
-		for rows.Next() {
-			var columnName, columnType, null, key string
-			var defaultVal, extra *string
-			err = rows.Scan(&columnName, &columnType, &null, &key, &defaultVal, &extra)
-			if err != nil {
-				log.Println("Error scanning column info:", err)
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Error scanning column info: " + err.Error()})
-				return
-			}
+		for _, row := range result.Rows {
 			columns = append(columns, map[string]string{
-				"name": columnName,
-				"type": columnType,
+				"name": fmt.Sprint(row[0]),
+				"type": fmt.Sprint(row[1]),
 			})
 		}
 		c.JSON(http.StatusOK, gin.H{"columns": columns})
@@ -417,29 +3730,22 @@ func startFrontend() {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "Database and table names are required"})
 			return
 		}
-		_, err := db.Exec("USE " + dbName)
-		if err != nil {
+		s := session.Of(c)
+		if err := s.Use(context.Background(), dbName); err != nil {
 			log.Println("Error selecting database:", err)
 			c.JSON(http.StatusBadRequest, gin.H{"error": "Error selecting database: " + err.Error()})
 			return
 		}
-		rows, err := db.Query("SELECT id FROM " + tableName)
+		// The rows may be spread over several shards
+		result, err := queryWithSharding(s, "SELECT id FROM "+tableName)
 		if err != nil {
 			log.Println("Error fetching rows:", err)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error fetching rows: " + err.Error()})
 			return
 		}
-		defer rows.Close()
 		var ids []string
-		for rows.Next() {
-			var id string
-			err := rows.Scan(&id)
-			if err != nil {
-				log.Println("Error scanning ID:", err)
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Error scanning ID: " + err.Error()})
-				return
-			}
-			ids = append(ids, id)
+		for _, row := range result.Rows {
+			ids = append(ids, fmt.Sprint(row[0]))
 		}
 		c.JSON(http.StatusOK, gin.H{"ids": ids})
 	})
@@ -454,32 +3760,24 @@ func startFrontend() {
 		}
 		log.Println("Fetching row for db:", dbName, "table:", tableName, "id:", id)
 
-		_, err := db.Exec("USE " + dbName)
-		if err != nil {
+		s := session.Of(c)
+		if err := s.Use(context.Background(), dbName); err != nil {
 			log.Println("Error selecting database:", err)
 			c.JSON(http.StatusBadRequest, gin.H{"error": "Error selecting database: " + err.Error()})
 			return
 		}
 
-		columnRows, err := db.Query("DESCRIBE " + tableName)
+		description, err := s.Query(context.Background(), 0, "DESCRIBE "+tableName)
 		if err != nil {
 			log.Println("Error describing table:", err)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error describing table: " + err.Error()})
 			return
 		}
-		defer columnRows.Close()
 
 		var columnNames []string
 		var columnTypes = make(map[string]string)
-		for columnRows.Next() {
-			var columnName, columnType, null, key string
-			var defaultVal, extra *string
-			err = columnRows.Scan(&columnName, &columnType, &null, &key, &defaultVal, &extra)
-			if err != nil {
-				log.Println("Error scanning column info:", err)
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Error scanning column info: " + err.Error()})
-				return
-			}
+		for _, row := range description.Rows {
+			columnName, columnType := fmt.Sprint(row[0]), fmt.Sprint(row[1])
 			if columnName != "id" {
 				columnNames = append(columnNames, columnName)
 				columnTypes[columnName] = columnType
@@ -500,40 +3798,31 @@ func startFrontend() {
 				selectColumns = append(selectColumns, col)
 			}
 		}
-		query := fmt.Sprintf("SELECT %s FROM %s WHERE id = ?", strings.Join(selectColumns, ", "), tableName)
+		query := fmt.Sprintf("SELECT %s FROM %s WHERE id = %s", strings.Join(selectColumns, ", "), tableName, sqlparse.QuoteString(id))
 
-		rows, err := db.Query(query, id)
+		// The row lives on one of the shards
+		result, err := queryWithSharding(s, query)
 		if err != nil {
 			log.Println("Error fetching row:", err)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error fetching row: " + err.Error()})
 			return
 		}
-		defer rows.Close()
-
-		if !rows.Next() {
+		if len(result.Rows) == 0 {
 			log.Println("No row found with id:", id)
 			c.JSON(http.StatusNotFound, gin.H{"error": "No row found with id: " + id})
 			return
 		}
 
-		values := make([]string, len(columnNames))
-		valuePtrs := make([]interface{}, len(columnNames))
-		for i := range columnNames {
-			valuePtrs[i] = &values[i]
-		}
-
-		if err := rows.Scan(valuePtrs...); err != nil {
-			log.Println("Error scanning row:", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error scanning row: " + err.Error()})
-			return
-		}
-
 		var columnData []map[string]string
 		for i, col := range columnNames {
+			value := ""
+			if v := result.Rows[0][i]; v != nil {
+				value = fmt.Sprint(v)
+			}
 			columnData = append(columnData, map[string]string{
 				"name":  col,
 				"type":  columnTypes[col],
-				"value": values[i],
+				"value": value,
 			})
 		}
 		c.JSON(http.StatusOK, gin.H{"columns": columnData})
@@ -544,79 +3833,498 @@ func startFrontend() {
 		dbName := c.PostForm("dbName")
 		query := c.PostForm("query")
 
-		queryType := strings.ToUpper(strings.Split(query, " ")[0])
-		if queryType != "CREATE" || !strings.Contains(strings.ToUpper(query), "DATABASE") {
-			_, err := db.Exec("USE " + dbName)
-			if err != nil {
+		stmt, err := sqlparse.Parse(query)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Error parsing query: " + err.Error()})
+			return
+		}
+		s := session.Of(c)
+		if stmt.Kind != sqlparse.CreateDatabase {
+			if err := s.Use(context.Background(), dbName); err != nil {
 				log.Println("Error selecting database:", err)
 				c.JSON(http.StatusBadRequest, gin.H{"error": "Error selecting database: " + err.Error()})
 				return
 			}
+			dbName = s.DB()
 		}
 
-		if userType != "master" && (queryType == "CREATE" || queryType == "DROP") {
-			c.JSON(http.StatusForbidden, gin.H{"error": "CREATE and DROP are Master-only operations"})
+		if userType != "master" && stmt.Kind.IsDDL() {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Schema changes are Master-only operations"})
+			return
+		}
+		if stmt.Kind == sqlparse.Use || session.Local(stmt) {
+			session.Respond(c, s, stmt)
+			return
+		}
+		if stmt.Kind == sqlparse.Transaction || txOf(c) != "" {
+			respondTransaction(c, s, dbName, stmt)
+			return
+		}
+		shardKey := c.PostForm("shardKey")
+		if shardKey != "" && stmt.Kind != sqlparse.CreateTable {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "A shard key can only be declared with CREATE TABLE"})
 			return
 		}
 
-		if queryType == "SELECT" {
-			rows, err := db.Query(query)
+		if stmt.Kind.IsRead() {
+			result, err := queryWithSharding(s, query)
 			if err != nil {
 				log.Println("Error executing query:", err)
 				c.JSON(http.StatusBadRequest, gin.H{"error": "Error executing query: " + err.Error()})
 				return
 			}
-			defer rows.Close()
-			columns, _ := rows.Columns()
 			var results []map[string]interface{}
-			for rows.Next() {
-				values := make([]interface{}, len(columns))
-				valuePtrs := make([]interface{}, len(columns))
-				for i := range values {
-					valuePtrs[i] = &values[i]
-				}
-				err := rows.Scan(valuePtrs...)
-				if err != nil {
-					log.Println("Error scanning row:", err)
-					c.JSON(http.StatusInternalServerError, gin.H{"error": "Error scanning row: " + err.Error()})
-					return
-				}
+			for _, values := range result.Rows {
 				row := make(map[string]interface{})
-				for i, col := range columns {
-					val := values[i]
-					if b, ok := val.([]byte); ok {
-						row[col] = string(b)
-					} else {
-						row[col] = val
-					}
+				for i, col := range result.Columns {
+					row[col] = values[i]
 				}
 				results = append(results, row)
 			}
 			c.JSON(http.StatusOK, gin.H{"message": "Query executed successfully", "data": results})
 		} else {
-			result, err := db.Exec(query)
+			if err := fencedError(); err != nil {
+				c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+				return
+			}
+			concern, err := parseWriteConcern(c.PostForm("writeConcern"))
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+
+			// Execute, log and broadcast the query to all slaves, with
+			// the session variables it ran with
+			var rowsAffected int64
+			var report []schemaStatus
+			write := protocol.LogEntry{DB: dbName, Query: query}
+			if !stmt.Kind.IsDDL() {
+				write.Vars = s.Vars()
+			}
+			entry, wait, err := commitStatement(write, nil, concern, func() error {
+				var err error
+				if stmt.Kind.IsDDL() {
+					rowsAffected, report, err = executeSchemaChange(dbName, stmt)
+				} else {
+					rowsAffected, err = executeQueryWithSharding(s, query)
+				}
+				return err
+			})
 			if err != nil {
 				log.Println("Error executing query:", err)
-				c.JSON(http.StatusBadRequest, gin.H{"error": "Error executing query: " + err.Error()})
+				response := gin.H{"error": "Error executing query: " + err.Error()}
+				if report != nil {
+					response["shards"] = report
+				}
+				c.JSON(http.StatusBadRequest, response)
 				return
 			}
-			rowsAffected, _ := result.RowsAffected()
 
-			// Broadcast the query to all slaves immediately (Synchronous Replication)
-			mu.Lock()
-			for _, slave := range slaves {
-				_, err := slave.Write([]byte(dbName + "|" + query))
-				if err != nil {
-					fmt.Println("Error sending to Slave:", err)
+			// A shard key can be declared together with CREATE TABLE
+			if shardKey != "" {
+				tableDB := stmt.Table.DB
+				if tableDB == "" {
+					tableDB = dbName
+				}
+				if _, err := declareShardKey(tableDB, stmt.Table.Name, shardKey); err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": "Table created but shard key rejected: " + err.Error()})
+					return
 				}
 			}
-			mu.Unlock()
 
-			c.JSON(http.StatusOK, gin.H{"message": "Query executed successfully", "rows": rowsAffected})
+			// Only report success once the write concern is satisfied
+			replicas, err := waitForAcks(entry.LSN, wait)
+			if err != nil {
+				log.Println("Error replicating query:", err)
+				c.JSON(http.StatusGatewayTimeout, gin.H{
+					"error":         "Query executed on master but " + err.Error(),
+					"rows":          rowsAffected,
+					"lsn":           entry.LSN,
+					"write_concern": concern,
+					"replicas":      replicas,
+				})
+				return
+			}
+
+			response := gin.H{
+				"message":       "Query executed successfully",
+				"rows":          rowsAffected,
+				"lsn":           entry.LSN,
+				"write_concern": concern,
+				"replicas":      replicas,
+			}
+			if id := s.InsertID(); id != 0 && (stmt.Kind == sqlparse.Insert || stmt.Kind == sqlparse.Replace) {
+				response["last_insert_id"] = id
+			}
+			if report != nil {
+				response["shards"] = report
+			}
+			c.JSON(http.StatusOK, response)
+		}
+	})
+
+	r.POST("/session", func(c *gin.Context) {
+		s, err := sessions.Open()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if err := s.Use(context.Background(), c.PostForm("dbName")); err != nil {
+			sessions.Close(s.ID)
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Error selecting database: " + err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Session opened", "session": s.ID, "db": s.DB()})
+	})
+
+	r.GET("/session", func(c *gin.Context) {
+		s := session.Of(c)
+		c.JSON(http.StatusOK, gin.H{"session": s.ID, "db": s.DB(), "variables": s.Vars(), "tx": s.Tx(), "open": sessions.Len()})
+	})
+
+	r.POST("/session/close", func(c *gin.Context) {
+		s, ok := sessions.Close(session.Of(c).ID)
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "No session given: pass its ID as session"})
+			return
+		}
+		abandonSession(s)
+		c.JSON(http.StatusOK, gin.H{"message": "Session closed", "session": s.ID})
+	})
+
+	r.POST("/tx/begin", func(c *gin.Context) {
+		t, err := beginTx(c.PostForm("dbName"), session.Of(c).Vars())
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		session.Of(c).SetTx(t.ID)
+		c.JSON(http.StatusOK, gin.H{"message": "Transaction started", "tx": t.ID})
+	})
+
+	r.POST("/tx/commit", func(c *gin.Context) {
+		s := session.Of(c)
+		t, err := lookupTx(txOf(c))
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		if s.Tx() == t.ID {
+			s.SetTx("")
+		}
+		respondCommit(c, t)
+	})
+
+	r.POST("/tx/rollback", func(c *gin.Context) {
+		s := session.Of(c)
+		t, err := lookupTx(txOf(c))
+		if err == nil {
+			if s.Tx() == t.ID {
+				s.SetTx("")
+			}
+			err = t.rollback()
+		}
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Transaction rolled back", "tx": t.ID})
+	})
+
+	r.GET("/tx", func(c *gin.Context) {
+		txMu.Lock()
+		open := make([]gin.H, 0, len(transactions))
+		for _, t := range transactions {
+			open = append(open, gin.H{"tx": t.ID, "db": t.DB, "started": t.started})
+		}
+		txMu.Unlock()
+		pending := decisions.Pending()
+		inDoubt := make([]string, len(pending))
+		for i, d := range pending {
+			inDoubt[i] = d.XID
+		}
+		c.JSON(http.StatusOK, gin.H{"open": open, "in_doubt": inDoubt})
+	})
+
+	r.GET("/admin/conflicts", func(c *gin.Context) {
+		mu.Lock()
+		recent := append([]conflict{}, conflicts...)
+		mu.Unlock()
+		c.JSON(http.StatusOK, gin.H{"conflicts": recent, "log": conflictsPath()})
+	})
+
+	r.GET("/admin/shardmap", func(c *gin.Context) {
+		c.JSON(http.StatusOK, shardMap.Snapshot())
+	})
+
+	r.POST("/admin/shardkey", func(c *gin.Context) {
+		dbName := c.PostForm("db")
+		tableName := c.PostForm("table")
+		column := c.PostForm("column")
+		if dbName == "" || tableName == "" || column == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Database, table, and column are required"})
+			return
+		}
+		var table shard.Table
+		var err error
+		switch c.DefaultPostForm("mode", "hash") {
+		case "hash":
+			table, err = declareShardKey(dbName, tableName, column)
+		case "range":
+			var splits []string
+			for _, start := range strings.Split(c.PostForm("splits"), ",") {
+				if start = strings.TrimSpace(start); start != "" {
+					splits = append(splits, start)
+				}
+			}
+			table, err = declareRangeKey(dbName, tableName, column, splits)
+		default:
+			err = fmt.Errorf("mode must be hash or range")
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Shard key declared", "table": table})
+	})
+
+	r.POST("/admin/reference", func(c *gin.Context) {
+		dbName := c.PostForm("db")
+		tableName := c.PostForm("table")
+		if dbName == "" || tableName == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Database and table are required"})
+			return
+		}
+		table, err := declareReference(dbName, tableName)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Reference table declared", "table": table})
+	})
+
+	// Lists the key ranges of a range-sharded table with the rows in each.
+	r.GET("/admin/ranges", func(c *gin.Context) {
+		t, ok := shardMap.Lookup(c.Query("db"), c.Query("table"))
+		if !ok || !t.RangeSharded() {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Ranges need the db and table of a range-sharded table"})
+			return
+		}
+		ranges := make([]gin.H, len(t.Ranges))
+		for i, kr := range t.Ranges {
+			var rows int64
+			query := fmt.Sprintf("SELECT COUNT(*) FROM %s.%s WHERE %s", sqlparse.QuoteIdent(t.DB), sqlparse.QuoteIdent(t.Name), t.RangeCondition(t.Ranges, i))
+			if err := shardDBs[kr.Shard].QueryRow(query).Scan(&rows); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			end := ""
+			if i+1 < len(t.Ranges) {
+				end = t.Ranges[i+1].Start
+			}
+			ranges[i] = gin.H{"start": kr.Start, "end": end, "shard": kr.Shard, "rows": rows}
+		}
+		c.JSON(http.StatusOK, gin.H{"db": t.DB, "table": t.Name, "key": t.Key, "ranges": ranges, "migration": t.Migration})
+	})
+
+	// Splits the range holding at in two, the upper part moving to shard
+	// if given.
+	r.POST("/admin/ranges/split", func(c *gin.Context) {
+		dbName := c.PostForm("db")
+		tableName := c.PostForm("table")
+		at := c.PostForm("at")
+		if dbName == "" || tableName == "" || at == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Database, table, and split point are required"})
+			return
+		}
+		to := -1
+		if c.PostForm("shard") != "" {
+			var err error
+			if to, err = strconv.Atoi(c.PostForm("shard")); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Shard must be a number"})
+				return
+			}
+		}
+		table, m, err := rerange(dbName, tableName, func(t shard.Table) ([]shard.KeyRange, error) {
+			id := to
+			if id < 0 {
+				id = t.ShardOf(at, len(shardDBs))
+			}
+			return t.Split(at, id)
+		})
+		respondRerange(c, "Range split", table, m, err)
+	})
+
+	// Merges the range starting at at into the one below it.
+	r.POST("/admin/ranges/merge", func(c *gin.Context) {
+		dbName := c.PostForm("db")
+		tableName := c.PostForm("table")
+		at := c.PostForm("at")
+		if dbName == "" || tableName == "" || at == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Database, table, and range start are required"})
+			return
+		}
+		table, m, err := rerange(dbName, tableName, func(t shard.Table) ([]shard.KeyRange, error) {
+			return t.Merge(at)
+		})
+		respondRerange(c, "Ranges merged", table, m, err)
+	})
+
+	r.POST("/admin/rebalance", func(c *gin.Context) {
+		dbName := c.PostForm("db")
+		tableName := c.PostForm("table")
+		to, err := strconv.Atoi(c.PostForm("shard"))
+		if dbName == "" || tableName == "" || err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Database, table, and destination shard are required"})
+			return
+		}
+		var r *shard.HashRange
+		if spec := c.PostForm("hash_range"); spec != "" {
+			lo, hi, ok := strings.Cut(spec, "-")
+			l, errLo := strconv.ParseUint(lo, 10, 32)
+			h, errHi := strconv.ParseUint(hi, 10, 32)
+			if !ok || errLo != nil || errHi != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Hash range must be lo-hi with bounds from 0 to 4294967295"})
+				return
+			}
+			r = &shard.HashRange{Lo: uint32(l), Hi: uint32(h)}
+		}
+		m, err := startMigration(dbName, tableName, to, r)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusAccepted, gin.H{"message": "Migration started", "migration": m.DB + "." + m.Table})
+	})
+
+	r.GET("/admin/rebalance", func(c *gin.Context) {
+		mu.Lock()
+		list := make([]migration, 0, len(migrations))
+		for _, m := range migrations {
+			list = append(list, *m)
+		}
+		mu.Unlock()
+		sort.Slice(list, func(i, j int) bool {
+			return list[i].DB+"."+list[i].Table < list[j].DB+"."+list[j].Table
+		})
+		c.JSON(http.StatusOK, list)
+	})
+
+	// Without shards, shows the current ring; with them, previews which
+	// tables, hash ranges and given keys that ring would move.
+	r.GET("/admin/topology", func(c *gin.Context) {
+		current := shardMap.Ring()
+		if c.Query("shards") == "" {
+			c.JSON(http.StatusOK, gin.H{"ring": current, "vnodes": shard.Vnodes})
+			return
+		}
+		ring, err := parseShards(c.Query("shards"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		preview := gin.H{"ring": current, "proposed": ring, "tables": planTopology(ring)}
+		if keys := c.QueryArray("key"); len(keys) > 0 {
+			t, ok := shardMap.Lookup(c.Query("db"), c.Query("table"))
+			if !ok || !t.Sharded() {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Keys need the db and table of a sharded table"})
+				return
+			}
+			next := t
+			if t.Ring != nil {
+				next.Ring = ring
+			}
+			var moved []gin.H
+			for _, key := range keys {
+				from, to := t.ShardOf(key, len(shardDBs)), next.ShardOf(key, len(shardDBs))
+				moved = append(moved, gin.H{"key": key, "from": from, "to": to, "moves": from != to})
+			}
+			preview["keys"] = moved
+		}
+		c.JSON(http.StatusOK, preview)
+	})
+
+	r.POST("/admin/topology", func(c *gin.Context) {
+		ring, err := parseShards(c.PostForm("shards"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		runs, err := changeTopology(ring)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		tables := make([]string, len(runs))
+		for i, m := range runs {
+			tables[i] = m.DB + "." + m.Table
+		}
+		c.JSON(http.StatusAccepted, gin.H{"message": "Ring changed", "ring": ring, "migrations": tables})
+	})
+
+	// Browsers get the topology page, which polls the same URL for JSON
+	r.GET("/cluster", func(c *gin.Context) {
+		if c.NegotiateFormat(gin.MIMEJSON, gin.MIMEHTML) == gin.MIMEHTML {
+			c.HTML(http.StatusOK, "cluster.html", gin.H{"Title": cfg.UI.Title})
+			return
+		}
+		host, _, err := net.SplitHostPort(c.Request.Host)
+		if err != nil {
+			host = c.Request.Host
+		}
+		c.JSON(http.StatusOK, clusterView(host))
+	})
+
+	r.GET("/admin/nodes", func(c *gin.Context) {
+		mu.Lock()
+		defer mu.Unlock()
+		c.JSON(http.StatusOK, gin.H{"nodes": registeredNodes()})
+	})
+
+	r.POST("/admin/nodes/remove", func(c *gin.Context) {
+		id := c.PostForm("id")
+		if id == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "A node ID is required"})
+			return
+		}
+		if err := deregisterNode(id); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Node deregistered"})
+	})
+
+	r.GET("/admin/members", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{
+			"heartbeat_interval": cfg.Replication.HeartbeatInterval.String(),
+			"heartbeat_timeout":  cfg.Replication.HeartbeatTimeout.String(),
+			"slaves":             membership(),
+		})
+	})
+
+	r.GET("/admin/raft", func(c *gin.Context) {
+		if raftNode == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Raft is not enabled"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"raft": raftNode.Status(), "metadata": metadata.State()})
+	})
+
+	r.POST("/admin/fence", func(c *gin.Context) {
+		newEpoch, err := strconv.ParseUint(c.PostForm("epoch"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "A numeric epoch is required"})
+			return
+		}
+		if newEpoch <= epoch {
+			c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Epoch %d is not newer than this master's epoch %d", newEpoch, epoch)})
+			return
 		}
+		fence(protocol.Fence{Epoch: newEpoch, Master: c.PostForm("master")})
+		c.JSON(http.StatusOK, gin.H{"message": "Master fenced", "epoch": newEpoch})
 	})
 
-	if err := r.Run(":8081"); err != nil {
+	if err := r.Run(cfg.Listen.HTTP); err != nil {
 		log.Fatal("Error starting frontend:", err)
 	}
 }
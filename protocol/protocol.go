@@ -0,0 +1,438 @@
+// Package protocol implements the framed message format spoken between the
+// master and its slaves over TCP.
+//
+// Every message is sent as a single frame:
+//
+//	+----------------+--------+-----------------+
+//	| length (4B BE) | type   | payload         |
+//	+----------------+--------+-----------------+
+//
+// The length covers the type byte and the payload, so a reader always knows
+// exactly how many bytes belong to a message no matter how TCP splits or
+// coalesces the stream. Payloads are JSON encoded.
+package protocol
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Version is the protocol version. Slaves present it when they register and
+// the master turns away slaves speaking another version.
+const Version = 3
+
+// MaxFrameSize bounds a single frame so a corrupt length header cannot make
+// the reader allocate unbounded memory.
+const MaxFrameSize = 64 << 20
+
+// MsgType identifies the kind of payload carried by a frame.
+type MsgType byte
+
+const (
+	// MsgSetup is sent by the master to prepare a freshly connected slave.
+	MsgSetup MsgType = iota + 1
+	// MsgHello is the first message a slave sends, announcing its
+	// replication position.
+	MsgHello
+	// MsgReplicate carries a statement the slave must apply locally.
+	MsgReplicate
+	// MsgForward carries a write a slave received from its own clients.
+	MsgForward
+	// MsgFullSyncRequest asks the master for a snapshot of all databases.
+	MsgFullSyncRequest
+	// MsgSyncManifest opens a snapshot stream and lists what it contains.
+	MsgSyncManifest
+	// MsgSyncChunk carries one numbered piece of a snapshot.
+	MsgSyncChunk
+	// MsgSyncDone closes a snapshot stream with its checksum.
+	MsgSyncDone
+	// MsgShardMap carries the master's shard map (a shard.Snapshot).
+	MsgShardMap
+	// MsgOK acknowledges a setup command.
+	MsgOK
+	// MsgAck acknowledges that a slave applied a replicated log entry.
+	MsgAck
+	// MsgResult reports the outcome of a forwarded statement.
+	MsgResult
+	// MsgError reports a failure.
+	MsgError
+	// MsgWelcome answers MsgHello with the master's epoch.
+	MsgWelcome
+	// MsgPeers lists the HTTP addresses of the slaves replicating from the
+	// master.
+	MsgPeers
+	// MsgHeartbeat is sent periodically in both directions so an idle but
+	// dead link is noticed.
+	MsgHeartbeat
+	// MsgRegister is the first message of a slave, identifying it.
+	MsgRegister
+	// MsgRegistered answers MsgRegister.
+	MsgRegistered
+	// MsgConflict tells a slave that a write it applied before the master
+	// conflicts with the master's history.
+	MsgConflict
+)
+
+func (t MsgType) String() string {
+	switch t {
+	case MsgSetup:
+		return "SETUP"
+	case MsgHello:
+		return "HELLO"
+	case MsgReplicate:
+		return "REPLICATE"
+	case MsgForward:
+		return "FORWARD"
+	case MsgFullSyncRequest:
+		return "FULL_SYNC_REQUEST"
+	case MsgSyncManifest:
+		return "SYNC_MANIFEST"
+	case MsgSyncChunk:
+		return "SYNC_CHUNK"
+	case MsgSyncDone:
+		return "SYNC_DONE"
+	case MsgShardMap:
+		return "SHARD_MAP"
+	case MsgOK:
+		return "OK"
+	case MsgAck:
+		return "ACK"
+	case MsgResult:
+		return "RESULT"
+	case MsgError:
+		return "ERROR"
+	case MsgWelcome:
+		return "WELCOME"
+	case MsgPeers:
+		return "PEERS"
+	case MsgHeartbeat:
+		return "HEARTBEAT"
+	case MsgRegister:
+		return "REGISTER"
+	case MsgRegistered:
+		return "REGISTERED"
+	case MsgConflict:
+		return "CONFLICT"
+	}
+	return fmt.Sprintf("MsgType(%d)", byte(t))
+}
+
+// Statement is a SQL statement bound to the database it must run in.
+// WriteConcern is only used for forwarded writes and names how many
+// replicas must confirm the write before the master replies.
+//
+// A slave forwards a write either after applying it itself, with the rows
+// it affected and BaseLSN, the last log entry it had applied by then, or
+// with Forward set, in which case it applies the write only once it is
+// replicated back. ID, when set, is repeated in the master's reply so the
+// slave can hand it to the client waiting for it. Vars are the SET
+// statements of the client's session, to run before the write.
+type Statement struct {
+	ID           uint64   `json:"id,omitempty"`
+	DB           string   `json:"db"`
+	Query        string   `json:"query"`
+	Vars         []string `json:"vars,omitempty"`
+	WriteConcern string   `json:"write_concern,omitempty"`
+	Forward      bool     `json:"forward,omitempty"`
+	BaseLSN      uint64   `json:"base_lsn,omitempty"`
+	Rows         int64    `json:"rows,omitempty"`
+}
+
+// LogEntry is a statement from the master's replication log. LSNs start at 1
+// and increase by one for every mutating statement. Shard, when set, pins
+// the statement to that shard instead of routing it through the shard map;
+// migrations copy and remove rows this way. Such a statement is skipped on a
+// node where the shard shares its MySQL server with shard Peer, which
+// already holds the same rows, unless Peer is the shard itself. Statements,
+// when set, are those of a committed transaction, to be applied together;
+// Query is then empty. Vars are the SET statements of the session that ran
+// the statement, which a node applying it runs first in a session of its
+// own. Origin is the node ID of the slave that applied the statement before
+// forwarding it, if any.
+type LogEntry struct {
+	LSN        uint64   `json:"lsn"`
+	DB         string   `json:"db"`
+	Query      string   `json:"query"`
+	Vars       []string `json:"vars,omitempty"`
+	Shard      *int     `json:"shard,omitempty"`
+	Peer       int      `json:"peer,omitempty"`
+	Statements []string `json:"statements,omitempty"`
+	Origin     string   `json:"origin,omitempty"`
+}
+
+// Replicate is the payload of MsgReplicate. Applied is set when the
+// receiving slave originated the write and already executed it, so it only
+// needs to advance its position.
+type Replicate struct {
+	LogEntry
+	Applied bool `json:"applied,omitempty"`
+}
+
+// Hello is the payload of MsgHello. A slave with HasPosition set has applied
+// every entry up to LastLSN and only needs the entries after it; otherwise
+// it needs a snapshot, optionally resuming an interrupted one at ResumeFrom.
+// Epoch is the newest master epoch the slave has followed.
+type Hello struct {
+	LastLSN     uint64 `json:"last_lsn"`
+	HasPosition bool   `json:"has_position"`
+	ResumeFrom  int    `json:"resume_from"`
+	Epoch       uint64 `json:"epoch"`
+}
+
+// Welcome is the payload of MsgWelcome. The epoch grows every time a slave
+// is promoted to master. Addr is the slave's HTTP address as the master
+// sees it, which is how the other slaves reach it, and HTTPPort the port of
+// the master's own HTTP server.
+type Welcome struct {
+	Epoch    uint64 `json:"epoch"`
+	Addr     string `json:"addr"`
+	HTTPPort string `json:"http_port"`
+}
+
+// Peers is the payload of MsgPeers. Hosts are host:port HTTP addresses.
+type Peers struct {
+	Hosts []string `json:"hosts"`
+}
+
+// Fence records that a master was replaced by a newer one at Master (its
+// replication address), with a higher epoch. A fenced master refuses writes.
+type Fence struct {
+	Epoch  uint64 `json:"epoch"`
+	Master string `json:"master"`
+}
+
+// Heartbeat is the payload of MsgHeartbeat. LSN is the sender's newest log
+// entry (the master) or last applied entry (a slave), and Status its health
+// as shown by its status endpoint.
+type Heartbeat struct {
+	NodeID string `json:"node_id"`
+	LSN    uint64 `json:"lsn"`
+	Status string `json:"status"`
+}
+
+// Register is the payload of MsgRegister. NodeID is generated once by the
+// slave and kept across restarts, so the master recognizes it whatever
+// address it connects from.
+type Register struct {
+	NodeID       string   `json:"node_id"`
+	Version      int      `json:"version"`
+	Capabilities []string `json:"capabilities"`
+	// HTTPPort is the port of the slave's HTTP server and Shards the
+	// number of shards it is configured with.
+	HTTPPort string `json:"http_port"`
+	Shards   int    `json:"shards"`
+}
+
+// Registered is the payload of MsgRegistered. Returning is set when the
+// master has registered the node before.
+type Registered struct {
+	NodeID    string    `json:"node_id"`
+	Returning bool      `json:"returning"`
+	FirstSeen time.Time `json:"first_seen"`
+}
+
+// Promotion is left by a slave that is being promoted for master.go to
+// pick up with -promote. The new master continues the replication log after
+// LSN, takes over the slaves in Peers and fences OldMaster.
+type Promotion struct {
+	Epoch     uint64   `json:"epoch"`
+	LSN       uint64   `json:"lsn"`
+	Self      string   `json:"self"`
+	Peers     []string `json:"peers"`
+	OldMaster string   `json:"old_master"`
+}
+
+// Ack is the payload of MsgAck. Error is set if the slave failed to apply
+// the entry.
+type Ack struct {
+	LSN   uint64 `json:"lsn"`
+	Error string `json:"error,omitempty"`
+}
+
+// Result is the reply to a forwarded statement, carrying the ID of the
+// statement. LastInsertID is the first AUTO_INCREMENT value an INSERT
+// generated, if any. Replicas lists the slaves that confirmed the write
+// under the requested write concern; if there were too few, Error says so
+// although the write is executed and logged.
+type Result struct {
+	ID           uint64   `json:"id,omitempty"`
+	Message      string   `json:"message"`
+	RowsAffected int64    `json:"rows_affected"`
+	LastInsertID int64    `json:"last_insert_id,omitempty"`
+	LSN          uint64   `json:"lsn"`
+	Replicas     []string `json:"replicas,omitempty"`
+	Error        string   `json:"error,omitempty"`
+}
+
+// Conflict is the payload of MsgConflict: a write the slave applied itself
+// may have left its data different from the master's, for Reason. The
+// slave repairs the tables the write touched, so that the master's outcome
+// wins.
+type Conflict struct {
+	LSN    uint64 `json:"lsn,omitempty"`
+	DB     string `json:"db"`
+	Query  string `json:"query"`
+	Reason string `json:"reason"`
+}
+
+// Error is the payload of MsgError. ID is that of the forwarded statement
+// that failed, if any.
+type Error struct {
+	ID      uint64 `json:"id,omitempty"`
+	Message string `json:"message"`
+}
+
+// FullSyncRequest asks for a snapshot. A non-zero ResumeFrom skips the
+// chunks the slave already applied during an interrupted transfer. Tables,
+// when set, asks for a repair instead: a snapshot of those tables only,
+// whose row counts are ignored.
+type FullSyncRequest struct {
+	ResumeFrom int         `json:"resume_from"`
+	Tables     []SyncTable `json:"tables,omitempty"`
+}
+
+// SyncTable describes one table contained in a snapshot.
+type SyncTable struct {
+	DB    string `json:"db"`
+	Table string `json:"table"`
+	Rows  int64  `json:"rows"`
+}
+
+// SyncManifest is sent before the first chunk of a snapshot. The snapshot
+// contains every log entry up to and including LSN. A repair snapshot only
+// replaces the tables it lists; the slave was sent every log entry up to LSN
+// before it and is sent those after LSN once it is done.
+type SyncManifest struct {
+	LSN        uint64      `json:"lsn"`
+	Databases  []string    `json:"databases"`
+	Tables     []SyncTable `json:"tables"`
+	ResumeFrom int         `json:"resume_from"`
+	Repair     bool        `json:"repair,omitempty"`
+}
+
+// SyncChunk is a numbered batch of statements for a single table. A chunk
+// with an empty Table creates its database. RowsDone counts the rows of the
+// table sent so far, including this chunk.
+type SyncChunk struct {
+	Seq        int      `json:"seq"`
+	DB         string   `json:"db"`
+	Table      string   `json:"table"`
+	Statements []string `json:"statements"`
+	RowsDone   int64    `json:"rows_done"`
+}
+
+// Hash feeds the chunk into a running snapshot checksum. Master and slave
+// must hash chunks identically for the final checksum to match.
+func (c *SyncChunk) Hash(h hash.Hash) {
+	fmt.Fprintf(h, "%d\x00%s\x00%s\x00", c.Seq, c.DB, c.Table)
+	for _, stmt := range c.Statements {
+		h.Write([]byte(stmt))
+		h.Write([]byte{0})
+	}
+}
+
+// SyncDone closes a snapshot. Checksum is the hex SHA-256 over every chunk
+// of the snapshot, including any skipped because of ResumeFrom.
+type SyncDone struct {
+	Chunks   int    `json:"chunks"`
+	Checksum string `json:"checksum"`
+}
+
+// Message is a decoded frame.
+type Message struct {
+	Type    MsgType
+	Payload []byte
+}
+
+// Decode unmarshals the JSON payload into v.
+func (m *Message) Decode(v interface{}) error {
+	if err := json.Unmarshal(m.Payload, v); err != nil {
+		return fmt.Errorf("decoding %s payload: %w", m.Type, err)
+	}
+	return nil
+}
+
+// WriteFrame writes a single frame to w.
+func WriteFrame(w io.Writer, t MsgType, payload []byte) error {
+	if len(payload)+1 > MaxFrameSize {
+		return fmt.Errorf("frame of %d bytes exceeds limit of %d", len(payload)+1, MaxFrameSize)
+	}
+	buf := make([]byte, 5+len(payload))
+	binary.BigEndian.PutUint32(buf[:4], uint32(len(payload)+1))
+	buf[4] = byte(t)
+	copy(buf[5:], payload)
+	_, err := w.Write(buf)
+	return err
+}
+
+// ReadFrame reads a single frame from r.
+func ReadFrame(r io.Reader) (*Message, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(r, header[:4]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(header[:4])
+	if size == 0 || size > MaxFrameSize {
+		return nil, fmt.Errorf("invalid frame length %d", size)
+	}
+	if _, err := io.ReadFull(r, header[4:5]); err != nil {
+		return nil, err
+	}
+	payload := make([]byte, size-1)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	return &Message{Type: MsgType(header[4]), Payload: payload}, nil
+}
+
+// Conn wraps a net.Conn with framed reads and writes. Send is safe for
+// concurrent use; Receive must only be called from a single goroutine.
+type Conn struct {
+	net.Conn
+	r            *bufio.Reader
+	wmu          sync.Mutex
+	writeTimeout time.Duration
+}
+
+// NewConn wraps c for framed messaging. A frame that cannot be written
+// within writeTimeout, if set, fails the Send: the peer is gone or stuck.
+func NewConn(c net.Conn, writeTimeout time.Duration) *Conn {
+	return &Conn{Conn: c, r: bufio.NewReader(c), writeTimeout: writeTimeout}
+}
+
+// Send JSON-encodes v and writes it as a single frame of type t. A failed
+// write closes the connection, since the peer could not make sense of
+// what follows a partly written frame.
+func (c *Conn) Send(t MsgType, v interface{}) error {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("encoding %s payload: %w", t, err)
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.writeTimeout > 0 {
+		c.Conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	}
+	if err := WriteFrame(c.Conn, t, payload); err != nil {
+		c.Conn.Close()
+		return err
+	}
+	return nil
+}
+
+// SendError is a shorthand for sending an Error payload.
+func (c *Conn) SendError(msg string) error {
+	return c.Send(MsgError, Error{Message: msg})
+}
+
+// Receive reads the next frame.
+func (c *Conn) Receive() (*Message, error) {
+	return ReadFrame(c.r)
+}
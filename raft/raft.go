@@ -0,0 +1,795 @@
+// Package raft is a small implementation of the Raft consensus algorithm.
+// A fixed set of nodes elects a leader, which replicates the commands
+// proposed to it through a log; once a majority has stored a command it is
+// committed and applied, in log order, to each node's state machine.
+//
+// The log is compacted into a state machine snapshot every
+// SnapshotThreshold entries, and followers that fall behind the snapshot
+// receive it whole. Nodes talk JSON over HTTP (see Handler).
+package raft
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrNotLeader is returned by Propose on a node that is not the leader,
+	// or when leadership was lost before the command was committed.
+	ErrNotLeader = errors.New("raft: not the leader")
+	// ErrTimeout is returned by Propose when a command is not committed in
+	// time, typically because no majority is reachable.
+	ErrTimeout = errors.New("raft: timed out waiting for commit")
+)
+
+// Entry is one command in the replicated log. Entries without data are
+// appended by new leaders and never reach the state machine.
+type Entry struct {
+	Index uint64 `json:"index"`
+	Term  uint64 `json:"term"`
+	Data  []byte `json:"data,omitempty"`
+}
+
+// FSM is the replicated state machine. Apply is called for every committed
+// command in log order; Snapshot and Restore save and load its whole state.
+// They are never called concurrently.
+type FSM interface {
+	Apply(data []byte)
+	Snapshot() ([]byte, error)
+	Restore(data []byte) error
+}
+
+// Config describes a node and its cluster.
+type Config struct {
+	// ID names this node; Peers maps the ID of every node, this one
+	// included, to the host:port its Raft handler listens on.
+	ID    string
+	Peers map[string]string
+	// Dir holds the node's term, vote, log and snapshot.
+	Dir string
+	FSM FSM
+
+	// A follower that hears nothing from a leader for ElectionTimeout
+	// (plus a random amount up to as much again) starts an election.
+	ElectionTimeout   time.Duration
+	HeartbeatInterval time.Duration
+	SnapshotThreshold uint64
+
+	// CanCampaign, if set, is asked before starting an election; a node
+	// for which it returns false only votes. Priority, if set, is sent with
+	// vote requests, and a node never votes for a candidate whose priority
+	// is below its own. Both are called with the node's lock held and must
+	// not call back into it.
+	CanCampaign func() bool
+	Priority    func() uint64
+	// OnLeader is called from its own goroutine whenever the known leader
+	// changes; leader is empty while there is none.
+	OnLeader func(leader string, term uint64)
+}
+
+type role int
+
+const (
+	follower role = iota
+	candidate
+	leader
+)
+
+func (r role) String() string {
+	switch r {
+	case candidate:
+		return "candidate"
+	case leader:
+		return "leader"
+	}
+	return "follower"
+}
+
+// Status describes a node's view of the cluster.
+type Status struct {
+	ID          string            `json:"id"`
+	Role        string            `json:"role"`
+	Term        uint64            `json:"term"`
+	Leader      string            `json:"leader"`
+	LeaderAddr  string            `json:"leader_addr"`
+	CommitIndex uint64            `json:"commit_index"`
+	Applied     uint64            `json:"applied_index"`
+	LastIndex   uint64            `json:"last_index"`
+	Snapshot    uint64            `json:"snapshot_index"`
+	Peers       map[string]string `json:"peers"`
+}
+
+type waiter struct {
+	term uint64
+	done chan error
+}
+
+// Node is a running Raft node.
+type Node struct {
+	cfg    Config
+	store  *storage
+	client *http.Client
+	server *http.Server
+
+	// applyMu is held while the state machine is being changed; it is
+	// always taken before mu.
+	applyMu sync.Mutex
+	mu      sync.Mutex
+	commit  *sync.Cond // signalled when commitIndex advances
+
+	role     role
+	term     uint64
+	votedFor string
+	// log[0] stands for the last entry covered by the snapshot; only its
+	// index and term are kept.
+	log         []Entry
+	snapshot    []byte
+	commitIndex uint64
+	lastApplied uint64
+
+	leader        string
+	lastContact   time.Time // last message from a leader, or vote granted
+	timeout       time.Duration
+	leaderSince   time.Time
+	lastBroadcast time.Time
+	nextIndex     map[string]uint64
+	matchIndex    map[string]uint64
+	lastAck       map[string]time.Time
+	sending       map[string]bool
+	waiters       map[uint64]waiter
+	notify        chan struct{}
+	stopped       bool
+}
+
+// Start restores the node's saved state, starts serving the Raft RPCs on
+// the port of its own address and joins the cluster as a follower.
+func Start(cfg Config) (*Node, error) {
+	addr, ok := cfg.Peers[cfg.ID]
+	if !ok {
+		return nil, fmt.Errorf("raft: node %q is not one of the peers", cfg.ID)
+	}
+	if cfg.ElectionTimeout == 0 {
+		cfg.ElectionTimeout = time.Second
+	}
+	if cfg.HeartbeatInterval == 0 {
+		cfg.HeartbeatInterval = cfg.ElectionTimeout / 5
+	}
+	if cfg.SnapshotThreshold == 0 {
+		cfg.SnapshotThreshold = 1000
+	}
+
+	store, err := openStorage(cfg.Dir)
+	if err != nil {
+		return nil, err
+	}
+	hs, snap, entries, err := store.load()
+	if err != nil {
+		return nil, err
+	}
+	n := &Node{
+		cfg:         cfg,
+		store:       store,
+		client:      &http.Client{Timeout: cfg.ElectionTimeout},
+		term:        hs.Term,
+		votedFor:    hs.VotedFor,
+		log:         append([]Entry{{Index: snap.Index, Term: snap.Term}}, entries...),
+		snapshot:    snap.Data,
+		commitIndex: snap.Index,
+		lastApplied: snap.Index,
+		lastContact: time.Now(),
+		nextIndex:   make(map[string]uint64),
+		matchIndex:  make(map[string]uint64),
+		lastAck:     make(map[string]time.Time),
+		sending:     make(map[string]bool),
+		waiters:     make(map[uint64]waiter),
+		notify:      make(chan struct{}, 1),
+	}
+	n.commit = sync.NewCond(&n.mu)
+	n.resetTimer()
+	if snap.Data != nil {
+		if err := cfg.FSM.Restore(snap.Data); err != nil {
+			return nil, fmt.Errorf("raft: restoring snapshot: %w", err)
+		}
+	}
+
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ln, err := listen(":" + port)
+	if err != nil {
+		return nil, err
+	}
+	n.server = &http.Server{Handler: n.Handler()}
+	go n.server.Serve(ln)
+	go n.run()
+	go n.applyCommitted()
+	go n.notifyLeader()
+	return n, nil
+}
+
+// listen retries for a while, since the port may still be held by a
+// process handing over to this one.
+func listen(addr string) (net.Listener, error) {
+	var err error
+	for i := 0; i < 20; i++ {
+		var ln net.Listener
+		if ln, err = net.Listen("tcp", addr); err == nil {
+			return ln, nil
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	return nil, err
+}
+
+// Stop shuts the node down.
+func (n *Node) Stop() {
+	n.mu.Lock()
+	n.stopped = true
+	n.role = follower
+	n.commit.Broadcast()
+	n.mu.Unlock()
+	n.server.Close()
+	n.store.close()
+}
+
+// Status returns the node's view of the cluster.
+func (n *Node) Status() Status {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return Status{
+		ID:          n.cfg.ID,
+		Role:        n.role.String(),
+		Term:        n.term,
+		Leader:      n.leader,
+		LeaderAddr:  n.cfg.Peers[n.leader],
+		CommitIndex: n.commitIndex,
+		Applied:     n.lastApplied,
+		LastIndex:   n.lastIndex(),
+		Snapshot:    n.log[0].Index,
+		Peers:       n.cfg.Peers,
+	}
+}
+
+// IsLeader reports whether this node is the leader.
+func (n *Node) IsLeader() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.role == leader
+}
+
+// Leader returns the ID of the current leader, or "" if none is known.
+func (n *Node) Leader() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.leader
+}
+
+// Propose replicates a command and waits until it has been applied to this
+// node's state machine. It fails with ErrNotLeader on followers.
+func (n *Node) Propose(data []byte) error {
+	n.mu.Lock()
+	if n.role != leader {
+		n.mu.Unlock()
+		return ErrNotLeader
+	}
+	e := n.appendLocal(data)
+	done := make(chan error, 1)
+	n.waiters[e.Index] = waiter{term: e.Term, done: done}
+	n.broadcast()
+	n.mu.Unlock()
+
+	timer := time.NewTimer(5 * n.cfg.ElectionTimeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		n.mu.Lock()
+		delete(n.waiters, e.Index)
+		n.mu.Unlock()
+		return ErrTimeout
+	}
+}
+
+func (n *Node) logf(format string, args ...interface{}) {
+	log.Printf("raft %s: "+format, append([]interface{}{n.cfg.ID}, args...)...)
+}
+
+func (n *Node) lastIndex() uint64 {
+	return n.log[len(n.log)-1].Index
+}
+
+// termAt returns the term of the entry at index, which must not be before
+// the snapshot or after the end of the log.
+func (n *Node) termAt(index uint64) uint64 {
+	return n.log[index-n.log[0].Index].Term
+}
+
+func (n *Node) resetTimer() {
+	n.lastContact = time.Now()
+	n.timeout = n.cfg.ElectionTimeout + time.Duration(rand.Int63n(int64(n.cfg.ElectionTimeout)))
+}
+
+func (n *Node) persistState() {
+	if err := n.store.saveState(hardState{Term: n.term, VotedFor: n.votedFor}); err != nil {
+		n.logf("error saving state: %v", err)
+	}
+}
+
+func (n *Node) setLeader(id string) {
+	if n.leader == id {
+		return
+	}
+	n.leader = id
+	select {
+	case n.notify <- struct{}{}:
+	default:
+	}
+}
+
+// notifyLeader delivers leader changes to OnLeader, skipping any that were
+// superseded before it got to them.
+func (n *Node) notifyLeader() {
+	var last string
+	var lastTerm uint64
+	for range n.notify {
+		n.mu.Lock()
+		id, term, stopped := n.leader, n.term, n.stopped
+		n.mu.Unlock()
+		if stopped {
+			return
+		}
+		if (id != last || term != lastTerm) && n.cfg.OnLeader != nil {
+			n.cfg.OnLeader(id, term)
+		}
+		last, lastTerm = id, term
+	}
+}
+
+// stepDown makes the node a follower, in term if that is newer.
+func (n *Node) stepDown(term uint64) {
+	if term > n.term {
+		n.term = term
+		n.votedFor = ""
+		n.persistState()
+		n.setLeader("")
+	}
+	if n.role != follower {
+		if n.role == leader {
+			n.setLeader("")
+		}
+		n.role = follower
+		n.resetTimer()
+	}
+}
+
+// run drives elections and heartbeats.
+func (n *Node) run() {
+	ticker := time.NewTicker(n.cfg.HeartbeatInterval / 4)
+	defer ticker.Stop()
+	for range ticker.C {
+		n.mu.Lock()
+		if n.stopped {
+			n.mu.Unlock()
+			return
+		}
+		switch {
+		case n.role == leader && !n.hasQuorum():
+			// Cut off from the majority; a new leader may already exist
+			n.logf("lost contact with the majority, stepping down in term %d", n.term)
+			n.stepDown(n.term)
+		case n.role == leader:
+			if time.Since(n.lastBroadcast) >= n.cfg.HeartbeatInterval {
+				n.broadcast()
+			}
+		case time.Since(n.lastContact) >= n.timeout:
+			if n.cfg.CanCampaign == nil || n.cfg.CanCampaign() {
+				n.campaign()
+			} else {
+				n.resetTimer()
+			}
+		}
+		n.mu.Unlock()
+	}
+}
+
+// hasQuorum reports whether a leader has heard from a majority within the
+// election timeout.
+func (n *Node) hasQuorum() bool {
+	if time.Since(n.leaderSince) < n.cfg.ElectionTimeout {
+		return true
+	}
+	count := 1
+	for id := range n.cfg.Peers {
+		if id != n.cfg.ID && time.Since(n.lastAck[id]) < n.cfg.ElectionTimeout {
+			count++
+		}
+	}
+	return count*2 > len(n.cfg.Peers)
+}
+
+func (n *Node) campaign() {
+	n.term++
+	n.role = candidate
+	n.votedFor = n.cfg.ID
+	n.setLeader("")
+	n.persistState()
+	n.resetTimer()
+
+	req := voteRequest{
+		Term:      n.term,
+		Candidate: n.cfg.ID,
+		LastIndex: n.lastIndex(),
+		LastTerm:  n.termAt(n.lastIndex()),
+	}
+	if n.cfg.Priority != nil {
+		req.Priority = n.cfg.Priority()
+	}
+	votes := 1
+	if votes*2 > len(n.cfg.Peers) {
+		n.becomeLeader()
+		return
+	}
+	for id := range n.cfg.Peers {
+		if id == n.cfg.ID {
+			continue
+		}
+		go func(id string) {
+			var resp voteResponse
+			if err := n.call(id, "/raft/vote", req, &resp); err != nil {
+				return
+			}
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			if resp.Term > n.term {
+				n.stepDown(resp.Term)
+				return
+			}
+			if n.role != candidate || n.term != req.Term || !resp.Granted {
+				return
+			}
+			votes++
+			if votes*2 > len(n.cfg.Peers) {
+				n.becomeLeader()
+			}
+		}(id)
+	}
+}
+
+func (n *Node) becomeLeader() {
+	n.logf("elected leader in term %d", n.term)
+	n.role = leader
+	n.setLeader(n.cfg.ID)
+	n.leaderSince = time.Now()
+	for id := range n.cfg.Peers {
+		n.nextIndex[id] = n.lastIndex() + 1
+		n.matchIndex[id] = 0
+		n.lastAck[id] = time.Time{}
+	}
+	// Entries from earlier terms only commit along with one of this term
+	n.appendLocal(nil)
+	n.broadcast()
+}
+
+func (n *Node) appendLocal(data []byte) Entry {
+	e := Entry{Index: n.lastIndex() + 1, Term: n.term, Data: data}
+	n.log = append(n.log, e)
+	if err := n.store.appendEntries([]Entry{e}); err != nil {
+		n.logf("error saving log entry %d: %v", e.Index, err)
+	}
+	return e
+}
+
+// broadcast sends every follower the entries it is missing, or a heartbeat.
+func (n *Node) broadcast() {
+	n.lastBroadcast = time.Now()
+	for id := range n.cfg.Peers {
+		if id != n.cfg.ID && !n.sending[id] {
+			n.sending[id] = true
+			go n.replicate(id)
+		}
+	}
+	n.advanceCommit()
+}
+
+// replicate brings one follower up to date. Only one replicate runs per
+// follower at a time.
+func (n *Node) replicate(id string) {
+	for {
+		n.mu.Lock()
+		if n.role != leader || n.stopped {
+			n.sending[id] = false
+			n.mu.Unlock()
+			return
+		}
+		term := n.term
+		next := n.nextIndex[id]
+		var err error
+		if next <= n.log[0].Index {
+			req := snapshotRequest{Term: term, Leader: n.cfg.ID, Index: n.log[0].Index, Last: n.log[0].Term, Data: n.snapshot}
+			n.mu.Unlock()
+			var resp snapshotResponse
+			err = n.call(id, "/raft/snapshot", req, &resp)
+			n.mu.Lock()
+			if err == nil {
+				if resp.Term > n.term {
+					n.stepDown(resp.Term)
+				} else if n.role == leader && n.term == term {
+					n.lastAck[id] = time.Now()
+					n.matchIndex[id] = max(n.matchIndex[id], req.Index)
+					n.nextIndex[id] = max(n.nextIndex[id], req.Index+1)
+				}
+			}
+		} else {
+			req := appendRequest{
+				Term:         term,
+				Leader:       n.cfg.ID,
+				PrevIndex:    next - 1,
+				PrevTerm:     n.termAt(next - 1),
+				LeaderCommit: n.commitIndex,
+			}
+			end := min(n.lastIndex(), next+255)
+			req.Entries = append([]Entry(nil), n.log[next-n.log[0].Index:end-n.log[0].Index+1]...)
+			n.mu.Unlock()
+			var resp appendResponse
+			err = n.call(id, "/raft/append", req, &resp)
+			n.mu.Lock()
+			if err == nil {
+				if resp.Term > n.term {
+					n.stepDown(resp.Term)
+				} else if n.role == leader && n.term == term {
+					n.lastAck[id] = time.Now()
+					if resp.Success {
+						match := req.PrevIndex + uint64(len(req.Entries))
+						n.matchIndex[id] = max(n.matchIndex[id], match)
+						n.nextIndex[id] = max(n.nextIndex[id], match+1)
+						n.advanceCommit()
+					} else {
+						n.nextIndex[id] = max(1, min(resp.Next, n.lastIndex()+1))
+					}
+				}
+			}
+		}
+		more := err == nil && n.role == leader && n.nextIndex[id] <= n.lastIndex()
+		if !more {
+			n.sending[id] = false
+			n.mu.Unlock()
+			return
+		}
+		n.mu.Unlock()
+	}
+}
+
+// advanceCommit commits the newest entry of the current term stored on a
+// majority, and with it every entry before it.
+func (n *Node) advanceCommit() {
+	for index := n.lastIndex(); index > n.commitIndex && n.termAt(index) == n.term; index-- {
+		count := 1
+		for id := range n.cfg.Peers {
+			if id != n.cfg.ID && n.matchIndex[id] >= index {
+				count++
+			}
+		}
+		if count*2 > len(n.cfg.Peers) {
+			n.commitIndex = index
+			n.commit.Broadcast()
+			return
+		}
+	}
+}
+
+func (n *Node) handleVote(req *voteRequest) *voteResponse {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	resp := &voteResponse{Term: n.term}
+	// A node that still hears from a leader ignores candidates, so a node
+	// that was cut off cannot depose a healthy leader when it returns
+	switch {
+	case n.role == leader && n.hasQuorum():
+		return resp
+	case n.role == follower && n.leader != "" && time.Since(n.lastContact) < n.cfg.ElectionTimeout:
+		return resp
+	case req.Term < n.term:
+		return resp
+	}
+	if req.Term > n.term {
+		n.stepDown(req.Term)
+		resp.Term = n.term
+	}
+
+	lastTerm := n.termAt(n.lastIndex())
+	upToDate := req.LastTerm > lastTerm || req.LastTerm == lastTerm && req.LastIndex >= n.lastIndex()
+	if n.cfg.Priority != nil && req.Priority < n.cfg.Priority() {
+		upToDate = false
+	}
+	if (n.votedFor == "" || n.votedFor == req.Candidate) && upToDate {
+		n.votedFor = req.Candidate
+		n.persistState()
+		n.resetTimer()
+		resp.Granted = true
+	}
+	return resp
+}
+
+func (n *Node) handleAppend(req *appendRequest) *appendResponse {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	resp := &appendResponse{Term: n.term}
+	if req.Term < n.term {
+		return resp
+	}
+	n.stepDown(req.Term)
+	resp.Term = n.term
+	n.resetTimer()
+	n.setLeader(req.Leader)
+
+	// Entries covered by the snapshot are committed and known to match
+	snapIndex := n.log[0].Index
+	entries := req.Entries
+	if req.PrevIndex < snapIndex {
+		for len(entries) > 0 && entries[0].Index <= snapIndex {
+			entries = entries[1:]
+		}
+		req.PrevIndex, req.PrevTerm = snapIndex, n.log[0].Term
+	}
+	if req.PrevIndex > n.lastIndex() {
+		resp.Next = n.lastIndex() + 1
+		return resp
+	}
+	if conflict := n.termAt(req.PrevIndex); conflict != req.PrevTerm {
+		// Skip back over the whole conflicting term
+		index := req.PrevIndex
+		for index > snapIndex+1 && n.termAt(index-1) == conflict {
+			index--
+		}
+		resp.Next = index
+		return resp
+	}
+
+	truncated := false
+	var added []Entry
+	for i, e := range entries {
+		if e.Index <= n.lastIndex() {
+			if n.termAt(e.Index) == e.Term {
+				continue
+			}
+			n.log = n.log[:e.Index-snapIndex]
+			truncated = true
+		}
+		added = entries[i:]
+		break
+	}
+	n.log = append(n.log, added...)
+	var err error
+	if truncated {
+		err = n.store.rewrite(n.log[1:])
+	} else if len(added) > 0 {
+		err = n.store.appendEntries(added)
+	}
+	if err != nil {
+		n.logf("error saving log: %v", err)
+		return resp
+	}
+
+	if last := req.PrevIndex + uint64(len(entries)); req.LeaderCommit > n.commitIndex {
+		n.commitIndex = max(n.commitIndex, min(req.LeaderCommit, last))
+		n.commit.Broadcast()
+	}
+	resp.Success = true
+	return resp
+}
+
+func (n *Node) handleSnapshot(req *snapshotRequest) *snapshotResponse {
+	n.applyMu.Lock()
+	defer n.applyMu.Unlock()
+	n.mu.Lock()
+	resp := &snapshotResponse{Term: n.term}
+	if req.Term < n.term {
+		n.mu.Unlock()
+		return resp
+	}
+	n.stepDown(req.Term)
+	resp.Term = n.term
+	n.resetTimer()
+	n.setLeader(req.Leader)
+	if req.Index <= n.lastApplied {
+		n.mu.Unlock()
+		return resp
+	}
+	n.mu.Unlock()
+
+	if err := n.cfg.FSM.Restore(req.Data); err != nil {
+		n.logf("error restoring snapshot %d: %v", req.Index, err)
+		return resp
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	sentinel := Entry{Index: req.Index, Term: req.Last}
+	if req.Index <= n.lastIndex() && n.termAt(req.Index) == req.Last {
+		n.log = append([]Entry{sentinel}, n.log[req.Index-n.log[0].Index+1:]...)
+	} else {
+		n.log = []Entry{sentinel}
+	}
+	n.snapshot = req.Data
+	n.lastApplied = req.Index
+	n.commitIndex = max(n.commitIndex, req.Index)
+	n.saveSnapshot()
+	n.logf("installed snapshot at index %d", req.Index)
+	return resp
+}
+
+func (n *Node) saveSnapshot() {
+	err := n.store.saveSnapshot(snapshotFile{Index: n.log[0].Index, Term: n.log[0].Term, Data: n.snapshot})
+	if err == nil {
+		err = n.store.rewrite(n.log[1:])
+	}
+	if err != nil {
+		n.logf("error saving snapshot: %v", err)
+	}
+}
+
+// applyCommitted feeds committed entries to the state machine, answers the
+// proposals waiting for them and compacts the log.
+func (n *Node) applyCommitted() {
+	for {
+		n.mu.Lock()
+		for n.lastApplied >= n.commitIndex && !n.stopped {
+			n.commit.Wait()
+		}
+		if n.stopped {
+			n.mu.Unlock()
+			return
+		}
+		n.mu.Unlock()
+
+		n.applyMu.Lock()
+		n.mu.Lock()
+		first, last := n.lastApplied+1, n.commitIndex
+		base := n.log[0].Index
+		entries := append([]Entry(nil), n.log[first-base:last-base+1]...)
+		n.mu.Unlock()
+
+		for _, e := range entries {
+			if len(e.Data) > 0 {
+				n.cfg.FSM.Apply(e.Data)
+			}
+		}
+
+		n.mu.Lock()
+		n.lastApplied = max(n.lastApplied, last)
+		for _, e := range entries {
+			if w, ok := n.waiters[e.Index]; ok {
+				if w.term == e.Term {
+					w.done <- nil
+				} else {
+					w.done <- ErrNotLeader
+				}
+				delete(n.waiters, e.Index)
+			}
+		}
+		compact := n.lastApplied-n.log[0].Index >= n.cfg.SnapshotThreshold
+		n.mu.Unlock()
+
+		if compact {
+			data, err := n.cfg.FSM.Snapshot()
+			n.mu.Lock()
+			if err != nil {
+				n.logf("error taking snapshot: %v", err)
+			} else if last > n.log[0].Index {
+				n.log = append([]Entry{{Index: last, Term: n.termAt(last)}}, n.log[last-n.log[0].Index+1:]...)
+				n.snapshot = data
+				n.saveSnapshot()
+			}
+			n.mu.Unlock()
+		}
+		n.applyMu.Unlock()
+	}
+}
@@ -0,0 +1,420 @@
+package raft
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memFSM records the commands applied to it.
+type memFSM struct {
+	mu       sync.Mutex
+	commands []string
+}
+
+func (f *memFSM) Apply(data []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.commands = append(f.commands, string(data))
+}
+
+func (f *memFSM) Snapshot() ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return json.Marshal(f.commands)
+}
+
+func (f *memFSM) Restore(data []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.commands = nil
+	return json.Unmarshal(data, &f.commands)
+}
+
+func (f *memFSM) applied() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.commands...)
+}
+
+// cluster is a set of nodes talking over loopback HTTP.
+type cluster struct {
+	t     *testing.T
+	peers map[string]string
+	dirs  map[string]string
+	nodes map[string]*Node
+	fsms  map[string]*memFSM
+	cfg   func(*Config)
+}
+
+func newCluster(t *testing.T, size int, cfg func(*Config)) *cluster {
+	t.Helper()
+	c := &cluster{t: t, peers: map[string]string{}, dirs: map[string]string{},
+		nodes: map[string]*Node{}, fsms: map[string]*memFSM{}, cfg: cfg}
+	for i := 1; i <= size; i++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		id := fmt.Sprintf("n%d", i)
+		c.peers[id] = ln.Addr().String()
+		c.dirs[id] = t.TempDir()
+		ln.Close()
+	}
+	for id := range c.peers {
+		c.start(id)
+	}
+	t.Cleanup(func() {
+		for _, n := range c.nodes {
+			n.Stop()
+		}
+	})
+	return c
+}
+
+// start starts a node, or restarts it from its saved state.
+func (c *cluster) start(id string) {
+	c.t.Helper()
+	c.fsms[id] = &memFSM{}
+	cfg := Config{ID: id, Peers: c.peers, Dir: c.dirs[id], FSM: c.fsms[id],
+		ElectionTimeout: 150 * time.Millisecond, HeartbeatInterval: 30 * time.Millisecond}
+	if c.cfg != nil {
+		c.cfg(&cfg)
+	}
+	n, err := Start(cfg)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	c.nodes[id] = n
+}
+
+func (c *cluster) stop(id string) {
+	c.nodes[id].Stop()
+	delete(c.nodes, id)
+}
+
+// leader waits until the running nodes agree on a leader among them, and
+// returns it.
+func (c *cluster) leader() (string, uint64) {
+	c.t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		var leader string
+		var term uint64
+		agreed := true
+		for id, n := range c.nodes {
+			st := n.Status()
+			if st.Role == "leader" {
+				leader, term = id, st.Term
+			}
+			if st.Leader == "" || (leader != "" && st.Leader != leader) {
+				agreed = false
+			}
+		}
+		if agreed && leader != "" && c.nodes[leader] != nil {
+			return leader, term
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	c.t.Fatal("no leader was elected")
+	return "", 0
+}
+
+// waitApplied waits until every running node applied want.
+func (c *cluster) waitApplied(want []string) {
+	c.t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		done := true
+		for id := range c.nodes {
+			if got := c.fsms[id].applied(); fmt.Sprint(got) != fmt.Sprint(want) {
+				done = false
+				if time.Now().After(deadline) {
+					c.t.Fatalf("node %s applied %q, want %q", id, got, want)
+				}
+			}
+		}
+		if done {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestElection(t *testing.T) {
+	c := newCluster(t, 3, nil)
+	leader, term := c.leader()
+	if term == 0 {
+		t.Errorf("leader %s elected in term 0", leader)
+	}
+	leaders := 0
+	for id, n := range c.nodes {
+		st := n.Status()
+		if st.Role == "leader" {
+			leaders++
+		}
+		if st.Leader != leader || st.LeaderAddr != c.peers[leader] {
+			t.Errorf("node %s follows %q at %q, want %s", id, st.Leader, st.LeaderAddr, leader)
+		}
+		if n.IsLeader() != (id == leader) {
+			t.Errorf("node %s IsLeader = %v", id, n.IsLeader())
+		}
+	}
+	if leaders != 1 {
+		t.Errorf("%d leaders, want 1", leaders)
+	}
+}
+
+func TestSingleNode(t *testing.T) {
+	c := newCluster(t, 1, nil)
+	leader, _ := c.leader()
+	if err := c.nodes[leader].Propose([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	c.waitApplied([]string{"a"})
+}
+
+func TestReplication(t *testing.T) {
+	c := newCluster(t, 3, nil)
+	leader, _ := c.leader()
+	var want []string
+	for i := 0; i < 20; i++ {
+		cmd := fmt.Sprint("cmd-", i)
+		if err := c.nodes[leader].Propose([]byte(cmd)); err != nil {
+			t.Fatalf("Propose(%s): %v", cmd, err)
+		}
+		want = append(want, cmd)
+	}
+	// Propose returns once the leader applied the command
+	if got := c.fsms[leader].applied(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("leader applied %q, want %q", got, want)
+	}
+	c.waitApplied(want)
+	for id, n := range c.nodes {
+		if id != leader {
+			if err := n.Propose([]byte("x")); err != ErrNotLeader {
+				t.Errorf("Propose on follower %s = %v, want ErrNotLeader", id, err)
+			}
+		}
+	}
+}
+
+func TestLeaderChange(t *testing.T) {
+	c := newCluster(t, 3, nil)
+	first, term := c.leader()
+	if err := c.nodes[first].Propose([]byte("before")); err != nil {
+		t.Fatal(err)
+	}
+	c.waitApplied([]string{"before"})
+
+	c.stop(first)
+	second, newTerm := c.leader()
+	if second == first {
+		t.Fatalf("stopped node %s is still the leader", first)
+	}
+	if newTerm <= term {
+		t.Errorf("new leader elected in term %d, not after term %d", newTerm, term)
+	}
+	if err := c.nodes[second].Propose([]byte("after")); err != nil {
+		t.Fatal(err)
+	}
+	c.waitApplied([]string{"before", "after"})
+
+	// The old leader rejoins as a follower and catches up
+	c.start(first)
+	c.waitApplied([]string{"before", "after"})
+	if st := c.nodes[first].Status(); st.Term < newTerm {
+		t.Errorf("old leader %s is in term %d, behind term %d", first, st.Term, newTerm)
+	}
+}
+
+func TestNoQuorum(t *testing.T) {
+	c := newCluster(t, 3, nil)
+	leader, _ := c.leader()
+	for id := range c.peers {
+		if id != leader {
+			c.stop(id)
+		}
+	}
+	if err := c.nodes[leader].Propose([]byte("lost")); err != ErrTimeout && err != ErrNotLeader {
+		t.Errorf("Propose without a majority = %v, want a timeout or lost leadership", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for c.nodes[leader].IsLeader() {
+		if time.Now().After(deadline) {
+			t.Fatal("leader cut off from the majority did not step down")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestSnapshotCatchUp(t *testing.T) {
+	c := newCluster(t, 3, func(cfg *Config) { cfg.SnapshotThreshold = 5 })
+	leader, _ := c.leader()
+	var behind string
+	for id := range c.peers {
+		if id != leader {
+			behind = id
+			break
+		}
+	}
+	c.stop(behind)
+	var want []string
+	for i := 0; i < 20; i++ {
+		cmd := fmt.Sprint("cmd-", i)
+		if err := c.nodes[leader].Propose([]byte(cmd)); err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, cmd)
+	}
+	if st := c.nodes[leader].Status(); st.Snapshot == 0 {
+		t.Fatalf("leader did not compact its log: %+v", st)
+	}
+	c.start(behind)
+	c.waitApplied(want)
+	if st := c.nodes[behind].Status(); st.Snapshot == 0 {
+		t.Errorf("lagging node caught up without installing a snapshot: %+v", st)
+	}
+
+	// A restarted node restores its snapshot and log
+	c.stop(behind)
+	c.start(behind)
+	c.waitApplied(want)
+}
+
+// newNode returns a node that is not connected to any peer, for calling
+// its RPC handlers directly.
+func newNode(t *testing.T, cfg Config) *Node {
+	t.Helper()
+	store, err := openStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ElectionTimeout == 0 {
+		cfg.ElectionTimeout = time.Second
+	}
+	n := &Node{
+		cfg:        cfg,
+		store:      store,
+		log:        []Entry{{}},
+		nextIndex:  make(map[string]uint64),
+		matchIndex: make(map[string]uint64),
+		lastAck:    make(map[string]time.Time),
+		sending:    make(map[string]bool),
+		waiters:    make(map[uint64]waiter),
+		notify:     make(chan struct{}, 1),
+	}
+	n.commit = sync.NewCond(&n.mu)
+	t.Cleanup(func() { store.close() })
+	return n
+}
+
+var threePeers = map[string]string{"a": "a:1", "b": "b:1", "c": "c:1"}
+
+func TestHandleVote(t *testing.T) {
+	n := newNode(t, Config{ID: "a", Peers: threePeers})
+	n.term = 3
+	n.log = []Entry{{}, {Index: 1, Term: 1}, {Index: 2, Term: 3}}
+
+	tests := []struct {
+		name    string
+		req     voteRequest
+		granted bool
+		term    uint64
+	}{
+		{"stale term", voteRequest{Term: 2, Candidate: "b", LastIndex: 9, LastTerm: 3}, false, 3},
+		{"older last term", voteRequest{Term: 4, Candidate: "b", LastIndex: 9, LastTerm: 2}, false, 4},
+		{"shorter log", voteRequest{Term: 4, Candidate: "b", LastIndex: 1, LastTerm: 3}, false, 4},
+		{"up to date", voteRequest{Term: 4, Candidate: "b", LastIndex: 2, LastTerm: 3}, true, 4},
+		{"second candidate of the term", voteRequest{Term: 4, Candidate: "c", LastIndex: 5, LastTerm: 3}, false, 4},
+		{"same candidate again", voteRequest{Term: 4, Candidate: "b", LastIndex: 2, LastTerm: 3}, true, 4},
+		{"next term", voteRequest{Term: 5, Candidate: "c", LastIndex: 2, LastTerm: 3}, true, 5},
+	}
+	for _, tt := range tests {
+		resp := n.handleVote(&tt.req)
+		if resp.Granted != tt.granted || resp.Term != tt.term {
+			t.Errorf("%s: vote %+v, want granted %v in term %d", tt.name, *resp, tt.granted, tt.term)
+		}
+	}
+	if n.role != follower || n.votedFor != "c" {
+		t.Errorf("after voting: role %s, voted for %q", n.role, n.votedFor)
+	}
+
+	// The vote survives a restart
+	hs, _, _, err := n.store.load()
+	if err != nil || hs.Term != 5 || hs.VotedFor != "c" {
+		t.Errorf("saved state %+v, %v, want term 5 voted for c", hs, err)
+	}
+}
+
+func TestHandleVotePriority(t *testing.T) {
+	n := newNode(t, Config{ID: "a", Peers: threePeers, Priority: func() uint64 { return 10 }})
+	if resp := n.handleVote(&voteRequest{Term: 1, Candidate: "b", Priority: 9}); resp.Granted {
+		t.Error("granted a vote to a candidate with a lower priority")
+	}
+	if resp := n.handleVote(&voteRequest{Term: 1, Candidate: "b", Priority: 10}); !resp.Granted {
+		t.Error("refused a vote to a candidate with the same priority")
+	}
+}
+
+func TestHandleVoteWithLeader(t *testing.T) {
+	n := newNode(t, Config{ID: "a", Peers: threePeers})
+	n.handleAppend(&appendRequest{Term: 1, Leader: "b"})
+	if resp := n.handleVote(&voteRequest{Term: 2, Candidate: "c"}); resp.Granted || resp.Term != 1 {
+		t.Errorf("follower of a live leader answered %+v, want the vote refused in term 1", *resp)
+	}
+}
+
+func TestHandleAppend(t *testing.T) {
+	n := newNode(t, Config{ID: "a", Peers: threePeers})
+	entries := func(terms ...uint64) []Entry {
+		var out []Entry
+		for i, term := range terms {
+			out = append(out, Entry{Index: uint64(i + 1), Term: term, Data: []byte(fmt.Sprint(i + 1))})
+		}
+		return out
+	}
+
+	resp := n.handleAppend(&appendRequest{Term: 1, Leader: "b", Entries: entries(1, 1, 1), LeaderCommit: 2})
+	if !resp.Success || n.lastIndex() != 3 || n.commitIndex != 2 || n.leader != "b" || n.term != 1 {
+		t.Fatalf("first append: %+v, last %d, commit %d, leader %q, term %d", *resp, n.lastIndex(), n.commitIndex, n.leader, n.term)
+	}
+
+	if resp := n.handleAppend(&appendRequest{Term: 0, Leader: "c"}); resp.Success || resp.Term != 1 {
+		t.Errorf("append from a stale term: %+v, want refused with term 1", *resp)
+	}
+
+	resp = n.handleAppend(&appendRequest{Term: 2, Leader: "c", PrevIndex: 5, PrevTerm: 2})
+	if resp.Success || resp.Next != 4 {
+		t.Errorf("append past the end: %+v, want refused with next 4", *resp)
+	}
+	if n.term != 2 || n.leader != "c" {
+		t.Errorf("newer leader not adopted: term %d, leader %q", n.term, n.leader)
+	}
+
+	resp = n.handleAppend(&appendRequest{Term: 2, Leader: "c", PrevIndex: 3, PrevTerm: 2})
+	if resp.Success || resp.Next != 1 {
+		t.Errorf("append after a conflicting term: %+v, want refused with next 1, the start of term 1", *resp)
+	}
+
+	// A new leader overwrites the uncommitted entry 3 of the old term
+	resp = n.handleAppend(&appendRequest{Term: 2, Leader: "c", PrevIndex: 2, PrevTerm: 1,
+		Entries: []Entry{{Index: 3, Term: 2, Data: []byte("x")}, {Index: 4, Term: 2}}, LeaderCommit: 4})
+	if !resp.Success || n.lastIndex() != 4 || n.termAt(3) != 2 || n.commitIndex != 4 {
+		t.Errorf("conflicting append: %+v, last %d, term of 3 %d, commit %d", *resp, n.lastIndex(), n.termAt(3), n.commitIndex)
+	}
+
+	// A repeated, older append changes nothing
+	resp = n.handleAppend(&appendRequest{Term: 2, Leader: "c", PrevIndex: 0, PrevTerm: 0, Entries: entries(1, 1)})
+	if !resp.Success || n.lastIndex() != 4 || n.termAt(3) != 2 {
+		t.Errorf("repeated append: %+v, last %d, term of 3 %d", *resp, n.lastIndex(), n.termAt(3))
+	}
+
+	_, _, saved, err := n.store.load()
+	if err != nil || len(saved) != 4 || saved[2].Term != 2 {
+		t.Errorf("saved log %+v, %v, want four entries with entry 3 of term 2", saved, err)
+	}
+}
@@ -0,0 +1,179 @@
+package raft
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
+// storage keeps a node's Raft state in its directory: the current term and
+// vote in state.json, the log entries after the last snapshot in log.jsonl,
+// one JSON entry per line, and the snapshot itself in snapshot.json.
+type storage struct {
+	dir string
+	log *os.File
+}
+
+type hardState struct {
+	Term     uint64 `json:"term"`
+	VotedFor string `json:"voted_for"`
+}
+
+type snapshotFile struct {
+	Index uint64 `json:"index"`
+	Term  uint64 `json:"term"`
+	Data  []byte `json:"data"`
+}
+
+func openStorage(dir string) (*storage, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &storage{dir: dir}, nil
+}
+
+func (s *storage) path(name string) string {
+	return filepath.Join(s.dir, name)
+}
+
+// load returns everything saved by an earlier run. A missing file reads as
+// its zero value.
+func (s *storage) load() (hardState, snapshotFile, []Entry, error) {
+	var hs hardState
+	var snap snapshotFile
+	if err := readJSON(s.path("state.json"), &hs); err != nil {
+		return hs, snap, nil, err
+	}
+	if err := readJSON(s.path("snapshot.json"), &snap); err != nil {
+		return hs, snap, nil, err
+	}
+
+	var entries []Entry
+	f, err := os.Open(s.path("log.jsonl"))
+	if err != nil && !os.IsNotExist(err) {
+		return hs, snap, nil, err
+	}
+	if f != nil {
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+		for scanner.Scan() {
+			var e Entry
+			if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+				// A torn last line from a crash mid-write
+				break
+			}
+			if e.Index > snap.Index {
+				entries = append(entries, e)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return hs, snap, nil, err
+		}
+	}
+	return hs, snap, entries, nil
+}
+
+func (s *storage) saveState(hs hardState) error {
+	return writeJSON(s.path("state.json"), hs)
+}
+
+func (s *storage) saveSnapshot(snap snapshotFile) error {
+	return writeJSON(s.path("snapshot.json"), snap)
+}
+
+// appendEntries adds entries to the end of the log file.
+func (s *storage) appendEntries(entries []Entry) error {
+	if s.log == nil {
+		f, err := os.OpenFile(s.path("log.jsonl"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return err
+		}
+		s.log = f
+	}
+	w := bufio.NewWriter(s.log)
+	for _, e := range entries {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		w.Write(data)
+		w.WriteByte('\n')
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return s.log.Sync()
+}
+
+// rewrite replaces the log file with entries, after the log was truncated
+// or compacted.
+func (s *storage) rewrite(entries []Entry) error {
+	if s.log != nil {
+		s.log.Close()
+		s.log = nil
+	}
+	tmp := s.path("log.jsonl.tmp")
+	if err := os.Remove(tmp); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	s.log = f
+	if err := s.appendEntries(entries); err != nil {
+		f.Close()
+		s.log = nil
+		return err
+	}
+	if err := os.Rename(tmp, s.path("log.jsonl")); err != nil {
+		f.Close()
+		s.log = nil
+		return err
+	}
+	return nil
+}
+
+func (s *storage) close() error {
+	if s.log == nil {
+		return nil
+	}
+	return s.log.Close()
+}
+
+func readJSON(path string, v interface{}) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func writeJSON(path string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
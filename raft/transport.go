@@ -0,0 +1,97 @@
+package raft
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// The RPCs are JSON documents POSTed to the peer's address.
+
+type voteRequest struct {
+	Term      uint64 `json:"term"`
+	Candidate string `json:"candidate"`
+	LastIndex uint64 `json:"last_index"`
+	LastTerm  uint64 `json:"last_term"`
+	Priority  uint64 `json:"priority"`
+}
+
+type voteResponse struct {
+	Term    uint64 `json:"term"`
+	Granted bool   `json:"granted"`
+}
+
+type appendRequest struct {
+	Term         uint64  `json:"term"`
+	Leader       string  `json:"leader"`
+	PrevIndex    uint64  `json:"prev_index"`
+	PrevTerm     uint64  `json:"prev_term"`
+	Entries      []Entry `json:"entries"`
+	LeaderCommit uint64  `json:"leader_commit"`
+}
+
+// appendResponse carries, on failure, the index the leader should continue
+// from instead of stepping back one entry at a time.
+type appendResponse struct {
+	Term    uint64 `json:"term"`
+	Success bool   `json:"success"`
+	Next    uint64 `json:"next"`
+}
+
+type snapshotRequest struct {
+	Term   uint64 `json:"term"`
+	Leader string `json:"leader"`
+	Index  uint64 `json:"index"`
+	Last   uint64 `json:"last_term"`
+	Data   []byte `json:"data"`
+}
+
+type snapshotResponse struct {
+	Term uint64 `json:"term"`
+}
+
+func (n *Node) call(peer, path string, req, resp interface{}) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	r, err := n.client.Post("http://"+n.cfg.Peers[peer]+path, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", path, r.Status)
+	}
+	return json.NewDecoder(r.Body).Decode(resp)
+}
+
+// Handler serves the Raft RPCs and GET /raft/status.
+func (n *Node) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/raft/vote", rpcHandler(n.handleVote))
+	mux.HandleFunc("/raft/append", rpcHandler(n.handleAppend))
+	mux.HandleFunc("/raft/snapshot", rpcHandler(n.handleSnapshot))
+	mux.HandleFunc("/raft/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(n.Status())
+	})
+	return mux
+}
+
+func rpcHandler[Req, Resp any](handle func(*Req) *Resp) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req Req
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(handle(&req))
+	}
+}
@@ -0,0 +1,274 @@
+// Package replog implements the master's durable replication log: an
+// append-only file of mutating statements, each tagged with a monotonically
+// increasing log sequence number (LSN).
+//
+// Records are stored as
+//
+//	| length (4B BE) | crc32 (4B BE) | JSON-encoded protocol.LogEntry |
+//
+// A torn record at the tail, left behind by a crash in the middle of a
+// write, is detected by its length or checksum and truncated on Open.
+//
+// A log started with OpenAt does not begin at LSN 1; the LSN it continues
+// from is kept next to it in a ".base" file.
+package replog
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"distributed-db/protocol"
+)
+
+const headerSize = 8
+
+// ErrCompacted is returned when entries that were requested are no longer
+// part of the log.
+var ErrCompacted = errors.New("replog: requested entries are no longer in the log")
+
+// Log is a durable, ordered replication log. It is safe for concurrent use.
+type Log struct {
+	mu       sync.Mutex
+	f        *os.File
+	path     string
+	firstLSN uint64
+	offsets  []int64 // file offset of each entry, indexed by LSN-firstLSN
+	size     int64
+}
+
+// Open opens the log at path, creating it if needed, and rebuilds the
+// in-memory index of entry offsets.
+func Open(path string) (*Log, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	l := &Log{f: f, path: path, firstLSN: 1}
+	base, ok, err := LoadPosition(path + ".base")
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if ok {
+		l.firstLSN = base + 1
+	}
+	if err := l.recover(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// OpenAt starts a new, empty log at path whose first entry gets LSN
+// after+1. An existing log at path is kept under a timestamped name.
+func OpenAt(path string, after uint64) (*Log, error) {
+	if _, err := os.Stat(path); err == nil {
+		if err := os.Rename(path, fmt.Sprintf("%s.%d", path, time.Now().Unix())); err != nil {
+			return nil, err
+		}
+	}
+	if err := SavePosition(path+".base", after); err != nil {
+		return nil, err
+	}
+	return Open(path)
+}
+
+func (l *Log) recover() error {
+	r := bufio.NewReader(l.f)
+	var offset int64
+	for {
+		entry, n, err := readRecord(r)
+		if err != nil {
+			if err != io.EOF {
+				fmt.Printf("Replication log: truncating torn record at offset %d: %v\n", offset, err)
+				if err := l.f.Truncate(offset); err != nil {
+					return err
+				}
+			}
+			break
+		}
+		if len(l.offsets) == 0 {
+			l.firstLSN = entry.LSN
+		} else if entry.LSN != l.firstLSN+uint64(len(l.offsets)) {
+			return fmt.Errorf("replog: entry at offset %d has LSN %d, expected %d", offset, entry.LSN, l.firstLSN+uint64(len(l.offsets)))
+		}
+		l.offsets = append(l.offsets, offset)
+		offset += n
+	}
+	l.size = offset
+	_, err := l.f.Seek(offset, io.SeekStart)
+	return err
+}
+
+func readRecord(r io.Reader) (protocol.LogEntry, int64, error) {
+	var entry protocol.LogEntry
+	var header [headerSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return entry, 0, errors.New("short header")
+		}
+		return entry, 0, err
+	}
+	size := binary.BigEndian.Uint32(header[:4])
+	if size > protocol.MaxFrameSize {
+		return entry, 0, fmt.Errorf("invalid record length %d", size)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return entry, 0, errors.New("short record")
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:]) {
+		return entry, 0, errors.New("checksum mismatch")
+	}
+	if err := json.Unmarshal(payload, &entry); err != nil {
+		return entry, 0, err
+	}
+	return entry, int64(headerSize + size), nil
+}
+
+// Append assigns the next LSN to a statement and durably writes it before
+// returning.
+func (l *Log) Append(dbName, query string) (protocol.LogEntry, error) {
+	return l.AppendEntry(protocol.LogEntry{DB: dbName, Query: query})
+}
+
+// AppendEntry is Append for an entry that carries more than a statement,
+// such as one pinned to a shard. Its LSN is ignored.
+func (l *Log) AppendEntry(entry protocol.LogEntry) (protocol.LogEntry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entry.LSN = l.firstLSN + uint64(len(l.offsets))
+	payload, err := json.Marshal(entry)
+	if err != nil {
+		return entry, err
+	}
+	record := make([]byte, headerSize+len(payload))
+	binary.BigEndian.PutUint32(record[:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(payload))
+	copy(record[headerSize:], payload)
+
+	if _, err := l.f.WriteAt(record, l.size); err != nil {
+		return entry, err
+	}
+	if err := l.f.Sync(); err != nil {
+		return entry, err
+	}
+	l.offsets = append(l.offsets, l.size)
+	l.size += int64(len(record))
+	return entry, nil
+}
+
+// LastLSN returns the LSN of the newest entry, or firstLSN-1 if the log is
+// empty.
+func (l *Log) LastLSN() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.firstLSN + uint64(len(l.offsets)) - 1
+}
+
+// FirstLSN returns the LSN of the oldest entry still in the log.
+func (l *Log) FirstLSN() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.firstLSN
+}
+
+// ReadAfter calls fn for every entry with an LSN greater than after and not
+// greater than upTo, in order. It returns ErrCompacted if some of those
+// entries have already been dropped from the log.
+func (l *Log) ReadAfter(after, upTo uint64, fn func(protocol.LogEntry) error) error {
+	l.mu.Lock()
+	if after+1 < l.firstLSN {
+		l.mu.Unlock()
+		return ErrCompacted
+	}
+	last := l.firstLSN + uint64(len(l.offsets)) - 1
+	if upTo > last {
+		upTo = last
+	}
+	if after >= upTo {
+		l.mu.Unlock()
+		return nil
+	}
+	start := l.offsets[after+1-l.firstLSN]
+	end := l.size
+	if upTo < last {
+		end = l.offsets[upTo+1-l.firstLSN]
+	}
+	l.mu.Unlock()
+
+	r := bufio.NewReader(io.NewSectionReader(l.f, start, end-start))
+	for {
+		entry, _, err := readRecord(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+}
+
+// Close closes the underlying file.
+func (l *Log) Close() error {
+	return l.f.Close()
+}
+
+// LoadPosition reads a replication position saved by SavePosition. The
+// boolean result is false if no position has been saved yet.
+func LoadPosition(path string) (uint64, bool, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	lsn, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("replog: corrupt position file %s: %w", path, err)
+	}
+	return lsn, true, nil
+}
+
+// SavePosition atomically records lsn as the last applied position.
+func SavePosition(path string, lsn uint64) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(f, "%d\n", lsn); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,57 @@
+package session
+
+import (
+	"context"
+	"net/http"
+
+	"distributed-db/sqlparse"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Attach gives every request a session: the one named by its session
+// parameter or X-Session header, or else one of its own that ends with it.
+func (m *Manager) Attach(c *gin.Context) {
+	id := c.GetHeader("X-Session")
+	if id == "" {
+		id = c.Query("session")
+	}
+	if id == "" {
+		id = c.PostForm("session")
+	}
+	var s *Session
+	if id == "" {
+		s = New(m.pools)
+		defer s.Close()
+	} else {
+		var err error
+		if s, err = m.Acquire(id); err != nil {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		defer m.Release(s)
+	}
+	c.Set("session", s)
+	c.Next()
+}
+
+// Of returns the session Attach gave a request.
+func Of(c *gin.Context) *Session {
+	return c.MustGet("session").(*Session)
+}
+
+// Respond answers a /query request that selects a database or sets
+// session variables, which only change the request's session.
+func Respond(c *gin.Context, s *Session, stmt *sqlparse.Statement) {
+	var err error
+	if stmt.Kind == sqlparse.Use {
+		err = s.Use(context.Background(), stmt.Database)
+	} else {
+		err = s.Set(context.Background(), stmt.Query)
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Error executing query: " + err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Query executed successfully", "session": s.ID, "db": s.DB()})
+}
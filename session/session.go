@@ -0,0 +1,594 @@
+// Package session pins database connections to a client, so that the
+// database it selected, the session variables it set and the transaction
+// it opened carry over from one statement to the next, and concurrent
+// clients never share a connection's state.
+//
+// A session holds one connection per MySQL server it has used, index 0
+// being the node's main server. Each connection is switched to the
+// session's database and given its session variables before use.
+// Connections that received session variables are closed rather than
+// returned to the pool when the session ends.
+package session
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"distributed-db/shard"
+	"distributed-db/sqlparse"
+)
+
+// Session is the state of one client. It is safe for concurrent use;
+// statements on the same server run one at a time.
+type Session struct {
+	ID    string
+	pools []*sql.DB
+
+	mu     sync.Mutex // guards the fields below
+	conns  map[int]*pinned
+	db     string
+	vars   []string // SET statements, in the order they ran
+	tx     string
+	insert int64 // first ID generated by the latest INSERT that made one
+	refs   int
+	used   time.Time
+	closed bool
+}
+
+// pinned is a connection held by a session.
+type pinned struct {
+	mu     sync.Mutex // held while a statement runs on conn
+	conn   *sql.Conn
+	db     string // database selected on conn
+	vars   int    // number of the session's variables set on conn
+	closed bool
+}
+
+// New returns a session over a pool per server, the main server first.
+// It is not registered anywhere and must be closed by its creator.
+func New(pools []*sql.DB) *Session {
+	return &Session{pools: pools, conns: make(map[int]*pinned), used: time.Now()}
+}
+
+// DB returns the database the session has selected.
+func (s *Session) DB() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.db
+}
+
+// Use selects a database for the following statements, after checking on
+// the main server that it exists.
+func (s *Session) Use(ctx context.Context, dbName string) error {
+	if dbName == "" || dbName == s.DB() {
+		return nil
+	}
+	p, err := s.pin(ctx, 0)
+	if err != nil {
+		return err
+	}
+	defer p.mu.Unlock()
+	if _, err := p.conn.ExecContext(ctx, "USE "+sqlparse.QuoteIdent(dbName)); err != nil {
+		return err
+	}
+	p.db = dbName
+	s.mu.Lock()
+	s.db = dbName
+	s.mu.Unlock()
+	return nil
+}
+
+// Set runs a SET statement on the session's connections and remembers it
+// for the connections it opens later. User variables are remembered by the
+// value they got on the main server, so that the other servers, and the
+// nodes the session's writes are replicated to, get the same value even
+// from RAND() or a subquery.
+func (s *Session) Set(ctx context.Context, query string) error {
+	// The main server rejects invalid settings before they are kept
+	p, err := s.pin(ctx, 0)
+	if err != nil {
+		return err
+	}
+	defer p.mu.Unlock()
+	if _, err := p.conn.ExecContext(ctx, query); err != nil {
+		return err
+	}
+	p.vars++
+	resolved, err := resolveUserVars(ctx, p.conn, query)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.vars = append(s.vars, resolved)
+	s.mu.Unlock()
+	return nil
+}
+
+// resolveUserVars rewrites a SET statement that ran on conn so that it
+// gives its user variables the values they got there, as literals. Other
+// assignments are kept as they are.
+func resolveUserVars(ctx context.Context, conn *sql.Conn, query string) (string, error) {
+	toks, err := sqlparse.Tokenize(query)
+	if err != nil || len(toks) < 2 || !toks[0].Is("SET") {
+		return query, nil
+	}
+	// Split the assignments at the commas outside parentheses
+	end := strings.TrimRight(query, "; \t\r\n")
+	var parts []string
+	var names []string
+	var userVar []bool
+	depth, start := 0, 1
+	for i := 1; i <= len(toks); i++ {
+		if i < len(toks) {
+			switch {
+			case toks[i].IsPunct("("):
+				depth++
+			case toks[i].IsPunct(")"):
+				depth--
+			}
+			if depth > 0 || !toks[i].IsPunct(",") {
+				continue
+			}
+		}
+		if start < i {
+			stop := len(end)
+			if i < len(toks) {
+				stop = toks[i].Pos
+			}
+			first := toks[start]
+			isVar := first.Kind == sqlparse.Ident && !first.Quoted && len(first.Text) > 1 &&
+				first.Text[0] == '@' && first.Text[1] != '@'
+			parts = append(parts, strings.TrimSpace(end[first.Pos:stop]))
+			userVar = append(userVar, isVar)
+			if isVar {
+				names = append(names, first.Raw)
+			}
+		}
+		start = i + 1
+	}
+	if len(names) == 0 {
+		return query, nil
+	}
+
+	rows, err := conn.QueryContext(ctx, "SELECT "+strings.Join(names, ", "))
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+	types, err := rows.ColumnTypes()
+	if err != nil {
+		return "", err
+	}
+	values := make([]sql.RawBytes, len(names))
+	ptrs := make([]interface{}, len(names))
+	for i := range values {
+		ptrs[i] = &values[i]
+	}
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return "", err
+		}
+		return "", fmt.Errorf("reading user variables: no row")
+	}
+	if err := rows.Scan(ptrs...); err != nil {
+		return "", err
+	}
+	j := 0
+	for i, isVar := range userVar {
+		if isVar {
+			parts[i] = names[j] + " = " + literal(values[j], types[j].DatabaseTypeName())
+			j++
+		}
+	}
+	return "SET " + strings.Join(parts, ", "), rows.Err()
+}
+
+// literal renders a value read from a column of type typ as a literal of
+// the same type.
+func literal(v sql.RawBytes, typ string) string {
+	switch strings.TrimPrefix(strings.ToUpper(typ), "UNSIGNED ") {
+	case "NULL":
+		return "NULL"
+	case "TINYINT", "SMALLINT", "MEDIUMINT", "INT", "BIGINT", "DECIMAL", "FLOAT", "DOUBLE":
+		if v != nil {
+			return string(v)
+		}
+	case "BINARY", "VARBINARY", "TINYBLOB", "BLOB", "MEDIUMBLOB", "LONGBLOB":
+		if v != nil {
+			return "X'" + hex.EncodeToString(v) + "'"
+		}
+	}
+	if v == nil {
+		return "NULL"
+	}
+	return sqlparse.QuoteString(string(v))
+}
+
+// Vars returns the SET statements the session has run.
+func (s *Session) Vars() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.vars...)
+}
+
+// Tx returns the ID of the transaction the session has open, if any.
+func (s *Session) Tx() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tx
+}
+
+// SetTx records the transaction the session has open; an empty ID clears
+// it.
+func (s *Session) SetTx(id string) {
+	s.mu.Lock()
+	s.tx = id
+	s.mu.Unlock()
+}
+
+// InsertID returns the first AUTO_INCREMENT value generated by the latest
+// statement of the session that generated one, like LAST_INSERT_ID(), or
+// 0 if none has.
+func (s *Session) InsertID() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.insert
+}
+
+// Exec runs a statement on a server and returns the rows it affected.
+func (s *Session) Exec(ctx context.Context, server int, query string) (int64, error) {
+	p, err := s.pin(ctx, server)
+	if err != nil {
+		return 0, err
+	}
+	defer p.mu.Unlock()
+	result, err := p.conn.ExecContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+	if id, err := result.LastInsertId(); err == nil && id != 0 {
+		s.mu.Lock()
+		s.insert = id
+		s.mu.Unlock()
+	}
+	return result.RowsAffected()
+}
+
+// Stmt is a statement to run on one server.
+type Stmt struct {
+	Server int
+	Query  string
+}
+
+// PartialError is returned by ExecAll when a server failed to commit after
+// others had committed. Applied holds the statements of those others, which
+// stay applied.
+type PartialError struct {
+	Applied []Stmt
+	Err     error
+}
+
+func (e *PartialError) Error() string {
+	return fmt.Sprintf("%v (after %d statements were committed)", e.Err, len(e.Applied))
+}
+
+func (e *PartialError) Unwrap() error {
+	return e.Err
+}
+
+// ExecAll runs statements in one transaction per server and returns the
+// rows they affected in total. If a statement fails, every transaction is
+// rolled back and nothing is applied. The servers then commit one after the
+// other, so a server failing to commit leaves those before it committed;
+// the error is a *PartialError in that case.
+func (s *Session) ExecAll(ctx context.Context, stmts []Stmt) (int64, error) {
+	return s.ExecAllWithin(ctx, stmts, 0)
+}
+
+// ExecAllWithin is ExecAll with the statements waiting at most lockWait
+// seconds for a row lock, whatever innodb_lock_wait_timeout the session
+// set; a statement that times out fails with MySQL error 1205 and leaves
+// nothing applied. The session's own setting is restored afterwards. A
+// lockWait of 0 keeps the session's setting.
+func (s *Session) ExecAllWithin(ctx context.Context, stmts []Stmt, lockWait int) (int64, error) {
+	if lockWait > 0 {
+		var bounded []int
+		defer func() {
+			for _, server := range bounded {
+				s.Exec(ctx, server, "SET SESSION innodb_lock_wait_timeout = @session_lock_wait")
+			}
+		}()
+		for _, stmt := range stmts {
+			if slices.Contains(bounded, stmt.Server) {
+				continue
+			}
+			set := fmt.Sprintf("SET @session_lock_wait = @@SESSION.innodb_lock_wait_timeout, SESSION innodb_lock_wait_timeout = %d", lockWait)
+			if _, err := s.Exec(ctx, stmt.Server, set); err != nil {
+				return 0, fmt.Errorf("server %d: %w", stmt.Server, err)
+			}
+			bounded = append(bounded, stmt.Server)
+		}
+	}
+	if len(stmts) == 1 {
+		return s.Exec(ctx, stmts[0].Server, stmts[0].Query)
+	}
+	var begun []int // servers with an open transaction, in order
+	rollback := func(servers []int) {
+		for _, server := range servers {
+			s.Exec(ctx, server, "ROLLBACK")
+		}
+	}
+	open := func(server int) bool {
+		for _, b := range begun {
+			if b == server {
+				return true
+			}
+		}
+		return false
+	}
+	var total int64
+	for _, stmt := range stmts {
+		if !open(stmt.Server) {
+			if _, err := s.Exec(ctx, stmt.Server, "START TRANSACTION"); err != nil {
+				rollback(begun)
+				return 0, fmt.Errorf("server %d: %w", stmt.Server, err)
+			}
+			begun = append(begun, stmt.Server)
+		}
+		n, err := s.Exec(ctx, stmt.Server, stmt.Query)
+		if err != nil {
+			rollback(begun)
+			return 0, err
+		}
+		total += n
+	}
+	for i, server := range begun {
+		if _, err := s.Exec(ctx, server, "COMMIT"); err != nil {
+			rollback(begun[i+1:])
+			err = fmt.Errorf("committing on server %d: %w", server, err)
+			if i == 0 {
+				return 0, err
+			}
+			var applied []Stmt
+			for _, stmt := range stmts {
+				for _, committed := range begun[:i] {
+					if stmt.Server == committed {
+						applied = append(applied, stmt)
+					}
+				}
+			}
+			return total, &PartialError{Applied: applied, Err: err}
+		}
+	}
+	return total, nil
+}
+
+// Query runs a query on a server and returns all of its rows.
+func (s *Session) Query(ctx context.Context, server int, query string) (*shard.ResultSet, error) {
+	p, err := s.pin(ctx, server)
+	if err != nil {
+		return nil, err
+	}
+	defer p.mu.Unlock()
+	rows, err := p.conn.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return shard.ScanRows(rows)
+}
+
+// pin returns the session's connection to a server, locked and brought in
+// line with the session's database and variables.
+func (s *Session) pin(ctx context.Context, server int) (*pinned, error) {
+	if server < 0 || server >= len(s.pools) {
+		return nil, fmt.Errorf("server %d does not exist", server)
+	}
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil, fmt.Errorf("session %s is closed", s.ID)
+	}
+	s.used = time.Now()
+	p, ok := s.conns[server]
+	if !ok {
+		p = &pinned{}
+		s.conns[server] = p
+	}
+	dbName, vars := s.db, s.vars
+	s.mu.Unlock()
+
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, fmt.Errorf("session %s is closed", s.ID)
+	}
+	if p.conn == nil {
+		conn, err := s.pools[server].Conn(ctx)
+		if err != nil {
+			p.mu.Unlock()
+			return nil, err
+		}
+		p.conn = conn
+	}
+	if dbName != "" && p.db != dbName {
+		if _, err := p.conn.ExecContext(ctx, "USE "+sqlparse.QuoteIdent(dbName)); err != nil {
+			p.mu.Unlock()
+			return nil, err
+		}
+		p.db = dbName
+	}
+	for ; p.vars < len(vars); p.vars++ {
+		if _, err := p.conn.ExecContext(ctx, vars[p.vars]); err != nil {
+			p.mu.Unlock()
+			return nil, fmt.Errorf("server %d: %w", server, err)
+		}
+	}
+	return p, nil
+}
+
+// Close releases the session's connections. Statements still running
+// finish first.
+func (s *Session) Close() {
+	s.mu.Lock()
+	s.closed = true
+	conns := s.conns
+	s.conns = nil
+	s.mu.Unlock()
+	for _, p := range conns {
+		p.mu.Lock()
+		if p.conn != nil {
+			if p.vars > 0 {
+				// Keep the settings from leaking to other clients
+				p.conn.Raw(func(any) error { return driver.ErrBadConn })
+			}
+			p.conn.Close()
+		}
+		p.closed = true
+		p.mu.Unlock()
+	}
+}
+
+// Local reports whether a statement sets variables of the session only, as
+// opposed to global settings and accounts, which every node must share.
+func Local(stmt *sqlparse.Statement) bool {
+	if stmt.Kind != sqlparse.Set {
+		return false
+	}
+	if len(stmt.Tokens) > 1 && (stmt.Tokens[1].Is("PASSWORD") || stmt.Tokens[1].Is("DEFAULT") || stmt.Tokens[1].Is("RESOURCE")) {
+		return false
+	}
+	for _, t := range stmt.Tokens {
+		switch {
+		case t.Is("GLOBAL"), t.Is("PERSIST"), t.Is("PERSIST_ONLY"):
+			return false
+		case strings.EqualFold(t.Text, "@@global"), strings.EqualFold(t.Text, "@@persist"), strings.EqualFold(t.Text, "@@persist_only"):
+			return false
+		}
+	}
+	return true
+}
+
+// ExecOn runs query on a single connection of pool after selecting dbName,
+// so the USE cannot land on a different pooled connection than the query.
+func ExecOn(pool *sql.DB, dbName, query string) (int64, error) {
+	ctx := context.Background()
+	conn, err := pool.Conn(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	if dbName != "" {
+		if _, err := conn.ExecContext(ctx, "USE "+sqlparse.QuoteIdent(dbName)); err != nil {
+			return 0, err
+		}
+	}
+	result, err := conn.ExecContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// Manager keeps the sessions clients open explicitly, by ID, and closes
+// them once they have been idle for too long. It is safe for concurrent
+// use.
+type Manager struct {
+	pools []*sql.DB
+	idle  time.Duration
+
+	mu       sync.Mutex
+	sessions map[string]*Session
+}
+
+// NewManager returns a manager of sessions over a pool per server, the
+// main server first, that expire after idle without a request.
+func NewManager(pools []*sql.DB, idle time.Duration) *Manager {
+	return &Manager{pools: pools, idle: idle, sessions: make(map[string]*Session)}
+}
+
+// Open starts a registered session.
+func (m *Manager) Open() (*Session, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	s := New(m.pools)
+	s.ID = hex.EncodeToString(b)
+	m.mu.Lock()
+	m.sessions[s.ID] = s
+	m.mu.Unlock()
+	return s, nil
+}
+
+// Acquire returns a registered session for the duration of a request,
+// which must end with Release. A session in use never expires.
+func (m *Manager) Acquire(id string) (*Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[id]
+	if !ok {
+		return nil, fmt.Errorf("no session %q", id)
+	}
+	s.mu.Lock()
+	s.refs++
+	s.mu.Unlock()
+	return s, nil
+}
+
+// Release ends a request's use of a session returned by Acquire.
+func (m *Manager) Release(s *Session) {
+	s.mu.Lock()
+	s.refs--
+	s.used = time.Now()
+	s.mu.Unlock()
+}
+
+// Close unregisters a session and closes it. It returns the session, so
+// that the caller can end its transaction, and false if there was none.
+func (m *Manager) Close(id string) (*Session, bool) {
+	m.mu.Lock()
+	s, ok := m.sessions[id]
+	delete(m.sessions, id)
+	m.mu.Unlock()
+	if ok {
+		s.Close()
+	}
+	return s, ok
+}
+
+// Expire closes the sessions idle for longer than the manager's limit and
+// returns them.
+func (m *Manager) Expire() []*Session {
+	m.mu.Lock()
+	var expired []*Session
+	for id, s := range m.sessions {
+		s.mu.Lock()
+		idle := s.refs == 0 && time.Since(s.used) > m.idle
+		s.mu.Unlock()
+		if idle {
+			delete(m.sessions, id)
+			expired = append(expired, s)
+		}
+	}
+	m.mu.Unlock()
+	for _, s := range expired {
+		s.Close()
+	}
+	return expired
+}
+
+// Len returns the number of registered sessions.
+func (m *Manager) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.sessions)
+}
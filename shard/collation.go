@@ -0,0 +1,235 @@
+package shard
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+
+	"golang.org/x/text/collate"
+	"golang.org/x/text/language"
+)
+
+// collator orders text as MySQL's default collation, utf8mb4_0900_ai_ci,
+// does: by the Unicode collation algorithm, ignoring case and accents. A
+// collator is not safe for concurrent use, hence collatorMu.
+var (
+	collatorMu sync.Mutex
+	collator   = collate.New(language.Und, collate.IgnoreCase, collate.IgnoreDiacritics, collate.IgnoreWidth)
+	keyBuf     collate.Buffer // guarded by collatorMu
+)
+
+// CompareText compares two strings in the order of MySQL's default
+// collation. Strings it considers equal, such as "a" and "A", compare as 0.
+func CompareText(a, b string) int {
+	collatorMu.Lock()
+	defer collatorMu.Unlock()
+	return collator.CompareString(a, b)
+}
+
+// textKey returns a key that is the same for strings the default collation
+// considers equal.
+func textKey(s string) string {
+	collatorMu.Lock()
+	defer collatorMu.Unlock()
+	key := string(collator.KeyFromString(&keyBuf, s))
+	keyBuf.Reset()
+	return key
+}
+
+// textOrder compares strings as one MySQL collation does: by the Unicode
+// collation algorithm at some strength, or byte-wise when it has no
+// collator. PAD SPACE collations ignore trailing spaces.
+type textOrder struct {
+	mu       sync.Mutex
+	collator *collate.Collator
+	buf      collate.Buffer // guarded by mu
+	padSpace bool
+}
+
+// collations holds the collations text keys can be compared in. The
+// default one is also used for tables sharded before their key's
+// collation was recorded.
+var collations = map[string]*textOrder{
+	"utf8mb4_0900_ai_ci": {collator: collator},
+	"utf8mb4_0900_as_ci": {collator: collate.New(language.Und, collate.IgnoreCase, collate.IgnoreWidth)},
+	"utf8mb4_0900_as_cs": {collator: collate.New(language.Und)},
+	"utf8mb4_0900_bin":   {},
+	"utf8mb4_bin":        {padSpace: true},
+}
+
+// SupportedCollation reports whether text keys of the named collation can
+// be compared as MySQL compares them.
+func SupportedCollation(name string) bool {
+	return collations[strings.ToLower(name)] != nil
+}
+
+// orderOf returns the order of the named collation, or of the default
+// collation if the name is empty or unknown.
+func orderOf(name string) *textOrder {
+	if o := collations[strings.ToLower(name)]; o != nil {
+		return o
+	}
+	return collations["utf8mb4_0900_ai_ci"]
+}
+
+func (o *textOrder) compare(a, b string) int {
+	if o.padSpace {
+		a, b = strings.TrimRight(a, " "), strings.TrimRight(b, " ")
+	}
+	if o.collator == nil {
+		return strings.Compare(a, b)
+	}
+	if o.collator == collator {
+		return CompareText(a, b)
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.collator.CompareString(a, b)
+}
+
+// key returns a key that is the same for strings the collation considers
+// equal.
+func (o *textOrder) key(s string) string {
+	if o.padSpace {
+		s = strings.TrimRight(s, " ")
+	}
+	if o.collator == nil {
+		return s
+	}
+	if o.collator == collator {
+		return textKey(s)
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	key := string(o.collator.KeyFromString(&o.buf, s))
+	o.buf.Reset()
+	return key
+}
+
+// valueClass groups column types by how their values compare.
+type valueClass int
+
+const (
+	classUnknown valueClass = iota // no type known: guess from the value
+	classNumber                    // integers and floating point
+	classDecimal                   // exact fixed point, kept exact
+	classText                      // character strings, in collation order
+	classBytes                     // binary strings, dates and the rest, byte-wise
+)
+
+// classOf returns the class of a database type name as reported by the
+// driver, such as "VARCHAR", "DECIMAL" or "UNSIGNED BIGINT".
+func classOf(typ string) valueClass {
+	typ = strings.TrimPrefix(strings.ToUpper(typ), "UNSIGNED ")
+	switch typ {
+	case "":
+		return classUnknown
+	case "DECIMAL", "NEWDECIMAL":
+		return classDecimal
+	case "TINYINT", "SMALLINT", "MEDIUMINT", "INT", "BIGINT", "YEAR", "FLOAT", "DOUBLE":
+		return classNumber
+	case "CHAR", "VARCHAR", "TEXT", "TINYTEXT", "MEDIUMTEXT", "LONGTEXT", "ENUM", "SET":
+		return classText
+	}
+	return classBytes
+}
+
+// compareTyped orders two values of a column of type typ: NULL first,
+// numbers by value, text in collation order and anything else byte-wise.
+// Without a type, values that look like numbers compare as numbers.
+func compareTyped(a, b interface{}, typ string) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return -1
+	case b == nil:
+		return 1
+	}
+	switch classOf(typ) {
+	case classNumber, classDecimal:
+		x, okA := toRat(a)
+		y, okB := toRat(b)
+		if okA && okB {
+			return x.Cmp(y)
+		}
+	case classText:
+		return CompareText(fmt.Sprint(a), fmt.Sprint(b))
+	case classBytes:
+		return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+	}
+	return compareValues(a, b)
+}
+
+// valueKey returns a key that is the same for the values of a column of
+// type typ that compare as equal, for grouping and DISTINCT.
+func valueKey(v interface{}, typ string) string {
+	if v == nil {
+		return "\x00NULL"
+	}
+	switch classOf(typ) {
+	case classText:
+		return textKey(fmt.Sprint(v))
+	case classNumber, classDecimal:
+		if r, ok := toRat(v); ok {
+			return r.RatString()
+		}
+	}
+	return fmt.Sprintf("%#v", v)
+}
+
+func toRat(v interface{}) (*big.Rat, bool) {
+	switch x := v.(type) {
+	case int64:
+		return new(big.Rat).SetInt64(x), true
+	case float64:
+		r := new(big.Rat)
+		if r.SetFloat64(x) == nil {
+			return nil, false
+		}
+		return r, true
+	case string:
+		return new(big.Rat).SetString(x)
+	}
+	return nil, false
+}
+
+// scale returns the number of digits after the decimal point of a DECIMAL
+// value.
+func scale(v interface{}) int {
+	s, ok := v.(string)
+	if !ok {
+		return 0
+	}
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		return len(s) - i - 1
+	}
+	return 0
+}
+
+// addDecimal sums two DECIMAL values exactly, keeping the larger scale as
+// MySQL does.
+func addDecimal(a, b interface{}) interface{} {
+	x, okA := toRat(a)
+	y, okB := toRat(b)
+	if !okA || !okB {
+		return addValues(a, b)
+	}
+	digits := scale(a)
+	if s := scale(b); s > digits {
+		digits = s
+	}
+	return new(big.Rat).Add(x, y).FloatString(digits)
+}
+
+// avgDecimal divides a DECIMAL sum by a row count, with four more digits
+// than the sum as MySQL's AVG gives.
+func avgDecimal(sum interface{}, count int64) interface{} {
+	x, ok := toRat(sum)
+	if !ok {
+		return nil
+	}
+	avg := new(big.Rat).Quo(x, new(big.Rat).SetInt64(count))
+	return avg.FloatString(scale(sum) + 4)
+}
@@ -0,0 +1,768 @@
+package shard
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"distributed-db/sqlparse"
+)
+
+// ResultSet holds the rows returned by a SELECT. Byte slices returned by the
+// driver are converted to strings. Types holds the database type of each
+// column, such as VARCHAR or DECIMAL, when known; merging results compares
+// and sums values according to it.
+type ResultSet struct {
+	Columns []string
+	Types   []string
+	Rows    [][]interface{}
+}
+
+// SelectPlan describes how a SELECT is run on several shards and how their
+// results are combined into the answer a single database would give.
+type SelectPlan struct {
+	// Query is the statement sent to every shard.
+	Query string
+
+	distinct  bool
+	aggregate bool
+	items     []planItem // output columns, aggregate plans only
+	groupCols []int      // shard result columns forming the group key
+	order     []orderKey
+	hidden    int // trailing helper columns to strip, plain plans only
+	limit     int64
+	offset    int64
+}
+
+type planItem struct {
+	agg   string // COUNT, SUM, MIN, MAX, AVG, or empty for a plain column
+	col   int    // first shard result column holding the item
+	alias string
+}
+
+type orderKey struct {
+	col    int
+	desc   bool
+	hidden bool // col counts helper columns, whose position is only known once rows arrive
+}
+
+var aggregates = map[string]bool{"COUNT": true, "SUM": true, "MIN": true, "MAX": true, "AVG": true}
+
+type selectItem struct {
+	toks  []sqlparse.Token
+	expr  []sqlparse.Token // item without its alias
+	alias string
+	agg   string
+	star  bool
+}
+
+// PlanSelect plans a SELECT for scatter-gather execution. ORDER BY and
+// LIMIT/OFFSET are re-applied at the coordinator, and COUNT, SUM, MIN, MAX
+// and AVG (with or without GROUP BY) are combined from per-shard partial
+// results. Statements whose results cannot be merged correctly, such as
+// UNION, HAVING with grouping or COUNT(DISTINCT ...), are rejected.
+func PlanSelect(query string) (*SelectPlan, error) {
+	toks, err := sqlparse.Tokenize(query)
+	if err != nil {
+		return nil, err
+	}
+	if len(toks) == 0 || !toks[0].Is("SELECT") {
+		return nil, fmt.Errorf("not a SELECT statement")
+	}
+
+	// Locate the top-level clauses
+	clause := map[string]int{}
+	end := len(toks)
+	depth := 0
+	for i := 1; i < len(toks); i++ {
+		t := toks[i]
+		depth += parenDelta(t)
+		if depth != 0 {
+			continue
+		}
+		switch {
+		case t.Is("UNION"):
+			return nil, fmt.Errorf("UNION is not supported across shards")
+		case t.Is("FROM"), t.Is("WHERE"), t.Is("HAVING"), t.Is("LIMIT"):
+			if _, seen := clause[strings.ToUpper(t.Text)]; !seen {
+				clause[strings.ToUpper(t.Text)] = i
+			}
+		case (t.Is("GROUP") || t.Is("ORDER")) && i+1 < len(toks) && toks[i+1].Is("BY"):
+			clause[strings.ToUpper(t.Text)] = i
+		case t.Is("FOR"), t.Is("LOCK"), t.Is("INTO"), t.IsPunct(";"):
+			if end == len(toks) {
+				end = i
+			}
+		}
+	}
+	from, ok := clause["FROM"]
+	if !ok {
+		return nil, fmt.Errorf("SELECT without FROM is not sharded")
+	}
+
+	plan := &SelectPlan{limit: -1}
+	start := 1
+	for start < from && toks[start].Kind == sqlparse.Ident && !toks[start].Quoted && isSelectModifier(toks[start].Text) {
+		if toks[start].Is("DISTINCT") || toks[start].Is("DISTINCTROW") {
+			plan.distinct = true
+		}
+		start++
+	}
+	items, err := splitItems(toks[start:from])
+	if err != nil {
+		return nil, err
+	}
+
+	groupToks := clauseTokens(toks, clause, "GROUP", end)
+	orderToks := clauseTokens(toks, clause, "ORDER", end)
+	for _, item := range items {
+		if item.agg != "" {
+			plan.aggregate = true
+		}
+	}
+	if len(groupToks) > 0 {
+		plan.aggregate = true
+	}
+	if plan.aggregate {
+		if _, ok := clause["HAVING"]; ok {
+			return nil, fmt.Errorf("HAVING is not supported across shards")
+		}
+	}
+
+	if limitAt, ok := clause["LIMIT"]; ok {
+		limitEnd := end
+		plan.limit, plan.offset, err = parseLimit(toks[limitAt+1 : limitEnd])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Build the select list sent to the shards
+	var list []string
+	col := 0
+	afterStar := false
+	itemCol := make([]int, len(items))
+	for i, item := range items {
+		itemCol[i] = col
+		if afterStar {
+			itemCol[i] = -1
+		}
+		switch {
+		case item.star:
+			if plan.aggregate {
+				return nil, fmt.Errorf("cannot combine * with aggregates across shards")
+			}
+			list = append(list, rawText(query, item.toks))
+			afterStar = true
+		case item.agg == "AVG":
+			args := rawText(query, item.expr[2:len(item.expr)-1])
+			list = append(list, fmt.Sprintf("SUM(%s), COUNT(%s)", args, args))
+			plan.items = append(plan.items, planItem{agg: "AVG", col: col, alias: item.alias})
+			col += 2
+		default:
+			list = append(list, rawText(query, item.toks))
+			plan.items = append(plan.items, planItem{agg: item.agg, col: col, alias: item.alias})
+			col++
+		}
+	}
+
+	// findItem returns the index of the select item an ORDER BY or GROUP
+	// BY expression refers to, or -1.
+	findItem := func(expr []sqlparse.Token) int {
+		if len(expr) == 1 && expr[0].Kind == sqlparse.Number {
+			n, err := strconv.Atoi(expr[0].Text)
+			if err == nil && n >= 1 && n <= len(items) {
+				return n - 1
+			}
+			return -1
+		}
+		key := exprKey(expr)
+		for i, item := range items {
+			if item.star {
+				continue
+			}
+			if (item.alias != "" && len(expr) == 1 && strings.EqualFold(item.alias, expr[0].Text)) || exprKey(item.expr) == key {
+				return i
+			}
+			if isColumnRef(item.expr) && isColumnRef(expr) && item.alias == "" &&
+				strings.EqualFold(item.expr[len(item.expr)-1].Text, expr[len(expr)-1].Text) && len(expr) == 1 {
+				return i
+			}
+		}
+		return -1
+	}
+
+	var hidden []string
+	for _, g := range splitList(groupToks) {
+		i := findItem(g)
+		if i >= 0 && itemCol[i] >= 0 && items[i].agg == "" {
+			plan.groupCols = append(plan.groupCols, itemCol[i])
+			continue
+		}
+		hidden = append(hidden, fmt.Sprintf("%s AS `__group_%d`", rawText(query, g), len(hidden)))
+		plan.groupCols = append(plan.groupCols, col)
+		col++
+	}
+	for _, o := range splitList(orderToks) {
+		desc := false
+		if n := len(o); n > 1 && (o[n-1].Is("DESC") || o[n-1].Is("ASC")) {
+			desc = o[n-1].Is("DESC")
+			o = o[:n-1]
+		}
+		i := findItem(o)
+		switch {
+		case plan.aggregate && i >= 0:
+			plan.order = append(plan.order, orderKey{col: i, desc: desc})
+		case plan.aggregate:
+			return nil, fmt.Errorf("ORDER BY %s must refer to a selected column across shards", rawText(query, o))
+		case i >= 0 && itemCol[i] >= 0:
+			plan.order = append(plan.order, orderKey{col: itemCol[i], desc: desc})
+		default:
+			plan.order = append(plan.order, orderKey{col: len(hidden), desc: desc, hidden: true})
+			hidden = append(hidden, fmt.Sprintf("%s AS `__order_%d`", rawText(query, o), len(hidden)))
+		}
+	}
+	if !plan.aggregate {
+		plan.hidden = len(hidden)
+	}
+	list = append(list, hidden...)
+
+	// Assemble the per-shard statement
+	var b strings.Builder
+	b.WriteString(query[:toks[start].Pos])
+	b.WriteString(strings.Join(list, ", "))
+	b.WriteString(" ")
+	bodyEnd := end
+	if at, ok := clause["LIMIT"]; ok {
+		bodyEnd = at
+	}
+	if plan.aggregate {
+		// Groups span shards, so ordering and limits only make sense
+		// once the partial results are combined.
+		if at, ok := clause["ORDER"]; ok {
+			bodyEnd = at
+		}
+	}
+	b.WriteString(strings.TrimSpace(rawSpan(query, toks, from, bodyEnd)))
+	if !plan.aggregate && plan.limit >= 0 {
+		fmt.Fprintf(&b, " LIMIT %d", plan.limit+plan.offset)
+	}
+	if end < len(toks) && !toks[end].IsPunct(";") {
+		b.WriteString(" ")
+		b.WriteString(strings.TrimSuffix(strings.TrimSpace(query[toks[end].Pos:]), ";"))
+	}
+	plan.Query = b.String()
+	return plan, nil
+}
+
+func isSelectModifier(word string) bool {
+	switch strings.ToUpper(word) {
+	case "ALL", "DISTINCT", "DISTINCTROW", "HIGH_PRIORITY", "STRAIGHT_JOIN", "SQL_SMALL_RESULT",
+		"SQL_BIG_RESULT", "SQL_BUFFER_RESULT", "SQL_NO_CACHE", "SQL_CALC_FOUND_ROWS":
+		return true
+	}
+	return false
+}
+
+func parenDelta(t sqlparse.Token) int {
+	switch {
+	case t.IsPunct("("):
+		return 1
+	case t.IsPunct(")"):
+		return -1
+	}
+	return 0
+}
+
+// splitList splits tokens at top-level commas.
+func splitList(toks []sqlparse.Token) [][]sqlparse.Token {
+	if len(toks) == 0 {
+		return nil
+	}
+	var parts [][]sqlparse.Token
+	depth, start := 0, 0
+	for i, t := range toks {
+		depth += parenDelta(t)
+		if depth == 0 && t.IsPunct(",") {
+			parts = append(parts, toks[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, toks[start:])
+}
+
+func splitItems(toks []sqlparse.Token) ([]selectItem, error) {
+	var items []selectItem
+	for _, part := range splitList(toks) {
+		if len(part) == 0 {
+			return nil, fmt.Errorf("empty select item")
+		}
+		item := selectItem{toks: part, expr: part}
+		n := len(part)
+		switch {
+		case n >= 3 && part[n-2].Is("AS"):
+			item.alias, item.expr = part[n-1].Text, part[:n-2]
+		case n >= 2 && part[n-1].Kind == sqlparse.Ident && !part[n-2].IsPunct(".") &&
+			(part[n-2].IsPunct(")") || part[n-2].Kind == sqlparse.Ident || part[n-2].Literal()):
+			item.alias, item.expr = part[n-1].Text, part[:n-1]
+		}
+		e := item.expr
+		last := e[len(e)-1]
+		item.star = last.IsPunct("*") && (len(e) == 1 || e[len(e)-2].IsPunct("."))
+
+		for i, t := range e {
+			if t.Kind != sqlparse.Ident || t.Quoted || !aggregates[strings.ToUpper(t.Text)] || i+1 >= len(e) || !e[i+1].IsPunct("(") {
+				continue
+			}
+			if i != 0 || !closesAt(e, 1, len(e)-1) {
+				return nil, fmt.Errorf("aggregate inside an expression is not supported across shards")
+			}
+			if len(e) > 3 && e[2].Is("DISTINCT") {
+				return nil, fmt.Errorf("%s(DISTINCT ...) is not supported across shards", strings.ToUpper(t.Text))
+			}
+			item.agg = strings.ToUpper(t.Text)
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// closesAt reports whether the parenthesis opened at toks[open] is closed
+// at toks[close].
+func closesAt(toks []sqlparse.Token, open, close int) bool {
+	depth := 0
+	for i := open; i <= close; i++ {
+		depth += parenDelta(toks[i])
+		if depth == 0 {
+			return i == close
+		}
+	}
+	return false
+}
+
+func clauseTokens(toks []sqlparse.Token, clause map[string]int, name string, end int) []sqlparse.Token {
+	at, ok := clause[name]
+	if !ok {
+		return nil
+	}
+	stop := end
+	for _, next := range clause {
+		if next > at && next < stop {
+			stop = next
+		}
+	}
+	return toks[at+2 : stop] // skip "GROUP BY" / "ORDER BY"
+}
+
+func parseLimit(toks []sqlparse.Token) (limit, offset int64, err error) {
+	num := func(t sqlparse.Token) (int64, error) {
+		if t.Kind != sqlparse.Number {
+			return 0, fmt.Errorf("LIMIT must use literal numbers across shards")
+		}
+		return strconv.ParseInt(t.Text, 10, 64)
+	}
+	switch {
+	case len(toks) == 1:
+		limit, err = num(toks[0])
+	case len(toks) == 3 && toks[1].IsPunct(","):
+		if offset, err = num(toks[0]); err == nil {
+			limit, err = num(toks[2])
+		}
+	case len(toks) == 3 && toks[1].Is("OFFSET"):
+		if limit, err = num(toks[0]); err == nil {
+			offset, err = num(toks[2])
+		}
+	default:
+		err = fmt.Errorf("unsupported LIMIT clause")
+	}
+	return limit, offset, err
+}
+
+func rawText(query string, toks []sqlparse.Token) string {
+	last := toks[len(toks)-1]
+	return query[toks[0].Pos : last.Pos+len(last.Raw)]
+}
+
+func rawSpan(query string, toks []sqlparse.Token, from, to int) string {
+	if to >= len(toks) {
+		return query[toks[from].Pos:]
+	}
+	return query[toks[from].Pos:toks[to].Pos]
+}
+
+func exprKey(toks []sqlparse.Token) string {
+	parts := make([]string, len(toks))
+	for i, t := range toks {
+		parts[i] = strings.ToLower(t.Text)
+	}
+	return strings.Join(parts, " ")
+}
+
+func isColumnRef(toks []sqlparse.Token) bool {
+	for i, t := range toks {
+		if i%2 == 0 && t.Kind != sqlparse.Ident {
+			return false
+		}
+		if i%2 == 1 && !t.IsPunct(".") {
+			return false
+		}
+	}
+	return len(toks)%2 == 1
+}
+
+// Gather runs a SELECT on every target concurrently and merges the results.
+// A single target is queried directly. pools is indexed by shard ID and every
+// query runs after selecting dbName.
+func Gather(ctx context.Context, pools []*sql.DB, dbName string, targets []Target, args ...interface{}) (*ResultSet, error) {
+	return GatherWith(ctx, targets, func(ctx context.Context, shard int, query string) (*ResultSet, error) {
+		return queryShard(ctx, pools[shard], dbName, query, args...)
+	})
+}
+
+// GatherWith is Gather with every query run by query, such as on the
+// connections of a transaction.
+func GatherWith(ctx context.Context, targets []Target, query func(ctx context.Context, shard int, query string) (*ResultSet, error)) (*ResultSet, error) {
+	if len(targets) == 1 {
+		return query(ctx, targets[0].Shard, targets[0].Query)
+	}
+	plan, err := PlanSelect(targets[0].Query)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]*ResultSet, len(targets))
+	errs := make([]error, len(targets))
+	var wg sync.WaitGroup
+	for i, target := range targets {
+		wg.Add(1)
+		go func(i int, target Target) {
+			defer wg.Done()
+			results[i], errs[i] = query(ctx, target.Shard, plan.Query)
+			if errs[i] != nil {
+				errs[i] = fmt.Errorf("shard %d: %w", target.Shard, errs[i])
+			}
+		}(i, target)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return plan.Merge(results), nil
+}
+
+func queryShard(ctx context.Context, pool *sql.DB, dbName, query string, args ...interface{}) (*ResultSet, error) {
+	conn, err := pool.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if dbName != "" {
+		if _, err := conn.ExecContext(ctx, "USE `"+strings.ReplaceAll(dbName, "`", "``")+"`"); err != nil {
+			return nil, err
+		}
+	}
+	rows, err := conn.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return ScanRows(rows)
+}
+
+// ScanRows reads every row of rows into a ResultSet.
+func ScanRows(rows *sql.Rows) (*ResultSet, error) {
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	rs := &ResultSet{Columns: columns}
+	if columnTypes, err := rows.ColumnTypes(); err == nil {
+		rs.Types = make([]string, len(columnTypes))
+		for i, ct := range columnTypes {
+			rs.Types[i] = ct.DatabaseTypeName()
+		}
+	}
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		valuePtrs := make([]interface{}, len(columns))
+		for i := range values {
+			valuePtrs[i] = &values[i]
+		}
+		if err := rows.Scan(valuePtrs...); err != nil {
+			return nil, err
+		}
+		for i, v := range values {
+			if b, ok := v.([]byte); ok {
+				values[i] = string(b)
+			}
+		}
+		rs.Rows = append(rs.Rows, values)
+	}
+	return rs, rows.Err()
+}
+
+// Merge combines per-shard results into the final result.
+func (p *SelectPlan) Merge(results []*ResultSet) *ResultSet {
+	var columns, types []string
+	var rows [][]interface{}
+	for _, rs := range results {
+		if rs == nil {
+			continue
+		}
+		if columns == nil {
+			columns, types = rs.Columns, rs.Types
+		}
+		rows = append(rows, rs.Rows...)
+	}
+	if len(types) != len(columns) {
+		types = make([]string, len(columns))
+	}
+
+	if p.aggregate {
+		columns, types, rows = p.combine(columns, types, rows)
+	}
+
+	p.sort(rows, types)
+	if !p.aggregate && p.hidden > 0 {
+		columns = columns[:len(columns)-p.hidden]
+		types = types[:len(types)-p.hidden]
+		for i, row := range rows {
+			rows[i] = row[:len(row)-p.hidden]
+		}
+	}
+	if p.distinct {
+		rows = distinctRows(rows, types)
+	}
+	if p.offset > 0 {
+		if p.offset >= int64(len(rows)) {
+			rows = nil
+		} else {
+			rows = rows[p.offset:]
+		}
+	}
+	if p.limit >= 0 && int64(len(rows)) > p.limit {
+		rows = rows[:p.limit]
+	}
+	return &ResultSet{Columns: columns, Types: types, Rows: rows}
+}
+
+// combine folds partial aggregates into one row per group. Partial SUMs of
+// DECIMAL columns are added exactly, and group keys compare as the column
+// types do.
+func (p *SelectPlan) combine(columns, types []string, rows [][]interface{}) ([]string, []string, [][]interface{}) {
+	out := make([]string, len(p.items))
+	outTypes := make([]string, len(p.items))
+	for i, item := range p.items {
+		switch {
+		case item.alias != "":
+			out[i] = item.alias
+		case item.col < len(columns):
+			out[i] = columns[item.col]
+		}
+		if item.col < len(types) {
+			outTypes[i] = types[item.col]
+		}
+		if item.agg == "AVG" && item.alias == "" && item.col < len(columns) {
+			// The shard column is named after the rewritten SUM(...)
+			out[i] = "AVG" + strings.TrimPrefix(columns[item.col], "SUM")
+		}
+	}
+
+	type group struct {
+		values []interface{}
+		counts []int64 // AVG row counts
+	}
+	var order []string
+	groups := make(map[string]*group)
+	for _, row := range rows {
+		var key strings.Builder
+		for _, c := range p.groupCols {
+			key.WriteString(valueKey(row[c], types[c]))
+			key.WriteByte(0)
+		}
+		g, ok := groups[key.String()]
+		if !ok {
+			g = &group{values: make([]interface{}, len(p.items)), counts: make([]int64, len(p.items))}
+			for i, item := range p.items {
+				g.values[i] = row[item.col]
+				if item.agg == "AVG" {
+					g.counts[i], _ = toInt(row[item.col+1])
+				}
+			}
+			groups[key.String()] = g
+			order = append(order, key.String())
+			continue
+		}
+		for i, item := range p.items {
+			v := row[item.col]
+			typ := types[item.col]
+			switch item.agg {
+			case "COUNT", "SUM", "AVG":
+				if classOf(typ) == classDecimal && g.values[i] != nil && v != nil {
+					g.values[i] = addDecimal(g.values[i], v)
+				} else {
+					g.values[i] = addValues(g.values[i], v)
+				}
+				if item.agg == "AVG" {
+					n, _ := toInt(row[item.col+1])
+					g.counts[i] += n
+				}
+			case "MIN":
+				if v != nil && (g.values[i] == nil || compareTyped(v, g.values[i], typ) < 0) {
+					g.values[i] = v
+				}
+			case "MAX":
+				if v != nil && (g.values[i] == nil || compareTyped(v, g.values[i], typ) > 0) {
+					g.values[i] = v
+				}
+			}
+		}
+	}
+
+	// An aggregate without GROUP BY always yields one row, even when
+	// every shard is empty.
+	if len(order) == 0 && len(p.groupCols) == 0 {
+		g := &group{values: make([]interface{}, len(p.items)), counts: make([]int64, len(p.items))}
+		for i, item := range p.items {
+			if item.agg == "COUNT" {
+				g.values[i] = int64(0)
+			}
+		}
+		groups[""] = g
+		order = append(order, "")
+	}
+
+	result := make([][]interface{}, 0, len(order))
+	for _, key := range order {
+		g := groups[key]
+		for i, item := range p.items {
+			if item.agg == "AVG" {
+				sum, ok := toFloat(g.values[i])
+				switch {
+				case !ok || g.counts[i] == 0:
+					g.values[i] = nil
+				case classOf(outTypes[i]) == classDecimal:
+					g.values[i] = avgDecimal(g.values[i], g.counts[i])
+				default:
+					g.values[i] = sum / float64(g.counts[i])
+				}
+			}
+		}
+		result = append(result, g.values)
+	}
+	return out, outTypes, result
+}
+
+func (p *SelectPlan) sort(rows [][]interface{}, types []string) {
+	if len(p.order) == 0 {
+		return
+	}
+	sort.SliceStable(rows, func(a, b int) bool {
+		for _, o := range p.order {
+			col := o.col
+			if o.hidden {
+				col += len(rows[a]) - p.hidden
+			}
+			c := compareTyped(rows[a][col], rows[b][col], types[col])
+			if c == 0 {
+				continue
+			}
+			if o.desc {
+				return c > 0
+			}
+			return c < 0
+		}
+		return false
+	})
+}
+
+func distinctRows(rows [][]interface{}, types []string) [][]interface{} {
+	seen := make(map[string]bool)
+	out := rows[:0]
+	for _, row := range rows {
+		var b strings.Builder
+		for i, v := range row {
+			b.WriteString(valueKey(v, types[i]))
+			b.WriteByte(0)
+		}
+		key := b.String()
+		if !seen[key] {
+			seen[key] = true
+			out = append(out, row)
+		}
+	}
+	return out
+}
+
+// compareValues orders NULL first, numbers numerically and everything else
+// as strings. It guesses from the values, for columns of unknown type.
+func compareValues(a, b interface{}) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return -1
+	case b == nil:
+		return 1
+	}
+	fa, okA := toFloat(a)
+	fb, okB := toFloat(b)
+	if okA && okB {
+		switch {
+		case fa < fb:
+			return -1
+		case fa > fb:
+			return 1
+		}
+		return 0
+	}
+	return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch x := v.(type) {
+	case int64:
+		return float64(x), true
+	case float64:
+		return x, true
+	case string:
+		f, err := strconv.ParseFloat(x, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+func toInt(v interface{}) (int64, bool) {
+	switch x := v.(type) {
+	case int64:
+		return x, true
+	case string:
+		n, err := strconv.ParseInt(x, 10, 64)
+		return n, err == nil
+	}
+	return 0, false
+}
+
+// addValues sums two partial COUNT or SUM results, keeping integers exact.
+func addValues(a, b interface{}) interface{} {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+	if x, ok := toInt(a); ok {
+		if y, ok := toInt(b); ok {
+			return x + y
+		}
+	}
+	x, _ := toFloat(a)
+	y, _ := toFloat(b)
+	return x + y
+}
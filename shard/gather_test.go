@@ -0,0 +1,148 @@
+package shard
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestPlanSelect(t *testing.T) {
+	tests := []struct {
+		query string
+		sent  string // query sent to every shard, empty if rejected
+	}{
+		{"SELECT id, name FROM t ORDER BY name LIMIT 2", "SELECT id, name FROM t ORDER BY name LIMIT 2"},
+		{"SELECT id FROM t LIMIT 1, 2", "SELECT id FROM t LIMIT 3"},
+		{"SELECT id FROM t LIMIT 2 OFFSET 1", "SELECT id FROM t LIMIT 3"},
+		{"SELECT id FROM t ORDER BY name", "SELECT id, name AS `__order_0` FROM t ORDER BY name"},
+		{"SELECT COUNT(*), AVG(n) FROM t", "SELECT COUNT(*), SUM(n), COUNT(n) FROM t"},
+		{"SELECT g, COUNT(*) AS c FROM t GROUP BY g ORDER BY c DESC", "SELECT g, COUNT(*) AS c FROM t GROUP BY g"},
+		{"SELECT DISTINCT g FROM t", "SELECT DISTINCT g FROM t"},
+		{"SELECT COUNT(DISTINCT g) FROM t", ""},
+		{"SELECT g FROM t UNION SELECT g FROM u", ""},
+		{"SELECT 1", ""},
+		{"UPDATE t SET a = 1", ""},
+	}
+	for _, tt := range tests {
+		plan, err := PlanSelect(tt.query)
+		switch {
+		case tt.sent == "" && err == nil:
+			t.Errorf("PlanSelect(%q) sends %q, want an error", tt.query, plan.Query)
+		case tt.sent != "" && err != nil:
+			t.Errorf("PlanSelect(%q): %v", tt.query, err)
+		case err == nil && plan.Query != tt.sent:
+			t.Errorf("PlanSelect(%q) sends %q, want %q", tt.query, plan.Query, tt.sent)
+		}
+	}
+}
+
+func TestMerge(t *testing.T) {
+	tests := []struct {
+		query   string
+		columns []string
+		types   []string
+		shards  [][][]interface{} // rows each shard returns for the planned query
+		want    [][]interface{}
+	}{
+		{
+			"SELECT id, name FROM t ORDER BY name LIMIT 3",
+			[]string{"id", "name"}, []string{"BIGINT", "VARCHAR"},
+			[][][]interface{}{{{int64(1), "b"}, {int64(3), "d"}}, {{int64(2), "A"}, {int64(4), "c"}}},
+			[][]interface{}{{int64(2), "A"}, {int64(1), "b"}, {int64(4), "c"}},
+		},
+		{
+			"SELECT id FROM t ORDER BY id DESC LIMIT 1, 2",
+			[]string{"id"}, []string{"BIGINT"},
+			[][][]interface{}{{{int64(5)}, {int64(1)}}, {{int64(9)}, {int64(3)}}},
+			[][]interface{}{{int64(5)}, {int64(3)}},
+		},
+		{
+			"SELECT id FROM t ORDER BY name",
+			[]string{"id", "__order_0"}, []string{"BIGINT", "VARCHAR"},
+			[][][]interface{}{{{int64(1), "y"}}, {{int64(2), "x"}}},
+			[][]interface{}{{int64(2)}, {int64(1)}},
+		},
+		{
+			"SELECT COUNT(*), SUM(n), MIN(n), MAX(n) FROM t",
+			[]string{"COUNT(*)", "SUM(n)", "MIN(n)", "MAX(n)"}, []string{"BIGINT", "BIGINT", "BIGINT", "BIGINT"},
+			[][][]interface{}{{{int64(2), int64(10), int64(3), int64(7)}}, {{int64(3), int64(5), int64(1), int64(2)}}},
+			[][]interface{}{{int64(5), int64(15), int64(1), int64(7)}},
+		},
+		{
+			"SELECT g, COUNT(*) AS c FROM t GROUP BY g ORDER BY c DESC",
+			[]string{"g", "c"}, []string{"VARCHAR", "BIGINT"},
+			[][][]interface{}{{{"a", int64(1)}, {"b", int64(4)}}, {{"A", int64(2)}, {"c", int64(2)}}},
+			[][]interface{}{{"b", int64(4)}, {"a", int64(3)}, {"c", int64(2)}},
+		},
+		{
+			"SELECT DISTINCT g FROM t ORDER BY g",
+			[]string{"g"}, []string{"VARCHAR"},
+			[][][]interface{}{{{"a"}, {"b"}}, {{"B"}, {"c"}}},
+			[][]interface{}{{"a"}, {"b"}, {"c"}},
+		},
+	}
+	for _, tt := range tests {
+		plan, err := PlanSelect(tt.query)
+		if err != nil {
+			t.Errorf("PlanSelect(%q): %v", tt.query, err)
+			continue
+		}
+		results := make([]*ResultSet, len(tt.shards))
+		for i, rows := range tt.shards {
+			results[i] = &ResultSet{Columns: tt.columns, Types: tt.types, Rows: rows}
+		}
+		got := plan.Merge(results)
+		if !reflect.DeepEqual(got.Rows, tt.want) {
+			t.Errorf("%s: merged rows %v, want %v", tt.query, got.Rows, tt.want)
+		}
+	}
+}
+
+func TestMergeAverage(t *testing.T) {
+	plan, err := PlanSelect("SELECT AVG(n) AS a FROM t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	columns := []string{"a", "COUNT(n)"}
+	types := []string{"DECIMAL", "BIGINT"}
+	got := plan.Merge([]*ResultSet{
+		{Columns: columns, Types: types, Rows: [][]interface{}{{"10", int64(2)}}},
+		{Columns: columns, Types: types, Rows: [][]interface{}{{"5", int64(3)}}},
+	})
+	if len(got.Rows) != 1 || fmt.Sprint(got.Rows[0][0]) != "3.0000" {
+		t.Errorf("AVG over shards = %v, want 3.0000", got.Rows)
+	}
+	if !reflect.DeepEqual(got.Columns, []string{"a"}) {
+		t.Errorf("AVG over shards has columns %q, want [a]", got.Columns)
+	}
+}
+
+func TestGatherWith(t *testing.T) {
+	rows := map[int][][]interface{}{
+		0: {{int64(3)}, {int64(1)}},
+		1: {{int64(2)}},
+	}
+	query := func(ctx context.Context, shard int, query string) (*ResultSet, error) {
+		if shard == 2 {
+			return nil, fmt.Errorf("unreachable")
+		}
+		return &ResultSet{Columns: []string{"id"}, Types: []string{"BIGINT"}, Rows: rows[shard]}, nil
+	}
+	targets := []Target{{Shard: 0, Query: "SELECT id FROM t ORDER BY id"}, {Shard: 1, Query: "SELECT id FROM t ORDER BY id"}}
+	got, err := GatherWith(context.Background(), targets[:1], query)
+	if err != nil || len(got.Rows) != 2 {
+		t.Errorf("single target = %v, %v, want its own rows", got, err)
+	}
+	got, err = GatherWith(context.Background(), targets, query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := [][]interface{}{{int64(1)}, {int64(2)}, {int64(3)}}; !reflect.DeepEqual(got.Rows, want) {
+		t.Errorf("gathered rows %v, want %v", got.Rows, want)
+	}
+	_, err = GatherWith(context.Background(), append(targets, Target{Shard: 2, Query: targets[0].Query}), query)
+	if err == nil {
+		t.Error("a failing shard does not fail the query")
+	}
+}
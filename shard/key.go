@@ -0,0 +1,54 @@
+package shard
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// NormalKey returns the form of a shard key value that places its row:
+// numbers as their exact value, so that 1, 1.0 and 01 agree, and text as
+// its collation key, so that values the column's collation considers
+// equal agree. Other values, and those of tables sharded before their key
+// type was recorded, are placed as written. It fails for a value no row
+// of the table can hold, such as 'abc' or 1.5 for an integer key, which
+// MySQL would convert to another value when comparing or storing it.
+func (t Table) NormalKey(value string) (string, error) {
+	switch classOf(t.KeyType) {
+	case classNumber, classDecimal:
+		r, ok := new(big.Rat).SetString(strings.TrimSpace(value))
+		if !ok || strings.Contains(value, "/") {
+			return "", fmt.Errorf("shard key column %s of table %s holds numbers, not '%s'", t.Key, t.Name, value)
+		}
+		if t.integerKey() && !r.IsInt() {
+			return "", fmt.Errorf("shard key column %s of table %s holds integers, not %s", t.Key, t.Name, value)
+		}
+		return r.RatString(), nil
+	case classText:
+		return orderOf(t.Collation).key(value), nil
+	}
+	return value, nil
+}
+
+// keyText returns the normal form of a key value, or the value as written
+// if it has none.
+func (t Table) keyText(value string) string {
+	if key, err := t.NormalKey(value); err == nil {
+		return key
+	}
+	return value
+}
+
+// numericKey reports whether the table's key values are numbers.
+func (t Table) numericKey() bool {
+	c := classOf(t.KeyType)
+	return c == classNumber || c == classDecimal
+}
+
+func (t Table) integerKey() bool {
+	switch strings.TrimPrefix(strings.ToUpper(t.KeyType), "UNSIGNED ") {
+	case "TINYINT", "SMALLINT", "MEDIUMINT", "INT", "BIGINT", "YEAR":
+		return true
+	}
+	return false
+}
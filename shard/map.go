@@ -0,0 +1,967 @@
+// Package shard decides which shard database holds the rows a statement
+// touches. A table either lives whole on one shard, is a reference table
+// copied to every shard, or declares a shard key column whose hashed
+// value, or the range its value falls in, picks the shard of every row.
+package shard
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// MetaDB is the database holding a node's cluster metadata. It is never
+// replicated as data; the master distributes its contents explicitly.
+const MetaDB = "distdb_meta"
+
+// Table is the placement of one table.
+type Table struct {
+	DB    string `json:"db"`
+	Name  string `json:"table"`
+	Shard int    `json:"shard"`
+	Key   string `json:"shard_key,omitempty"`
+	// KeyType is the data type of the shard key column. Key values are
+	// placed by what they equal under it rather than as written, so that
+	// 1, 1.0 and 01, or 'bob' and 'BOB', find the same row. Tables sharded
+	// before the type was recorded place key values as written.
+	KeyType string `json:"key_type,omitempty"`
+	// Collation is the collation of a text shard key column, by which its
+	// values are compared and placed. Tables sharded before it was
+	// recorded use MySQL's default collation.
+	Collation string `json:"collation,omitempty"`
+	// Ring lists the shards whose consistent hashing ring places the keys
+	// of a sharded table. Tables sharded before the ring existed have
+	// their keys hashed modulo Spread shards instead.
+	Ring   []int `json:"ring,omitempty"`
+	Spread int   `json:"spread,omitempty"`
+	// Moves are the hash ranges of a sharded table that were migrated
+	// away from their hashed shard; a later move overrides an earlier one.
+	Moves []Move `json:"moves,omitempty"`
+	// Ranges, when set, place the rows of a range-sharded table by the
+	// value of their key instead of its hash. Numeric keys are compared
+	// as numbers.
+	Ranges  []KeyRange `json:"ranges,omitempty"`
+	Numeric bool       `json:"numeric,omitempty"`
+	// Reference tables have a full copy on every shard: writes go to all
+	// of them and reads to any one, so they can be joined with any table.
+	// Shard is where reads of the table alone go.
+	Reference bool `json:"reference,omitempty"`
+	// Filling is set while the rows of a table being made a reference
+	// table are copied to the other shards: writes go to all of them
+	// already, but reads only to Shard.
+	Filling bool `json:"filling,omitempty"`
+	// Migration is the migration of the table in progress, if any.
+	Migration *Migration `json:"migration,omitempty"`
+}
+
+// HashRange is an inclusive range of shard key hashes.
+type HashRange struct {
+	Lo uint32 `json:"lo"`
+	Hi uint32 `json:"hi"`
+}
+
+// AllHashes is the range of every hash.
+var AllHashes = HashRange{Lo: 0, Hi: ^uint32(0)}
+
+// Contains reports whether h lies in the range.
+func (r HashRange) Contains(h uint32) bool {
+	return h >= r.Lo && h <= r.Hi
+}
+
+// Size returns the number of hashes in the range.
+func (r HashRange) Size() uint64 {
+	return uint64(r.Hi) - uint64(r.Lo) + 1
+}
+
+func (r HashRange) String() string {
+	return fmt.Sprintf("%d-%d", r.Lo, r.Hi)
+}
+
+// Move places the rows of a sharded table whose key hashes into a range on
+// one shard.
+type Move struct {
+	HashRange
+	Shard int `json:"shard"`
+}
+
+// Fraction returns the share of all hashes that moves cover.
+func Fraction(moves []Move) float64 {
+	var n uint64
+	for _, mv := range moves {
+		n += mv.Size()
+	}
+	return float64(n) / float64(AllHashes.Size())
+}
+
+// Migration states. While copying, writes go to both the old and the new
+// shard and reads only to the old one; after the cutover the map points at
+// the new shard and the rows left on the old ones are being removed.
+const (
+	Copying = "copying"
+	Cleanup = "cleanup"
+)
+
+// Migration is a move of a table, or of hash ranges of a sharded table's
+// rows, to shards that hold none of its rows yet. An unsharded table has a
+// single move covering AllHashes. A range-sharded table instead moves from
+// its Prior ranges to new Ranges, possibly onto shards holding other
+// ranges.
+type Migration struct {
+	Moves []Move `json:"moves"`
+	From  []int  `json:"from"`
+	// Ring, when set, becomes the table's ring once the migration ends;
+	// Moves are then the ranges that ring places differently.
+	Ring   []int      `json:"ring,omitempty"`
+	Ranges []KeyRange `json:"ranges,omitempty"`
+	Prior  []KeyRange `json:"prior,omitempty"`
+	State  string     `json:"state"`
+	// Generated are the columns the old and new shards would each fill
+	// in themselves for a write that goes to both.
+	Generated Generated `json:"generated"`
+}
+
+// Generated names the columns of a table MySQL picks values for: Insert
+// those an INSERT may leave out, such as AUTO_INCREMENT columns and ones
+// defaulting to CURRENT_TIMESTAMP, and Update those an UPDATE sets to
+// CURRENT_TIMESTAMP unless it assigns them.
+type Generated struct {
+	Insert []string `json:"insert,omitempty"`
+	Update []string `json:"update,omitempty"`
+}
+
+// Dest returns the shard the migration moves a row with key hash h to, and
+// false if it does not move the row.
+func (m *Migration) Dest(h uint32) (int, bool) {
+	for _, mv := range m.Moves {
+		if mv.Contains(h) {
+			return mv.Shard, true
+		}
+	}
+	return 0, false
+}
+
+// Dest returns the shard the table's migration moves the row with the
+// given key value to, and false if it does not move the row.
+func (t Table) Dest(value string) (int, bool) {
+	mig := t.Migration
+	if mig == nil {
+		return 0, false
+	}
+	if t.RangeSharded() {
+		to := t.rangeShard(mig.Ranges, value)
+		return to, to != t.rangeShard(mig.Prior, value)
+	}
+	return mig.Dest(t.keyHash(value))
+}
+
+// Sharded reports whether the rows of the table are spread over shards by
+// their shard key.
+func (t Table) Sharded() bool {
+	return t.Key != ""
+}
+
+// KeyHash is the hash of a shard key value that places its row: 32-bit
+// FNV-1a, mixed by the MurmurHash3 finalizer since FNV alone spreads short,
+// similar keys poorly over the high bits that pick a point on the ring.
+func KeyHash(value string) uint32 {
+	h := fnv32(value)
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+	return h
+}
+
+func fnv32(value string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(value))
+	return h.Sum32()
+}
+
+// keyHash returns the hash of a key value of the table.
+func (t Table) keyHash(value string) uint32 {
+	return KeyHash(t.keyText(value))
+}
+
+func (t Table) spread(shards int) int {
+	if t.Spread > 0 {
+		return t.Spread
+	}
+	return shards
+}
+
+// ShardOf returns the shard holding the row of a sharded table with the
+// given key value. Tables sharded before the ring existed take the plain
+// FNV-1a hash of the key modulo their spread.
+func (t Table) ShardOf(value string, shards int) int {
+	if t.RangeSharded() {
+		return t.rangeShard(t.Ranges, value)
+	}
+	if t.Ring == nil {
+		if id, ok := t.moved(t.keyHash(value)); ok {
+			return id
+		}
+		return int(fnv32(t.keyText(value)) % uint32(t.spread(shards)))
+	}
+	return t.ringShard(t.keyHash(value))
+}
+
+// moved returns the shard that the moves of the table put a key hash on.
+func (t Table) moved(h uint32) (int, bool) {
+	for i := len(t.Moves) - 1; i >= 0; i-- {
+		if t.Moves[i].Contains(h) {
+			return t.Moves[i].Shard, true
+		}
+	}
+	return 0, false
+}
+
+// ringShard places a key hash of a table on a ring.
+func (t Table) ringShard(h uint32) int {
+	if id, ok := t.moved(h); ok {
+		return id
+	}
+	return NewRing(t.Ring).Locate(h)
+}
+
+// Owners returns the shards that may hold rows of the table, in order.
+func (t Table) Owners(shards int) []int {
+	if t.Reference || t.Filling {
+		ids := make([]int, shards)
+		for id := range ids {
+			ids[id] = id
+		}
+		return ids
+	}
+	if !t.Sharded() {
+		return []int{t.Shard}
+	}
+	if t.RangeSharded() {
+		var ids []int
+		for _, r := range t.Ranges {
+			ids = union(ids, []int{r.Shard})
+		}
+		return ids
+	}
+	ids := t.Ring
+	if ids == nil {
+		for id := 0; id < t.spread(shards); id++ {
+			ids = append(ids, id)
+		}
+	}
+	for _, mv := range t.Moves {
+		ids = union(ids, []int{mv.Shard})
+	}
+	return union(ids, nil)
+}
+
+// Source returns the shard the row with the given key value is migrated
+// from, and false if the table's migration does not move the row.
+func (t Table) Source(value string, shards int) (int, bool) {
+	mig := t.Migration
+	if mig == nil {
+		return 0, false
+	}
+	if t.RangeSharded() {
+		from := t.rangeShard(mig.Prior, value)
+		return from, from != t.rangeShard(mig.Ranges, value)
+	}
+	if _, ok := mig.Dest(t.keyHash(value)); !ok {
+		return 0, false
+	}
+	if !t.Sharded() {
+		return mig.From[0], true
+	}
+	prior := t
+	if mig.State == Cleanup {
+		// The cutover appended the migrated ranges to Moves
+		prior.Moves = t.Moves[:len(t.Moves)-len(mig.Moves)]
+	}
+	return prior.ShardOf(value, shards), true
+}
+
+// migratingTo returns the shard that a write to the row with the given key
+// value must also go to while the table is being copied, and false if
+// there is none.
+func (t Table) migratingTo(value string) (int, bool) {
+	if t.Migration == nil || t.Migration.State != Copying {
+		return 0, false
+	}
+	return t.Dest(value)
+}
+
+// Reassign returns the moves that would place the keys of a sharded table
+// on the ring of the given shards, with the shard each range would move
+// to. The table's own moves stay in effect. Tables sharded before the ring
+// existed cannot be reassigned and have none.
+func (t Table) Reassign(ring []int) []Move {
+	if !t.Sharded() || t.Ring == nil {
+		return nil
+	}
+	next := t
+	next.Ring = ring
+	// Both placements are constant between these bounds
+	bounds := append([]uint32{0}, NewRing(t.Ring).bounds()...)
+	bounds = append(bounds, NewRing(ring).bounds()...)
+	for _, mv := range t.Moves {
+		bounds = append(bounds, mv.Lo)
+		if mv.Hi != AllHashes.Hi {
+			bounds = append(bounds, mv.Hi+1)
+		}
+	}
+	sort.Slice(bounds, func(i, j int) bool { return bounds[i] < bounds[j] })
+	distinct := bounds[:1]
+	for _, b := range bounds[1:] {
+		if b != distinct[len(distinct)-1] {
+			distinct = append(distinct, b)
+		}
+	}
+
+	var moves []Move
+	for i, lo := range distinct {
+		hi := AllHashes.Hi
+		if i+1 < len(distinct) {
+			hi = distinct[i+1] - 1
+		}
+		to := next.ringShard(lo)
+		if t.ringShard(lo) == to {
+			continue
+		}
+		if n := len(moves); n > 0 && moves[n-1].Shard == to && moves[n-1].Hi+1 == lo {
+			moves[n-1].Hi = hi
+			continue
+		}
+		moves = append(moves, Move{HashRange: HashRange{Lo: lo, Hi: hi}, Shard: to})
+	}
+	return moves
+}
+
+// layout is the part of a placement stored as JSON in the layout column.
+type layout struct {
+	Ring      []int      `json:"ring,omitempty"`
+	Spread    int        `json:"spread,omitempty"`
+	Moves     []Move     `json:"moves,omitempty"`
+	Ranges    []KeyRange `json:"ranges,omitempty"`
+	Numeric   bool       `json:"numeric,omitempty"`
+	KeyType   string     `json:"key_type,omitempty"`
+	Collation string     `json:"collation,omitempty"`
+	Reference bool       `json:"reference,omitempty"`
+	Filling   bool       `json:"filling,omitempty"`
+	Migration *Migration `json:"migration,omitempty"`
+}
+
+// Snapshot is a versioned copy of a map, as stored and as sent to slaves.
+type Snapshot struct {
+	Version uint64  `json:"version"`
+	Tables  []Table `json:"tables"`
+	Ring    []int   `json:"ring,omitempty"`
+}
+
+// Map holds the placement of every known table. Every change bumps its
+// version and, once the map is attached to a database, is written through
+// to MetaDB before it becomes visible. It is safe for concurrent use.
+type Map struct {
+	mu      sync.RWMutex
+	shards  int
+	version uint64
+	tables  map[string]Table
+	// ring lists the shards that new tables and new shard keys are
+	// placed on; nil means every shard.
+	ring  []int
+	store *sql.DB
+}
+
+// NewMap returns an empty map for the given number of shards.
+func NewMap(shards int) *Map {
+	return &Map{shards: shards, tables: make(map[string]Table)}
+}
+
+func mapKey(db, table string) string {
+	return db + "." + table
+}
+
+// Attach creates the metadata tables in store if needed, loads the map
+// saved there and persists every later change to it.
+func (m *Map) Attach(store *sql.DB) error {
+	statements := []string{
+		"CREATE DATABASE IF NOT EXISTS " + MetaDB,
+		"CREATE TABLE IF NOT EXISTS " + MetaDB + ".shard_map (" +
+			"db_name VARCHAR(64) NOT NULL, " +
+			"table_name VARCHAR(64) NOT NULL, " +
+			"shard_id INT NOT NULL, " +
+			"shard_key VARCHAR(64) NOT NULL DEFAULT '', " +
+			"layout TEXT NULL, " +
+			"PRIMARY KEY (db_name, table_name))",
+		"CREATE TABLE IF NOT EXISTS " + MetaDB + ".shard_map_version (" +
+			"id TINYINT NOT NULL PRIMARY KEY, " +
+			"version BIGINT UNSIGNED NOT NULL)",
+		"CREATE TABLE IF NOT EXISTS " + MetaDB + ".shard_ring (" +
+			"shard_id INT NOT NULL PRIMARY KEY)",
+	}
+	for _, stmt := range statements {
+		if _, err := store.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	// Maps saved before tables could move have no layout column.
+	var columns int
+	err := store.QueryRow("SELECT COUNT(*) FROM information_schema.COLUMNS "+
+		"WHERE TABLE_SCHEMA = ? AND TABLE_NAME = 'shard_map' AND COLUMN_NAME = 'layout'", MetaDB).Scan(&columns)
+	if err != nil {
+		return err
+	}
+	if columns == 0 {
+		if _, err := store.Exec("ALTER TABLE " + MetaDB + ".shard_map ADD COLUMN layout TEXT NULL"); err != nil {
+			return err
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	err = store.QueryRow("SELECT version FROM " + MetaDB + ".shard_map_version WHERE id = 1").Scan(&m.version)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	rows, err := store.Query("SELECT db_name, table_name, shard_id, shard_key, layout FROM " + MetaDB + ".shard_map")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	m.tables = make(map[string]Table)
+	for rows.Next() {
+		var t Table
+		var saved sql.NullString
+		if err := rows.Scan(&t.DB, &t.Name, &t.Shard, &t.Key, &saved); err != nil {
+			return err
+		}
+		if saved.Valid && saved.String != "" {
+			var l layout
+			if err := json.Unmarshal([]byte(saved.String), &l); err != nil {
+				return fmt.Errorf("layout of %s.%s: %v", t.DB, t.Name, err)
+			}
+			t.Ring, t.Spread, t.Moves, t.Migration = l.Ring, l.Spread, l.Moves, l.Migration
+			t.Ranges, t.Numeric, t.Reference, t.Filling = l.Ranges, l.Numeric, l.Reference, l.Filling
+			t.KeyType, t.Collation = l.KeyType, l.Collation
+		}
+		if t.Sharded() && t.Ring == nil && t.Spread == 0 && t.Ranges == nil {
+			// Sharded before the spread was recorded: it was hashed
+			// over every shard configured at the time.
+			t.Spread = m.shards
+		}
+		m.tables[mapKey(t.DB, t.Name)] = t
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	ring, err := store.Query("SELECT shard_id FROM " + MetaDB + ".shard_ring ORDER BY shard_id")
+	if err != nil {
+		return err
+	}
+	defer ring.Close()
+	m.ring = nil
+	for ring.Next() {
+		var id int
+		if err := ring.Scan(&id); err != nil {
+			return err
+		}
+		m.ring = append(m.ring, id)
+	}
+	if err := ring.Err(); err != nil {
+		return err
+	}
+	m.store = store
+	return nil
+}
+
+// write applies change to the store together with the next version number
+// in one transaction. It must be called with m.mu held.
+func (m *Map) write(change func(tx *sql.Tx) error) error {
+	if m.store == nil {
+		m.version++
+		return nil
+	}
+	tx, err := m.store.Begin()
+	if err != nil {
+		return err
+	}
+	if err := change(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	_, err = tx.Exec("REPLACE INTO "+MetaDB+".shard_map_version (id, version) VALUES (1, ?)", m.version+1)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	m.version++
+	return nil
+}
+
+func upsert(tx *sql.Tx, t Table) error {
+	var saved sql.NullString
+	if t.Ring != nil || t.Spread > 0 || len(t.Moves) > 0 || t.Ranges != nil || t.KeyType != "" || t.Reference || t.Filling || t.Migration != nil {
+		b, err := json.Marshal(layout{Ring: t.Ring, Spread: t.Spread, Moves: t.Moves, Ranges: t.Ranges, Numeric: t.Numeric,
+			KeyType: t.KeyType, Collation: t.Collation, Reference: t.Reference, Filling: t.Filling, Migration: t.Migration})
+		if err != nil {
+			return err
+		}
+		saved = sql.NullString{String: string(b), Valid: true}
+	}
+	_, err := tx.Exec("REPLACE INTO "+MetaDB+".shard_map (db_name, table_name, shard_id, shard_key, layout) VALUES (?, ?, ?, ?, ?)",
+		t.DB, t.Name, t.Shard, t.Key, saved)
+	return err
+}
+
+// Shards returns the number of shards.
+func (m *Map) Shards() int {
+	return m.shards
+}
+
+func writeRing(tx *sql.Tx, ring []int) error {
+	if _, err := tx.Exec("DELETE FROM " + MetaDB + ".shard_ring"); err != nil {
+		return err
+	}
+	for _, id := range ring {
+		if _, err := tx.Exec("INSERT INTO "+MetaDB+".shard_ring (shard_id) VALUES (?)", id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Ring returns the shards on the ring that places new tables and the keys
+// of newly sharded ones.
+func (m *Map) Ring() []int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.currentRing()
+}
+
+func (m *Map) currentRing() []int {
+	if m.ring != nil {
+		return append([]int(nil), m.ring...)
+	}
+	ring := make([]int, m.shards)
+	for i := range ring {
+		ring[i] = i
+	}
+	return ring
+}
+
+// SetRing changes the shards on the ring. It does not move any table; see
+// Reshard.
+func (m *Map) SetRing(ring []int) error {
+	ring = union(ring, nil)
+	if len(ring) == 0 {
+		return fmt.Errorf("the ring needs at least one shard")
+	}
+	for _, id := range ring {
+		if id < 0 || id >= m.shards {
+			return fmt.Errorf("shard %d does not exist", id)
+		}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.write(func(tx *sql.Tx) error { return writeRing(tx, ring) }); err != nil {
+		return err
+	}
+	m.ring = ring
+	return nil
+}
+
+// Place returns the shard the ring puts a new unsharded table on.
+func (m *Map) Place(db, table string) int {
+	return NewRing(m.Ring()).Locate(KeyHash(mapKey(db, table)))
+}
+
+// Version returns the current version of the map.
+func (m *Map) Version() uint64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.version
+}
+
+// Len returns the number of tables in the map.
+func (m *Map) Len() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.tables)
+}
+
+// Lookup returns the placement of a table.
+func (m *Map) Lookup(db, table string) (Table, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	t, ok := m.tables[mapKey(db, table)]
+	return t, ok
+}
+
+// Assign places a table on a shard unless it is already placed, and returns
+// its placement. The boolean result reports whether the map changed.
+func (m *Map) Assign(db, table string, shard int) (Table, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if t, ok := m.tables[mapKey(db, table)]; ok {
+		return t, false, nil
+	}
+	t := Table{DB: db, Name: table, Shard: shard}
+	if err := m.write(func(tx *sql.Tx) error { return upsert(tx, t) }); err != nil {
+		return t, false, err
+	}
+	m.tables[mapKey(db, table)] = t
+	return t, true, nil
+}
+
+// SetKey declares the shard key column of a table, of the given data type
+// and, for text, collation, spreading its rows over the shards of the
+// ring. A table's shard key cannot be changed once declared.
+func (m *Map) SetKey(db, table, column, keyType, collation string) (Table, error) {
+	return m.setKey(db, table, column, keyType, collation, func(t *Table) error {
+		t.Ring = m.currentRing()
+		return nil
+	})
+}
+
+// SetRangeKey declares the shard key column of a table, of the given data
+// type and collation, whose rows are placed by ranges of its values,
+// compared as numbers if numeric.
+func (m *Map) SetRangeKey(db, table, column, keyType, collation string, ranges []KeyRange) (Table, error) {
+	return m.setKey(db, table, column, keyType, collation, func(t *Table) error {
+		t.Numeric = t.numericKey()
+		if err := t.CheckRanges(ranges, m.shards); err != nil {
+			return err
+		}
+		t.Ranges = ranges
+		return nil
+	})
+}
+
+func (m *Map) setKey(db, table, column, keyType, collation string, place func(t *Table) error) (Table, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.tables[mapKey(db, table)]
+	if t.Reference || t.Filling {
+		return t, fmt.Errorf("table %s.%s is a reference table", db, table)
+	}
+	if ok && t.Key != "" {
+		if t.Key != column {
+			return t, fmt.Errorf("table %s.%s is already sharded on %s", db, table, t.Key)
+		}
+		return t, nil
+	}
+	if t.Migration != nil {
+		return t, fmt.Errorf("table %s.%s is being migrated", db, table)
+	}
+	if classOf(keyType) == classText && !SupportedCollation(collation) {
+		return t, fmt.Errorf("shard key column %s of table %s.%s uses collation %s, whose order is not supported; use utf8mb4_0900_ai_ci, utf8mb4_0900_as_ci, utf8mb4_0900_as_cs, utf8mb4_0900_bin or utf8mb4_bin", column, db, table, collation)
+	}
+	t.DB, t.Name, t.Key, t.KeyType = db, table, column, strings.ToLower(keyType)
+	if classOf(keyType) == classText {
+		t.Collation = strings.ToLower(collation)
+	}
+	if err := place(&t); err != nil {
+		return t, err
+	}
+	if err := m.write(func(tx *sql.Tx) error { return upsert(tx, t) }); err != nil {
+		return t, err
+	}
+	m.tables[mapKey(db, table)] = t
+	return t, nil
+}
+
+// update applies change to the placement of a table and saves it.
+func (m *Map) update(db, table string, change func(t *Table) error) (Table, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.tables[mapKey(db, table)]
+	if !ok {
+		return t, fmt.Errorf("table %s.%s is not in the shard map", db, table)
+	}
+	// Moves is shared with the stored copy; change must not append to it
+	// in place.
+	t.Moves = append([]Move(nil), t.Moves...)
+	if err := change(&t); err != nil {
+		return t, err
+	}
+	if err := m.write(func(tx *sql.Tx) error { return upsert(tx, t) }); err != nil {
+		return t, err
+	}
+	m.tables[mapKey(db, table)] = t
+	return t, nil
+}
+
+// StartMigration begins moving a table to shard to. A sharded table moves
+// the rows whose key hashes into r, an unsharded one moves whole and r must
+// be nil. gen names the table's generated columns.
+func (m *Map) StartMigration(db, table string, to int, r *HashRange, gen Generated) (Table, error) {
+	return m.update(db, table, func(t *Table) error {
+		switch {
+		case t.Reference || t.Filling:
+			return fmt.Errorf("table %s.%s is a reference table and is already on every shard", db, table)
+		case t.RangeSharded():
+			return fmt.Errorf("table %s.%s is range-sharded; its ranges are moved by splitting and merging them", db, table)
+		case t.Sharded() && r == nil:
+			return fmt.Errorf("sharded table %s.%s needs a hash range to move", db, table)
+		case t.Sharded() && r.Lo > r.Hi:
+			return fmt.Errorf("empty hash range %s", r)
+		case t.Sharded():
+			return m.begin(t, []Move{{HashRange: *r, Shard: to}}, nil, gen)
+		case r != nil:
+			return fmt.Errorf("table %s.%s is not sharded; it can only move whole", db, table)
+		}
+		return m.begin(t, []Move{{HashRange: AllHashes, Shard: to}}, nil, gen)
+	})
+}
+
+// Reshard places the keys of a sharded table on the ring of the given
+// shards. It starts a migration of the ranges that ring places elsewhere,
+// or switches the ring right away if there are none.
+func (m *Map) Reshard(db, table string, ring []int, gen Generated) (Table, error) {
+	return m.update(db, table, func(t *Table) error {
+		if !t.Sharded() || t.Ring == nil {
+			return fmt.Errorf("table %s.%s does not place its keys on a ring", db, table)
+		}
+		moves := t.Reassign(ring)
+		if len(moves) == 0 {
+			if t.Migration != nil {
+				return fmt.Errorf("table %s.%s is already being migrated", db, table)
+			}
+			t.Ring = ring
+			return nil
+		}
+		return m.begin(t, moves, ring, gen)
+	})
+}
+
+// FillReference starts making a table a reference table: writes go to
+// every shard from now on, while its rows are copied to the others.
+func (m *Map) FillReference(db, table string) (Table, error) {
+	return m.update(db, table, func(t *Table) error {
+		switch {
+		case t.Sharded():
+			return fmt.Errorf("table %s.%s is sharded on %s", db, table, t.Key)
+		case t.Migration != nil:
+			return fmt.Errorf("table %s.%s is being migrated", db, table)
+		}
+		t.Filling = true
+		return nil
+	})
+}
+
+// SetReference makes a table being filled a reference table. Its rows must
+// have been copied to every shard by then.
+func (m *Map) SetReference(db, table string) (Table, error) {
+	return m.update(db, table, func(t *Table) error {
+		if !t.Filling {
+			return fmt.Errorf("table %s.%s is not being made a reference table", db, table)
+		}
+		t.Filling, t.Reference = false, true
+		return nil
+	})
+}
+
+// Rerange places the rows of a range-sharded table by new ranges. It starts
+// a migration of the key ranges they place on other shards, or switches to
+// them right away if there are none.
+func (m *Map) Rerange(db, table string, ranges []KeyRange, gen Generated) (Table, error) {
+	return m.update(db, table, func(t *Table) error {
+		if !t.RangeSharded() {
+			return fmt.Errorf("table %s.%s is not range-sharded", db, table)
+		}
+		if t.Migration != nil {
+			return fmt.Errorf("table %s.%s is already being migrated", db, table)
+		}
+		if err := t.CheckRanges(ranges, m.shards); err != nil {
+			return err
+		}
+		mig := &Migration{Prior: t.Ranges, Ranges: ranges, State: Copying, Generated: gen}
+		next := *t
+		next.Migration = mig
+		for _, s := range next.spans() {
+			mig.From = union(mig.From, []int{s.from})
+		}
+		if len(mig.From) == 0 {
+			t.Ranges = ranges
+			return nil
+		}
+		// Reads skip the rows being moved on the shards they move to,
+		// so those may hold other ranges.
+		t.Migration = mig
+		return nil
+	})
+}
+
+// begin records the migration of t. It must be called with m.mu held.
+func (m *Map) begin(t *Table, moves []Move, ring []int, gen Generated) error {
+	if t.Migration != nil {
+		return fmt.Errorf("table %s.%s is already being migrated", t.DB, t.Name)
+	}
+	mig := &Migration{Moves: moves, Ring: ring, State: Copying, Generated: gen}
+	if t.Sharded() {
+		mig.From = t.Owners(m.shards)
+	} else {
+		mig.From = []int{t.Shard}
+	}
+	for _, mv := range moves {
+		if mv.Shard < 0 || mv.Shard >= m.shards {
+			return fmt.Errorf("shard %d does not exist", mv.Shard)
+		}
+		// Reads ignore the destination until the cutover, which would
+		// hide rows it already holds.
+		for _, id := range mig.From {
+			if id == mv.Shard {
+				return fmt.Errorf("shard %d already holds rows of %s.%s", id, t.DB, t.Name)
+			}
+		}
+	}
+	t.Migration = mig
+	return nil
+}
+
+// Cutover points the map at the destinations of a table's migration and
+// moves the migration on to cleaning up the old shards.
+func (m *Map) Cutover(db, table string) (Table, error) {
+	return m.update(db, table, func(t *Table) error {
+		if t.Migration == nil || t.Migration.State != Copying {
+			return fmt.Errorf("table %s.%s is not being copied", db, table)
+		}
+		mig := *t.Migration
+		if t.RangeSharded() {
+			t.Ranges = mig.Ranges
+		} else if t.Sharded() {
+			t.Moves = append(t.Moves, mig.Moves...)
+		} else {
+			t.Shard = mig.Moves[0].Shard
+		}
+		mig.State = Cleanup
+		t.Migration = &mig
+		return nil
+	})
+}
+
+// EndMigration forgets the migration of a table once it is complete or
+// abandoned. Abandoning is only possible before the cutover. A complete
+// migration to a new ring replaces the moves it added by that ring.
+func (m *Map) EndMigration(db, table string) (Table, error) {
+	return m.update(db, table, func(t *Table) error {
+		mig := t.Migration
+		if mig == nil {
+			return fmt.Errorf("table %s.%s is not being migrated", db, table)
+		}
+		if mig.State == Cleanup && mig.Ring != nil {
+			t.Ring = mig.Ring
+			t.Moves = t.Moves[:len(t.Moves)-len(mig.Moves)]
+			if len(t.Moves) == 0 {
+				t.Moves = nil
+			}
+		}
+		t.Migration = nil
+		return nil
+	})
+}
+
+// Remove forgets the placement of a table. An empty table name removes every
+// table of the database. The boolean result reports whether the map changed.
+func (m *Map) Remove(db, table string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var keys []string
+	for key, t := range m.tables {
+		if t.DB == db && (table == "" || t.Name == table) {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return false, nil
+	}
+	err := m.write(func(tx *sql.Tx) error {
+		var err error
+		if table == "" {
+			_, err = tx.Exec("DELETE FROM "+MetaDB+".shard_map WHERE db_name = ?", db)
+		} else {
+			_, err = tx.Exec("DELETE FROM "+MetaDB+".shard_map WHERE db_name = ? AND table_name = ?", db, table)
+		}
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	for _, key := range keys {
+		delete(m.tables, key)
+	}
+	return true, nil
+}
+
+// Snapshot returns a copy of the map and its version.
+func (m *Map) Snapshot() Snapshot {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return Snapshot{Version: m.version, Tables: m.sortedTables(), Ring: append([]int(nil), m.ring...)}
+}
+
+// Replace overwrites the map with a snapshot received from the master.
+func (m *Map) Replace(s Snapshot) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.store != nil {
+		tx, err := m.store.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec("DELETE FROM " + MetaDB + ".shard_map"); err != nil {
+			tx.Rollback()
+			return err
+		}
+		for _, t := range s.Tables {
+			if err := upsert(tx, t); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+		if err := writeRing(tx, s.Ring); err != nil {
+			tx.Rollback()
+			return err
+		}
+		_, err = tx.Exec("REPLACE INTO "+MetaDB+".shard_map_version (id, version) VALUES (1, ?)", s.Version)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	m.version = s.Version
+	m.ring = s.Ring
+	m.tables = make(map[string]Table, len(s.Tables))
+	for _, t := range s.Tables {
+		m.tables[mapKey(t.DB, t.Name)] = t
+	}
+	return nil
+}
+
+// Tables returns every placement, ordered by database and table name.
+func (m *Map) Tables() []Table {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.sortedTables()
+}
+
+func (m *Map) sortedTables() []Table {
+	tables := make([]Table, 0, len(m.tables))
+	for _, t := range m.tables {
+		tables = append(tables, t)
+	}
+	sort.Slice(tables, func(i, j int) bool {
+		return mapKey(tables[i].DB, tables[i].Name) < mapKey(tables[j].DB, tables[j].Name)
+	})
+	return tables
+}
@@ -0,0 +1,283 @@
+package shard
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"distributed-db/sqlparse"
+)
+
+// KeyRange places the rows of a range-sharded table whose shard key is at
+// least Start, and below the Start of the next range, on Shard. The first
+// range of a table has no lower bound and an empty Start.
+type KeyRange struct {
+	Start string `json:"start"`
+	Shard int    `json:"shard"`
+}
+
+// RangeSharded reports whether the table places its rows by ranges of
+// shard key values rather than by their hash.
+func (t Table) RangeSharded() bool {
+	return t.Ranges != nil
+}
+
+// Compare orders two shard key values of a range-sharded table: as
+// numbers for a numeric key, as strings in the order of the key column's
+// collation for text, in which the conditions on the key that migrations
+// and clients send are evaluated, and byte-wise for anything else. Values
+// equal under the collation, such as 'a' and 'A' in a case-insensitive
+// one, compare as equal and so always share a range. Dates and times
+// written in ISO form order chronologically.
+func (t Table) Compare(a, b string) int {
+	if t.Numeric {
+		if x, err := strconv.ParseInt(a, 10, 64); err == nil {
+			if y, err := strconv.ParseInt(b, 10, 64); err == nil {
+				switch {
+				case x < y:
+					return -1
+				case x > y:
+					return 1
+				}
+				return 0
+			}
+		}
+		if x, err := strconv.ParseFloat(a, 64); err == nil {
+			if y, err := strconv.ParseFloat(b, 64); err == nil {
+				switch {
+				case x < y:
+					return -1
+				case x > y:
+					return 1
+				}
+				return 0
+			}
+		}
+	}
+	if classOf(t.KeyType) == classBytes {
+		return strings.Compare(a, b)
+	}
+	return orderOf(t.Collation).compare(a, b)
+}
+
+// rangeIndex returns the index of the range holding a key value.
+func (t Table) rangeIndex(ranges []KeyRange, value string) int {
+	return sort.Search(len(ranges)-1, func(i int) bool {
+		return t.Compare(value, ranges[i+1].Start) < 0
+	})
+}
+
+// rangeShard returns the shard that ranges put a key value on.
+func (t Table) rangeShard(ranges []KeyRange, value string) int {
+	return ranges[t.rangeIndex(ranges, value)].Shard
+}
+
+// rangeShards returns the shards whose ranges overlap the interval, in
+// order.
+func (t Table) rangeShards(ranges []KeyRange, iv sqlparse.Interval) []int {
+	var ids []int
+	for i, r := range ranges {
+		// range i is [r.Start, next.Start)
+		if i > 0 && !iv.Hi.Unbounded {
+			c := t.Compare(iv.Hi.Value, r.Start)
+			if c < 0 || (c == 0 && !iv.Hi.Inclusive) {
+				continue
+			}
+		}
+		if i+1 < len(ranges) && !iv.Lo.Unbounded && t.Compare(iv.Lo.Value, ranges[i+1].Start) >= 0 {
+			continue
+		}
+		ids = union(ids, []int{r.Shard})
+	}
+	return ids
+}
+
+// CheckRanges reports whether ranges are a valid placement for the table:
+// at least one range, starts in increasing order, and existing shards.
+func (t Table) CheckRanges(ranges []KeyRange, shards int) error {
+	if len(ranges) == 0 || ranges[0].Start != "" {
+		return fmt.Errorf("the first range must have no lower bound")
+	}
+	for i, r := range ranges {
+		if r.Shard < 0 || r.Shard >= shards {
+			return fmt.Errorf("shard %d does not exist", r.Shard)
+		}
+		if i > 0 && r.Start == "" {
+			return fmt.Errorf("only the first range can have no lower bound")
+		}
+		if i > 1 && t.Compare(ranges[i-1].Start, r.Start) >= 0 {
+			return fmt.Errorf("range starts %q and %q are out of order", ranges[i-1].Start, r.Start)
+		}
+		if i > 0 && t.Numeric {
+			if _, err := strconv.ParseFloat(r.Start, 64); err != nil {
+				return fmt.Errorf("range start %q is not a number", r.Start)
+			}
+		}
+	}
+	return nil
+}
+
+// Split returns the ranges of the table with the range holding at split
+// in two there, the upper part placed on shard to.
+func (t Table) Split(at string, to int) ([]KeyRange, error) {
+	if !t.RangeSharded() {
+		return nil, fmt.Errorf("table %s.%s is not range-sharded", t.DB, t.Name)
+	}
+	if at == "" {
+		return nil, fmt.Errorf("a range needs a start to split at")
+	}
+	i := t.rangeIndex(t.Ranges, at)
+	if i > 0 && t.Compare(t.Ranges[i].Start, at) == 0 {
+		return nil, fmt.Errorf("a range of %s.%s already starts at %q", t.DB, t.Name, at)
+	}
+	ranges := append([]KeyRange(nil), t.Ranges[:i+1]...)
+	ranges = append(ranges, KeyRange{Start: at, Shard: to})
+	return append(ranges, t.Ranges[i+1:]...), nil
+}
+
+// Merge returns the ranges of the table with the range starting at at
+// joined to the one below it, on that range's shard.
+func (t Table) Merge(at string) ([]KeyRange, error) {
+	if !t.RangeSharded() {
+		return nil, fmt.Errorf("table %s.%s is not range-sharded", t.DB, t.Name)
+	}
+	i := t.rangeIndex(t.Ranges, at)
+	if i == 0 || t.Compare(t.Ranges[i].Start, at) != 0 {
+		return nil, fmt.Errorf("no range of %s.%s starts at %q", t.DB, t.Name, at)
+	}
+	ranges := append([]KeyRange(nil), t.Ranges[:i]...)
+	return append(ranges, t.Ranges[i+1:]...), nil
+}
+
+// RangeCondition returns an SQL condition selecting the rows in range i of
+// ranges.
+func (t Table) RangeCondition(ranges []KeyRange, i int) string {
+	lo, hi := "", ""
+	if i > 0 {
+		lo = ranges[i].Start
+	}
+	if i+1 < len(ranges) {
+		hi = ranges[i+1].Start
+	}
+	return t.spanCondition(span{lo: lo, hi: hi})
+}
+
+// span is a range of key values, from lo inclusive to hi exclusive; an
+// empty bound is unbounded. A migration moves a span from one shard to
+// another.
+type span struct {
+	lo, hi   string
+	from, to int
+}
+
+// spans returns the key ranges that the migration of a range-sharded
+// table moves, in order.
+func (t Table) spans() []span {
+	mig := t.Migration
+	if mig == nil || !t.RangeSharded() {
+		return nil
+	}
+	// Both placements are constant between these bounds
+	var bounds []string
+	for _, r := range append(append([]KeyRange(nil), mig.Prior[1:]...), mig.Ranges[1:]...) {
+		bounds = append(bounds, r.Start)
+	}
+	sort.Slice(bounds, func(i, j int) bool { return t.Compare(bounds[i], bounds[j]) < 0 })
+	var starts []string
+	for i, b := range bounds {
+		if i == 0 || t.Compare(b, bounds[i-1]) != 0 {
+			starts = append(starts, b)
+		}
+	}
+
+	var spans []span
+	for i := -1; i < len(starts); i++ {
+		s := span{from: mig.Prior[0].Shard, to: mig.Ranges[0].Shard}
+		if i >= 0 {
+			s.lo = starts[i]
+			s.from, s.to = t.rangeShard(mig.Prior, s.lo), t.rangeShard(mig.Ranges, s.lo)
+		}
+		if i+1 < len(starts) {
+			s.hi = starts[i+1]
+		}
+		if s.from == s.to {
+			continue
+		}
+		if n := len(spans); n > 0 && spans[n-1].hi == s.lo && spans[n-1].from == s.from && spans[n-1].to == s.to {
+			spans[n-1].hi = s.hi
+			continue
+		}
+		spans = append(spans, s)
+	}
+	return spans
+}
+
+// hidden returns the spans whose rows reads from shard id must skip while
+// the table is migrated: copies on their destination until the cutover,
+// and rows left on their source after it.
+func (t Table) hidden(id int, servers *Servers) []span {
+	var out []span
+	for _, s := range t.spans() {
+		if servers.Shared(s.from, s.to) {
+			continue
+		}
+		if (t.Migration.State == Copying && s.to == id) || (t.Migration.State == Cleanup && s.from == id) {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+func (t Table) spanCondition(s span) string {
+	key := quoteIdent(t.Key)
+	var parts []string
+	if s.lo != "" {
+		parts = append(parts, key+" >= "+t.literal(s.lo))
+	}
+	if s.hi != "" {
+		parts = append(parts, key+" < "+t.literal(s.hi))
+	}
+	if len(parts) == 0 {
+		return "TRUE"
+	}
+	return strings.Join(parts, " AND ")
+}
+
+// literal renders a key value as an SQL literal.
+func (t Table) literal(value string) string {
+	if _, err := strconv.ParseFloat(value, 64); err == nil && t.Numeric {
+		return value
+	}
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(value) + "'"
+}
+
+func quoteIdent(name string) string {
+	return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+}
+
+// hideRows rewrites a read of a range-sharded table so that it skips the
+// rows of spans, by replacing the table in its FROM clause with a derived
+// table of the other rows.
+func hideRows(t Table, stmt *sqlparse.Statement, spans []span) (string, error) {
+	if len(spans) == 0 {
+		return stmt.Query, nil
+	}
+	if stmt.TableEnd == 0 || stmt.Compound || len(stmt.CTEs) > 0 {
+		return "", fmt.Errorf("table %s.%s is being migrated; only plain SELECTs from it can be run", t.DB, t.Name)
+	}
+	conds := make([]string, len(spans))
+	for i, s := range spans {
+		conds[i] = "(" + t.spanCondition(s) + ")"
+	}
+	name := quoteIdent(stmt.Table.Name)
+	if stmt.Table.DB != "" {
+		name = quoteIdent(stmt.Table.DB) + "." + name
+	}
+	alias := stmt.TableAlias
+	if alias == "" {
+		alias = stmt.Table.Name
+	}
+	derived := fmt.Sprintf("(SELECT * FROM %s WHERE NOT (%s)) AS %s", name, strings.Join(conds, " OR "), quoteIdent(alias))
+	return stmt.Query[:stmt.TableStart] + derived + stmt.Query[stmt.TableEnd:], nil
+}
@@ -0,0 +1,87 @@
+package shard
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Vnodes is the number of points each shard has on a ring. More points
+// even out the share of keys each shard gets.
+const Vnodes = 128
+
+// Ring places hashes on shards by consistent hashing: every shard owns the
+// hashes up to each of its points, so adding or removing a shard only
+// moves the hashes next to that shard's points.
+type Ring struct {
+	points []uint32
+	owners []int
+}
+
+// rings caches the ring of each set of shards, keyed by ringKey.
+var rings sync.Map
+
+// NewRing returns the ring of the given shards.
+func NewRing(shards []int) *Ring {
+	key := ringKey(shards)
+	if r, ok := rings.Load(key); ok {
+		return r.(*Ring)
+	}
+	r := &Ring{}
+	type point struct {
+		hash  uint32
+		shard int
+	}
+	var points []point
+	for _, id := range shards {
+		for v := 0; v < Vnodes; v++ {
+			points = append(points, point{KeyHash(fmt.Sprintf("shard-%d#%d", id, v)), id})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool {
+		if points[i].hash != points[j].hash {
+			return points[i].hash < points[j].hash
+		}
+		return points[i].shard < points[j].shard
+	})
+	for _, p := range points {
+		r.points = append(r.points, p.hash)
+		r.owners = append(r.owners, p.shard)
+	}
+	rings.Store(key, r)
+	return r
+}
+
+func ringKey(shards []int) string {
+	ids := make([]string, len(shards))
+	for i, id := range shards {
+		ids[i] = fmt.Sprint(id)
+	}
+	return strings.Join(ids, ",")
+}
+
+// Locate returns the shard owning a hash: that of the first point at or
+// after it, wrapping around past the last point.
+func (r *Ring) Locate(h uint32) int {
+	if len(r.points) == 0 {
+		return 0
+	}
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[i]
+}
+
+// bounds returns the first hash of every range the ring places on one
+// shard.
+func (r *Ring) bounds() []uint32 {
+	var b []uint32
+	for _, p := range r.points {
+		if p != ^uint32(0) {
+			b = append(b, p+1)
+		}
+	}
+	return b
+}
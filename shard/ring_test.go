@@ -0,0 +1,80 @@
+package shard
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRingLocate(t *testing.T) {
+	r := NewRing([]int{0, 1, 2, 3})
+	if NewRing([]int{0, 1, 2, 3}) != r {
+		t.Error("NewRing does not reuse the ring of the same shards")
+	}
+	counts := make(map[int]int)
+	const keys = 20000
+	for i := 0; i < keys; i++ {
+		h := KeyHash(fmt.Sprint(i))
+		id := r.Locate(h)
+		if id < 0 || id > 3 {
+			t.Fatalf("Locate(%d) = %d, not a shard of the ring", h, id)
+		}
+		if r.Locate(h) != id {
+			t.Fatalf("Locate(%d) is not stable", h)
+		}
+		counts[id]++
+	}
+	for id := 0; id < 4; id++ {
+		// Each shard should get about a quarter of the keys
+		if share := float64(counts[id]) / keys; share < 0.15 || share > 0.35 {
+			t.Errorf("shard %d holds %.0f%% of the keys", id, share*100)
+		}
+	}
+	if last := r.points[len(r.points)-1]; last != ^uint32(0) {
+		if got := r.Locate(last + 1); got != r.owners[0] {
+			t.Errorf("Locate past the last point = %d, want the owner of the first point, %d", got, r.owners[0])
+		}
+	}
+	if got := NewRing(nil).Locate(42); got != 0 {
+		t.Errorf("empty ring Locate = %d, want 0", got)
+	}
+}
+
+func TestRingAddShard(t *testing.T) {
+	before := NewRing([]int{0, 1, 2})
+	after := NewRing([]int{0, 1, 2, 3})
+	moved := 0
+	const keys = 20000
+	for i := 0; i < keys; i++ {
+		h := KeyHash(fmt.Sprint("key-", i))
+		from, to := before.Locate(h), after.Locate(h)
+		if from != to {
+			if to != 3 {
+				t.Fatalf("key %d moved from shard %d to %d, not to the new shard", i, from, to)
+			}
+			moved++
+		}
+	}
+	if share := float64(moved) / keys; share < 0.15 || share > 0.35 {
+		t.Errorf("adding a fourth shard moved %.0f%% of the keys", share*100)
+	}
+}
+
+func TestRingBounds(t *testing.T) {
+	r := NewRing([]int{0, 1})
+	bounds := r.bounds()
+	if len(bounds) == 0 {
+		t.Fatal("no bounds")
+	}
+	for i, lo := range bounds {
+		hi := ^uint32(0)
+		if i+1 < len(bounds) {
+			hi = bounds[i+1] - 1
+		}
+		if lo > hi {
+			continue
+		}
+		if r.Locate(lo) != r.Locate(hi) {
+			t.Fatalf("range %d..%d spans shards %d and %d", lo, hi, r.Locate(lo), r.Locate(hi))
+		}
+	}
+}
@@ -0,0 +1,386 @@
+package shard
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"distributed-db/sqlparse"
+)
+
+// Target is a statement to run on one shard.
+type Target struct {
+	Shard int
+	Query string
+}
+
+// Route splits a statement into the statements each shard of servers must
+// run. tables holds the placement of every table the statement references,
+// in the order of stmt.Tables. A statement may reference several tables only
+// when none of them is sharded and all of them live on the same shard; it
+// then runs whole on that shard. Reference tables are on every shard, so
+// they can be combined with any table and leave the choice of shards to the
+// others; a write to a reference table goes to every shard and a read of
+// reference tables alone to one. While a table is being made a reference
+// table, writes to it already go to every shard but reads only to its own.
+// For a sharded table, INSERT rows are grouped by the hash of their shard
+// key and UPDATE, DELETE and SELECT go to the shards selected by shard key
+// equality or IN predicates in the WHERE clause, or to every shard holding
+// rows of the table otherwise. A range-sharded table also narrows them down
+// by comparisons and BETWEEN predicates on its key. While a table is being
+// migrated, writes to the rows being moved also go to the destination shard,
+// unless it is on the same server, and reads ignore it until the cutover.
+// The destination of a range-sharded table may hold other ranges, so reads
+// from it skip the moved rows instead, as they skip the rows left on the old
+// shard after the cutover. Both copies run such writes on their own, so
+// they must not leave the values they store to the server: see
+// deterministic.
+func Route(tables []Table, servers *Servers, stmt *sqlparse.Statement) ([]Target, error) {
+	shards := servers.Shards()
+	if len(tables) == 0 {
+		return nil, fmt.Errorf("statement does not reference a table")
+	}
+	write := !stmt.Kind.IsRead()
+	var placed []Table
+	for _, t := range tables {
+		if !t.Reference {
+			placed = append(placed, t)
+		} else if write && writes(stmt, t) {
+			for _, other := range tables {
+				if !other.Reference {
+					return nil, fmt.Errorf("reference table %s.%s cannot be written together with table %s.%s", t.DB, t.Name, other.DB, other.Name)
+				}
+			}
+		}
+	}
+	if len(placed) == 0 {
+		if write {
+			return broadcast(stmt.Query, tables[0].Owners(shards)), nil
+		}
+		return broadcast(stmt.Query, []int{tables[0].Shard}), nil
+	}
+	t := placed[0]
+	for _, other := range placed[1:] {
+		switch {
+		case write && (t.Filling || other.Filling):
+			filling := t
+			if !t.Filling {
+				filling = other
+			}
+			return nil, fmt.Errorf("table %s.%s is being made a reference table and cannot be written together with other tables", filling.DB, filling.Name)
+		case write && (t.Migration != nil || other.Migration != nil):
+			moving := t
+			if t.Migration == nil {
+				moving = other
+			}
+			return nil, fmt.Errorf("table %s.%s is being migrated and cannot be written together with other tables", moving.DB, moving.Name)
+		case t.Sharded() || other.Sharded():
+			sharded := t
+			if !t.Sharded() {
+				sharded = other
+			}
+			return nil, fmt.Errorf("sharded table %s.%s cannot be combined with other tables in one statement", sharded.DB, sharded.Name)
+		case other.Shard != t.Shard:
+			return nil, fmt.Errorf("tables %s.%s and %s.%s are on different shards", t.DB, t.Name, other.DB, other.Name)
+		}
+	}
+	if write && t.Migration != nil && t.Migration.State == Copying {
+		if err := deterministic(t, stmt); err != nil {
+			return nil, err
+		}
+	}
+	if !t.Sharded() {
+		ids := []int{t.Shard}
+		if to, ok := t.migratingTo(""); write && ok && !servers.Shared(t.Shard, to) {
+			ids = append(ids, to)
+		}
+		if write && t.Filling {
+			ids = t.Owners(shards)
+		}
+		return broadcast(stmt.Query, ids), nil
+	}
+
+	switch stmt.Kind {
+	case sqlparse.Insert, sqlparse.Replace:
+		// ON DUPLICATE KEY UPDATE changes the existing row in place, on
+		// the shard of the key it had
+		if err := keepsKey(t, stmt.OnDuplicate); err != nil {
+			return nil, err
+		}
+		return routeInsert(t, servers, stmt)
+	case sqlparse.Update:
+		if err := keepsKey(t, stmt.Set); err != nil {
+			return nil, err
+		}
+	}
+
+	// The WHERE clause only restricts the rows of the table when it is the
+	// statement's own, not that of a derived table, CTE or UNION part.
+	var ids []int
+	if stmt.Table.Name != "" && len(stmt.CTEs) == 0 && !stmt.Compound {
+		if values, ok := sqlparse.ColumnValues(stmt.Where, t.Key, t.keyText); ok {
+			var err error
+			if ids, err = shardsOf(t, values, servers, write); err != nil {
+				return nil, err
+			}
+		} else if intervals, ok := sqlparse.ColumnIntervals(stmt.Where, t.Key, t.Compare); ok && t.RangeSharded() {
+			ids = intervalShards(t, intervals, write)
+		}
+	}
+	copying := t.Migration != nil && t.Migration.State == Copying
+	if ids == nil {
+		ids = t.Owners(shards)
+		if write && copying {
+			for _, mv := range t.Migration.Moves {
+				ids = union(ids, []int{mv.Shard})
+			}
+			for _, r := range t.Migration.Ranges {
+				ids = union(ids, []int{r.Shard})
+			}
+		}
+	}
+	if write || !t.RangeSharded() || t.Migration == nil {
+		return broadcast(stmt.Query, ids), nil
+	}
+	targets := make([]Target, len(ids))
+	for i, id := range ids {
+		query, err := hideRows(t, stmt, t.hidden(id, servers))
+		if err != nil {
+			return nil, err
+		}
+		targets[i] = Target{Shard: id, Query: query}
+	}
+	return targets, nil
+}
+
+// intervalShards returns the shards holding the key values in intervals of
+// a range-sharded table.
+func intervalShards(t Table, intervals []sqlparse.Interval, write bool) []int {
+	if len(intervals) == 0 {
+		return t.Owners(0)[:1]
+	}
+	var ids []int
+	for _, iv := range intervals {
+		ids = union(ids, t.rangeShards(t.Ranges, iv))
+		if write && t.Migration != nil && t.Migration.State == Copying {
+			ids = union(ids, t.rangeShards(t.Migration.Ranges, iv))
+		}
+	}
+	return ids
+}
+
+// writes reports whether t is the table a statement writes to.
+func writes(stmt *sqlparse.Statement, t Table) bool {
+	return stmt.Table.Name == t.Name && (stmt.Table.DB == "" || stmt.Table.DB == t.DB)
+}
+
+// keepsKey fails if assignments change the shard key of a row, which would
+// leave it on a shard that no longer holds its key.
+func keepsKey(t Table, set []sqlparse.Assignment) error {
+	for _, a := range set {
+		if strings.EqualFold(a.Column.Name, t.Key) {
+			return fmt.Errorf("cannot change shard key column %s of table %s", t.Key, t.Name)
+		}
+	}
+	return nil
+}
+
+// deterministic fails for a write to a table being copied that the old and
+// the new shard could apply differently: one calling a function such as
+// NOW() or UUID(), inserting rows without values for the columns MySQL
+// fills in, such as AUTO_INCREMENT ones, or updating rows without setting
+// the columns MySQL sets to the current time.
+func deterministic(t Table, stmt *sqlparse.Statement) error {
+	if name := stmt.Volatile(); name != "" {
+		return fmt.Errorf("table %s.%s is being migrated; writes to it cannot call %s", t.DB, t.Name, name)
+	}
+	gen := t.Migration.Generated
+	switch stmt.Kind {
+	case sqlparse.Insert, sqlparse.Replace:
+		for _, col := range gen.Insert {
+			if !setsLiteral(stmt, col) {
+				return fmt.Errorf("table %s.%s is being migrated; rows inserted into it must give column %s a literal value", t.DB, t.Name, col)
+			}
+		}
+		if len(stmt.OnDuplicate) > 0 {
+			return assignsAll(t, stmt.OnDuplicate, gen)
+		}
+	case sqlparse.Update:
+		return assignsAll(t, stmt.Set, gen)
+	}
+	return nil
+}
+
+// setsLiteral reports whether an INSERT gives column a literal value in
+// every row.
+func setsLiteral(stmt *sqlparse.Statement, column string) bool {
+	for _, a := range stmt.Set {
+		if strings.EqualFold(a.Column.Name, column) {
+			_, ok := a.Value.(*sqlparse.Literal)
+			return ok
+		}
+	}
+	idx := -1
+	for j, col := range stmt.Columns {
+		if strings.EqualFold(col, column) {
+			idx = j
+		}
+	}
+	if idx < 0 || len(stmt.Rows) == 0 {
+		return false
+	}
+	for _, row := range stmt.Rows {
+		if idx >= len(row.Values) {
+			return false
+		}
+		if _, ok := row.Values[idx].(*sqlparse.Literal); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// assignsAll fails unless assignments set every column MySQL would set to
+// the current time, and set none of the generated columns to their
+// default.
+func assignsAll(t Table, set []sqlparse.Assignment, gen Generated) error {
+	assigned := make(map[string]bool)
+	for _, a := range set {
+		name := strings.ToLower(a.Column.Name)
+		if raw, ok := a.Value.(*sqlparse.RawExpr); ok && len(raw.Tokens) > 0 && raw.Tokens[0].Is("DEFAULT") {
+			for _, col := range append(append([]string(nil), gen.Insert...), gen.Update...) {
+				if strings.EqualFold(col, name) {
+					return fmt.Errorf("table %s.%s is being migrated; column %s cannot be set to its default", t.DB, t.Name, col)
+				}
+			}
+		}
+		assigned[name] = true
+	}
+	for _, col := range gen.Update {
+		if !assigned[strings.ToLower(col)] {
+			return fmt.Errorf("table %s.%s is being migrated; updates to it must set column %s", t.DB, t.Name, col)
+		}
+	}
+	return nil
+}
+
+// rowShards returns the shards a row with the given key literal is written
+// to, or read from. A number compared with a text key matches every string
+// that converts to it, so it cannot pick a shard.
+func rowShards(t Table, lit *sqlparse.Literal, servers *Servers, write bool) ([]int, error) {
+	if lit.Kind == sqlparse.Number && classOf(t.KeyType) == classText {
+		return nil, fmt.Errorf("shard key column %s of table %s holds text and must be given as a string, not %s", t.Key, t.Name, lit.Value)
+	}
+	if _, err := t.NormalKey(lit.Value); err != nil {
+		return nil, err
+	}
+	id := t.ShardOf(lit.Value, servers.Shards())
+	if to, ok := t.migratingTo(lit.Value); write && ok && !servers.Shared(id, to) {
+		return []int{id, to}, nil
+	}
+	return []int{id}, nil
+}
+
+// shardsOf returns the shards holding the given key values, in order.
+func shardsOf(t Table, values []*sqlparse.Literal, servers *Servers, write bool) ([]int, error) {
+	if len(values) == 0 {
+		// Contradictory predicates match no rows; any single shard
+		// holding the table returns the right (empty) answer.
+		return t.Owners(servers.Shards())[:1], nil
+	}
+	var ids []int
+	for _, v := range values {
+		row, err := rowShards(t, v, servers, write)
+		if err != nil {
+			return nil, err
+		}
+		ids = union(ids, row)
+	}
+	return ids, nil
+}
+
+// union returns the sorted union of two shard lists.
+func union(a, b []int) []int {
+	seen := make(map[int]bool)
+	var ids []int
+	for _, id := range append(append([]int(nil), a...), b...) {
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+func broadcast(query string, ids []int) []Target {
+	targets := make([]Target, len(ids))
+	for i, id := range ids {
+		targets[i] = Target{Shard: id, Query: query}
+	}
+	return targets
+}
+
+func routeInsert(t Table, servers *Servers, stmt *sqlparse.Statement) ([]Target, error) {
+	if len(stmt.Set) > 0 {
+		for _, a := range stmt.Set {
+			if lit, ok := a.Value.(*sqlparse.Literal); ok && strings.EqualFold(a.Column.Name, t.Key) {
+				ids, err := rowShards(t, lit, servers, true)
+				if err != nil {
+					return nil, err
+				}
+				return broadcast(stmt.Query, ids), nil
+			}
+		}
+		return nil, fmt.Errorf("INSERT into sharded table %s must set shard key column %s to a literal value", t.Name, t.Key)
+	}
+	if len(stmt.Rows) == 0 {
+		return nil, fmt.Errorf("INSERT into sharded table %s must use VALUES", t.Name)
+	}
+	if len(stmt.Columns) == 0 {
+		return nil, fmt.Errorf("INSERT into sharded table %s must list its columns", t.Name)
+	}
+	keyIdx := -1
+	for j, col := range stmt.Columns {
+		if strings.EqualFold(col, t.Key) {
+			keyIdx = j
+		}
+	}
+	if keyIdx < 0 {
+		return nil, fmt.Errorf("INSERT into sharded table %s must set shard key column %s", t.Name, t.Key)
+	}
+
+	var order []int
+	tuples := make(map[int][]string)
+	for _, row := range stmt.Rows {
+		if len(row.Values) != len(stmt.Columns) {
+			return nil, fmt.Errorf("VALUES row has %d values for %d columns", len(row.Values), len(stmt.Columns))
+		}
+		lit, ok := row.Values[keyIdx].(*sqlparse.Literal)
+		if !ok {
+			return nil, fmt.Errorf("shard key column %s must be a literal value", t.Key)
+		}
+		ids, err := rowShards(t, lit, servers, true)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range ids {
+			if _, seen := tuples[id]; !seen {
+				order = append(order, id)
+			}
+			tuples[id] = append(tuples[id], stmt.Query[row.Start:row.End])
+		}
+	}
+	prefix := stmt.Query[:stmt.ValuesEnd]
+	suffix := strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(stmt.Query[stmt.RowsEnd:]), ";"))
+	if suffix != "" {
+		suffix = " " + suffix
+	}
+
+	sort.Ints(order)
+	targets := make([]Target, 0, len(order))
+	for _, id := range order {
+		targets = append(targets, Target{Shard: id, Query: prefix + " " + strings.Join(tuples[id], ", ") + suffix})
+	}
+	return targets, nil
+}
@@ -0,0 +1,194 @@
+package shard
+
+import (
+	"reflect"
+	"testing"
+
+	"distributed-db/sqlparse"
+)
+
+func testServers(t *testing.T) *Servers {
+	t.Helper()
+	servers, err := NewServers("u:p@tcp(main:3306)/", []string{
+		"u:p@tcp(s0:3306)/", "u:p@tcp(s1:3306)/", "u:p@tcp(s2:3306)/", "u:p@tcp(s3:3306)/",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return servers
+}
+
+func route(t *testing.T, table Table, query string) ([]int, error) {
+	t.Helper()
+	stmt, err := sqlparse.Parse(query)
+	if err != nil {
+		t.Fatalf("Parse(%q): %v", query, err)
+	}
+	targets, err := Route([]Table{table}, testServers(t), stmt)
+	var ids []int
+	for _, target := range targets {
+		ids = append(ids, target.Shard)
+	}
+	return ids, err
+}
+
+func TestRouteKeyValues(t *testing.T) {
+	ints := Table{DB: "d", Name: "t", Key: "id", Ring: []int{0, 1, 2, 3}, KeyType: "int"}
+	text := Table{DB: "d", Name: "t", Key: "id", Ring: []int{0, 1, 2, 3}, KeyType: "varchar"}
+	tests := []struct {
+		table Table
+		same  []string // queries that must reach the same single shard
+	}{
+		{ints, []string{
+			"SELECT * FROM t WHERE id = 1",
+			"SELECT * FROM t WHERE id = 1.0",
+			"SELECT * FROM t WHERE id = 01",
+			"SELECT * FROM t WHERE id = '1'",
+			"SELECT * FROM t WHERE id = 1 AND id = 1.0",
+			"SELECT * FROM t WHERE id IN (1, 1.00)",
+			"INSERT INTO t (id) VALUES (1.0)",
+			"UPDATE t SET n = 2 WHERE id = 001",
+		}},
+		{text, []string{
+			"SELECT * FROM t WHERE id = 'bob'",
+			"SELECT * FROM t WHERE id = 'BOB'",
+			"SELECT * FROM t WHERE id = 'Böb'",
+			"SELECT * FROM t WHERE id = 'bob' AND id = 'Bob'",
+			"INSERT INTO t SET id = 'bOb'",
+		}},
+	}
+	for _, tt := range tests {
+		var first []int
+		for _, query := range tt.same {
+			ids, err := route(t, tt.table, query)
+			if err != nil {
+				t.Errorf("%s: %v", query, err)
+				continue
+			}
+			if len(ids) != 1 {
+				t.Errorf("%s: routed to shards %v, want one", query, ids)
+				continue
+			}
+			if first == nil {
+				first = ids
+			} else if !reflect.DeepEqual(ids, first) {
+				t.Errorf("%s: routed to shard %v, but %s to %v", query, ids, tt.same[0], first)
+			}
+		}
+	}
+}
+
+func TestRouteRejects(t *testing.T) {
+	ints := Table{DB: "d", Name: "t", Key: "id", Ring: []int{0, 1, 2, 3}, KeyType: "int"}
+	text := Table{DB: "d", Name: "t", Key: "id", Ring: []int{0, 1, 2, 3}, KeyType: "varchar"}
+	tests := []struct {
+		table Table
+		query string
+	}{
+		{ints, "SELECT * FROM t WHERE id = 'abc'"},
+		{ints, "SELECT * FROM t WHERE id = 1.5"},
+		{ints, "INSERT INTO t (id) VALUES (1), ('x')"},
+		{text, "SELECT * FROM t WHERE id = 1"},
+		{ints, "UPDATE t SET id = 2 WHERE id = 1"},
+		{ints, "INSERT INTO t (id, n) VALUES (1, 2) ON DUPLICATE KEY UPDATE id = id + 10"},
+		{ints, "INSERT INTO t SET id = 1 ON DUPLICATE KEY UPDATE t.id = 3"},
+		{ints, "INSERT INTO t (n) VALUES (1)"},
+	}
+	for _, tt := range tests {
+		if ids, err := route(t, tt.table, tt.query); err == nil {
+			t.Errorf("%s: routed to shards %v, want an error", tt.query, ids)
+		}
+	}
+	if _, err := route(t, ints, "INSERT INTO t (id, n) VALUES (1, 2) ON DUPLICATE KEY UPDATE n = n + 1"); err != nil {
+		t.Errorf("ON DUPLICATE KEY UPDATE of another column: %v", err)
+	}
+}
+
+func TestRouteLegacyKeys(t *testing.T) {
+	// Tables sharded before key types were recorded place values as written
+	legacy := Table{DB: "d", Name: "t", Key: "id", Ring: []int{0, 1, 2, 3}}
+	for _, query := range []string{"SELECT * FROM t WHERE id = 'x'", "SELECT * FROM t WHERE id = 1.5"} {
+		ids, err := route(t, legacy, query)
+		if err != nil || len(ids) != 1 {
+			t.Errorf("%s: routed to %v, %v, want one shard", query, ids, err)
+		}
+	}
+	if legacy.ShardOf("Bob", 4) != legacy.ringShard(KeyHash("Bob")) {
+		t.Error("legacy key values are not hashed as written")
+	}
+}
+
+func TestRouteMigrating(t *testing.T) {
+	gen := Generated{Insert: []string{"id", "created"}, Update: []string{"changed"}}
+	moving := Table{DB: "d", Name: "t", Shard: 0, Migration: &Migration{
+		Moves: []Move{{HashRange: AllHashes, Shard: 1}}, From: []int{0}, State: Copying, Generated: gen}}
+	rejected := []string{
+		"INSERT INTO t (id, created, n) VALUES (1, NOW(), 2)",
+		"INSERT INTO t (n) VALUES (2)",
+		"INSERT INTO t (id, created, n) VALUES (1, '2024-01-01', 2), (NULL, '2024-01-01', 3)",
+		"INSERT INTO t (id, created) SELECT id, created FROM t",
+		"INSERT INTO t SET id = 1, created = DEFAULT",
+		"INSERT INTO t (id, created) VALUES (1, '2024-01-01') ON DUPLICATE KEY UPDATE n = n + 1",
+		"UPDATE t SET n = 1 WHERE id = 1",
+		"UPDATE t SET n = RAND(), changed = '2024-01-01'",
+		"UPDATE t SET created = DEFAULT, changed = '2024-01-01'",
+		"DELETE FROM t WHERE created < CURRENT_DATE",
+	}
+	for _, query := range rejected {
+		if ids, err := route(t, moving, query); err == nil {
+			t.Errorf("%s: routed to shards %v, want an error", query, ids)
+		}
+	}
+	allowed := []string{
+		"INSERT INTO t (id, created, n) VALUES (1, '2024-01-01', 2), (2, '2024-01-02', 3)",
+		"INSERT INTO t SET id = 1, created = '2024-01-01' ON DUPLICATE KEY UPDATE n = n + 1, changed = '2024-01-02'",
+		"UPDATE t SET n = n + 1, changed = '2024-01-01' WHERE id = 1",
+		"DELETE FROM t WHERE created < '2024-01-01'",
+		"SELECT * FROM t WHERE created < NOW()",
+	}
+	for _, query := range allowed {
+		if _, err := route(t, moving, query); err != nil {
+			t.Errorf("%s: %v", query, err)
+		}
+	}
+}
+
+func TestKeyCollations(t *testing.T) {
+	tests := []struct {
+		collation string
+		a, b      string
+		cmp       int
+	}{
+		{"", "a", "A", 0},
+		{"utf8mb4_0900_ai_ci", "é", "E", 0},
+		{"utf8mb4_0900_as_ci", "é", "E", 1},
+		{"utf8mb4_0900_as_ci", "É", "é", 0},
+		{"utf8mb4_0900_as_cs", "a", "A", -1},
+		{"utf8mb4_0900_bin", "B", "a", -1},
+		{"utf8mb4_0900_bin", "a ", "a", 1},
+		{"utf8mb4_bin", "a ", "a", 0},
+	}
+	for _, tt := range tests {
+		table := Table{Key: "k", KeyType: "varchar", Collation: tt.collation, Ranges: []KeyRange{{Shard: 0}}}
+		if got := table.Compare(tt.a, tt.b); got != tt.cmp {
+			t.Errorf("%s: Compare(%q, %q) = %d, want %d", tt.collation, tt.a, tt.b, got, tt.cmp)
+		}
+		ka, _ := table.NormalKey(tt.a)
+		kb, _ := table.NormalKey(tt.b)
+		if (ka == kb) != (tt.cmp == 0) {
+			t.Errorf("%s: NormalKey(%q) == NormalKey(%q) is %v, want %v", tt.collation, tt.a, tt.b, ka == kb, tt.cmp == 0)
+		}
+	}
+	bytes := Table{Key: "k", KeyType: "varbinary", Ranges: []KeyRange{{Shard: 0}}}
+	if bytes.Compare("B", "a") >= 0 {
+		t.Error("binary keys do not compare byte-wise")
+	}
+
+	m := NewMap(4)
+	if _, err := m.SetRangeKey("d", "t", "k", "varchar", "utf8mb4_general_ci", []KeyRange{{Shard: 0}}); err == nil {
+		t.Error("SetRangeKey accepted a text key in an unsupported collation")
+	}
+	if _, err := m.SetKey("d", "t", "k", "varchar", "utf8mb4_0900_as_cs"); err != nil {
+		t.Errorf("SetKey: %v", err)
+	}
+}
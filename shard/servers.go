@@ -0,0 +1,116 @@
+package shard
+
+import (
+	"database/sql"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// Open connects to the shard database name on the MySQL server at dsn,
+// creating the database if it does not exist yet.
+func Open(dsn, name string) (*sql.DB, error) {
+	cfg, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+	server, err := sql.Open("mysql", cfg.FormatDSN())
+	if err != nil {
+		return nil, err
+	}
+	defer server.Close()
+	if _, err := server.Exec("CREATE DATABASE IF NOT EXISTS `" + strings.ReplaceAll(name, "`", "``") + "`"); err != nil {
+		return nil, err
+	}
+	cfg.DBName = name
+	return sql.Open("mysql", cfg.FormatDSN())
+}
+
+// Servers tells which shards share a MySQL server. Rows are stored in the
+// user databases of the server holding their shard, so shards on one server
+// see each other's rows, and every server needs the full schema. Server 0
+// is the node's main server, whether or not it holds shards.
+type Servers struct {
+	of    []int
+	first []int // first shard of each server, -1 for an unused main server
+}
+
+// NewServers groups shards by server from the DSN of the main server and
+// those of the shards; DSNs naming the same address are the same server.
+func NewServers(main string, shards []string) (*Servers, error) {
+	addr := func(dsn string) (string, error) {
+		cfg, err := mysql.ParseDSN(dsn)
+		if err != nil {
+			return "", err
+		}
+		return cfg.Net + "(" + cfg.Addr + ")", nil
+	}
+	mainAddr, err := addr(main)
+	if err != nil {
+		return nil, err
+	}
+	s := &Servers{of: make([]int, len(shards)), first: []int{-1}}
+	index := map[string]int{mainAddr: 0}
+	for i, dsn := range shards {
+		a, err := addr(dsn)
+		if err != nil {
+			return nil, err
+		}
+		id, ok := index[a]
+		if !ok {
+			id = len(s.first)
+			index[a] = id
+			s.first = append(s.first, i)
+		} else if s.first[id] < 0 {
+			s.first[id] = i
+		}
+		s.of[i] = id
+	}
+	return s, nil
+}
+
+// Of returns the server holding a shard.
+func (s *Servers) Of(shard int) int {
+	return s.of[shard]
+}
+
+// Shards returns the number of shards.
+func (s *Servers) Shards() int {
+	return len(s.of)
+}
+
+// Shared reports whether two shards are on the same server, and so hold
+// the same rows.
+func (s *Servers) Shared(a, b int) bool {
+	return s.of[a] == s.of[b]
+}
+
+// Pools returns a connection pool for each server, given the node's main
+// pool and those of its shards.
+func (s *Servers) Pools(main *sql.DB, shards []*sql.DB) []*sql.DB {
+	pools := []*sql.DB{main}
+	for _, first := range s.first[1:] {
+		pools = append(pools, shards[first])
+	}
+	return pools
+}
+
+// Distinct drops the targets that repeat the query of an earlier target on
+// the same server, which would otherwise read or change the same rows
+// twice.
+func (s *Servers) Distinct(targets []Target) []Target {
+	type key struct {
+		server int
+		query  string
+	}
+	seen := make(map[key]bool, len(targets))
+	distinct := targets[:0:0]
+	for _, t := range targets {
+		k := key{s.of[t.Shard], t.Query}
+		if !seen[k] {
+			seen[k] = true
+			distinct = append(distinct, t)
+		}
+	}
+	return distinct
+}
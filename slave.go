@@ -1,240 +1,2017 @@
 package main
 
 import (
+	"context"
+	crand "crypto/rand"
+	"crypto/sha256"
 	"database/sql"
+	"database/sql/driver"
+	"encoding"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
 	"fmt"
+	"hash"
 	"log"
+	"math/rand"
 	"net"
 	"net/http"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
+
+	"distributed-db/cluster"
+	"distributed-db/config"
+	"distributed-db/protocol"
+	"distributed-db/raft"
+	"distributed-db/replog"
+	"distributed-db/session"
+	"distributed-db/shard"
+	"distributed-db/sqlparse"
 
 	"github.com/gin-gonic/gin"
 	_ "github.com/go-sql-driver/mysql"
 )
 
 var (
-	db         *sql.DB
-	masterConn net.Conn
-	mu         sync.Mutex
-	shardMap   map[string]int
-	shardDBs   []*sql.DB
-	slaveID    int
+	db         *sql.DB
+	mu         sync.Mutex
+	shardMap   *shard.Map
+	shardDBs   []*sql.DB
+	nodeID     string // persistent identity presented to the Master
+	appliedLSN uint64 // last replication log entry applied, guarded by mu
+	// appliedSignal is closed and replaced whenever appliedLSN changes,
+	// guarded by mu.
+	appliedSignal = make(chan struct{})
+
+	// servers tells which shards share a MySQL server, and serverDBs
+	// holds a pool for each server, the main one first.
+	servers   *shard.Servers
+	serverDBs []*sql.DB
+	// sessions holds the client sessions opened with /session.
+	sessions *session.Manager
+)
+
+var (
+	// cfg holds the settings loaded at startup; see the config package.
+	cfg *config.Config
+
+	// raftNode replicates the cluster metadata when Raft is enabled. Its
+	// elections then replace the -failover-timeout vote among slaves.
+	raftNode *raft.Node
+	metadata *cluster.Metadata
+)
+
+func main() {
+	var err error
+	// The Master's address comes from the configuration or the first
+	// argument (e.g., go run slave.go 192.168.1.100)
+	if cfg, err = config.Load(config.Slave, flag.CommandLine, os.Args[1:]); err != nil {
+		log.Fatal(err)
+	}
+
+	// Connect to local MySQL (will sync with Master later)
+	db, err = sql.Open("mysql", cfg.MySQL)
+	if err != nil {
+		log.Fatal("Error connecting to local MySQL:", err)
+	}
+	defer db.Close()
+
+	// Initialize shard databases and map
+	shardDBs = make([]*sql.DB, len(cfg.Shards))
+	shardMap = shard.NewMap(len(shardDBs)) // Initialize the shard map
+	for i, s := range cfg.Shards {
+		shardDBs[i], err = shard.Open(cfg.ShardDSN(i), s.Name)
+		if err != nil {
+			log.Fatalf("Error connecting to shard %s: %v", s.Name, err)
+		}
+		defer shardDBs[i].Close()
+	}
+	dsns := make([]string, len(cfg.Shards))
+	for i := range cfg.Shards {
+		dsns[i] = cfg.ShardDSN(i)
+	}
+	if servers, err = shard.NewServers(cfg.MySQL, dsns); err != nil {
+		log.Fatal("Error grouping shards by server:", err)
+	}
+	serverDBs = servers.Pools(db, shardDBs)
+	sessions = session.NewManager(serverDBs, sessionIdleTimeout)
+
+	// Load the shard map received from the Master before the last restart
+	if err := shardMap.Attach(db); err != nil {
+		log.Fatal("Error loading shard map:", err)
+	}
+	if nodeID, err = loadNodeID(); err != nil {
+		log.Fatal("Error loading node ID:", err)
+	}
+	// Report the saved position even before the Master is reached, so a
+	// failover can compare it with the other slaves
+	if appliedLSN, _, err = replog.LoadPosition(positionPath()); err != nil {
+		log.Fatal("Error loading replication position:", err)
+	}
+
+	// Connect to the Master, and reconnect whenever the connection
+	// drops. A master chosen by a failover takes precedence.
+	addr := link.load(cfg.Master)
+	if err := startConsensus(); err != nil {
+		log.Fatal("Error starting Raft:", err)
+	}
+	go maintainMasterConnection(addr)
+
+	// Start Web Frontend
+	go startFrontend()
+	go expireSessions()
+
+	// Keep the main goroutine alive
+	select {}
+}
+
+// Delays between attempts to reconnect to the Master. The delay doubles
+// after every failed attempt, up to reconnectMaxDelay.
+const (
+	reconnectMinDelay = 500 * time.Millisecond
+	reconnectMaxDelay = 30 * time.Second
+)
+
+// masterLink tracks the connection to the Master. While it is down the
+// slave still serves reads, but reports itself as degraded.
+type masterLink struct {
+	mu        sync.Mutex
+	addr      string
+	conn      *protocol.Conn
+	connected bool
+	since     time.Time // start of the current connected or disconnected period
+	attempts  int       // failed connection attempts since the link went down
+	lastError string
+
+	// epoch is the newest master epoch seen, self the slave's HTTP address
+	// as the Master sees it and peers those of all slaves of the Master. They
+	// are kept in linkStatePath for failovers.
+	epoch     uint64
+	self      string
+	peers     []string
+	promoting bool
+	kick      chan struct{} // wakes the reconnect loop after a repoint
+
+	// lastHeartbeat and masterLSN come from the Master's last heartbeat.
+	lastHeartbeat time.Time
+	masterLSN     uint64
+	// masterHTTPPort is the port of the Master's web server, from its
+	// welcome.
+	masterHTTPPort string
+}
+
+var link = &masterLink{since: time.Now(), kick: make(chan struct{}, 1)}
+
+type linkState struct {
+	Addr  string   `json:"addr"`
+	Epoch uint64   `json:"epoch"`
+	Self  string   `json:"self"`
+	Peers []string `json:"peers"`
+}
+
+func linkStatePath() string {
+	return filepath.Join(cfg.DataDir, "master.json")
+}
+
+// load restores the saved link state and returns the address to connect
+// to. A slave re-pointed by a failover keeps following the new master after
+// a restart; otherwise addr is used.
+func (l *masterLink) load(addr string) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var state linkState
+	if data, err := os.ReadFile(linkStatePath()); err == nil && json.Unmarshal(data, &state) == nil {
+		l.epoch, l.self, l.peers = state.Epoch, state.Self, state.Peers
+		if state.Epoch > 1 && state.Addr != "" && state.Addr != addr {
+			log.Printf("Following Master %s chosen at epoch %d instead of %s\n", state.Addr, state.Epoch, addr)
+			addr = state.Addr
+		}
+	}
+	l.addr = addr
+	return addr
+}
+
+// save persists the link state. It must be called with l.mu held.
+func (l *masterLink) save() {
+	data, err := json.Marshal(linkState{Addr: l.addr, Epoch: l.epoch, Self: l.self, Peers: l.peers})
+	if err == nil {
+		if err = os.MkdirAll(cfg.DataDir, 0o755); err == nil {
+			err = os.WriteFile(linkStatePath(), data, 0o644)
+		}
+	}
+	if err != nil {
+		log.Println("Error saving Master link state:", err)
+	}
+}
+
+// repoint makes the slave follow the master at host from epoch on. The
+// current connection is dropped and the reconnect loop woken up.
+func (l *masterLink) repoint(host string, epoch uint64) error {
+	addr := host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		addr = net.JoinHostPort(host, "8083")
+	}
+	l.mu.Lock()
+	if epoch < l.epoch {
+		current := l.epoch
+		l.mu.Unlock()
+		return fmt.Errorf("epoch %d is older than the current epoch %d", epoch, current)
+	}
+	l.addr, l.epoch = addr, epoch
+	l.save()
+	conn := l.conn
+	l.mu.Unlock()
+
+	log.Printf("Re-pointed to Master %s at epoch %d\n", addr, epoch)
+	if conn != nil {
+		conn.Close()
+	}
+	select {
+	case l.kick <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// sendToMaster sends a message on the current connection to the Master. It
+// fails before the slave first connects, and once the connection is lost.
+func sendToMaster(t protocol.MsgType, v interface{}) error {
+	link.mu.Lock()
+	conn := link.conn
+	link.mu.Unlock()
+	if conn == nil {
+		return fmt.Errorf("not connected to the Master")
+	}
+	return conn.Send(t, v)
+}
+
+func connectedToMaster() bool {
+	link.mu.Lock()
+	defer link.mu.Unlock()
+	return link.connected
+}
+
+func (l *masterLink) up(conn *protocol.Conn) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.conn = conn
+	l.connected = true
+	l.since = time.Now()
+	l.attempts = 0
+	l.lastError = ""
+}
+
+func (l *masterLink) down(err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.connected {
+		l.since = time.Now()
+	}
+	l.connected = false
+	l.attempts++
+	if err != nil {
+		l.lastError = err.Error()
+	}
+}
+
+// maintainMasterConnection keeps the slave connected to the Master. After a
+// connection is lost it reconnects with exponential backoff and says hello
+// again, so replication resumes from the saved position, or from a fresh
+// snapshot if the Master can no longer serve it.
+func maintainMasterConnection(addr string) {
+	link.mu.Lock()
+	link.addr = addr
+	link.mu.Unlock()
+
+	delay := reconnectMinDelay
+	for {
+		link.mu.Lock()
+		addr, promoting := link.addr, link.promoting
+		link.mu.Unlock()
+		if promoting {
+			// Stay away from the Master until the promotion is over
+			time.Sleep(time.Second)
+			continue
+		}
+
+		conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+		if err == nil {
+			masterConn := protocol.NewConn(conn, cfg.Replication.HeartbeatTimeout)
+			link.up(masterConn)
+			log.Printf("Slave %s connected to Master at %s\n", nodeID, addr)
+			connectedAt := time.Now()
+
+			// Register, then resume replication from the saved
+			// position, or full sync
+			stop := make(chan struct{})
+			go sendHeartbeats(masterConn, stop)
+			registerWithMaster(masterConn)
+			helloMaster()
+			err = handleMasterCommands(masterConn)
+			close(stop)
+			masterConn.Close()
+			abortSnapshot()
+			abortForwards()
+			if time.Since(connectedAt) > reconnectMaxDelay {
+				delay = reconnectMinDelay
+			}
+			log.Println("Lost connection to Master:", err)
+		} else {
+			log.Printf("Error connecting to Master at %s: %v\n", addr, err)
+		}
+		link.down(err)
+		if raftNode == nil && cfg.Replication.FailoverTimeout > 0 {
+			link.mu.Lock()
+			down := !link.connected && !link.promoting && time.Since(link.since) > cfg.Replication.FailoverTimeout
+			link.mu.Unlock()
+			if down {
+				tryFailover()
+			}
+		}
+
+		// Jitter keeps slaves from reconnecting in lockstep
+		wait := delay + time.Duration(rand.Int63n(int64(delay)/2+1))
+		log.Printf("Reconnecting to Master in %s\n", wait.Round(time.Millisecond))
+		select {
+		case <-time.After(wait):
+		case <-link.kick:
+			delay = reconnectMinDelay
+			continue
+		}
+		delay *= 2
+		if delay > reconnectMaxDelay {
+			delay = reconnectMaxDelay
+		}
+	}
+}
+
+// lag returns how many log entries a slave at lsn is behind the master.
+func lag(masterLSN, lsn uint64) uint64 {
+	if masterLSN < lsn {
+		return 0
+	}
+	return masterLSN - lsn
+}
+
+func nodeIDPath() string {
+	return filepath.Join(cfg.DataDir, "node_id")
+}
+
+// loadNodeID returns the slave's node ID, generating and saving one on the
+// first start.
+func loadNodeID() (string, error) {
+	data, err := os.ReadFile(nodeIDPath())
+	if err == nil && len(strings.TrimSpace(string(data))) > 0 {
+		return strings.TrimSpace(string(data)), nil
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	var b [8]byte
+	if _, err := crand.Read(b[:]); err != nil {
+		return "", err
+	}
+	id := "node-" + hex.EncodeToString(b[:])
+	if err := os.MkdirAll(cfg.DataDir, 0o755); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(nodeIDPath(), []byte(id+"\n"), 0o644); err != nil {
+		return "", err
+	}
+	log.Println("Generated node ID", id)
+	return id, nil
+}
+
+// capabilities lists the optional features this slave supports, for the
+// Master's registry.
+func capabilities() []string {
+	caps := []string{"heartbeat", "chunked-sync", "ack", "failover"}
+	if raftNode != nil {
+		caps = append(caps, "raft")
+	}
+	return caps
+}
+
+// registerWithMaster presents the slave's identity. The Master answers
+// with MsgRegistered, handled with the other messages.
+func registerWithMaster(conn *protocol.Conn) {
+	reg := protocol.Register{
+		NodeID:       nodeID,
+		Version:      protocol.Version,
+		Capabilities: capabilities(),
+		HTTPPort:     config.Port(cfg.Listen.HTTP),
+		Shards:       len(shardDBs),
+	}
+	if err := conn.Send(protocol.MsgRegister, reg); err != nil {
+		log.Println("Error registering with Master:", err)
+	}
+}
+
+// sendHeartbeats tells the Master this slave is alive, and how far it has
+// got, until stop is closed.
+func sendHeartbeats(conn *protocol.Conn, stop <-chan struct{}) {
+	id := nodeID
+	ticker := time.NewTicker(cfg.Replication.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		mu.Lock()
+		hb := protocol.Heartbeat{NodeID: id, LSN: appliedLSN, Status: slaveStatus()}
+		mu.Unlock()
+		if err := conn.Send(protocol.MsgHeartbeat, hb); err != nil {
+			return
+		}
+	}
+}
+
+// slaveStatus returns "degraded" while the Master is unreachable,
+// "syncing" during a full sync or a repair, "unsynced" after a failed full
+// sync and "healthy" otherwise. It must be called with mu held.
+func slaveStatus() string {
+	switch {
+	case !connectedToMaster():
+		return "degraded"
+	case fullSync.Active, repair.Active && !repair.Void:
+		return "syncing"
+	case fullSync.Error != "":
+		return "unsynced"
+	}
+	return "healthy"
+}
+
+// startConsensus joins the configured Raft cluster, if any. A slave only
+// stands for election once it has lost the Master for longer than the
+// failover timeout (10s if unset), and only wins with the votes of nodes
+// that are not ahead of it in replication; when it wins, it promotes
+// itself.
+func startConsensus() error {
+	peers := cfg.Raft.Peers
+	if len(peers) == 0 {
+		return nil
+	}
+	campaignAfter := cfg.Replication.FailoverTimeout
+	if campaignAfter == 0 {
+		campaignAfter = 10 * time.Second
+	}
+	metadata = cluster.New(func(snapshot shard.Snapshot) {
+		if snapshot.Version <= shardMap.Version() {
+			return
+		}
+		if err := shardMap.Replace(snapshot); err != nil {
+			log.Println("Error saving shard map:", err)
+		}
+	})
+	var err error
+	raftNode, err = raft.Start(raft.Config{
+		ID:    cfg.Raft.ID,
+		Peers: peers,
+		Dir:   cfg.Raft.Dir,
+		FSM:   metadata,
+		CanCampaign: func() bool {
+			link.mu.Lock()
+			down := !link.connected && !link.promoting && link.self != "" && time.Since(link.since) > campaignAfter
+			link.mu.Unlock()
+			mu.Lock()
+			defer mu.Unlock()
+			return down && !fullSync.Active
+		},
+		Priority: func() uint64 {
+			mu.Lock()
+			defer mu.Unlock()
+			return appliedLSN
+		},
+		OnLeader: func(leader string, term uint64) {
+			if leader == "" {
+				return
+			}
+			log.Printf("Raft leader is %s in term %d\n", leader, term)
+			if leader != cfg.Raft.ID || connectedToMaster() {
+				return
+			}
+			if err := promote(term); err != nil {
+				log.Println("Error promoting to Master:", err)
+			}
+		},
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("Raft node %s started with %d peers\n", cfg.Raft.ID, len(peers))
+	return nil
+}
+
+// peerStatus is the part of a peer's GET /status used by failovers.
+type peerStatus struct {
+	Connected bool   `json:"connected"`
+	Syncing   bool   `json:"syncing"`
+	Epoch     uint64 `json:"epoch"`
+	Master    string `json:"master"`
+	LSN       uint64 `json:"lsn"`
+}
+
+var peerClient = &http.Client{Timeout: 3 * time.Second}
+
+// peerAddr returns the HTTP address of a peer. Peers saved before slaves
+// advertised their port are bare hosts on the default port.
+func peerAddr(peer string) string {
+	if _, _, err := net.SplitHostPort(peer); err == nil {
+		return peer
+	}
+	return net.JoinHostPort(peer, "8082")
+}
+
+// tryFailover runs once the Master has been unreachable for longer than
+// -failover-timeout. It follows a newer master if a peer already knows one.
+// Otherwise, if a majority of the cluster (the Master included) cannot
+// reach the Master, the most up-to-date slave promotes itself; ties go to
+// the smallest host so every slave picks the same one.
+func tryFailover() {
+	link.mu.Lock()
+	self, peers, epoch := link.self, link.peers, link.epoch
+	link.mu.Unlock()
+	if self == "" || len(peers) == 0 {
+		log.Println("Cannot fail over: the Master never reported the other slaves")
+		return
+	}
+
+	mu.Lock()
+	best, bestLSN := self, appliedLSN
+	if fullSync.Active {
+		best = ""
+	}
+	mu.Unlock()
+	votes := 1
+	for _, peer := range peers {
+		if peer == self {
+			continue
+		}
+		resp, err := peerClient.Get("http://" + peerAddr(peer) + "/status")
+		if err != nil {
+			continue
+		}
+		var status peerStatus
+		err = json.NewDecoder(resp.Body).Decode(&status)
+		resp.Body.Close()
+		if err != nil {
+			continue
+		}
+		if status.Epoch > epoch {
+			if err := link.repoint(status.Master, status.Epoch); err != nil {
+				log.Println("Error following new Master:", err)
+			}
+			return
+		}
+		if status.Connected && status.Epoch == epoch {
+			log.Printf("Not failing over: slave %s still reaches the Master\n", peer)
+			return
+		}
+		votes++
+		if !status.Syncing && (best == "" || status.LSN > bestLSN || status.LSN == bestLSN && peer < best) {
+			best, bestLSN = peer, status.LSN
+		}
+	}
+
+	if votes*2 <= len(peers)+1 {
+		log.Printf("Not failing over: only %d of %d nodes see the Master as down\n", votes, len(peers)+1)
+		return
+	}
+	if best != self {
+		log.Printf("Waiting for slave %s (LSN %d) to take over as Master\n", best, bestLSN)
+		return
+	}
+	if err := promote(epoch + 1); err != nil {
+		log.Println("Error promoting to Master:", err)
+	}
+}
+
+// promote turns this slave into the Master for newEpoch. It stops
+// replicating, leaves a promotion file naming its position, its peers and
+// the old master, and hands over to -master-cmd with that file; the new
+// master re-points the peers and fences the old master. The slave process
+// exits once the master has started.
+func promote(newEpoch uint64) error {
+	mu.Lock()
+	syncing := fullSync.Active
+	mu.Unlock()
+	if _, err := os.Stat(syncStatePath()); err == nil || syncing {
+		return fmt.Errorf("a full sync is in progress")
+	}
+
+	link.mu.Lock()
+	if link.promoting {
+		link.mu.Unlock()
+		return fmt.Errorf("a promotion is already in progress")
+	}
+	if newEpoch <= link.epoch {
+		newEpoch = link.epoch + 1
+	}
+	oldMaster, _, _ := net.SplitHostPort(link.addr)
+	if link.masterHTTPPort != "" {
+		oldMaster = net.JoinHostPort(oldMaster, link.masterHTTPPort)
+	}
+	promotion := protocol.Promotion{
+		Epoch:     newEpoch,
+		Self:      link.self,
+		Peers:     link.peers,
+		OldMaster: oldMaster,
+	}
+	link.promoting = true
+	conn := link.conn
+	link.mu.Unlock()
+	if conn != nil {
+		// Nothing more may be applied after the promotion position
+		conn.Close()
+	}
+
+	fail := func(err error) error {
+		link.mu.Lock()
+		link.promoting = false
+		link.mu.Unlock()
+		return err
+	}
+	// Wait for an entry being applied to be recorded
+	mu.Lock()
+	lsn, ok, err := replog.LoadPosition(positionPath())
+	mu.Unlock()
+	if err != nil {
+		return fail(err)
+	}
+	if !ok {
+		return fail(fmt.Errorf("this slave has no replication position yet"))
+	}
+	promotion.LSN = lsn
+
+	data, err := json.Marshal(promotion)
+	if err != nil {
+		return fail(err)
+	}
+	path, err := filepath.Abs(filepath.Join(cfg.DataDir, "promotion.json"))
+	if err != nil {
+		return fail(err)
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		return fail(err)
+	}
+	args := strings.Fields(cfg.Replication.MasterCmd)
+	if len(args) == 0 {
+		return fail(fmt.Errorf("no -master-cmd to start the Master with"))
+	}
+	args = append(args, "-promote", path)
+	if raftNode != nil {
+		// The master takes over this node's place in the Raft cluster
+		args = append(args, "-raft-id", cfg.Raft.ID, "-raft-peers", cfg.RaftPeers(), "-raft-dir", cfg.Raft.Dir)
+		raftNode.Stop()
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	if err := cmd.Start(); err != nil {
+		return fail(err)
+	}
+	log.Printf("Promoted to Master at epoch %d after LSN %d (pid %d)\n", newEpoch, lsn, cmd.Process.Pid)
+	go func() {
+		// Let the HTTP response that triggered the promotion go out
+		time.Sleep(time.Second)
+		os.Exit(0)
+	}()
+	return nil
+}
+
+// snapshotSync tracks the progress of a FULL_SYNC transfer. NextChunk and
+// HashState are persisted after every applied chunk so an interrupted
+// transfer can resume where it stopped.
+type snapshotSync struct {
+	NextChunk int    `json:"next_chunk"`
+	HashState []byte `json:"hash_state"`
+
+	checksum hash.Hash
+	LSN      uint64                    `json:"-"`
+	Active   bool                      `json:"-"`
+	Tables   map[string]*tableProgress `json:"-"`
+	Failed   int                       `json:"-"`
+	// Error says why the last full sync failed and Retries how many
+	// failed in a row; both are cleared by a successful one.
+	Error   string `json:"-"`
+	Retries int    `json:"-"`
+	// Requested is set from asking the Master for a full sync until its
+	// manifest arrives.
+	Requested bool `json:"-"`
+}
+
+// catchingUp is set, under mu, from a hello sent after a replication gap
+// until the Master's welcome; the entries in between are stale.
+var catchingUp bool
+
+// maxSyncRetries is how many failed full syncs in a row are retried at once.
+// After that the slave waits for its next connection to the Master.
+const maxSyncRetries = 3
+
+type tableProgress struct {
+	Rows     int64 `json:"rows"`
+	RowsDone int64 `json:"rows_done"`
+}
+
+var fullSync = &snapshotSync{}
+
+func syncStatePath() string {
+	return filepath.Join(cfg.DataDir, "full_sync.json")
+}
+
+func positionPath() string {
+	return filepath.Join(cfg.DataDir, "position")
+}
+
+// helloMaster announces the slave's replication position. The master
+// answers with the log entries the slave missed, or with a snapshot if the
+// slave has no usable position.
+func helloMaster() {
+	mu.Lock()
+	defer mu.Unlock()
+
+	var hello protocol.Hello
+	if data, err := os.ReadFile(syncStatePath()); err == nil {
+		// A full sync was interrupted, or tables written here wait for
+		// a repair; the local data is not the Master's so the saved
+		// position cannot be trusted.
+		var saved snapshotSync
+		if json.Unmarshal(data, &saved) == nil {
+			hello.ResumeFrom = saved.NextChunk
+			fullSync.HashState = saved.HashState
+		}
+	} else {
+		lsn, ok, err := replog.LoadPosition(positionPath())
+		if err != nil {
+			log.Println("Error loading replication position:", err)
+		}
+		hello.LastLSN, hello.HasPosition = lsn, ok
+		setApplied(lsn)
+	}
+	link.mu.Lock()
+	hello.Epoch = link.epoch
+	link.mu.Unlock()
+	fullSync.Retries = 0
+
+	err := sendToMaster(protocol.MsgHello, hello)
+	if err != nil {
+		log.Println("Error sending hello to Master:", err)
+		return
+	}
+	if hello.HasPosition {
+		log.Printf("Resuming replication after LSN %d\n", hello.LastLSN)
+	} else if hello.ResumeFrom > 0 {
+		log.Printf("Resuming full sync from chunk %d\n", hello.ResumeFrom)
+	}
+}
+
+func (s *snapshotSync) save() error {
+	state, err := s.checksum.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return err
+	}
+	s.HashState = state
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(cfg.DataDir, 0o755); err != nil {
+		return err
+	}
+	tmp := syncStatePath() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, syncStatePath())
+}
+
+// fullSyncWithMaster requests a fresh snapshot from the Master, unless one
+// is already requested or under way; it is applied by handleMasterCommands
+// as it arrives.
+func fullSyncWithMaster() {
+	mu.Lock()
+	if fullSync.Requested || fullSync.Active {
+		mu.Unlock()
+		return
+	}
+	fullSync.Requested = true
+	mu.Unlock()
+
+	err := sendToMaster(protocol.MsgFullSyncRequest, protocol.FullSyncRequest{})
+	if err != nil {
+		log.Println("Error syncing with Master:", err)
+		mu.Lock()
+		fullSync.Requested = false
+		mu.Unlock()
+	}
+}
+
+// catchUpWithMaster says hello again after a replication gap, so that the
+// Master replays the entries after the slave's position.
+func catchUpWithMaster() {
+	mu.Lock()
+	if catchingUp {
+		mu.Unlock()
+		return
+	}
+	catchingUp = true
+	mu.Unlock()
+	helloMaster()
+}
+
+func startSnapshot(manifest protocol.SyncManifest) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	fullSync.checksum = sha256.New()
+	fullSync.NextChunk = manifest.ResumeFrom
+	if manifest.ResumeFrom > 0 {
+		err := fullSync.checksum.(encoding.BinaryUnmarshaler).UnmarshalBinary(fullSync.HashState)
+		if err != nil {
+			log.Println("Error restoring sync checksum, restarting full sync:", err)
+			os.Remove(syncStatePath())
+			fullSync.checksum.Reset()
+			fullSync.NextChunk = 0
+		}
+	}
+	// The local data is about to be replaced, so the old position is void
+	os.Remove(positionPath())
+	fullSync.LSN = manifest.LSN
+	fullSync.Active = true
+	fullSync.Requested = false
+	fullSync.Failed = 0
+	// The snapshot replaces the tables waiting for a repair too
+	repair.Tables = make(map[string]protocol.SyncTable)
+	fullSync.Tables = make(map[string]*tableProgress)
+	for _, table := range manifest.Tables {
+		fullSync.Tables[table.DB+"."+table.Table] = &tableProgress{Rows: table.Rows}
+	}
+	log.Printf("Full sync started: %d databases, %d tables\n", len(manifest.Databases), len(manifest.Tables))
+}
+
+func applySnapshotChunk(chunk protocol.SyncChunk) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if !fullSync.Active || chunk.Seq != fullSync.NextChunk {
+		log.Printf("Ignoring out-of-order sync chunk %d (expected %d)\n", chunk.Seq, fullSync.NextChunk)
+		return
+	}
+	failed, err := applyChunk(chunk)
+	if err != nil {
+		log.Println("Error applying sync chunk:", err)
+		return
+	}
+	fullSync.Failed += failed
+
+	chunk.Hash(fullSync.checksum)
+	fullSync.NextChunk = chunk.Seq + 1
+	if progress, ok := fullSync.Tables[chunk.DB+"."+chunk.Table]; ok && chunk.RowsDone > 0 {
+		progress.RowsDone = chunk.RowsDone
+		log.Printf("Synced %s.%s: %d/%d rows\n", chunk.DB, chunk.Table, progress.RowsDone, progress.Rows)
+	}
+	if err := fullSync.save(); err != nil {
+		log.Println("Error saving sync progress:", err)
+	}
+}
+
+// applyChunk runs the statements of a sync chunk and returns how many of
+// them failed.
+func applyChunk(chunk protocol.SyncChunk) (int, error) {
+	ctx := context.Background()
+	// Rows are applied on the server of their shard, the schema on all
+	conns := make([]*sql.Conn, len(serverDBs))
+	for i, pool := range serverDBs {
+		conn, err := pool.Conn(ctx)
+		if err != nil {
+			return 0, err
+		}
+		defer conn.Close()
+
+		conn.ExecContext(ctx, "SET FOREIGN_KEY_CHECKS = 0")
+		defer conn.ExecContext(ctx, "SET FOREIGN_KEY_CHECKS = 1")
+		if chunk.Table != "" {
+			_, err = conn.ExecContext(ctx, "USE "+sqlparse.QuoteIdent(chunk.DB))
+			if err != nil {
+				return 0, err
+			}
+		}
+		conns[i] = conn
+	}
+	failed := 0
+	for _, query := range chunk.Statements {
+		if err := applySyncStatement(ctx, conns, chunk.DB, query); err != nil {
+			log.Println("Error applying sync query:", err)
+			failed++
+		}
+	}
+	return failed, nil
+}
+
+// applySyncStatement runs a statement of a sync chunk on conns, one per
+// server: schema changes on every server, rows on the server of their shard
+// and anything else on the main server.
+func applySyncStatement(ctx context.Context, conns []*sql.Conn, dbName, query string) error {
+	stmt, err := sqlparse.Parse(query)
+	if err == nil && stmt.Kind.IsDDL() {
+		for _, conn := range conns {
+			if _, err := conn.ExecContext(ctx, query); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err == nil && stmt.Kind.IsDML() && len(stmt.Tables) > 0 {
+		if tables, err := lookupTables(stmt, dbName); err == nil {
+			targets, err := shard.Route(tables, servers, stmt)
+			if err != nil {
+				return err
+			}
+			for _, target := range servers.Distinct(targets) {
+				if _, err := conns[servers.Of(target.Shard)].ExecContext(ctx, target.Query); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+	_, err = conns[0].ExecContext(ctx, query)
+	return err
+}
+
+func finishSnapshot(done protocol.SyncDone) {
+	mu.Lock()
+	if !fullSync.Active {
+		mu.Unlock()
+		return
+	}
+	fullSync.Active = false
+	checksum := hex.EncodeToString(fullSync.checksum.Sum(nil))
+	lsn := fullSync.LSN
+	// A snapshot missing some statements is as wrong as a corrupt one, and
+	// the position must not claim it is complete
+	switch {
+	case checksum != done.Checksum || fullSync.NextChunk != done.Chunks:
+		fullSync.Error = fmt.Sprintf("checksum mismatch (got %s, want %s)", checksum, done.Checksum)
+	case fullSync.Failed > 0:
+		fullSync.Error = fmt.Sprintf("%d statements failed", fullSync.Failed)
+	default:
+		fullSync.Error = ""
+		fullSync.Retries = 0
+		setApplied(lsn)
+		if err := replog.SavePosition(positionPath(), appliedLSN); err != nil {
+			log.Println("Error saving replication position:", err)
+		}
+	}
+	problem := fullSync.Error
+	retry := false
+	if problem != "" {
+		fullSync.Retries++
+		retry = fullSync.Retries <= maxSyncRetries
+	}
+	os.Remove(syncStatePath())
+	fullSync.NextChunk = 0
+	fullSync.HashState = nil
+	mu.Unlock()
+
+	switch {
+	case retry:
+		log.Printf("Full sync failed: %s, restarting full sync\n", problem)
+		fullSyncWithMaster()
+	case problem != "":
+		log.Printf("Full sync failed %d times in a row: %s; will retry on the next connection to Master\n", maxSyncRetries+1, problem)
+	default:
+		log.Printf("Full sync complete at LSN %d: %d chunks\n", lsn, done.Chunks)
+		requestRepair()
+	}
+}
+
+// abortSnapshot stops a full sync whose connection to the Master was lost.
+// The progress saved after the last applied chunk lets helloMaster resume it.
+// Requests for a full sync, catch-up or repair die with the connection too;
+// the tables of a repair wait for the next one.
+func abortSnapshot() {
+	mu.Lock()
+	defer mu.Unlock()
+	fullSync.Requested = false
+	catchingUp = false
+	if fullSync.Active {
+		fullSync.Active = false
+		log.Printf("Full sync interrupted before chunk %d\n", fullSync.NextChunk)
+	}
+	if repair.Requested {
+		requeueRepair()
+	}
+}
+
+// tableRepair tracks the repair of tables that writes of this slave may
+// have left different from the Master's. One repair is asked for at a time;
+// tables found to need one meanwhile wait in Tables, by "db.table".
+type tableRepair struct {
+	Tables map[string]protocol.SyncTable
+	// Asked lists the tables of the repair asked for. Requested is set
+	// from asking until its snapshot is done, Active from the snapshot's
+	// manifest on.
+	Asked     []protocol.SyncTable
+	Requested bool
+	Active    bool
+	// Void is set when the slave has not applied every entry up to the
+	// snapshot's LSN, which it must have to use the snapshot.
+	Void      bool
+	LSN       uint64
+	NextChunk int
+	Failed    int
+	checksum  hash.Hash
+}
+
+var repair = &tableRepair{Tables: make(map[string]protocol.SyncTable)} // guarded by mu
+
+// statementTables returns the tables a statement run in dbName refers to,
+// or nil if it cannot tell.
+func statementTables(dbName, query string) []protocol.SyncTable {
+	stmt, err := sqlparse.Parse(query)
+	if err != nil {
+		return nil
+	}
+	var tables []protocol.SyncTable
+	for _, name := range stmt.Tables {
+		if name.DB == "" {
+			name.DB = dbName
+		}
+		tables = append(tables, protocol.SyncTable{DB: name.DB, Table: name.Name})
+	}
+	return tables
+}
+
+// repairTables has the Master's copy of tables replace the slave's, after a
+// write of the slave's own may have left them different. Without tables to
+// repair, the slave takes a full sync instead.
+func repairTables(tables []protocol.SyncTable) {
+	mu.Lock()
+	distrustPosition()
+	for _, t := range tables {
+		repair.Tables[t.DB+"."+t.Table] = t
+	}
+	mu.Unlock()
+	if len(tables) == 0 {
+		fullSyncWithMaster()
+		return
+	}
+	requestRepair()
+}
+
+// distrustPosition makes the slave ask for a full sync the next time it
+// says hello to the Master, even after a restart, while it holds data the
+// Master does not. Finishing a full sync, or the repairs, undoes it. It must
+// be called with mu held.
+func distrustPosition() {
+	if _, err := os.Stat(syncStatePath()); err == nil {
+		return
+	}
+	err := os.MkdirAll(cfg.DataDir, 0o755)
+	if err == nil {
+		err = os.WriteFile(syncStatePath(), []byte("{}"), 0o644)
+	}
+	if err != nil {
+		log.Println("Error saving sync state:", err)
+	}
+}
+
+// requestRepair asks the Master to repair the tables waiting for it, unless
+// a repair, full sync or catch-up is already on its way; whatever finishes
+// it asks again.
+func requestRepair() {
+	mu.Lock()
+	if len(repair.Tables) == 0 || repair.Requested || fullSync.Requested || fullSync.Active || catchingUp {
+		mu.Unlock()
+		return
+	}
+	asked := make([]protocol.SyncTable, 0, len(repair.Tables))
+	for _, t := range repair.Tables {
+		asked = append(asked, t)
+	}
+	sort.Slice(asked, func(i, j int) bool {
+		if asked[i].DB != asked[j].DB {
+			return asked[i].DB < asked[j].DB
+		}
+		return asked[i].Table < asked[j].Table
+	})
+	repair.Tables = make(map[string]protocol.SyncTable)
+	repair.Asked = asked
+	repair.Requested = true
+	distrustPosition()
+	mu.Unlock()
+
+	err := sendToMaster(protocol.MsgFullSyncRequest, protocol.FullSyncRequest{Tables: asked})
+	if err != nil {
+		log.Println("Error asking Master for a repair:", err)
+		mu.Lock()
+		requeueRepair()
+		mu.Unlock()
+	}
+}
+
+// requeueRepair gives up on the repair asked for, whose tables wait for the
+// next one. It must be called with mu held.
+func requeueRepair() {
+	for _, t := range repair.Asked {
+		repair.Tables[t.DB+"."+t.Table] = t
+	}
+	repair.Asked = nil
+	repair.Requested, repair.Active, repair.Void = false, false, false
+}
+
+// repairing reports whether the snapshot coming from the Master is a repair.
+func repairing() bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return repair.Active
+}
+
+// startRepair begins to receive the snapshot of the tables to repair. The
+// Master sent every log entry up to its LSN before it; if the slave did not
+// apply them all, the entries replayed to it later would be applied to the
+// repaired tables a second time, so it ignores the snapshot.
+func startRepair(manifest protocol.SyncManifest) {
+	mu.Lock()
+	defer mu.Unlock()
+	repair.Active = true
+	repair.LSN = manifest.LSN
+	repair.NextChunk = 0
+	repair.Failed = 0
+	repair.checksum = sha256.New()
+	repair.Void = catchingUp || fullSync.Requested || fullSync.Active || appliedLSN != manifest.LSN
+	if repair.Void {
+		log.Printf("Ignoring repair at LSN %d: applied LSN %d\n", manifest.LSN, appliedLSN)
+		return
+	}
+	// Tables left half replaced void the position
+	os.Remove(positionPath())
+	log.Printf("Repairing %d tables at LSN %d\n", len(manifest.Tables), manifest.LSN)
+}
+
+func applyRepairChunk(chunk protocol.SyncChunk) {
+	mu.Lock()
+	defer mu.Unlock()
+	if repair.Void {
+		return
+	}
+	if chunk.Seq != repair.NextChunk {
+		log.Printf("Ignoring out-of-order repair chunk %d (expected %d)\n", chunk.Seq, repair.NextChunk)
+		return
+	}
+	failed, err := applyChunk(chunk)
+	if err != nil {
+		log.Println("Error applying repair chunk:", err)
+		return
+	}
+	repair.Failed += failed
+	chunk.Hash(repair.checksum)
+	repair.NextChunk = chunk.Seq + 1
+}
+
+// finishRepair checks a repair once its snapshot is done. A failed repair
+// is followed by a full sync, and an ignored one by a full sync or the next
+// repair, once the slave has caught up.
+func finishRepair(done protocol.SyncDone) {
+	mu.Lock()
+	checksum := hex.EncodeToString(repair.checksum.Sum(nil))
+	var problem string
+	switch {
+	case repair.Void:
+	case checksum != done.Checksum || repair.NextChunk != done.Chunks:
+		problem = fmt.Sprintf("checksum mismatch (got %s, want %s)", checksum, done.Checksum)
+	case repair.Failed > 0:
+		problem = fmt.Sprintf("%d statements failed", repair.Failed)
+	}
+	void, lsn := repair.Void, repair.LSN
+	// Whatever the slave was catching up with asks for the repair again
+	waiting := catchingUp || fullSync.Requested || fullSync.Active
+	if void || problem != "" {
+		requeueRepair()
+	} else {
+		repair.Asked = nil
+		repair.Requested, repair.Active = false, false
+		if err := replog.SavePosition(positionPath(), appliedLSN); err != nil {
+			log.Println("Error saving replication position:", err)
+		}
+		if len(repair.Tables) == 0 && !fullSync.Active {
+			os.Remove(syncStatePath())
+		}
+	}
+	mu.Unlock()
+
+	switch {
+	case problem != "":
+		log.Printf("Repair failed: %s, requesting full sync\n", problem)
+		fullSyncWithMaster()
+	case void && !waiting:
+		fullSyncWithMaster()
+	case void:
+	default:
+		log.Printf("Repair complete at LSN %d\n", lsn)
+		requestRepair()
+	}
+}
+
+// handleMasterCommands processes messages from the Master until the
+// connection fails, and returns the error that ended it.
+func handleMasterCommands(masterConn *protocol.Conn) error {
+	for {
+		// The Master heartbeats while idle, so silence means it or the
+		// link is gone
+		masterConn.SetReadDeadline(time.Now().Add(cfg.Replication.HeartbeatTimeout))
+		msg, err := masterConn.Receive()
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return fmt.Errorf("no heartbeat from Master for %s", cfg.Replication.HeartbeatTimeout)
+		}
+		if err != nil {
+			return err
+		}
+
+		switch msg.Type {
+		case protocol.MsgHeartbeat:
+			var hb protocol.Heartbeat
+			if err := msg.Decode(&hb); err != nil {
+				continue
+			}
+			link.mu.Lock()
+			link.lastHeartbeat, link.masterLSN = time.Now(), hb.LSN
+			link.mu.Unlock()
+		case protocol.MsgSetup:
+			var stmt protocol.Statement
+			if err := msg.Decode(&stmt); err != nil {
+				log.Println("Received invalid setup command from Master:", err)
+				continue
+			}
+			// Send acknowledgment for setup commands
+			_, err = db.Exec(stmt.Query)
+			if err != nil {
+				log.Println("Error executing Master setup command:", err)
+				masterConn.SendError(err.Error())
+			} else {
+				masterConn.Send(protocol.MsgOK, struct{}{})
+			}
+		case protocol.MsgSyncManifest:
+			var manifest protocol.SyncManifest
+			if err := msg.Decode(&manifest); err != nil {
+				log.Println("Error syncing with Master:", err)
+				continue
+			}
+			if manifest.Repair {
+				startRepair(manifest)
+			} else {
+				startSnapshot(manifest)
+			}
+		case protocol.MsgSyncChunk:
+			var chunk protocol.SyncChunk
+			if err := msg.Decode(&chunk); err != nil {
+				log.Println("Error syncing with Master:", err)
+				continue
+			}
+			if repairing() {
+				applyRepairChunk(chunk)
+			} else {
+				applySnapshotChunk(chunk)
+			}
+		case protocol.MsgSyncDone:
+			var done protocol.SyncDone
+			if err := msg.Decode(&done); err != nil {
+				log.Println("Error syncing with Master:", err)
+				continue
+			}
+			if repairing() {
+				finishRepair(done)
+			} else {
+				finishSnapshot(done)
+			}
+		case protocol.MsgReplicate:
+			var entry protocol.Replicate
+			if err := msg.Decode(&entry); err != nil {
+				log.Println("Received invalid command from Master:", err)
+				continue
+			}
+			applyLogEntry(entry)
+		case protocol.MsgShardMap:
+			var snapshot shard.Snapshot
+			if err := msg.Decode(&snapshot); err != nil {
+				log.Println("Received invalid shard map from Master:", err)
+				continue
+			}
+			if err := shardMap.Replace(snapshot); err != nil {
+				log.Println("Error saving shard map:", err)
+				continue
+			}
+			log.Printf("Shard map updated to version %d (%d tables)\n", snapshot.Version, len(snapshot.Tables))
+		case protocol.MsgRegistered:
+			var registered protocol.Registered
+			if err := msg.Decode(&registered); err != nil {
+				log.Println("Received invalid registration from Master:", err)
+				continue
+			}
+			if registered.Returning {
+				log.Printf("Master recognized this slave as %s, first seen %s\n", registered.NodeID, registered.FirstSeen.Format(time.RFC3339))
+			} else {
+				log.Printf("Registered with Master as %s\n", registered.NodeID)
+			}
+		case protocol.MsgWelcome:
+			var welcome protocol.Welcome
+			if err := msg.Decode(&welcome); err != nil {
+				log.Println("Received invalid welcome from Master:", err)
+				continue
+			}
+			link.mu.Lock()
+			if welcome.Epoch < link.epoch {
+				current := link.epoch
+				link.mu.Unlock()
+				return fmt.Errorf("master is at epoch %d but epoch %d has been reached", welcome.Epoch, current)
+			}
+			link.epoch, link.self, link.masterHTTPPort = welcome.Epoch, welcome.Addr, welcome.HTTPPort
+			link.save()
+			link.mu.Unlock()
+			// The Master replays the missed entries from here on
+			mu.Lock()
+			catchingUp = false
+			mu.Unlock()
+			requestRepair()
+		case protocol.MsgPeers:
+			var peers protocol.Peers
+			if err := msg.Decode(&peers); err != nil {
+				log.Println("Received invalid peer list from Master:", err)
+				continue
+			}
+			link.mu.Lock()
+			link.peers = peers.Hosts
+			link.save()
+			link.mu.Unlock()
+		case protocol.MsgResult:
+			var result protocol.Result
+			if err := msg.Decode(&result); err != nil || deliverReply(result.ID, msg) {
+				continue
+			}
+			if result.Error != "" {
+				log.Println("Master reported error:", result.Error)
+			} else {
+				log.Printf("Master: %s (LSN %d, replicas %v)\n", result.Message, result.LSN, result.Replicas)
+			}
+		case protocol.MsgError:
+			var e protocol.Error
+			if err := msg.Decode(&e); err == nil && !deliverReply(e.ID, msg) {
+				log.Println("Master reported error:", e.Message)
+			}
+		case protocol.MsgConflict:
+			var conflict protocol.Conflict
+			if err := msg.Decode(&conflict); err != nil {
+				log.Println("Received invalid conflict from Master:", err)
+				continue
+			}
+			log.Printf("Write %q conflicts with the Master: %s\n", conflict.Query, conflict.Reason)
+			// Take the Master's copy of the tables the write touched
+			// over ours
+			repairTables(statementTables(conflict.DB, conflict.Query))
+		default:
+			log.Println("Received unexpected message from Master:", msg.Type)
+		}
+	}
+}
+
+// forwardTimeout bounds how long a write forwarded in forward mode waits
+// for the Master, which replies once the write concern is settled, and
+// then for this slave to apply it.
+const forwardTimeout = 30 * time.Second
+
+// setApplied records lsn as the slave's position and wakes whoever waits
+// for it. It must be called with mu held.
+func setApplied(lsn uint64) {
+	appliedLSN = lsn
+	close(appliedSignal)
+	appliedSignal = make(chan struct{})
+}
+
+// waitApplied waits until the slave has applied the entry at lsn, for at
+// most forwardTimeout.
+func waitApplied(lsn uint64) error {
+	timer := time.NewTimer(forwardTimeout)
+	defer timer.Stop()
+	for {
+		mu.Lock()
+		applied, signal := appliedLSN, appliedSignal
+		mu.Unlock()
+		if applied >= lsn {
+			return nil
+		}
+		select {
+		case <-signal:
+		case <-timer.C:
+			return fmt.Errorf("the Master applied the write at LSN %d, but this slave is still at LSN %d after %s", lsn, applied, forwardTimeout)
+		}
+	}
+}
+
+// forwards holds a channel for every forwarded write awaiting the Master's
+// reply, by statement ID. It and forwardSeq are guarded by forwardMu.
+var (
+	forwardMu  sync.Mutex
+	forwardSeq uint64
+	forwards   = map[uint64]chan *protocol.Message{}
 )
 
-func main() {
-	if len(os.Args) < 2 {
-		log.Fatal("Please provide the Master's IP address as argument (e.g., go run slave.go 192.168.1.100)")
-	}
-	masterIP := os.Args[1]
+// forwardWrite sends a write to the Master and waits for its reply, a
+// MsgResult or MsgError. It fails if the reply does not come, in which case
+// the write may or may not have been executed.
+func forwardWrite(stmt protocol.Statement) (*protocol.Message, error) {
+	reply := make(chan *protocol.Message, 1)
+	forwardMu.Lock()
+	forwardSeq++
+	stmt.ID = forwardSeq
+	forwards[stmt.ID] = reply
+	forwardMu.Unlock()
+	defer func() {
+		forwardMu.Lock()
+		delete(forwards, stmt.ID)
+		forwardMu.Unlock()
+	}()
 
-	var err error
-	// Connect to local MySQL (will sync with Master later)
-	db, err = sql.Open("mysql", "root:1234@tcp(127.0.0.1:3306)/")
-	if err != nil {
-		log.Fatal("Error connecting to local MySQL:", err)
+	if err := sendToMaster(protocol.MsgForward, stmt); err != nil {
+		return nil, err
 	}
-	defer db.Close()
+	timer := time.NewTimer(forwardTimeout)
+	defer timer.Stop()
+	select {
+	case msg := <-reply:
+		if msg == nil {
+			return nil, fmt.Errorf("connection to Master lost before it replied; the write may have been applied")
+		}
+		return msg, nil
+	case <-timer.C:
+		return nil, fmt.Errorf("no reply from Master within %s; the write may have been applied", forwardTimeout)
+	}
+}
 
-	// Initialize shard databases and map
-	shardMap = make(map[string]int) // Initialize the shard map
-	shardDBs = make([]*sql.DB, 2)
-	shardDBs[0], err = sql.Open("mysql", "root:1234@tcp(127.0.0.1:3306)/shard1")
-	if err != nil {
-		log.Fatal("Error connecting to Shard1:", err)
+// deliverReply hands the Master's reply to a forwarded write to the client
+// waiting for it. It returns false if no client is waiting for id.
+func deliverReply(id uint64, msg *protocol.Message) bool {
+	if id == 0 {
+		return false
 	}
-	defer shardDBs[0].Close()
-	shardDBs[1], err = sql.Open("mysql", "root:1234@tcp(127.0.0.1:3306)/shard2")
-	if err != nil {
-		log.Fatal("Error connecting to Shard2:", err)
+	forwardMu.Lock()
+	defer forwardMu.Unlock()
+	reply, ok := forwards[id]
+	if ok {
+		reply <- msg
+		delete(forwards, id)
 	}
-	defer shardDBs[1].Close()
+	return ok
+}
 
-	// Connect to Master on port 8083
-	masterConn, err = net.Dial("tcp", masterIP+":8083")
-	if err != nil {
-		log.Fatal("Error connecting to Master:", err)
+// abortForwards tells the clients of every forwarded write that their reply
+// will not come, after the connection to the Master is lost.
+func abortForwards() {
+	forwardMu.Lock()
+	defer forwardMu.Unlock()
+	for id, reply := range forwards {
+		reply <- nil
+		delete(forwards, id)
 	}
-	defer masterConn.Close()
-
-	fmt.Printf("Slave %d connected to Master at %s:8083\n", slaveID, masterIP)
-
-	// Initial full sync with Master
-	go fullSyncWithMaster()
-
-	// Handle incoming commands from Master
-	go handleMasterCommands()
-
-	// Start Web Frontend on port 8082
-	go startFrontend()
+}
 
-	// Keep the main goroutine alive
-	select {}
+// respondForwarded reports the Master's reply to a forwarded write in the
+// form the Master's own /query uses. A successful write is reported once
+// this slave has applied it too, so that the client reads it back here.
+func respondForwarded(c *gin.Context, msg *protocol.Message) {
+	if msg.Type == protocol.MsgError {
+		var e protocol.Error
+		if err := msg.Decode(&e); err != nil {
+			c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": e.Message})
+		return
+	}
+	var result protocol.Result
+	if err := msg.Decode(&result); err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+	if result.Error != "" {
+		c.JSON(http.StatusGatewayTimeout, gin.H{
+			"error":    result.Error,
+			"rows":     result.RowsAffected,
+			"lsn":      result.LSN,
+			"replicas": result.Replicas,
+		})
+		return
+	}
+	if err := waitApplied(result.LSN); err != nil {
+		c.JSON(http.StatusGatewayTimeout, gin.H{
+			"error":    err.Error(),
+			"rows":     result.RowsAffected,
+			"lsn":      result.LSN,
+			"replicas": result.Replicas,
+		})
+		return
+	}
+	response := gin.H{
+		"message":  "Query executed successfully",
+		"rows":     result.RowsAffected,
+		"lsn":      result.LSN,
+		"replicas": result.Replicas,
+	}
+	if result.LastInsertID != 0 {
+		response["last_insert_id"] = result.LastInsertID
+	}
+	c.JSON(http.StatusOK, response)
 }
 
-func fullSyncWithMaster() {
+// applyLogEntry applies a replication log entry exactly once, records it as
+// the slave's new position and acknowledges it to the Master. The position
+// only ever advances entry by entry: after a gap the slave catches up from
+// its position, and after an entry fails to apply it takes a full sync.
+// Entries arriving meanwhile are acknowledged as failed and not applied.
+func applyLogEntry(entry protocol.Replicate) {
 	mu.Lock()
-	defer mu.Unlock()
-
-	// Request full sync from Master
-	masterConn.Write([]byte("FULL_SYNC|"))
-	buf := make([]byte, 4096) // Increased buffer size for full sync
-	n, err := masterConn.Read(buf)
-	if err != nil {
-		log.Println("Error syncing with Master:", err)
+	current := appliedLSN
+	halted := catchingUp || fullSync.Requested || fullSync.Active
+	mu.Unlock()
+	if entry.LSN <= current {
 		return
 	}
-	syncData := string(buf[:n])
-	if strings.HasPrefix(syncData, "FULL_SYNC|") {
-		syncData = strings.TrimPrefix(syncData, "FULL_SYNC|")
-		queries := strings.Split(syncData, ";")
-		for _, query := range queries {
-			query = strings.TrimSpace(query)
-			if query == "" {
-				continue
-			}
-			_, err = db.Exec(query)
-			if err != nil {
-				log.Println("Error applying sync query:", err)
-			} else {
-				log.Println("Synced query:", query)
-			}
-		}
+	ack := protocol.Ack{LSN: entry.LSN}
+	if halted {
+		ack.Error = "resynchronizing with Master"
+		sendToMaster(protocol.MsgAck, ack)
+		return
+	}
+	if entry.LSN != current+1 {
+		log.Printf("Replication gap: got LSN %d after %d, catching up\n", entry.LSN, current)
+		ack.Error = fmt.Sprintf("replication gap after LSN %d", current)
+		sendToMaster(protocol.MsgAck, ack)
+		catchUpWithMaster()
+		return
 	}
-}
 
-func handleMasterCommands() {
-	for {
-		buf := make([]byte, 1024)
-		n, err := masterConn.Read(buf)
+	if !entry.Applied {
+		var err error
+		if entry.Shard != nil {
+			err = applyPinned(entry.LogEntry)
+		} else if len(entry.Statements) > 0 {
+			err = applyTransaction(entry.LogEntry)
+		} else {
+			err = applyReplicated(entry.DB, entry.Query, entry.Vars)
+		}
 		if err != nil {
-			log.Println("Error reading from Master:", err)
+			log.Printf("Error applying LSN %d, requesting full sync: %v\n", entry.LSN, err)
+			ack.Error = err.Error()
+			sendToMaster(protocol.MsgAck, ack)
+			fullSyncWithMaster()
 			return
 		}
-		data := string(buf[:n])
-		if data == "" {
-			continue // Skip empty messages
+	}
+
+	mu.Lock()
+	setApplied(entry.LSN)
+	mu.Unlock()
+	if err := replog.SavePosition(positionPath(), entry.LSN); err != nil {
+		log.Println("Error saving replication position:", err)
+		ack.Error = "saving replication position: " + err.Error()
+	}
+	sendToMaster(protocol.MsgAck, ack)
+}
+
+// applyReplicated runs a statement of the Master's in a session of its own,
+// given the session variables it ran with there.
+func applyReplicated(dbName, query string, vars []string) error {
+	if stmt, err := sqlparse.Parse(query); err == nil && stmt.Kind.IsDDL() {
+		// Allow schema changes from Master
+		_, err := execSchema(dbName, stmt)
+		if err != nil {
+			log.Println("Error executing Master query:", err)
+		} else {
+			log.Println("Executed Master query:", query)
 		}
-		parts := strings.SplitN(data, "|", 2)
-		if len(parts) < 2 {
-			log.Println("Received incomplete command from Master, waiting for valid command")
-			continue
+		return err
+	}
+
+	// Execute query with proper sharding
+	s := session.New(serverDBs)
+	defer s.Close()
+	if err := s.Use(context.Background(), dbName); err != nil {
+		log.Println("Error selecting database:", err)
+		return err
+	}
+	for _, set := range vars {
+		if err := s.Set(context.Background(), set); err != nil {
+			log.Println("Error setting session variables:", err)
+			return err
 		}
+	}
+	rowsAffected, err := executeQueryWithSharding(s, query)
+	if err != nil {
+		log.Println("Error executing query:", err)
+	} else {
+		log.Println("Executed query:", query, "Rows affected:", rowsAffected)
+	}
+	return err
+}
 
-		dbName := parts[0]
-		query := parts[1]
+// applyPinned runs a log entry pinned to one shard by a migration, unless
+// here that shard shares its server with the entry's peer and so already
+// holds the result.
+func applyPinned(entry protocol.LogEntry) error {
+	id := *entry.Shard
+	if id < 0 || id >= len(shardDBs) || entry.Peer < 0 || entry.Peer >= len(shardDBs) {
+		return fmt.Errorf("invalid shard ID %d in log entry %d", id, entry.LSN)
+	}
+	if entry.Peer != id && servers.Shared(id, entry.Peer) {
+		return nil
+	}
+	var n int64
+	var err error
+	if len(entry.Vars) == 0 {
+		n, err = session.ExecOn(shardDBs[id], entry.DB, entry.Query)
+	} else {
+		n, err = execWithVars(id, entry)
+	}
+	if err != nil {
+		log.Printf("Error executing query on shard %d: %s\nError: %v\n", id, entry.Query, err)
+	} else {
+		log.Println("Executed migration query on Shard", id, "Rows affected:", n)
+	}
+	return err
+}
 
-		// Send acknowledgment for setup commands
-		if dbName == "master" {
-			_, err = db.Exec(query)
-			if err != nil {
-				log.Println("Error executing Master setup command:", err)
-				masterConn.Write([]byte("Error: " + err.Error()))
-			} else {
-				masterConn.Write([]byte("OK"))
-			}
-			continue
+// execWithVars runs a log entry pinned to shard id in a session given the
+// entry's session variables.
+func execWithVars(id int, entry protocol.LogEntry) (int64, error) {
+	ctx := context.Background()
+	s := session.New(serverDBs)
+	defer s.Close()
+	if err := s.Use(ctx, entry.DB); err != nil {
+		return 0, err
+	}
+	for _, set := range entry.Vars {
+		if err := s.Set(ctx, set); err != nil {
+			return 0, err
 		}
+	}
+	return s.Exec(ctx, servers.Of(id), entry.Query)
+}
 
-		queryType := strings.ToUpper(strings.Split(query, " ")[0])
-		if queryType == "CREATE" || queryType == "DROP" {
-			// Allow CREATE and DROP from Master
-			_, err = db.Exec(query)
-			if err != nil {
-				log.Println("Error executing Master query:", err)
-			} else {
-				log.Println("Executed Master query:", query)
+// applyTransaction runs the statements of a transaction committed on the
+// Master in one local transaction per server, so that a failure leaves
+// none of them applied, short of a server failing to commit. The session
+// variables of the transaction are set on connections that are then not
+// returned to their pool.
+func applyTransaction(entry protocol.LogEntry) error {
+	ctx := context.Background()
+	txs := make(map[int]*sql.Tx)
+	conns := make(map[int]*sql.Conn)
+	defer func() {
+		for _, conn := range conns {
+			if len(entry.Vars) > 0 {
+				conn.Raw(func(any) error { return driver.ErrBadConn })
 			}
-			continue
+			conn.Close()
 		}
-
-		// Execute query with proper sharding
-		result, err := executeQueryWithSharding(query, dbName)
+	}()
+	fail := func(err error) error {
+		for _, tx := range txs {
+			tx.Rollback()
+		}
+		log.Printf("Error applying transaction at LSN %d: %v\n", entry.LSN, err)
+		return err
+	}
+	for _, query := range entry.Statements {
+		stmt, err := sqlparse.Parse(query)
 		if err != nil {
-			log.Println("Error executing query:", err)
-		} else {
-			log.Println("Executed query:", query, "Result:", result)
+			return fail(err)
+		}
+		tables, err := lookupTables(stmt, entry.DB)
+		if err != nil {
+			return fail(err)
+		}
+		targets, err := shard.Route(tables, servers, stmt)
+		if err != nil {
+			return fail(err)
+		}
+		for _, target := range servers.Distinct(targets) {
+			if target.Shard < 0 || target.Shard >= len(shardDBs) {
+				return fail(fmt.Errorf("invalid shard ID %d for table %s", target.Shard, stmt.Table))
+			}
+			server := servers.Of(target.Shard)
+			tx, ok := txs[server]
+			if !ok {
+				conn, err := serverDBs[server].Conn(ctx)
+				if err != nil {
+					return fail(err)
+				}
+				conns[server] = conn
+				if tx, err = conn.BeginTx(ctx, nil); err != nil {
+					return fail(err)
+				}
+				txs[server] = tx
+				if _, err := tx.Exec("USE " + sqlparse.QuoteIdent(entry.DB)); err != nil {
+					return fail(err)
+				}
+				for _, set := range entry.Vars {
+					if _, err := tx.Exec(set); err != nil {
+						return fail(fmt.Errorf("server %d: %w", server, err))
+					}
+				}
+			}
+			if _, err := tx.Exec(target.Query); err != nil {
+				return fail(fmt.Errorf("shard %d: %w", target.Shard, err))
+			}
+		}
+	}
+	for server, tx := range txs {
+		if err := tx.Commit(); err != nil {
+			delete(txs, server)
+			return fail(fmt.Errorf("committing on server %d: %w", server, err))
 		}
+		delete(txs, server)
 	}
+	log.Printf("Applied transaction of %d statements at LSN %d\n", len(entry.Statements), entry.LSN)
+	return nil
 }
 
-func executeQueryWithSharding(query, dbName string) (string, error) {
-	queryType := strings.ToUpper(strings.Split(query, " ")[0])
-	var targetDB *sql.DB = db
-	var shardID int
+// executeQueryWithSharding runs a statement of a session on the shards that
+// hold the rows it touches and returns the total number of rows affected.
+func executeQueryWithSharding(s *session.Session, query string) (int64, error) {
+	ctx := context.Background()
+	stmt, err := sqlparse.Parse(query)
+	if err != nil {
+		return 0, err
+	}
+	if !stmt.Kind.IsDML() || len(stmt.Tables) == 0 {
+		return s.Exec(ctx, 0, query)
+	}
 
-	if queryType == "SELECT" || queryType == "INSERT" || queryType == "UPDATE" || queryType == "DELETE" {
-		parts := strings.Fields(query)
-		var tableName string
-		for i, part := range parts {
-			if strings.ToUpper(part) == "FROM" || strings.ToUpper(part) == "INTO" {
-				tableName = parts[i+1]
-				// Remove any backticks or quotes from table name
-				tableName = strings.Trim(tableName, "`\"'")
-				break
-			}
+	// Placement is decided by the Master only, so that every node agrees
+	tables, err := lookupTables(stmt, s.DB())
+	if err != nil {
+		return 0, err
+	}
+	targets, err := shard.Route(tables, servers, stmt)
+	if err != nil {
+		return 0, err
+	}
+	targets = servers.Distinct(targets)
+
+	// The shards' parts are applied together or not at all
+	stmts := make([]session.Stmt, len(targets))
+	for i, target := range targets {
+		if target.Shard < 0 || target.Shard >= len(shardDBs) {
+			return 0, fmt.Errorf("invalid shard ID %d for table %s", target.Shard, stmt.Table)
 		}
+		log.Printf("Executing %s on Shard %d\n", target.Query, target.Shard)
+		stmts[i] = session.Stmt{Server: servers.Of(target.Shard), Query: target.Query}
+	}
+	total, err := s.ExecAll(ctx, stmts)
+	if err != nil {
+		log.Println("Error executing query:", err)
+	}
+	return total, err
+}
 
-		if tableName != "" {
-			mu.Lock() // Lock when accessing/modifying shardMap
-			shardID, exists := shardMap[tableName]
-			if !exists {
-				// For new tables, assign to shard 0 by default
-				shardID = 0
-				shardMap[tableName] = shardID
-				log.Printf("Assigned new table %s to Shard %d\n", tableName, shardID)
-			}
-			mu.Unlock()
+// queryWithSharding runs a SELECT of a session on every shard that may hold
+// matching rows and merges their results. Tables missing from the shard map
+// are read through the session's main connection.
+func queryWithSharding(s *session.Session, query string) (*shard.ResultSet, error) {
+	ctx := context.Background()
+	stmt, err := sqlparse.Parse(query)
+	if err != nil {
+		return nil, err
+	}
+	tables, err := lookupTables(stmt, s.DB())
+	if stmt.Kind != sqlparse.Select || len(tables) == 0 || err != nil {
+		return s.Query(ctx, 0, query)
+	}
+	targets, err := shard.Route(tables, servers, stmt)
+	if err != nil {
+		return nil, err
+	}
+	targets = servers.Distinct(targets)
+	for _, target := range targets {
+		log.Printf("Querying Shard %d: %s\n", target.Shard, target.Query)
+	}
+	return shard.GatherWith(ctx, targets, func(ctx context.Context, id int, query string) (*shard.ResultSet, error) {
+		return s.Query(ctx, servers.Of(id), query)
+	})
+}
 
-			if shardID >= 0 && shardID < len(shardDBs) {
-				targetDB = shardDBs[shardID]
-				log.Printf("Executing %s on Shard %d\n", query, shardID)
-				_, err := targetDB.Exec("USE " + dbName)
-				if err != nil {
-					log.Printf("Error selecting database %s on shard %d: %v\n", dbName, shardID, err)
-					return "", err
+// execSchema runs a schema change on every MySQL server, the main one
+// first, and returns the rows affected on the main server. If a shard
+// server fails, the change is undone on the servers before it where
+// sqlparse.Undo knows how, so that this node's shards keep one schema.
+func execSchema(dbName string, stmt *sqlparse.Statement) (int64, error) {
+	n, err := session.ExecOn(db, dbName, stmt.Query)
+	if err != nil {
+		return n, err
+	}
+	for i, pool := range serverDBs[1:] {
+		if _, err := session.ExecOn(pool, dbName, stmt.Query); err != nil {
+			err = fmt.Errorf("shard server %d: %w", i+1, err)
+			undo, ok := sqlparse.Undo(stmt)
+			if !ok {
+				return n, fmt.Errorf("%w; the change cannot be rolled back", err)
+			}
+			for _, applied := range serverDBs[:i+1] {
+				if _, uerr := session.ExecOn(applied, dbName, undo); uerr != nil {
+					log.Println("Error rolling back schema change:", uerr)
 				}
-			} else {
-				log.Printf("Invalid shard ID %d for table %s, using default database\n", shardID, tableName)
 			}
+			return n, fmt.Errorf("%w; rolled back with %s", err, undo)
 		}
 	}
+	return n, nil
+}
 
-	result, err := targetDB.Exec(query)
-	if err != nil {
-		log.Printf("Error executing query on shard %d: %s\nError: %v\n", shardID, query, err)
-		return "", err
+// lookupTables returns the placement of every table a statement references.
+func lookupTables(stmt *sqlparse.Statement, dbName string) ([]shard.Table, error) {
+	tables := make([]shard.Table, 0, len(stmt.Tables))
+	for _, name := range stmt.Tables {
+		if name.DB == "" {
+			name.DB = dbName
+		}
+		table, exists := shardMap.Lookup(name.DB, name.Name)
+		if !exists {
+			return nil, fmt.Errorf("table %s is not in the shard map yet", name)
+		}
+		tables = append(tables, table)
+	}
+	return tables, nil
+}
+
+// sessionIdleTimeout is how long a session opened with /session may go
+// without a request before it is closed.
+const sessionIdleTimeout = 30 * time.Minute
+
+// expireSessions closes the sessions left idle for sessionIdleTimeout.
+func expireSessions() {
+	for range time.Tick(time.Minute) {
+		for _, s := range sessions.Expire() {
+			log.Printf("Closed session %s after %s idle\n", s.ID, sessionIdleTimeout)
+		}
 	}
-	rowsAffected, _ := result.RowsAffected()
-	return fmt.Sprintf("Rows affected: %d", rowsAffected), nil
 }
 
 func startFrontend() {
 	r := gin.Default()
-	r.LoadHTMLGlob("templates/*.html")
-	r.Static("/static", "./static")
+	r.Use(sessions.Attach)
+	r.LoadHTMLGlob(filepath.Join(cfg.UI.Templates, "*.html"))
+	r.Static("/static", cfg.UI.Static)
+
+	// Flag every response served while the Master is unreachable, since
+	// the data may be stale
+	r.Use(func(c *gin.Context) {
+		if !connectedToMaster() {
+			c.Header("X-Slave-Status", "degraded")
+		}
+		c.Next()
+	})
 
 	r.GET("/", func(c *gin.Context) {
 		userType := c.Query("user")
 		c.HTML(http.StatusOK, "index.html", gin.H{
+			"Title":    cfg.UI.Title,
 			"IsMaster": userType == "master",
 		})
 	})
 
+	r.GET("/sync", func(c *gin.Context) {
+		mu.Lock()
+		defer mu.Unlock()
+		c.JSON(http.StatusOK, gin.H{
+			"status":     slaveStatus(),
+			"lsn":        appliedLSN,
+			"active":     fullSync.Active,
+			"next_chunk": fullSync.NextChunk,
+			"failed":     fullSync.Failed,
+			"error":      fullSync.Error,
+			"tables":     fullSync.Tables,
+		})
+	})
+
+	r.GET("/status", func(c *gin.Context) {
+		mu.Lock()
+		status, lsn, syncing := slaveStatus(), appliedLSN, fullSync.Active
+		mu.Unlock()
+		link.mu.Lock()
+		defer link.mu.Unlock()
+		c.JSON(http.StatusOK, gin.H{
+			"node_id":    nodeID,
+			"status":     status,
+			"master":     link.addr,
+			"connected":  link.connected,
+			"since":      link.since,
+			"attempts":   link.attempts,
+			"last_error": link.lastError,
+			"lsn":        lsn,
+			"syncing":    syncing,
+			"epoch":      link.epoch,
+			"self":       link.self,
+			"peers":      link.peers,
+			"promoting":  link.promoting,
+			"heartbeat":  link.lastHeartbeat,
+			"master_lsn": link.masterLSN,
+			"lag":        lag(link.masterLSN, lsn),
+		})
+	})
+
+	r.GET("/admin/raft", func(c *gin.Context) {
+		if raftNode == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Raft is not enabled"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"raft": raftNode.Status(), "metadata": metadata.State()})
+	})
+
+	r.POST("/admin/promote", func(c *gin.Context) {
+		if raftNode != nil {
+			c.JSON(http.StatusConflict, gin.H{"error": "The Master is elected by Raft while it is enabled"})
+			return
+		}
+		// Promoting while the Master is alive loses the writes it accepts
+		// until it is fenced, so that has to be asked for explicitly
+		if connectedToMaster() && c.PostForm("force") != "true" {
+			c.JSON(http.StatusConflict, gin.H{"error": "The Master is still connected; set force=true to promote anyway"})
+			return
+		}
+		link.mu.Lock()
+		next := link.epoch + 1
+		link.mu.Unlock()
+		if err := promote(next); err != nil {
+			c.JSON(http.StatusConflict, gin.H{"error": "Cannot promote: " + err.Error()})
+			return
+		}
+		c.JSON(http.StatusAccepted, gin.H{"message": "Promoting to Master", "epoch": next})
+	})
+
+	r.POST("/admin/repoint", func(c *gin.Context) {
+		host := c.PostForm("master")
+		newEpoch, err := strconv.ParseUint(c.PostForm("epoch"), 10, 64)
+		if host == "" || err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Master and a numeric epoch are required"})
+			return
+		}
+		if err := link.repoint(host, newEpoch); err != nil {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Following Master " + host, "epoch": newEpoch})
+	})
+
+	r.GET("/admin/shardmap", func(c *gin.Context) {
+		c.JSON(http.StatusOK, shardMap.Snapshot())
+	})
+
+	r.POST("/session", func(c *gin.Context) {
+		s, err := sessions.Open()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if err := s.Use(context.Background(), c.PostForm("dbName")); err != nil {
+			sessions.Close(s.ID)
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Error selecting database: " + err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Session opened", "session": s.ID, "db": s.DB()})
+	})
+
+	r.GET("/session", func(c *gin.Context) {
+		s := session.Of(c)
+		c.JSON(http.StatusOK, gin.H{"session": s.ID, "db": s.DB(), "variables": s.Vars(), "open": sessions.Len()})
+	})
+
+	r.POST("/session/close", func(c *gin.Context) {
+		s, ok := sessions.Close(session.Of(c).ID)
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "No session given: pass its ID as session"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Session closed", "session": s.ID})
+	})
+
 	r.GET("/databases", func(c *gin.Context) {
-		rows, err := db.Query("SHOW DATABASES")
+		result, err := session.Of(c).Query(context.Background(), 0, "SHOW DATABASES")
 		if err != nil {
 			log.Println("Error fetching databases:", err)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
-		defer rows.Close()
 		var databases []string
-		for rows.Next() {
-			var dbName string
-			rows.Scan(&dbName)
-			if dbName != "information_schema" && dbName != "mysql" && dbName != "performance_schema" && dbName != "sys" {
+		for _, row := range result.Rows {
+			dbName := fmt.Sprint(row[0])
+			if dbName != "information_schema" && dbName != "mysql" && dbName != "performance_schema" && dbName != "sys" && dbName != shard.MetaDB {
 				databases = append(databases, dbName)
 			}
 		}
@@ -247,24 +2024,21 @@ func startFrontend() {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "Database name is required"})
 			return
 		}
-		_, err := db.Exec("USE " + dbName)
-		if err != nil {
+		s := session.Of(c)
+		if err := s.Use(context.Background(), dbName); err != nil {
 			log.Println("Error selecting database:", err)
 			c.JSON(http.StatusBadRequest, gin.H{"error": "Error selecting database: " + err.Error()})
 			return
 		}
-		rows, err := db.Query("SHOW TABLES")
+		result, err := s.Query(context.Background(), 0, "SHOW TABLES")
 		if err != nil {
 			log.Println("Error fetching tables:", err)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
-		defer rows.Close()
 		var tables []string
-		for rows.Next() {
-			var tableName string
-			rows.Scan(&tableName)
-			tables = append(tables, tableName)
+		for _, row := range result.Rows {
+			tables = append(tables, fmt.Sprint(row[0]))
 		}
 		c.JSON(http.StatusOK, gin.H{"tables": tables})
 	})
@@ -276,32 +2050,23 @@ func startFrontend() {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "Database and table names are required"})
 			return
 		}
-		_, err := db.Exec("USE " + dbName)
-		if err != nil {
+		s := session.Of(c)
+		if err := s.Use(context.Background(), dbName); err != nil {
 			log.Println("Error selecting database:", err)
 			c.JSON(http.StatusBadRequest, gin.H{"error": "Error selecting database: " + err.Error()})
 			return
 		}
-		rows, err := db.Query("DESCRIBE " + tableName)
+		result, err := s.Query(context.Background(), 0, "DESCRIBE "+tableName)
 		if err != nil {
 			log.Println("Error describing table:", err)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
-		defer rows.Close()
 		var columns []map[string]string
-		for rows.Next() {
-			var columnName, columnType, null, key string
-			var defaultVal, extra *string
-			err = rows.Scan(&columnName, &columnType, &null, &key, &defaultVal, &extra)
-			if err != nil {
-				log.Println("Error scanning column info:", err)
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Error scanning column info: " + err.Error()})
-				return
-			}
+		for _, row := range result.Rows {
 			columns = append(columns, map[string]string{
-				"name": columnName,
-				"type": columnType,
+				"name": fmt.Sprint(row[0]),
+				"type": fmt.Sprint(row[1]),
 			})
 		}
 		c.JSON(http.StatusOK, gin.H{"columns": columns})
@@ -314,29 +2079,22 @@ func startFrontend() {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "Database and table names are required"})
 			return
 		}
-		_, err := db.Exec("USE " + dbName)
-		if err != nil {
+		s := session.Of(c)
+		if err := s.Use(context.Background(), dbName); err != nil {
 			log.Println("Error selecting database:", err)
 			c.JSON(http.StatusBadRequest, gin.H{"error": "Error selecting database: " + err.Error()})
 			return
 		}
-		rows, err := db.Query("SELECT id FROM " + tableName)
+		// The rows may be spread over several shards
+		result, err := queryWithSharding(s, "SELECT id FROM "+tableName)
 		if err != nil {
 			log.Println("Error fetching rows:", err)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error fetching rows: " + err.Error()})
 			return
 		}
-		defer rows.Close()
 		var ids []string
-		for rows.Next() {
-			var id string
-			err := rows.Scan(&id)
-			if err != nil {
-				log.Println("Error scanning ID:", err)
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Error scanning ID: " + err.Error()})
-				return
-			}
-			ids = append(ids, id)
+		for _, row := range result.Rows {
+			ids = append(ids, fmt.Sprint(row[0]))
 		}
 		c.JSON(http.StatusOK, gin.H{"ids": ids})
 	})
@@ -351,32 +2109,24 @@ func startFrontend() {
 		}
 		log.Println("Fetching row for db:", dbName, "table:", tableName, "id:", id)
 
-		_, err := db.Exec("USE " + dbName)
-		if err != nil {
+		s := session.Of(c)
+		if err := s.Use(context.Background(), dbName); err != nil {
 			log.Println("Error selecting database:", err)
 			c.JSON(http.StatusBadRequest, gin.H{"error": "Error selecting database: " + err.Error()})
 			return
 		}
 
-		columnRows, err := db.Query("DESCRIBE " + tableName)
+		description, err := s.Query(context.Background(), 0, "DESCRIBE "+tableName)
 		if err != nil {
 			log.Println("Error describing table:", err)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error describing table: " + err.Error()})
 			return
 		}
-		defer columnRows.Close()
 
 		var columnNames []string
 		var columnTypes = make(map[string]string)
-		for columnRows.Next() {
-			var columnName, columnType, null, key string
-			var defaultVal, extra *string
-			err = columnRows.Scan(&columnName, &columnType, &null, &key, &defaultVal, &extra)
-			if err != nil {
-				log.Println("Error scanning column info:", err)
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Error scanning column info: " + err.Error()})
-				return
-			}
+		for _, row := range description.Rows {
+			columnName, columnType := fmt.Sprint(row[0]), fmt.Sprint(row[1])
 			if columnName != "id" {
 				columnNames = append(columnNames, columnName)
 				columnTypes[columnName] = columnType
@@ -397,40 +2147,31 @@ func startFrontend() {
 				selectColumns = append(selectColumns, col)
 			}
 		}
-		query := fmt.Sprintf("SELECT %s FROM %s WHERE id = ?", strings.Join(selectColumns, ", "), tableName)
+		query := fmt.Sprintf("SELECT %s FROM %s WHERE id = %s", strings.Join(selectColumns, ", "), tableName, sqlparse.QuoteString(id))
 
-		rows, err := db.Query(query, id)
+		// The row lives on one of the shards
+		result, err := queryWithSharding(s, query)
 		if err != nil {
 			log.Println("Error fetching row:", err)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error fetching row: " + err.Error()})
 			return
 		}
-		defer rows.Close()
-
-		if !rows.Next() {
+		if len(result.Rows) == 0 {
 			log.Println("No row found with id:", id)
 			c.JSON(http.StatusNotFound, gin.H{"error": "No row found with id: " + id})
 			return
 		}
 
-		values := make([]string, len(columnNames))
-		valuePtrs := make([]interface{}, len(columnNames))
-		for i := range columnNames {
-			valuePtrs[i] = &values[i]
-		}
-
-		if err := rows.Scan(valuePtrs...); err != nil {
-			log.Println("Error scanning row:", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error scanning row: " + err.Error()})
-			return
-		}
-
 		var columnData []map[string]string
 		for i, col := range columnNames {
+			value := ""
+			if v := result.Rows[0][i]; v != nil {
+				value = fmt.Sprint(v)
+			}
 			columnData = append(columnData, map[string]string{
 				"name":  col,
 				"type":  columnTypes[col],
-				"value": values[i],
+				"value": value,
 			})
 		}
 		c.JSON(http.StatusOK, gin.H{"columns": columnData})
@@ -441,65 +2182,111 @@ func startFrontend() {
 		dbName := c.PostForm("dbName")
 		query := c.PostForm("query")
 
-		queryType := strings.ToUpper(strings.Split(query, " ")[0])
-		if queryType != "CREATE" || !strings.Contains(strings.ToUpper(query), "DATABASE") {
-			_, err := db.Exec("USE " + dbName)
-			if err != nil {
+		stmt, err := sqlparse.Parse(query)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Error parsing query: " + err.Error()})
+			return
+		}
+		s := session.Of(c)
+		if stmt.Kind != sqlparse.CreateDatabase {
+			if err := s.Use(context.Background(), dbName); err != nil {
 				log.Println("Error selecting database:", err)
 				c.JSON(http.StatusBadRequest, gin.H{"error": "Error selecting database: " + err.Error()})
 				return
 			}
+			dbName = s.DB()
 		}
 
-		if userType != "master" && (queryType == "CREATE" || queryType == "DROP") {
-			c.JSON(http.StatusForbidden, gin.H{"error": "CREATE and DROP are Master-only operations"})
+		if userType != "master" && stmt.Kind.IsDDL() {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Schema changes are Master-only operations"})
+			return
+		}
+		if stmt.Kind == sqlparse.Transaction || c.PostForm("tx") != "" {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Transactions run on the Master only"})
+			return
+		}
+		if stmt.Kind == sqlparse.Use || session.Local(stmt) {
+			session.Respond(c, s, stmt)
 			return
 		}
 
-		if queryType == "SELECT" {
-			rows, err := db.Query(query)
+		if stmt.Kind.IsRead() {
+			result, err := queryWithSharding(s, query)
 			if err != nil {
 				log.Println("Error executing query:", err)
 				c.JSON(http.StatusBadRequest, gin.H{"error": "Error executing query: " + err.Error()})
 				return
 			}
-			defer rows.Close()
-			columns, _ := rows.Columns()
 			var results []map[string]interface{}
-			for rows.Next() {
-				values := make([]interface{}, len(columns))
-				valuePtrs := make([]interface{}, len(columns))
-				for i := range values {
-					valuePtrs[i] = &values[i]
-				}
-				rows.Scan(valuePtrs...)
+			for _, values := range result.Rows {
 				row := make(map[string]interface{})
-				for i, col := range columns {
-					val := values[i]
-					if b, ok := val.([]byte); ok {
-						row[col] = string(b)
-					} else {
-						row[col] = val
-					}
+				for i, col := range result.Columns {
+					row[col] = values[i]
 				}
 				results = append(results, row)
 			}
 			c.JSON(http.StatusOK, gin.H{"message": "Query executed successfully", "data": results})
 		} else {
-			// Execute the query locally first
-			result, err := db.Exec(query)
+			// Writes must reach the Master, so refuse them while it is
+			// unreachable rather than diverge from it
+			if !connectedToMaster() {
+				c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Slave is degraded: not connected to Master"})
+				return
+			}
+
+			if cfg.Replication.SlaveWrites == "forward" {
+				// Only the Master executes the write, and the client gets
+				// its outcome; the write reaches this node through
+				// replication, in the Master's order
+				reply, err := forwardWrite(protocol.Statement{
+					DB:           dbName,
+					Query:        query,
+					Vars:         s.Vars(),
+					WriteConcern: c.PostForm("writeConcern"),
+					Forward:      true,
+				})
+				if err != nil {
+					log.Println("Error forwarding query to Master:", err)
+					c.JSON(http.StatusBadGateway, gin.H{"error": "Error forwarding query to Master: " + err.Error()})
+					return
+				}
+				respondForwarded(c, reply)
+				return
+			}
+
+			// Execute the query locally first; the Master checks it
+			// against the entries not applied here yet. Data being
+			// replaced by the Master's takes no local writes.
+			mu.Lock()
+			base := appliedLSN
+			resyncing := catchingUp || fullSync.Requested || fullSync.Active || repair.Requested
+			mu.Unlock()
+			if resyncing {
+				c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Slave is resynchronizing with Master; try again shortly"})
+				return
+			}
+			rowsAffected, err := executeQueryWithSharding(s, query)
 			if err != nil {
 				log.Println("Error executing query:", err)
 				c.JSON(http.StatusBadRequest, gin.H{"error": "Error executing query: " + err.Error()})
 				return
 			}
-			rowsAffected, _ := result.RowsAffected()
 
 			// Send the query to Master immediately (Synchronous Replication)
-			_, err = masterConn.Write([]byte(dbName + "|" + query))
+			err = sendToMaster(protocol.MsgForward, protocol.Statement{
+				DB:           dbName,
+				Query:        query,
+				Vars:         s.Vars(),
+				WriteConcern: c.PostForm("writeConcern"),
+				BaseLSN:      base,
+				Rows:         rowsAffected,
+			})
 			if err != nil {
-				log.Println("Error sending query to Master:", err)
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Error sending query to Master: " + err.Error()})
+				// The Master never saw the write, so its copy of the
+				// tables the write touched replaces ours
+				log.Println("Error sending query to Master, repairing its tables:", err)
+				repairTables(statementTables(dbName, query))
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Error sending query to Master: " + err.Error() + "; the write is undone by resynchronizing with Master"})
 				return
 			}
 
@@ -507,7 +2294,7 @@ func startFrontend() {
 		}
 	})
 
-	if err := r.Run(":8082"); err != nil {
+	if err := r.Run(cfg.Listen.HTTP); err != nil {
 		log.Fatal("Error starting frontend:", err)
 	}
 }
@@ -0,0 +1,492 @@
+package sqlparse
+
+import "strings"
+
+// Kind classifies a statement.
+type Kind int
+
+const (
+	Unknown Kind = iota
+	Select
+	Insert
+	Replace
+	Update
+	Delete
+	CreateDatabase
+	CreateTable
+	CreateOther
+	DropDatabase
+	DropTable
+	DropOther
+	Alter
+	Truncate
+	Rename
+	Use
+	Show
+	Describe
+	Set
+	Transaction
+)
+
+func (k Kind) String() string {
+	switch k {
+	case Select:
+		return "SELECT"
+	case Insert:
+		return "INSERT"
+	case Replace:
+		return "REPLACE"
+	case Update:
+		return "UPDATE"
+	case Delete:
+		return "DELETE"
+	case CreateDatabase:
+		return "CREATE DATABASE"
+	case CreateTable:
+		return "CREATE TABLE"
+	case CreateOther:
+		return "CREATE"
+	case DropDatabase:
+		return "DROP DATABASE"
+	case DropTable:
+		return "DROP TABLE"
+	case DropOther:
+		return "DROP"
+	case Alter:
+		return "ALTER"
+	case Truncate:
+		return "TRUNCATE"
+	case Rename:
+		return "RENAME"
+	case Use:
+		return "USE"
+	case Show:
+		return "SHOW"
+	case Describe:
+		return "DESCRIBE"
+	case Set:
+		return "SET"
+	case Transaction:
+		return "TRANSACTION"
+	}
+	return "UNKNOWN"
+}
+
+// IsRead reports whether statements of this kind only read data.
+func (k Kind) IsRead() bool {
+	return k == Select || k == Show || k == Describe
+}
+
+// IsDML reports whether statements of this kind change table rows.
+func (k Kind) IsDML() bool {
+	return k == Insert || k == Replace || k == Update || k == Delete
+}
+
+// IsDDL reports whether statements of this kind change the schema.
+func (k Kind) IsDDL() bool {
+	switch k {
+	case CreateDatabase, CreateTable, CreateOther, DropDatabase, DropTable, DropOther, Alter, Truncate, Rename:
+		return true
+	}
+	return false
+}
+
+// TableName is a table name, qualified by its database when DB is not empty.
+type TableName struct {
+	DB   string
+	Name string
+}
+
+func (n TableName) String() string {
+	if n.DB == "" {
+		return n.Name
+	}
+	return n.DB + "." + n.Name
+}
+
+// Statement is a parsed statement. Only the parts needed to classify and
+// route statements are broken down; everything else is kept as tokens.
+type Statement struct {
+	Kind   Kind
+	Query  string
+	Tokens []Token
+
+	// Table is the table named directly by the statement: the target of
+	// INSERT, REPLACE, UPDATE, DELETE and table DDL, or the first table of
+	// a SELECT's top-level FROM clause. It is empty when that is a derived
+	// table or a common table expression.
+	Table TableName
+	// Tables lists every reference to a base table, including joins and
+	// subqueries, in order of appearance with the target first. Names of
+	// common table expressions are left out.
+	Tables []TableName
+	// Database is the database named by CREATE/DROP/ALTER DATABASE and USE.
+	Database string
+	// CTEs holds the names defined by a WITH clause.
+	CTEs []string
+	// Compound is set for a SELECT combined with UNION, EXCEPT or
+	// INTERSECT, whose WHERE clause only applies to its first part.
+	Compound bool
+
+	// Columns is the column list of an INSERT or REPLACE.
+	Columns []string
+	// Rows holds the VALUES rows of an INSERT or REPLACE.
+	Rows []Row
+	// ValuesEnd is the offset in Query just past the VALUES keyword, and
+	// RowsEnd the offset just past the last row.
+	ValuesEnd, RowsEnd int
+	// Set holds the assignments of an UPDATE, or of INSERT ... SET.
+	Set []Assignment
+	// OnDuplicate holds the assignments of an INSERT's ON DUPLICATE KEY
+	// UPDATE clause.
+	OnDuplicate []Assignment
+	// Where is the top-level WHERE condition, or nil.
+	Where Expr
+	// TableStart and TableEnd delimit in Query the reference to Table in
+	// a SELECT's top-level FROM clause, alias included, and TableAlias is
+	// that alias. Both offsets are zero for other statements.
+	TableStart, TableEnd int
+	TableAlias           string
+}
+
+// Row is one parenthesized row of a VALUES list. Start and End delimit it,
+// parentheses included, in the statement text.
+type Row struct {
+	Values     []Expr
+	Start, End int
+}
+
+// Assignment is a `column = value` item of a SET list.
+type Assignment struct {
+	Column *ColumnRef
+	Value  Expr
+}
+
+// Expr is a node of an expression tree.
+type Expr interface {
+	expr()
+}
+
+// BinaryExpr is a logical (AND, OR, XOR) or comparison operation. Op is
+// upper case.
+type BinaryExpr struct {
+	Op          string
+	Left, Right Expr
+}
+
+// NotExpr negates an expression.
+type NotExpr struct {
+	X Expr
+}
+
+// ParenExpr is a parenthesized expression.
+type ParenExpr struct {
+	X Expr
+}
+
+// InExpr is `X [NOT] IN (list)` or `X [NOT] IN (subquery)`.
+type InExpr struct {
+	X        Expr
+	List     []Expr
+	Not      bool
+	Subquery bool
+}
+
+// BetweenExpr is `X [NOT] BETWEEN Lo AND Hi`.
+type BetweenExpr struct {
+	X, Lo, Hi Expr
+	Not       bool
+}
+
+// ColumnRef is a possibly qualified column name.
+type ColumnRef struct {
+	DB, Table, Name string
+}
+
+// Literal is a string or numeric literal. Value holds the unquoted string,
+// or the number with its sign.
+type Literal struct {
+	Kind  TokenKind
+	Value string
+}
+
+// Placeholder is a ? parameter.
+type Placeholder struct{}
+
+// Subquery is a parenthesized SELECT used as an expression.
+type Subquery struct {
+	Tokens []Token
+}
+
+// RawExpr is any expression the parser does not break down further, such
+// as a function call or arithmetic.
+type RawExpr struct {
+	Tokens []Token
+}
+
+func (*BinaryExpr) expr()  {}
+func (*NotExpr) expr()     {}
+func (*ParenExpr) expr()   {}
+func (*InExpr) expr()      {}
+func (*BetweenExpr) expr() {}
+func (*ColumnRef) expr()   {}
+func (*Literal) expr()     {}
+func (*Placeholder) expr() {}
+func (*Subquery) expr()    {}
+func (*RawExpr) expr()     {}
+
+// volatile lists the functions whose result depends on when, where or by
+// whom they are called, and clockWords those of them that may be written
+// without parentheses.
+var (
+	volatile = map[string]bool{
+		"NOW": true, "SYSDATE": true, "CURDATE": true, "CURTIME": true,
+		"CURRENT_DATE": true, "CURRENT_TIME": true, "CURRENT_TIMESTAMP": true,
+		"LOCALTIME": true, "LOCALTIMESTAMP": true, "UTC_DATE": true, "UTC_TIME": true,
+		"UTC_TIMESTAMP": true, "UNIX_TIMESTAMP": true, "RAND": true, "UUID": true,
+		"UUID_SHORT": true, "RANDOM_BYTES": true, "LAST_INSERT_ID": true,
+		"CONNECTION_ID": true, "USER": true, "CURRENT_USER": true, "SESSION_USER": true,
+		"SYSTEM_USER": true, "FOUND_ROWS": true, "ROW_COUNT": true,
+	}
+	clockWords = map[string]bool{
+		"CURRENT_DATE": true, "CURRENT_TIME": true, "CURRENT_TIMESTAMP": true,
+		"LOCALTIME": true, "LOCALTIMESTAMP": true, "UTC_DATE": true, "UTC_TIME": true,
+		"UTC_TIMESTAMP": true, "CURRENT_USER": true,
+	}
+)
+
+// Volatile returns the name of the first function the statement calls whose
+// result differs from one server or run to the next, such as NOW() or
+// UUID(), or "" if it calls none. UNIX_TIMESTAMP only counts without an
+// argument.
+func (s *Statement) Volatile() string {
+	toks := s.Tokens
+	for i, tok := range toks {
+		if tok.Kind != Ident || tok.Quoted || (i > 0 && toks[i-1].IsPunct(".")) {
+			continue
+		}
+		name := strings.ToUpper(tok.Text)
+		call := i+1 < len(toks) && toks[i+1].IsPunct("(")
+		switch {
+		case !volatile[name]:
+		case name == "UNIX_TIMESTAMP":
+			if call && i+2 < len(toks) && toks[i+2].IsPunct(")") {
+				return name
+			}
+		case call || clockWords[name]:
+			return name
+		}
+	}
+	return ""
+}
+
+// ColumnValues returns the literals that rows matching e must hold in column,
+// as implied by equality and IN predicates combined with AND and OR. The
+// boolean result is false if e does not restrict the column to a finite
+// set of literal values. The column is matched by name, ignoring any
+// qualifier. key maps values to a form that is the same for values the
+// column considers equal; of several equal values, the first is returned.
+func ColumnValues(e Expr, column string, key func(string) string) ([]*Literal, bool) {
+	switch x := e.(type) {
+	case *ParenExpr:
+		return ColumnValues(x.X, column, key)
+	case *BinaryExpr:
+		switch x.Op {
+		case "AND":
+			left, lok := ColumnValues(x.Left, column, key)
+			right, rok := ColumnValues(x.Right, column, key)
+			switch {
+			case lok && rok:
+				return intersect(left, right, key), true
+			case lok:
+				return left, true
+			case rok:
+				return right, true
+			}
+		case "OR":
+			left, lok := ColumnValues(x.Left, column, key)
+			right, rok := ColumnValues(x.Right, column, key)
+			if lok && rok {
+				return union(left, right, key), true
+			}
+		case "=", "<=>":
+			if isColumn(x.Left, column) {
+				if lit, ok := x.Right.(*Literal); ok {
+					return []*Literal{lit}, true
+				}
+			}
+			if isColumn(x.Right, column) {
+				if lit, ok := x.Left.(*Literal); ok {
+					return []*Literal{lit}, true
+				}
+			}
+		}
+	case *InExpr:
+		if x.Not || x.Subquery || !isColumn(x.X, column) {
+			return nil, false
+		}
+		values := make([]*Literal, 0, len(x.List))
+		for _, item := range x.List {
+			lit, ok := item.(*Literal)
+			if !ok {
+				return nil, false
+			}
+			values = append(values, lit)
+		}
+		return union(nil, values, key), true
+	}
+	return nil, false
+}
+
+// Bound is one end of an Interval.
+type Bound struct {
+	Value     string
+	Inclusive bool
+	Unbounded bool
+}
+
+// Interval is a range of column values.
+type Interval struct {
+	Lo, Hi Bound
+}
+
+// ColumnIntervals returns intervals covering every value that rows matching
+// e can hold in column, as implied by comparisons, BETWEEN, equality and IN
+// predicates with literals, combined with AND and OR. cmp orders the
+// values of the column. The boolean result is false if e does not restrict
+// the column. The column is matched by name, ignoring any qualifier.
+func ColumnIntervals(e Expr, column string, cmp func(a, b string) int) ([]Interval, bool) {
+	point := func(v string) Interval {
+		return Interval{Lo: Bound{Value: v, Inclusive: true}, Hi: Bound{Value: v, Inclusive: true}}
+	}
+	switch x := e.(type) {
+	case *ParenExpr:
+		return ColumnIntervals(x.X, column, cmp)
+	case *BinaryExpr:
+		switch x.Op {
+		case "AND":
+			left, lok := ColumnIntervals(x.Left, column, cmp)
+			right, rok := ColumnIntervals(x.Right, column, cmp)
+			switch {
+			case lok && rok:
+				var out []Interval
+				for _, l := range left {
+					for _, r := range right {
+						if iv, ok := overlap(l, r, cmp); ok {
+							out = append(out, iv)
+						}
+					}
+				}
+				return out, true
+			case lok:
+				return left, true
+			case rok:
+				return right, true
+			}
+		case "OR":
+			left, lok := ColumnIntervals(x.Left, column, cmp)
+			right, rok := ColumnIntervals(x.Right, column, cmp)
+			if lok && rok {
+				return append(left, right...), true
+			}
+		case "=", "<=>", "<", "<=", ">", ">=":
+			op := x.Op
+			lit, ok := x.Right.(*Literal)
+			if !ok || !isColumn(x.Left, column) {
+				// value < column is column > value
+				if lit, ok = x.Left.(*Literal); !ok || !isColumn(x.Right, column) {
+					return nil, false
+				}
+				op = map[string]string{"=": "=", "<=>": "<=>", "<": ">", "<=": ">=", ">": "<", ">=": "<="}[op]
+			}
+			iv := Interval{Lo: Bound{Unbounded: true}, Hi: Bound{Unbounded: true}}
+			switch op {
+			case "=", "<=>":
+				iv = point(lit.Value)
+			case "<", "<=":
+				iv.Hi = Bound{Value: lit.Value, Inclusive: op == "<="}
+			case ">", ">=":
+				iv.Lo = Bound{Value: lit.Value, Inclusive: op == ">="}
+			}
+			return []Interval{iv}, true
+		}
+	case *InExpr:
+		values, ok := ColumnValues(x, column, func(v string) string { return v })
+		if !ok {
+			return nil, false
+		}
+		out := make([]Interval, len(values))
+		for i, v := range values {
+			out[i] = point(v.Value)
+		}
+		return out, true
+	case *BetweenExpr:
+		lo, lok := x.Lo.(*Literal)
+		hi, hok := x.Hi.(*Literal)
+		if x.Not || !lok || !hok || !isColumn(x.X, column) {
+			return nil, false
+		}
+		iv := Interval{Lo: Bound{Value: lo.Value, Inclusive: true}, Hi: Bound{Value: hi.Value, Inclusive: true}}
+		if _, ok := overlap(iv, iv, cmp); !ok {
+			return []Interval{}, true
+		}
+		return []Interval{iv}, true
+	}
+	return nil, false
+}
+
+// overlap returns the intersection of two intervals, and false if it is
+// empty.
+func overlap(a, b Interval, cmp func(a, b string) int) (Interval, bool) {
+	iv := a
+	if !b.Lo.Unbounded {
+		if c := cmp(b.Lo.Value, a.Lo.Value); a.Lo.Unbounded || c > 0 || (c == 0 && !b.Lo.Inclusive) {
+			iv.Lo = b.Lo
+		}
+	}
+	if !b.Hi.Unbounded {
+		if c := cmp(b.Hi.Value, a.Hi.Value); a.Hi.Unbounded || c < 0 || (c == 0 && !b.Hi.Inclusive) {
+			iv.Hi = b.Hi
+		}
+	}
+	if !iv.Lo.Unbounded && !iv.Hi.Unbounded {
+		c := cmp(iv.Lo.Value, iv.Hi.Value)
+		if c > 0 || (c == 0 && !(iv.Lo.Inclusive && iv.Hi.Inclusive)) {
+			return iv, false
+		}
+	}
+	return iv, true
+}
+
+func isColumn(e Expr, column string) bool {
+	c, ok := e.(*ColumnRef)
+	return ok && strings.EqualFold(c.Name, column)
+}
+
+func intersect(a, b []*Literal, key func(string) string) []*Literal {
+	in := make(map[string]bool, len(b))
+	for _, v := range b {
+		in[key(v.Value)] = true
+	}
+	out := []*Literal{}
+	for _, v := range a {
+		if in[key(v.Value)] {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func union(a, b []*Literal, key func(string) string) []*Literal {
+	seen := make(map[string]bool, len(a)+len(b))
+	out := []*Literal{}
+	for _, list := range [][]*Literal{a, b} {
+		for _, v := range list {
+			if !seen[key(v.Value)] {
+				seen[key(v.Value)] = true
+				out = append(out, v)
+			}
+		}
+	}
+	return out
+}
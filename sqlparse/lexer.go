@@ -0,0 +1,218 @@
+// Package sqlparse tokenizes and parses MySQL statements into a statement
+// AST used to classify and route them.
+package sqlparse
+
+import (
+	"fmt"
+	"strings"
+)
+
+// TokenKind classifies a token.
+type TokenKind int
+
+const (
+	// Ident is a bare or backtick-quoted identifier, or a keyword.
+	Ident TokenKind = iota
+	// String is a single- or double-quoted string literal.
+	String
+	// Number is a numeric literal.
+	Number
+	// Punct is an operator or punctuation.
+	Punct
+	// Param is a ? placeholder.
+	Param
+)
+
+// Token is a lexical token. Text holds the unquoted value for identifiers
+// and strings; Raw holds the token exactly as written.
+type Token struct {
+	Kind   TokenKind
+	Text   string
+	Raw    string
+	Quoted bool
+	Pos    int
+}
+
+// Is reports whether t is the unquoted keyword kw, case-insensitively.
+func (t Token) Is(kw string) bool {
+	return t.Kind == Ident && !t.Quoted && strings.EqualFold(t.Text, kw)
+}
+
+// IsPunct reports whether t is the punctuation p.
+func (t Token) IsPunct(p string) bool {
+	return t.Kind == Punct && t.Text == p
+}
+
+// Literal reports whether t is a string or numeric literal.
+func (t Token) Literal() bool {
+	return t.Kind == String || t.Kind == Number
+}
+
+// Tokenize splits a statement into tokens, dropping whitespace and comments.
+// The contents of executable comments, /*! ... */ and /*!80000 ... */, are
+// tokens like any other, since MySQL runs them.
+func Tokenize(query string) ([]Token, error) {
+	var tokens []Token
+	executable := -1 // offset of the open executable comment, if any
+	i := 0
+	for i < len(query) {
+		c := query[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f':
+			i++
+		case c == '#' || (c == '-' && isLineComment(query[i:])):
+			for i < len(query) && query[i] != '\n' {
+				i++
+			}
+		case c == '/' && strings.HasPrefix(query[i:], "/*!"):
+			if executable >= 0 {
+				return nil, fmt.Errorf("nested executable comment at offset %d", i)
+			}
+			executable = i
+			i += 3
+			for i < len(query) && isDigit(query[i]) {
+				i++
+			}
+		case c == '*' && executable >= 0 && strings.HasPrefix(query[i:], "*/"):
+			executable = -1
+			i += 2
+		case c == '/' && strings.HasPrefix(query[i:], "/*"):
+			end := strings.Index(query[i+2:], "*/")
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated comment at offset %d", i)
+			}
+			i += end + 4
+		case c == '\'' || c == '"' || c == '`':
+			text, n, err := scanQuoted(query[i:], c)
+			if err != nil {
+				return nil, fmt.Errorf("%v at offset %d", err, i)
+			}
+			kind := String
+			if c == '`' {
+				kind = Ident
+			}
+			tokens = append(tokens, Token{Kind: kind, Text: text, Raw: query[i : i+n], Quoted: true, Pos: i})
+			i += n
+		case isDigit(c) || (c == '.' && i+1 < len(query) && isDigit(query[i+1])):
+			n := scanNumber(query[i:])
+			tokens = append(tokens, Token{Kind: Number, Text: query[i : i+n], Raw: query[i : i+n], Pos: i})
+			i += n
+		case isIdentStart(c):
+			start := i
+			for i < len(query) && isIdentPart(query[i]) {
+				i++
+			}
+			tokens = append(tokens, Token{Kind: Ident, Text: query[start:i], Raw: query[start:i], Pos: start})
+		case c == '?':
+			tokens = append(tokens, Token{Kind: Param, Text: "?", Raw: "?", Pos: i})
+			i++
+		default:
+			n := 1
+			for _, op := range []string{"<=>", "<=", ">=", "<>", "!=", "||", "&&", ":=", "<<", ">>"} {
+				if strings.HasPrefix(query[i:], op) {
+					n = len(op)
+					break
+				}
+			}
+			tokens = append(tokens, Token{Kind: Punct, Text: query[i : i+n], Raw: query[i : i+n], Pos: i})
+			i += n
+		}
+	}
+	if executable >= 0 {
+		return nil, fmt.Errorf("unterminated comment at offset %d", executable)
+	}
+	return tokens, nil
+}
+
+// isLineComment reports whether s starts with a -- comment, which MySQL
+// only recognizes when the dashes are followed by whitespace, a control
+// character or the end of the statement.
+func isLineComment(s string) bool {
+	return strings.HasPrefix(s, "--") && (len(s) == 2 || s[2] <= ' ')
+}
+
+// scanQuoted reads a quoted token starting at s[0] and returns its unescaped
+// text and length in bytes.
+func scanQuoted(s string, quote byte) (string, int, error) {
+	var b strings.Builder
+	i := 1
+	for i < len(s) {
+		c := s[i]
+		switch {
+		case c == quote && i+1 < len(s) && s[i+1] == quote:
+			b.WriteByte(quote)
+			i += 2
+		case c == quote:
+			return b.String(), i + 1, nil
+		case c == '\\' && quote != '`' && i+1 < len(s):
+			b.WriteByte(unescape(s[i+1]))
+			i += 2
+		default:
+			b.WriteByte(c)
+			i++
+		}
+	}
+	return "", 0, fmt.Errorf("unterminated %c quote", quote)
+}
+
+// scanNumber returns the length of the numeric literal at the start of s.
+func scanNumber(s string) int {
+	if len(s) > 2 && s[0] == '0' && (s[1] == 'x' || s[1] == 'X') && isHexDigit(s[2]) {
+		i := 2
+		for i < len(s) && isHexDigit(s[i]) {
+			i++
+		}
+		return i
+	}
+	i := 0
+	for i < len(s) && (isDigit(s[i]) || s[i] == '.') {
+		i++
+	}
+	if i < len(s) && (s[i] == 'e' || s[i] == 'E') {
+		j := i + 1
+		if j < len(s) && (s[j] == '+' || s[j] == '-') {
+			j++
+		}
+		if j < len(s) && isDigit(s[j]) {
+			for j < len(s) && isDigit(s[j]) {
+				j++
+			}
+			i = j
+		}
+	}
+	return i
+}
+
+func unescape(c byte) byte {
+	switch c {
+	case '0':
+		return 0
+	case 'n':
+		return '\n'
+	case 'r':
+		return '\r'
+	case 't':
+		return '\t'
+	case 'b':
+		return '\b'
+	case 'Z':
+		return 0x1a
+	}
+	return c
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isHexDigit(c byte) bool {
+	return isDigit(c) || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || c == '$' || c == '@' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c >= 0x80
+}
+
+func isIdentPart(c byte) bool {
+	return isIdentStart(c) || isDigit(c)
+}
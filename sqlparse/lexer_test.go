@@ -0,0 +1,92 @@
+package sqlparse
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		query string
+		want  []string // Raw of every token
+	}{
+		{"SELECT * FROM t", []string{"SELECT", "*", "FROM", "t"}},
+		{"select `a b`.`c``d` from x", []string{"select", "`a b`", ".", "`c``d`", "from", "x"}},
+		{"SELECT 'it''s', \"a\\\"b\"", []string{"SELECT", "'it''s'", ",", `"a\"b"`}},
+		{"SELECT 1.5e3, .5, 0x1F, 7", []string{"SELECT", "1.5e3", ",", ".5", ",", "0x1F", ",", "7"}},
+		{"a <=> b <= c != d := e", []string{"a", "<=>", "b", "<=", "c", "!=", "d", ":=", "e"}},
+		{"SELECT ? , @v, @@session.x", []string{"SELECT", "?", ",", "@v", ",", "@@session", ".", "x"}},
+		{"SELECT 1 # comment\n, 2", []string{"SELECT", "1", ",", "2"}},
+		{"SELECT 1 -- comment\n, 2", []string{"SELECT", "1", ",", "2"}},
+		{"SELECT 1 --\tcomment\n, 2", []string{"SELECT", "1", ",", "2"}},
+		{"SELECT 1 --\n, 2", []string{"SELECT", "1", ",", "2"}},
+		{"SELECT 1 --", []string{"SELECT", "1"}},
+		{"SELECT 1--2", []string{"SELECT", "1", "-", "-", "2"}},
+		{"SELECT /* hidden */ 1", []string{"SELECT", "1"}},
+		{"SELECT /*+ BKA(t) */ 1", []string{"SELECT", "1"}},
+		{"/*! DROP TABLE t */", []string{"DROP", "TABLE", "t"}},
+		{"SELECT 1 /*!80000 , 2 */ , 3", []string{"SELECT", "1", ",", "2", ",", "3"}},
+		{"SELECT /*!50001 a * b */", []string{"SELECT", "a", "*", "b"}},
+		{"SELECT '/*!' , 1", []string{"SELECT", "'/*!'", ",", "1"}},
+	}
+	for _, tt := range tests {
+		toks, err := Tokenize(tt.query)
+		if err != nil {
+			t.Errorf("Tokenize(%q): %v", tt.query, err)
+			continue
+		}
+		var got []string
+		for _, tok := range toks {
+			got = append(got, tok.Raw)
+			if tt.query[tok.Pos:tok.Pos+len(tok.Raw)] != tok.Raw {
+				t.Errorf("Tokenize(%q): token %q is not at offset %d", tt.query, tok.Raw, tok.Pos)
+			}
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Tokenize(%q) = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestTokenizeText(t *testing.T) {
+	tests := []struct {
+		query  string
+		kind   TokenKind
+		text   string
+		quoted bool
+	}{
+		{"'it''s'", String, "it's", true},
+		{`'a\nb\\c'`, String, "a\nb\\c", true},
+		{`"say ""hi"""`, String, `say "hi"`, true},
+		{"`we``ird`", Ident, "we`ird", true},
+		{"name", Ident, "name", false},
+		{"42", Number, "42", false},
+		{"?", Param, "?", false},
+		{"<>", Punct, "<>", false},
+	}
+	for _, tt := range tests {
+		toks, err := Tokenize(tt.query)
+		if err != nil || len(toks) != 1 {
+			t.Errorf("Tokenize(%q) = %v, %v, want one token", tt.query, toks, err)
+			continue
+		}
+		tok := toks[0]
+		if tok.Kind != tt.kind || tok.Text != tt.text || tok.Quoted != tt.quoted {
+			t.Errorf("Tokenize(%q) = %+v, want kind %d, text %q, quoted %v", tt.query, tok, tt.kind, tt.text, tt.quoted)
+		}
+	}
+}
+
+func TestTokenizeErrors(t *testing.T) {
+	for _, query := range []string{
+		"SELECT 'abc",
+		"SELECT `abc",
+		"SELECT /* abc",
+		"SELECT /*! 1",
+		"SELECT /*! /*! 1 */ */",
+	} {
+		if toks, err := Tokenize(query); err == nil {
+			t.Errorf("Tokenize(%q) = %v, want an error", query, toks)
+		}
+	}
+}
@@ -0,0 +1,790 @@
+package sqlparse
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Parse parses a single statement. A trailing semicolon is allowed; several
+// statements in one string are rejected.
+func Parse(query string) (*Statement, error) {
+	toks, err := Tokenize(query)
+	if err != nil {
+		return nil, err
+	}
+	for len(toks) > 0 && toks[len(toks)-1].IsPunct(";") {
+		toks = toks[:len(toks)-1]
+	}
+	if len(toks) == 0 {
+		return nil, errors.New("empty statement")
+	}
+	for _, t := range toks {
+		if t.IsPunct(";") {
+			return nil, errors.New("multiple statements are not supported")
+		}
+	}
+
+	p := &parser{toks: toks}
+	s := &Statement{Query: query, Tokens: toks}
+	if err := p.with(s); err != nil {
+		return nil, err
+	}
+	start := p.pos
+	if start >= len(toks) {
+		return nil, errors.New("WITH clause without a statement")
+	}
+
+	first := toks[start]
+	p.pos++
+	switch {
+	case first.Is("SELECT"), first.IsPunct("("):
+		s.Kind = Select
+	case first.Is("INSERT"), first.Is("REPLACE"):
+		s.Kind = Insert
+		if first.Is("REPLACE") {
+			s.Kind = Replace
+		}
+		if err := p.insert(s); err != nil {
+			return nil, err
+		}
+	case first.Is("UPDATE"):
+		s.Kind = Update
+		p.skip("LOW_PRIORITY", "IGNORE")
+		if name, ok := p.name(); ok {
+			s.Table = name
+		}
+		p.assignments(s)
+	case first.Is("DELETE"):
+		s.Kind = Delete
+		p.skip("LOW_PRIORITY", "QUICK", "IGNORE")
+		if p.at("FROM") {
+			p.pos++
+			if name, ok := p.name(); ok {
+				s.Table = name
+			}
+		}
+	case first.Is("CREATE"):
+		p.skip("OR", "REPLACE", "TEMPORARY")
+		switch {
+		case p.at("TABLE"):
+			s.Kind = CreateTable
+			p.pos++
+			p.skip("IF", "NOT", "EXISTS")
+			s.Table, _ = p.name()
+		case p.at("DATABASE"), p.at("SCHEMA"):
+			s.Kind = CreateDatabase
+			p.pos++
+			p.skip("IF", "NOT", "EXISTS")
+			s.Database = p.ident()
+		default:
+			s.Kind = CreateOther
+			p.indexTable(s)
+		}
+	case first.Is("DROP"):
+		p.skip("TEMPORARY")
+		switch {
+		case p.at("TABLE"), p.at("TABLES"):
+			s.Kind = DropTable
+			p.pos++
+			p.skip("IF", "EXISTS")
+			s.Tables = p.nameList()
+			if len(s.Tables) > 0 {
+				s.Table = s.Tables[0]
+			}
+			return s, nil
+		case p.at("DATABASE"), p.at("SCHEMA"):
+			s.Kind = DropDatabase
+			p.pos++
+			p.skip("IF", "EXISTS")
+			s.Database = p.ident()
+		default:
+			s.Kind = DropOther
+			p.indexTable(s)
+		}
+	case first.Is("ALTER"):
+		s.Kind = Alter
+		p.skip("ONLINE", "OFFLINE", "IGNORE")
+		switch {
+		case p.at("TABLE"):
+			p.pos++
+			s.Table, _ = p.name()
+		case p.at("DATABASE"), p.at("SCHEMA"):
+			p.pos++
+			s.Database = p.ident()
+		}
+	case first.Is("TRUNCATE"):
+		s.Kind = Truncate
+		p.skip("TABLE")
+		s.Table, _ = p.name()
+	case first.Is("RENAME"):
+		s.Kind = Rename
+		p.skip("TABLE", "TABLES")
+		for {
+			name, ok := p.name()
+			if !ok {
+				break
+			}
+			s.Tables = append(s.Tables, name)
+			if !p.at("TO") && !p.atPunct(",") {
+				break
+			}
+			p.pos++
+		}
+		if len(s.Tables) > 0 {
+			s.Table = s.Tables[0]
+		}
+		return s, nil
+	case first.Is("USE"):
+		s.Kind = Use
+		s.Database = p.ident()
+		return s, nil
+	case first.Is("SHOW"):
+		s.Kind = Show
+		return s, nil
+	case first.Is("DESCRIBE"), first.Is("DESC"), first.Is("EXPLAIN"):
+		s.Kind = Describe
+		if p.pos < len(toks) && toks[p.pos].Kind == Ident && !isKeyword(toks[p.pos]) {
+			s.Table, _ = p.name()
+		}
+	case first.Is("SET"):
+		s.Kind = Set
+		return s, nil
+	case first.Is("BEGIN"), first.Is("START"), first.Is("COMMIT"), first.Is("ROLLBACK"),
+		first.Is("SAVEPOINT"), first.Is("RELEASE"), first.Is("XA"):
+		s.Kind = Transaction
+		return s, nil
+	case unroutable[strings.ToUpper(first.Text)] && first.Kind == Ident && !first.Quoted:
+		return nil, fmt.Errorf("%s statements are not supported", strings.ToUpper(first.Text))
+	default:
+		return s, nil
+	}
+
+	p.references(s, start)
+	if s.Kind == Select || s.Kind == Update || s.Kind == Delete {
+		p.where(s, start)
+	}
+	return s, nil
+}
+
+// unroutable lists the statements that read or write tables the parser
+// cannot find, or that tie later statements to one connection, and so
+// cannot be sent to the right shards.
+var unroutable = map[string]bool{
+	"LOAD": true, "CALL": true, "DO": true, "HANDLER": true, "TABLE": true, "VALUES": true, "IMPORT": true,
+	"LOCK": true, "UNLOCK": true, "PREPARE": true, "EXECUTE": true, "DEALLOCATE": true,
+}
+
+type parser struct {
+	toks []Token
+	pos  int
+}
+
+func (p *parser) at(kw string) bool {
+	return p.pos < len(p.toks) && p.toks[p.pos].Is(kw)
+}
+
+func (p *parser) atPunct(punct string) bool {
+	return p.pos < len(p.toks) && p.toks[p.pos].IsPunct(punct)
+}
+
+// skip advances past any of the given keywords.
+func (p *parser) skip(words ...string) {
+	for p.pos < len(p.toks) {
+		matched := false
+		for _, w := range words {
+			if p.toks[p.pos].Is(w) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return
+		}
+		p.pos++
+	}
+}
+
+func (p *parser) ident() string {
+	if p.pos < len(p.toks) && p.toks[p.pos].Kind == Ident {
+		p.pos++
+		return p.toks[p.pos-1].Text
+	}
+	return ""
+}
+
+// name reads a possibly qualified table name.
+func (p *parser) name() (TableName, bool) {
+	var n TableName
+	n, p.pos = nameAt(p.toks, p.pos)
+	return n, n.Name != ""
+}
+
+func nameAt(toks []Token, i int) (TableName, int) {
+	if i >= len(toks) || toks[i].Kind != Ident {
+		return TableName{}, i
+	}
+	if i+2 < len(toks) && toks[i+1].IsPunct(".") && toks[i+2].Kind == Ident {
+		return TableName{DB: toks[i].Text, Name: toks[i+2].Text}, i + 3
+	}
+	return TableName{Name: toks[i].Text}, i + 1
+}
+
+func (p *parser) nameList() []TableName {
+	var names []TableName
+	for {
+		name, ok := p.name()
+		if !ok {
+			return names
+		}
+		names = append(names, name)
+		if !p.atPunct(",") {
+			return names
+		}
+		p.pos++
+	}
+}
+
+// group returns the index of the parenthesis closing the one at toks[i].
+func group(toks []Token, i int) int {
+	depth := 0
+	for j := i; j < len(toks); j++ {
+		depth += parenDelta(toks[j])
+		if depth == 0 {
+			return j
+		}
+	}
+	return len(toks) - 1
+}
+
+func parenDelta(t Token) int {
+	switch {
+	case t.IsPunct("("):
+		return 1
+	case t.IsPunct(")"):
+		return -1
+	}
+	return 0
+}
+
+// with reads a leading WITH clause.
+func (p *parser) with(s *Statement) error {
+	if !p.at("WITH") {
+		return nil
+	}
+	p.pos++
+	p.skip("RECURSIVE")
+	for {
+		name := p.ident()
+		if name == "" {
+			return errors.New("expected a name in WITH clause")
+		}
+		s.CTEs = append(s.CTEs, name)
+		if p.atPunct("(") {
+			p.pos = group(p.toks, p.pos) + 1
+		}
+		if !p.at("AS") {
+			return fmt.Errorf("expected AS after %s in WITH clause", name)
+		}
+		p.pos++
+		if !p.atPunct("(") {
+			return fmt.Errorf("expected ( after %s AS", name)
+		}
+		p.pos = group(p.toks, p.pos) + 1
+		if !p.atPunct(",") {
+			return nil
+		}
+		p.pos++
+	}
+}
+
+// insert reads the target, column list and VALUES or SET part of an INSERT
+// or REPLACE.
+func (p *parser) insert(s *Statement) error {
+	p.skip("LOW_PRIORITY", "DELAYED", "HIGH_PRIORITY", "IGNORE", "INTO")
+	name, ok := p.name()
+	if !ok {
+		return errors.New("expected a table name after INTO")
+	}
+	s.Table = name
+	if p.at("PARTITION") && p.pos+1 < len(p.toks) && p.toks[p.pos+1].IsPunct("(") {
+		p.pos = group(p.toks, p.pos+1) + 1
+	}
+	if p.atPunct("(") && !(p.pos+1 < len(p.toks) && (p.toks[p.pos+1].Is("SELECT") || p.toks[p.pos+1].Is("WITH"))) {
+		end := group(p.toks, p.pos)
+		for _, t := range p.toks[p.pos+1 : end] {
+			if t.Kind == Ident {
+				s.Columns = append(s.Columns, t.Text)
+			}
+		}
+		p.pos = end + 1
+	}
+
+	switch {
+	case p.at("VALUES"), p.at("VALUE"):
+		s.ValuesEnd = p.toks[p.pos].Pos + len(p.toks[p.pos].Raw)
+		p.pos++
+		for p.atPunct("(") {
+			end := group(p.toks, p.pos)
+			if !p.toks[end].IsPunct(")") {
+				return errors.New("unterminated VALUES row")
+			}
+			row := Row{Start: p.toks[p.pos].Pos, End: p.toks[end].Pos + 1}
+			for _, item := range splitTop(p.toks[p.pos+1 : end]) {
+				row.Values = append(row.Values, parseExpr(item))
+			}
+			s.Rows = append(s.Rows, row)
+			s.RowsEnd = row.End
+			p.pos = end + 1
+			if !p.atPunct(",") {
+				break
+			}
+			p.pos++
+		}
+		if len(s.Rows) == 0 {
+			return errors.New("VALUES without rows")
+		}
+	case p.at("SET"):
+		p.assignments(s)
+	}
+	p.onDuplicate(s)
+	return nil
+}
+
+// onDuplicate reads the assignments of a top-level ON DUPLICATE KEY UPDATE
+// clause at or after the current position, if any.
+func (p *parser) onDuplicate(s *Statement) {
+	depth := 0
+	for i := p.pos; i+3 < len(p.toks); i++ {
+		depth += parenDelta(p.toks[i])
+		if depth == 0 && p.toks[i].Is("ON") && p.toks[i+1].Is("DUPLICATE") && p.toks[i+2].Is("KEY") && p.toks[i+3].Is("UPDATE") {
+			s.OnDuplicate = setList(p.toks[i+4:])
+			p.pos = len(p.toks)
+			return
+		}
+	}
+}
+
+// assignments reads the top-level SET list that follows the current
+// position, if any.
+func (p *parser) assignments(s *Statement) {
+	depth := 0
+	for ; p.pos < len(p.toks); p.pos++ {
+		t := p.toks[p.pos]
+		depth += parenDelta(t)
+		if depth == 0 && t.Is("SET") {
+			break
+		}
+		if depth == 0 && (t.Is("WHERE") || t.Is("ON")) && s.Kind != Update {
+			return
+		}
+	}
+	if p.pos >= len(p.toks) {
+		return
+	}
+	start := p.pos + 1
+	end := start
+	depth = 0
+	for ; end < len(p.toks); end++ {
+		t := p.toks[end]
+		depth += parenDelta(t)
+		if depth == 0 && (t.Is("WHERE") || t.Is("ORDER") || t.Is("LIMIT") || t.Is("ON")) {
+			break
+		}
+	}
+	s.Set = setList(p.toks[start:end])
+	p.pos = end
+}
+
+// setList parses a list of `column = value` assignments.
+func setList(toks []Token) []Assignment {
+	var set []Assignment
+	for _, item := range splitTop(toks) {
+		for i, t := range item {
+			if !t.IsPunct("=") {
+				continue
+			}
+			if col, ok := classify(item[:i]).(*ColumnRef); ok {
+				set = append(set, Assignment{Column: col, Value: parseExpr(item[i+1:])})
+			}
+			break
+		}
+	}
+	return set
+}
+
+// indexTable records the table of CREATE/DROP INDEX ... ON table.
+func (p *parser) indexTable(s *Statement) {
+	for ; p.pos < len(p.toks); p.pos++ {
+		if p.toks[p.pos].Is("ON") {
+			p.pos++
+			s.Table, _ = p.name()
+			return
+		}
+	}
+}
+
+// clauseWords cannot be table aliases; they end a table reference.
+var clauseWords = map[string]bool{
+	"WHERE": true, "GROUP": true, "HAVING": true, "ORDER": true, "LIMIT": true, "JOIN": true,
+	"INNER": true, "LEFT": true, "RIGHT": true, "CROSS": true, "NATURAL": true, "STRAIGHT_JOIN": true,
+	"OUTER": true, "FULL": true, "ON": true, "USING": true, "UNION": true, "EXCEPT": true,
+	"INTERSECT": true, "FOR": true, "LOCK": true, "SET": true, "WINDOW": true, "INTO": true,
+	"VALUES": true, "SELECT": true, "USE": true, "IGNORE": true, "FORCE": true, "PARTITION": true,
+	"AS": true, "LATERAL": true,
+}
+
+func isKeyword(t Token) bool {
+	return t.Kind == Ident && !t.Quoted && clauseWords[strings.ToUpper(t.Text)]
+}
+
+// references collects the tables named in FROM and JOIN clauses at any
+// nesting level, and the targets already found by the statement parser.
+func (p *parser) references(s *Statement, start int) {
+	ctes := make(map[string]bool, len(s.CTEs))
+	for _, name := range s.CTEs {
+		ctes[strings.ToLower(name)] = true
+	}
+	add := func(n TableName) bool {
+		if (n.DB == "" && ctes[strings.ToLower(n.Name)]) || strings.EqualFold(n.Name, "DUAL") {
+			return false
+		}
+		s.Tables = append(s.Tables, n)
+		return true
+	}
+	if s.Table.Name != "" && !add(s.Table) {
+		s.Table = TableName{}
+	}
+	if s.Kind == Update {
+		// UPDATE a, b SET ... lists further targets before SET
+		i := start + 1
+		for i < len(p.toks) && (p.toks[i].Is("LOW_PRIORITY") || p.toks[i].Is("IGNORE")) {
+			i++
+		}
+		_, i = nameAt(p.toks, i)
+		i = skipAlias(p.toks, i)
+		for i < len(p.toks) && p.toks[i].IsPunct(",") {
+			var n TableName
+			n, i = nameAt(p.toks, i+1)
+			if n.Name != "" {
+				add(n)
+			}
+			i = skipAlias(p.toks, i)
+		}
+	}
+
+	// Parentheses open either a query context (a subquery, derived table
+	// or parenthesized join) or something else, such as a function call
+	// whose arguments may contain FROM, as in EXTRACT(YEAR FROM d).
+	stack := []bool{true}
+	topFrom := false
+	for i := 0; i < len(p.toks); i++ {
+		t := p.toks[i]
+		switch {
+		case t.IsPunct("("):
+			query := i+1 < len(p.toks) && (p.toks[i+1].Is("SELECT") || p.toks[i+1].Is("WITH"))
+			if stack[len(stack)-1] && i > 0 && (p.toks[i-1].Is("FROM") || p.toks[i-1].Is("JOIN") || p.toks[i-1].Is("STRAIGHT_JOIN")) {
+				query = true
+			}
+			stack = append(stack, query)
+			continue
+		case t.IsPunct(")"):
+			if len(stack) > 1 {
+				stack = stack[:len(stack)-1]
+			}
+			continue
+		}
+		if !stack[len(stack)-1] || !(t.Is("FROM") || t.Is("JOIN") || t.Is("STRAIGHT_JOIN")) {
+			continue
+		}
+		first := true
+		j := i + 1
+		for j < len(p.toks) && p.toks[j].Kind == Ident && !isKeyword(p.toks[j]) {
+			var n TableName
+			begin := j
+			n, j = nameAt(p.toks, j)
+			// DELETE FROM t has already recorded t as its target
+			added := false
+			if !(s.Kind == Delete && first && i == start+1) {
+				added = add(n)
+			}
+			target := false
+			if first && len(stack) == 1 && t.Is("FROM") && !topFrom && s.Kind != Insert && s.Kind != Replace {
+				topFrom = true
+				if s.Table.Name == "" && added {
+					s.Table = n
+					target = s.Kind == Select
+				}
+			}
+			first = false
+			named := j
+			j = skipAlias(p.toks, j)
+			if target {
+				last := p.toks[j-1]
+				s.TableStart, s.TableEnd = p.toks[begin].Pos, last.Pos+len(last.Raw)
+				if j > named {
+					s.TableAlias = last.Text
+				}
+			}
+			if j >= len(p.toks) || !p.toks[j].IsPunct(",") {
+				break
+			}
+			j++
+		}
+		if first && len(stack) == 1 && t.Is("FROM") {
+			topFrom = true
+		}
+	}
+}
+
+func skipAlias(toks []Token, i int) int {
+	if i < len(toks) && toks[i].Is("AS") {
+		return i + 2
+	}
+	if i < len(toks) && toks[i].Kind == Ident && !isKeyword(toks[i]) {
+		return i + 1
+	}
+	return i
+}
+
+// where parses the statement's top-level WHERE clause.
+func (p *parser) where(s *Statement, start int) {
+	depth := 0
+	begin := -1
+	end := len(p.toks)
+	for i := start; i < len(p.toks); i++ {
+		t := p.toks[i]
+		depth += parenDelta(t)
+		if depth != 0 {
+			continue
+		}
+		switch {
+		case t.Is("UNION"), t.Is("EXCEPT"), t.Is("INTERSECT"):
+			s.Compound = true
+			if begin >= 0 && end == len(p.toks) {
+				end = i
+			}
+		case t.Is("WHERE") && begin < 0:
+			begin = i + 1
+		case begin >= 0 && end == len(p.toks) && (t.Is("GROUP") || t.Is("HAVING") || t.Is("ORDER") ||
+			t.Is("LIMIT") || t.Is("FOR") || t.Is("LOCK") || t.Is("WINDOW") || t.Is("INTO")):
+			end = i
+		}
+	}
+	if begin >= 0 && begin < end {
+		s.Where = parseExpr(p.toks[begin:end])
+	}
+}
+
+// splitTop splits tokens at top-level commas.
+func splitTop(toks []Token) [][]Token {
+	if len(toks) == 0 {
+		return nil
+	}
+	var parts [][]Token
+	depth, start := 0, 0
+	for i, t := range toks {
+		depth += parenDelta(t)
+		if depth == 0 && t.IsPunct(",") {
+			parts = append(parts, toks[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, toks[start:])
+}
+
+// parseExpr parses an expression made up of all of toks. Whatever cannot
+// be parsed completely becomes a RawExpr.
+func parseExpr(toks []Token) Expr {
+	if len(toks) == 0 {
+		return &RawExpr{}
+	}
+	p := &exprParser{toks: toks}
+	e := p.or()
+	if p.pos != len(toks) {
+		return &RawExpr{Tokens: toks}
+	}
+	return e
+}
+
+type exprParser struct {
+	toks []Token
+	pos  int
+}
+
+func (p *exprParser) at(words ...string) bool {
+	if p.pos >= len(p.toks) {
+		return false
+	}
+	for _, w := range words {
+		if p.toks[p.pos].Is(w) || p.toks[p.pos].IsPunct(w) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *exprParser) binary(op string, next func() Expr, words ...string) Expr {
+	left := next()
+	for p.at(words...) {
+		p.pos++
+		left = &BinaryExpr{Op: op, Left: left, Right: next()}
+	}
+	return left
+}
+
+func (p *exprParser) or() Expr {
+	return p.binary("OR", p.xor, "OR", "||")
+}
+
+func (p *exprParser) xor() Expr {
+	return p.binary("XOR", p.and, "XOR")
+}
+
+func (p *exprParser) and() Expr {
+	return p.binary("AND", p.not, "AND", "&&")
+}
+
+func (p *exprParser) not() Expr {
+	if p.at("NOT", "!") {
+		p.pos++
+		return &NotExpr{X: p.not()}
+	}
+	return p.predicate()
+}
+
+var comparisons = map[string]bool{"=": true, "<=>": true, "<>": true, "!=": true, "<": true, "<=": true, ">": true, ">=": true}
+
+func (p *exprParser) predicate() Expr {
+	start := p.pos
+	left := p.operand()
+	if p.pos >= len(p.toks) {
+		return left
+	}
+	t := p.toks[p.pos]
+	if t.Kind == Punct && comparisons[t.Text] {
+		p.pos++
+		return &BinaryExpr{Op: t.Text, Left: left, Right: p.operand()}
+	}
+
+	not := false
+	if t.Is("NOT") && p.pos+1 < len(p.toks) {
+		not = true
+		p.pos++
+		t = p.toks[p.pos]
+	}
+	switch {
+	case t.Is("IN") && p.pos+1 < len(p.toks) && p.toks[p.pos+1].IsPunct("("):
+		open := p.pos + 1
+		close := group(p.toks, open)
+		in := &InExpr{X: left, Not: not}
+		inner := p.toks[open+1 : close]
+		if len(inner) > 0 && (inner[0].Is("SELECT") || inner[0].Is("WITH")) {
+			in.Subquery = true
+		} else {
+			for _, item := range splitTop(inner) {
+				in.List = append(in.List, parseExpr(item))
+			}
+		}
+		p.pos = close + 1
+		return in
+	case t.Is("BETWEEN"):
+		p.pos++
+		between := &BetweenExpr{X: left, Lo: p.operand(), Not: not}
+		if !p.at("AND") {
+			break
+		}
+		p.pos++
+		between.Hi = p.operand()
+		return between
+	case t.Is("LIKE"), t.Is("REGEXP"), t.Is("RLIKE"):
+		p.pos++
+		p.operand()
+		if p.at("ESCAPE") {
+			p.pos++
+			p.operand()
+		}
+	case t.Is("IS") && !not:
+		p.pos++
+		if p.at("NOT") {
+			p.pos++
+		}
+		p.pos++ // NULL, TRUE, FALSE or UNKNOWN
+	case t.Is("SOUNDS") && !not:
+		p.pos += 2
+		p.operand()
+	default:
+		if not {
+			p.pos--
+		}
+		return left
+	}
+	if p.pos > len(p.toks) {
+		p.pos = len(p.toks)
+	}
+	return &RawExpr{Tokens: p.toks[start:p.pos]}
+}
+
+// operand reads the tokens up to the next operator the expression parser
+// handles itself and classifies them.
+func (p *exprParser) operand() Expr {
+	start := p.pos
+	depth, cases := 0, 0
+	for ; p.pos < len(p.toks); p.pos++ {
+		t := p.toks[p.pos]
+		depth += parenDelta(t)
+		if depth < 0 {
+			break
+		}
+		if t.Is("CASE") {
+			cases++
+		} else if t.Is("END") && cases > 0 {
+			cases--
+		}
+		if depth > 0 || cases > 0 || p.pos == start {
+			continue
+		}
+		if (t.Kind == Punct && (comparisons[t.Text] || t.Text == "||" || t.Text == "&&" || t.Text == ",")) ||
+			t.Is("AND") || t.Is("OR") || t.Is("XOR") || t.Is("NOT") || t.Is("IS") || t.Is("IN") ||
+			t.Is("BETWEEN") || t.Is("LIKE") || t.Is("REGEXP") || t.Is("RLIKE") || t.Is("SOUNDS") || t.Is("ESCAPE") {
+			break
+		}
+	}
+	return classify(p.toks[start:p.pos])
+}
+
+var constants = map[string]bool{
+	"NULL": true, "TRUE": true, "FALSE": true, "UNKNOWN": true, "DEFAULT": true, "CURRENT_DATE": true,
+	"CURRENT_TIME": true, "CURRENT_TIMESTAMP": true, "CURRENT_USER": true, "LOCALTIME": true, "LOCALTIMESTAMP": true,
+}
+
+func classify(toks []Token) Expr {
+	n := len(toks)
+	switch {
+	case n == 1 && toks[0].Kind == Param:
+		return &Placeholder{}
+	case n == 1 && toks[0].Literal():
+		return &Literal{Kind: toks[0].Kind, Value: toks[0].Text}
+	case n == 2 && (toks[0].IsPunct("-") || toks[0].IsPunct("+")) && toks[1].Kind == Number:
+		value := toks[1].Text
+		if toks[0].IsPunct("-") {
+			value = "-" + value
+		}
+		return &Literal{Kind: Number, Value: value}
+	case n == 1 && toks[0].Kind == Ident && (toks[0].Quoted || !constants[strings.ToUpper(toks[0].Text)]):
+		return &ColumnRef{Name: toks[0].Text}
+	case n == 3 && toks[0].Kind == Ident && toks[1].IsPunct(".") && toks[2].Kind == Ident:
+		return &ColumnRef{Table: toks[0].Text, Name: toks[2].Text}
+	case n == 5 && toks[0].Kind == Ident && toks[1].IsPunct(".") && toks[2].Kind == Ident && toks[3].IsPunct(".") && toks[4].Kind == Ident:
+		return &ColumnRef{DB: toks[0].Text, Table: toks[2].Text, Name: toks[4].Text}
+	case n >= 2 && toks[0].IsPunct("(") && group(toks, 0) == n-1:
+		inner := toks[1 : n-1]
+		if len(inner) > 0 && (inner[0].Is("SELECT") || inner[0].Is("WITH")) {
+			return &Subquery{Tokens: inner}
+		}
+		if len(splitTop(inner)) == 1 {
+			return &ParenExpr{X: parseExpr(inner)}
+		}
+	}
+	return &RawExpr{Tokens: toks}
+}
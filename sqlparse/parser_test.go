@@ -0,0 +1,261 @@
+package sqlparse
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseKind(t *testing.T) {
+	tests := []struct {
+		query string
+		kind  Kind
+	}{
+		{"SELECT 1", Select},
+		{"  select * from t;", Select},
+		{"(SELECT 1) UNION (SELECT 2)", Select},
+		{"WITH c AS (SELECT 1) SELECT * FROM c", Select},
+		{"/* note */ INSERT INTO t VALUES (1)", Insert},
+		{"REPLACE INTO t VALUES (1)", Replace},
+		{"update t set a = 1", Update},
+		{"DELETE FROM t WHERE id = 1", Delete},
+		{"CREATE TABLE t (id INT)", CreateTable},
+		{"CREATE TEMPORARY TABLE IF NOT EXISTS t (id INT)", CreateTable},
+		{"CREATE DATABASE d", CreateDatabase},
+		{"CREATE INDEX i ON t (a)", CreateOther},
+		{"DROP TABLE IF EXISTS a, b", DropTable},
+		{"DROP SCHEMA d", DropDatabase},
+		{"DROP INDEX i ON t", DropOther},
+		{"ALTER TABLE t ADD c INT", Alter},
+		{"TRUNCATE TABLE t", Truncate},
+		{"RENAME TABLE a TO b", Rename},
+		{"USE d", Use},
+		{"SHOW TABLES", Show},
+		{"DESC t", Describe},
+		{"EXPLAIN SELECT 1", Describe},
+		{"SET time_zone = '+00:00'", Set},
+		{"START TRANSACTION", Transaction},
+		{"XA COMMIT 'x'", Transaction},
+		{"/*! SELECT 1 */", Select},
+		{"GRANT SELECT ON d.* TO u", Unknown},
+	}
+	for _, tt := range tests {
+		s, err := Parse(tt.query)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", tt.query, err)
+			continue
+		}
+		if s.Kind != tt.kind {
+			t.Errorf("Parse(%q).Kind = %s, want %s", tt.query, s.Kind, tt.kind)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, query := range []string{
+		"",
+		";",
+		"SELECT 1; SELECT 2",
+		"WITH c AS (SELECT 1)",
+		"INSERT INTO",
+		"INSERT INTO t VALUES",
+		"LOAD DATA INFILE 'f' INTO TABLE t",
+		"load data local infile 'f' into table t",
+		"CALL p()",
+		"DO SLEEP(1)",
+		"HANDLER t OPEN",
+		"LOCK TABLES t WRITE",
+		"UNLOCK TABLES",
+		"TABLE t",
+		"PREPARE s FROM 'SELECT 1'",
+		"EXECUTE s",
+		"/*!40000 LOAD DATA INFILE 'f' INTO TABLE t */",
+	} {
+		if s, err := Parse(query); err == nil {
+			t.Errorf("Parse(%q) = %s, want an error", query, s.Kind)
+		}
+	}
+}
+
+func TestParseTables(t *testing.T) {
+	tests := []struct {
+		query  string
+		table  TableName
+		tables []TableName
+	}{
+		{"SELECT * FROM t", TableName{Name: "t"}, []TableName{{Name: "t"}}},
+		{"SELECT * FROM `d`.`t` AS x", TableName{DB: "d", Name: "t"}, []TableName{{DB: "d", Name: "t"}}},
+		{"SELECT * FROM a JOIN d.b ON a.id = b.id LEFT JOIN c USING (id)", TableName{Name: "a"},
+			[]TableName{{Name: "a"}, {DB: "d", Name: "b"}, {Name: "c"}}},
+		{"SELECT * FROM a WHERE id IN (SELECT id FROM b)", TableName{Name: "a"}, []TableName{{Name: "a"}, {Name: "b"}}},
+		{"WITH c AS (SELECT * FROM b) SELECT * FROM c", TableName{}, []TableName{{Name: "b"}}},
+		{"SELECT * FROM (SELECT * FROM b) AS x", TableName{}, []TableName{{Name: "b"}}},
+		{"INSERT INTO d.t (a) SELECT a FROM s", TableName{DB: "d", Name: "t"}, []TableName{{DB: "d", Name: "t"}, {Name: "s"}}},
+		{"UPDATE LOW_PRIORITY t SET a = 1", TableName{Name: "t"}, []TableName{{Name: "t"}}},
+		{"DELETE FROM t WHERE a = 1", TableName{Name: "t"}, []TableName{{Name: "t"}}},
+		{"DROP TABLE a, d.b", TableName{Name: "a"}, []TableName{{Name: "a"}, {DB: "d", Name: "b"}}},
+		{"RENAME TABLE a TO b, c TO d", TableName{Name: "a"}, []TableName{{Name: "a"}, {Name: "b"}, {Name: "c"}, {Name: "d"}}},
+		{"CREATE INDEX i ON t (a)", TableName{Name: "t"}, []TableName{{Name: "t"}}},
+	}
+	for _, tt := range tests {
+		s, err := Parse(tt.query)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", tt.query, err)
+			continue
+		}
+		if s.Table != tt.table {
+			t.Errorf("Parse(%q).Table = %v, want %v", tt.query, s.Table, tt.table)
+		}
+		if !reflect.DeepEqual(s.Tables, tt.tables) {
+			t.Errorf("Parse(%q).Tables = %v, want %v", tt.query, s.Tables, tt.tables)
+		}
+	}
+}
+
+func TestParseInsert(t *testing.T) {
+	tests := []struct {
+		query       string
+		columns     []string
+		rows        []string
+		set         []string
+		onDuplicate []string
+	}{
+		{"INSERT INTO t (a, b) VALUES (1, 'x'), (2, 'y')", []string{"a", "b"}, []string{"(1, 'x')", "(2, 'y')"}, nil, nil},
+		{"INSERT INTO t VALUE (1)", nil, []string{"(1)"}, nil, nil},
+		{"INSERT INTO t SET a = 1, b = (SELECT 2)", nil, nil, []string{"a", "b"}, nil},
+		{"INSERT INTO t (a, n) VALUES (1, 2) ON DUPLICATE KEY UPDATE n = n + 1", []string{"a", "n"}, []string{"(1, 2)"}, nil, []string{"n"}},
+		{"INSERT INTO t (a, n) VALUES (1, 2) AS new ON DUPLICATE KEY UPDATE n = new.n, t.a = 3", []string{"a", "n"}, []string{"(1, 2)"}, nil, []string{"n", "a"}},
+		{"INSERT INTO t SET a = 1 ON DUPLICATE KEY UPDATE a = 2", nil, nil, []string{"a"}, []string{"a"}},
+		{"INSERT INTO t (a) SELECT a FROM s JOIN u ON s.id = u.id ON DUPLICATE KEY UPDATE a = 1", []string{"a"}, nil, nil, []string{"a"}},
+	}
+	names := func(set []Assignment) []string {
+		var out []string
+		for _, a := range set {
+			out = append(out, a.Column.Name)
+		}
+		return out
+	}
+	for _, tt := range tests {
+		s, err := Parse(tt.query)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", tt.query, err)
+			continue
+		}
+		var rows []string
+		for _, r := range s.Rows {
+			rows = append(rows, tt.query[r.Start:r.End])
+		}
+		if !reflect.DeepEqual(s.Columns, tt.columns) {
+			t.Errorf("Parse(%q).Columns = %q, want %q", tt.query, s.Columns, tt.columns)
+		}
+		if !reflect.DeepEqual(rows, tt.rows) {
+			t.Errorf("Parse(%q) rows = %q, want %q", tt.query, rows, tt.rows)
+		}
+		if got := names(s.Set); !reflect.DeepEqual(got, tt.set) {
+			t.Errorf("Parse(%q).Set = %q, want %q", tt.query, got, tt.set)
+		}
+		if got := names(s.OnDuplicate); !reflect.DeepEqual(got, tt.onDuplicate) {
+			t.Errorf("Parse(%q).OnDuplicate = %q, want %q", tt.query, got, tt.onDuplicate)
+		}
+	}
+}
+
+func TestColumnValues(t *testing.T) {
+	tests := []struct {
+		where string
+		want  []string // nil if the column is not restricted
+	}{
+		{"id = 1", []string{"1"}},
+		{"1 = id", []string{"1"}},
+		{"t.id = 'a'", []string{"a"}},
+		{"id IN (1, 2, 2)", []string{"1", "2"}},
+		{"id = 1 OR id = 2", []string{"1", "2"}},
+		{"(id = 1 OR id = 2) AND name = 'x'", []string{"1", "2"}},
+		{"id IN (1, 2) AND id IN (2, 3)", []string{"2"}},
+		{"id = 'a' AND id = 'A'", []string{"a"}},
+		{"id = 1 AND id = 2", []string{}},
+		{"id = 1 OR name = 'x'", nil},
+		{"id > 1", nil},
+		{"id NOT IN (1)", nil},
+		{"id IN (SELECT id FROM u)", nil},
+		{"name = 'x'", nil},
+	}
+	for _, tt := range tests {
+		s, err := Parse("SELECT * FROM t WHERE " + tt.where)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", tt.where, err)
+			continue
+		}
+		lits, ok := ColumnValues(s.Where, "id", strings.ToLower)
+		if ok != (tt.want != nil) {
+			t.Errorf("ColumnValues(%q) restricted = %v, want %v", tt.where, ok, tt.want != nil)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		got := []string{}
+		for _, lit := range lits {
+			got = append(got, lit.Value)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ColumnValues(%q) = %q, want %q", tt.where, got, tt.want)
+		}
+	}
+}
+
+func TestColumnIntervals(t *testing.T) {
+	cmp := func(a, b string) int { return strings.Compare(a, b) }
+	tests := []struct {
+		where string
+		want  []Interval
+	}{
+		{"k = 'b'", []Interval{{Lo: Bound{Value: "b", Inclusive: true}, Hi: Bound{Value: "b", Inclusive: true}}}},
+		{"k >= 'b'", []Interval{{Lo: Bound{Value: "b", Inclusive: true}, Hi: Bound{Unbounded: true}}}},
+		{"'b' > k", []Interval{{Lo: Bound{Unbounded: true}, Hi: Bound{Value: "b"}}}},
+		{"k BETWEEN 'a' AND 'c'", []Interval{{Lo: Bound{Value: "a", Inclusive: true}, Hi: Bound{Value: "c", Inclusive: true}}}},
+		{"k > 'a' AND k <= 'c'", []Interval{{Lo: Bound{Value: "a"}, Hi: Bound{Value: "c", Inclusive: true}}}},
+		{"k > 'c' AND k < 'a'", nil},
+	}
+	for _, tt := range tests {
+		s, err := Parse("SELECT * FROM t WHERE " + tt.where)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", tt.where, err)
+			continue
+		}
+		got, ok := ColumnIntervals(s.Where, "k", cmp)
+		if !ok {
+			t.Errorf("ColumnIntervals(%q) is unrestricted", tt.where)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ColumnIntervals(%q) = %+v, want %+v", tt.where, got, tt.want)
+		}
+	}
+}
+
+func TestVolatile(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"INSERT INTO t (a, b) VALUES (1, NOW())", "NOW"},
+		{"UPDATE t SET b = uuid() WHERE a = 1", "UUID"},
+		{"UPDATE t SET b = CURRENT_TIMESTAMP WHERE a = 1", "CURRENT_TIMESTAMP"},
+		{"DELETE FROM t WHERE b < UNIX_TIMESTAMP()", "UNIX_TIMESTAMP"},
+		{"DELETE FROM t WHERE b < UNIX_TIMESTAMP('2024-01-01')", ""},
+		{"UPDATE t SET `now` = 1, t.rand = 2, user = 'x' WHERE a = 1", ""},
+		{"INSERT INTO t (a, b) VALUES (1, 'NOW()')", ""},
+		{"SELECT * FROM t ORDER BY RAND()", "RAND"},
+	}
+	for _, tt := range tests {
+		s, err := Parse(tt.query)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", tt.query, err)
+			continue
+		}
+		if got := s.Volatile(); got != tt.want {
+			t.Errorf("Parse(%q).Volatile() = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package sqlparse
+
+import "strings"
+
+// Undo returns a statement reverting the schema change s made, for the
+// changes that can be reverted without losing data: CREATE TABLE, CREATE
+// DATABASE and CREATE INDEX without IF NOT EXISTS, RENAME TABLE, and ALTER
+// TABLE adding columns and indexes. The boolean result is false for any
+// other statement.
+func Undo(s *Statement) (string, bool) {
+	toks := s.Tokens
+	for _, t := range toks {
+		// IF NOT EXISTS may have left an object it did not create
+		if t.Is("EXISTS") || t.Is("TEMPORARY") {
+			return "", false
+		}
+	}
+	switch s.Kind {
+	case CreateTable:
+		if s.Table.Name != "" {
+			return "DROP TABLE " + quoteName(s.Table), true
+		}
+	case CreateDatabase:
+		if s.Database != "" {
+			return "DROP DATABASE " + QuoteIdent(s.Database), true
+		}
+	case CreateOther:
+		// CREATE [UNIQUE | FULLTEXT | SPATIAL] INDEX name ON table
+		i := 1
+		if i < len(toks) && (toks[i].Is("UNIQUE") || toks[i].Is("FULLTEXT") || toks[i].Is("SPATIAL")) {
+			i++
+		}
+		if i+2 < len(toks) && toks[i].Is("INDEX") && toks[i+2].Is("ON") && s.Table.Name != "" {
+			return "DROP INDEX " + QuoteIdent(toks[i+1].Text) + " ON " + quoteName(s.Table), true
+		}
+	case Rename:
+		if len(s.Tables) == 0 || len(s.Tables)%2 != 0 {
+			return "", false
+		}
+		var pairs []string
+		for i := len(s.Tables) - 2; i >= 0; i -= 2 {
+			pairs = append(pairs, quoteName(s.Tables[i+1])+" TO "+quoteName(s.Tables[i]))
+		}
+		return "RENAME TABLE " + strings.Join(pairs, ", "), true
+	case Alter:
+		return undoAlter(s)
+	}
+	return "", false
+}
+
+// undoAlter reverts ALTER TABLE statements whose every clause adds a
+// named column or index.
+func undoAlter(s *Statement) (string, bool) {
+	toks := s.Tokens
+	i := 1
+	for i < len(toks) && !toks[i].Is("TABLE") {
+		i++
+	}
+	// skip TABLE and the possibly qualified name
+	i += 2
+	if i+1 < len(toks) && toks[i].IsPunct(".") {
+		i += 2
+	}
+	if s.Table.Name == "" || i >= len(toks) {
+		return "", false
+	}
+	var drops []string
+	for _, clause := range splitTop(toks[i:]) {
+		if len(clause) < 2 || !clause[0].Is("ADD") {
+			return "", false
+		}
+		j := 1
+		switch {
+		case clause[j].Is("PRIMARY"):
+			drops = append(drops, "DROP PRIMARY KEY")
+			continue
+		case clause[j].Is("UNIQUE"), clause[j].Is("FULLTEXT"), clause[j].Is("SPATIAL"):
+			j++
+			if j < len(clause) && (clause[j].Is("INDEX") || clause[j].Is("KEY")) {
+				j++
+			}
+		case clause[j].Is("INDEX"), clause[j].Is("KEY"):
+			j++
+		case clause[j].Is("CONSTRAINT"), clause[j].Is("FOREIGN"), clause[j].Is("CHECK"), clause[j].Is("PARTITION"):
+			return "", false
+		case clause[j].Is("COLUMN"):
+			j++
+			fallthrough
+		default:
+			if j >= len(clause) || clause[j].Kind != Ident || isKeyword(clause[j]) {
+				return "", false
+			}
+			drops = append(drops, "DROP COLUMN "+QuoteIdent(clause[j].Text))
+			continue
+		}
+		// an index needs its name to be dropped again
+		if j >= len(clause) || clause[j].Kind != Ident || isKeyword(clause[j]) {
+			return "", false
+		}
+		drops = append(drops, "DROP INDEX "+QuoteIdent(clause[j].Text))
+	}
+	for l, r := 0, len(drops)-1; l < r; l, r = l+1, r-1 {
+		drops[l], drops[r] = drops[r], drops[l]
+	}
+	return "ALTER TABLE " + quoteName(s.Table) + " " + strings.Join(drops, ", "), true
+}
+
+func quoteName(n TableName) string {
+	if n.DB == "" {
+		return QuoteIdent(n.Name)
+	}
+	return QuoteIdent(n.DB) + "." + QuoteIdent(n.Name)
+}
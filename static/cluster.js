@@ -0,0 +1,64 @@
+// Refreshes the cluster page from the JSON form of /cluster.
+const refreshInterval = 5000;
+
+function escapeHTML(value) {
+    return String(value ?? '').replace(/[&<>"']/g, c => ({
+        '&': '&amp;', '<': '&lt;', '>': '&gt;', '"': '&quot;', "'": '&#39;'
+    })[c]);
+}
+
+function formatTime(value) {
+    if (!value || value.startsWith('0001-')) return '-';
+    return new Date(value).toLocaleString();
+}
+
+function renderCluster(data) {
+    let summary = `Epoch ${data.epoch}, log at LSN ${data.lsn}, shard map version ${data.shard_map}`;
+    if (data.raft) {
+        summary += `, Raft term ${data.raft.term} led by ${escapeHTML(data.raft.leader || 'nobody')}`;
+    }
+    document.getElementById('summary').innerHTML = `<p>${summary}</p>`;
+
+    let nodes = `<table><tr><th>ID</th><th>Address</th><th>Role</th><th>Status</th><th>Connected</th>
+        <th>Last Seen</th><th>LSN</th><th>Lag</th><th>Shards</th></tr>`;
+    data.nodes.forEach(node => {
+        nodes += `<tr>
+            <td>${escapeHTML(node.id)}</td>
+            <td>${escapeHTML(node.address)}</td>
+            <td>${escapeHTML(node.role)}</td>
+            <td class="status-${escapeHTML(node.status)}">${escapeHTML(node.status || 'unknown')}</td>
+            <td>${formatTime(node.connected)}</td>
+            <td>${formatTime(node.last_seen)}</td>
+            <td>${node.lsn}</td>
+            <td>${node.lag}</td>
+            <td>${node.shards.join(', ')}</td>
+        </tr>`;
+    });
+    document.getElementById('nodes').innerHTML = nodes + '</table>';
+
+    let shards = '<table><tr><th>Shard</th><th>Database</th><th>Tables</th><th>Sharded Tables</th><th>Reference Tables</th></tr>';
+    data.shards.forEach(shard => {
+        shards += `<tr>
+            <td>${shard.shard}</td>
+            <td>${escapeHTML(shard.database)}</td>
+            <td>${shard.tables.map(escapeHTML).join('<br>') || '-'}</td>
+            <td>${shard.sharded.map(escapeHTML).join('<br>') || '-'}</td>
+            <td>${shard.reference.map(escapeHTML).join('<br>') || '-'}</td>
+        </tr>`;
+    });
+    document.getElementById('shards').innerHTML = shards + '</table>';
+}
+
+function loadCluster() {
+    fetch('/cluster', { headers: { 'Accept': 'application/json' } })
+        .then(response => response.json())
+        .then(renderCluster)
+        .catch(error => {
+            console.error('Error fetching cluster status:', error);
+            document.getElementById('summary').innerHTML =
+                `<p class="error">Error fetching cluster status: ${escapeHTML(error)}</p>`;
+        });
+}
+
+loadCluster();
+setInterval(loadCluster, refreshInterval);
@@ -47,6 +47,8 @@ document.getElementById('queryType').addEventListener('change', function () {
             </select><br>
             <label for="tableName">Table Name:</label>
             <input type="text" id="tableName"><br>
+            <label for="shardKey">Shard Key (optional):</label>
+            <input type="text" id="shardKey" placeholder="Column used to spread rows across shards"><br>
             <button type="button" onclick="addAttribute()">Add Attribute</button>
             <div id="attributes"></div>
         `;
@@ -510,10 +512,12 @@ function executeQuery() {
             }
         }
         const query = `CREATE TABLE ${tableName} (${columns.join(', ')})`;
+        const shardKeyInput = document.getElementById('shardKey');
+        const shardKey = shardKeyInput ? shardKeyInput.value : '';
         fetch('/query', {
             method: 'POST',
             headers: { 'Content-Type': 'application/x-www-form-urlencoded' },
-            body: `userType=${userType}&dbName=${dbName}&query=${encodeURIComponent(query)}`
+            body: `userType=${userType}&dbName=${dbName}&query=${encodeURIComponent(query)}&shardKey=${encodeURIComponent(shardKey)}`
         })
             .then(response => response.json())
             .then(data => {
@@ -0,0 +1,206 @@
+// Package txlog implements the master's durable log of two-phase commit
+// decisions. A distributed transaction commits once its decision is
+// recorded here, before any participant commits; after a crash, prepared
+// transactions with a recorded decision are committed and all others are
+// rolled back.
+//
+// The log is a file of JSON records, one per line. A record with Done set
+// marks the transaction as committed everywhere, after which its decision
+// is forgotten. A torn record at the tail is dropped on Open.
+package txlog
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// compactAfter is the number of records after which Done rewrites the
+// file with only the pending decisions.
+const compactAfter = 1000
+
+// Decision is the commit decision of one transaction: the statements it
+// ran, the session variables they ran with and the LSN its replication log
+// entry gets.
+type Decision struct {
+	XID        string    `json:"xid"`
+	LSN        uint64    `json:"lsn,omitempty"`
+	DB         string    `json:"db,omitempty"`
+	Statements []string  `json:"statements,omitempty"`
+	Vars       []string  `json:"vars,omitempty"`
+	Time       time.Time `json:"time"`
+	Done       bool      `json:"done,omitempty"`
+}
+
+// Log is a durable set of pending commit decisions. It is safe for
+// concurrent use.
+type Log struct {
+	mu      sync.Mutex
+	f       *os.File
+	path    string
+	pending map[string]Decision
+	records int
+}
+
+// Open opens the log at path, creating it if needed, and loads the
+// decisions not yet marked done.
+func Open(path string) (*Log, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	l := &Log{f: f, path: path, pending: make(map[string]Decision)}
+	r := bufio.NewReader(f)
+	var offset int64
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			// a record without its newline was torn by a crash
+			if len(line) > 0 {
+				fmt.Printf("Decision log: truncating torn record at offset %d\n", offset)
+			}
+			break
+		}
+		var d Decision
+		if err := json.Unmarshal(line, &d); err != nil {
+			fmt.Printf("Decision log: truncating corrupt record at offset %d: %v\n", offset, err)
+			break
+		}
+		l.apply(d)
+		offset += int64(len(line))
+	}
+	if err := f.Truncate(offset); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(offset, 0); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *Log) apply(d Decision) {
+	l.records++
+	if d.Done {
+		delete(l.pending, d.XID)
+	} else {
+		l.pending[d.XID] = d
+	}
+}
+
+func (l *Log) append(d Decision) error {
+	b, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	if _, err := l.f.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	if err := l.f.Sync(); err != nil {
+		return err
+	}
+	l.apply(d)
+	return nil
+}
+
+// Commit durably records the decision to commit a transaction.
+func (l *Log) Commit(d Decision) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	d.Done = false
+	if d.Time.IsZero() {
+		d.Time = time.Now()
+	}
+	return l.append(d)
+}
+
+// Done records that every participant of a transaction has committed, so
+// its decision is no longer needed.
+func (l *Log) Done(xid string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.pending[xid]; !ok {
+		return nil
+	}
+	if err := l.append(Decision{XID: xid, Time: time.Now(), Done: true}); err != nil {
+		return err
+	}
+	if l.records >= compactAfter {
+		return l.compact()
+	}
+	return nil
+}
+
+// compact rewrites the file with only the pending decisions. It must be
+// called with l.mu held.
+func (l *Log) compact() error {
+	tmp := l.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, d := range l.sorted() {
+		b, err := json.Marshal(d)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		w.Write(append(b, '\n'))
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := os.Rename(tmp, l.path); err != nil {
+		f.Close()
+		return err
+	}
+	l.f.Close()
+	l.f = f
+	l.records = len(l.pending)
+	return nil
+}
+
+// Lookup returns the pending commit decision of a transaction, and false
+// if there is none.
+func (l *Log) Lookup(xid string) (Decision, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	d, ok := l.pending[xid]
+	return d, ok
+}
+
+// Pending returns the decisions not yet marked done, oldest first.
+func (l *Log) Pending() []Decision {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.sorted()
+}
+
+func (l *Log) sorted() []Decision {
+	out := make([]Decision, 0, len(l.pending))
+	for _, d := range l.pending {
+		out = append(out, d)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Time.Before(out[j].Time) })
+	return out
+}
+
+// Close closes the underlying file.
+func (l *Log) Close() error {
+	return l.f.Close()
+}